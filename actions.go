@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Action modes: execute runs the action, approve waits for a person to approve
+// it through /admin/approvals, and log only records what the model asked for,
+// for trying out new actions safely
+const (
+	actionExecute = "execute"
+	actionApprove = "approve"
+	actionLog     = "log"
+)
+
+// Defaults for the limits of each action call
+const (
+	defaultActionTimeout     = 10 * time.Second
+	defaultActionOutputBytes = 8192
+	defaultActionCalls       = 5
+)
+
+// ActionsConfig defines actions, such as calling a Home Assistant service or
+// running a script, that templates listing them in their settings let the
+// model take through tool calls. Mode applies to every action that doesn't set
+// its own, and MaxCalls limits the calls of one generation.
+type ActionsConfig struct {
+	Mode     string                   `json:"mode"`
+	MaxCalls int                      `json:"max_calls"`
+	Tools    map[string]*ActionConfig `json:"tools"`
+	Approval ApprovalConfig           `json:"approval"`
+
+	approvals *Approvals
+}
+
+// ActionConfig is an action the model can call. It either sends its arguments
+// as JSON to URL, or runs Command with them as JSON on stdin. Each call is
+// limited to Timeout, MaxOutputBytes of the response or output the model gets
+// back, and CPUSeconds of CPU time for commands.
+type ActionConfig struct {
+	Description string `json:"description"`
+	// Parameters is the JSON Schema of the arguments, which calls are checked
+	// against before they run
+	Parameters json.RawMessage `json:"parameters"`
+
+	URL     string            `json:"url"`
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"headers"`
+	Command []string          `json:"command"`
+
+	Timeout        string `json:"timeout"`
+	MaxOutputBytes int    `json:"max_output_bytes"`
+	CPUSeconds     int    `json:"cpu_seconds"`
+	Mode           string `json:"mode"`
+
+	parameters map[string]interface{}
+	timeout    time.Duration
+}
+
+func (c *ActionsConfig) parse() error {
+	switch c.Mode {
+	case "", actionExecute, actionApprove, actionLog:
+	default:
+		return fmt.Errorf("unknown actions mode '%s', expected %s, %s or %s", c.Mode, actionExecute, actionApprove, actionLog)
+	}
+	if c.MaxCalls < 0 {
+		return errors.New("actions max_calls can't be negative")
+	}
+	if err := c.Approval.parse(); err != nil {
+		return err
+	}
+	for name, action := range c.Tools {
+		if err := action.parse(); err != nil {
+			return fmt.Errorf("action '%s': %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (a *ActionConfig) parse() error {
+	if (a.URL == "") == (len(a.Command) == 0) {
+		return errors.New("exactly one of url and command must be set")
+	}
+	if a.URL != "" {
+		if parsed, err := url.Parse(a.URL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("invalid url '%s'", a.URL)
+		}
+		if a.CPUSeconds != 0 {
+			return errors.New("cpu_seconds only applies to commands")
+		}
+	}
+	if a.CPUSeconds < 0 || a.MaxOutputBytes < 0 {
+		return errors.New("cpu_seconds and max_output_bytes can't be negative")
+	}
+	if a.CPUSeconds > 0 && !cpuLimits {
+		return errors.New("cpu_seconds isn't supported on this platform")
+	}
+
+	a.parameters = map[string]interface{}{"type": "object", "properties": map[string]interface{}{}}
+	if len(a.Parameters) > 0 {
+		if err := json.Unmarshal(a.Parameters, &a.parameters); err != nil {
+			return fmt.Errorf("parameters must be a JSON object: %w", err)
+		}
+		if err := checkSchema(a.parameters, "parameters"); err != nil {
+			return err
+		}
+	}
+
+	a.timeout = defaultActionTimeout
+	if a.Timeout != "" {
+		timeout, err := time.ParseDuration(a.Timeout)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid timeout '%s'", a.Timeout)
+		}
+		a.timeout = timeout
+	}
+	switch a.Mode {
+	case "", actionExecute, actionApprove, actionLog:
+	default:
+		return fmt.Errorf("unknown mode '%s', expected %s, %s or %s", a.Mode, actionExecute, actionApprove, actionLog)
+	}
+	return nil
+}
+
+func (a *ActionConfig) maxOutputBytes() int {
+	if a.MaxOutputBytes > 0 {
+		return a.MaxOutputBytes
+	}
+	return defaultActionOutputBytes
+}
+
+// mode is the action's own mode, or else the actions' mode.
+func (c *ActionsConfig) mode(action *ActionConfig) string {
+	if action.Mode != "" {
+		return action.Mode
+	}
+	if c.Mode != "" {
+		return c.Mode
+	}
+	return actionExecute
+}
+
+func (c *ActionsConfig) maxCalls() int {
+	if c.MaxCalls > 0 {
+		return c.MaxCalls
+	}
+	return defaultActionCalls
+}
+
+// actions are the actions the template lets the model take, by name.
+func (tc *TemplateConfig) actions(config *Config, templateName string) (map[string]*ActionConfig, error) {
+	settings, ok := tc.Settings[templateName]
+	if !ok || len(settings.Actions) == 0 {
+		return nil, nil
+	}
+	actions := make(map[string]*ActionConfig, len(settings.Actions))
+	for _, name := range settings.Actions {
+		action, ok := config.Actions.Tools[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown action '%s'", name)
+		}
+		actions[name] = action
+	}
+	return actions, nil
+}
+
+// actionTools describes the actions as tools in Ollama's chat request format.
+func actionTools(actions map[string]*ActionConfig) []map[string]interface{} {
+	tools := make([]map[string]interface{}, 0, len(actions))
+	for _, name := range sortedKeys(actions) {
+		tools = append(tools, map[string]interface{}{
+			"type": "function",
+			"function": map[string]interface{}{
+				"name":        name,
+				"description": actions[name].Description,
+				"parameters":  actions[name].parameters,
+			},
+		})
+	}
+	return tools
+}
+
+// Statuses of an action call
+const (
+	actionExecuted = "executed"
+	actionFailed   = "failed"
+	actionLogged   = "logged"
+	actionPending  = "pending"
+)
+
+// ActionCall is an action the model called and what became of it, returned
+// in the response's actions field.
+type ActionCall struct {
+	Action    string                 `json:"action"`
+	Arguments map[string]interface{} `json:"arguments"`
+	Status    string                 `json:"status"`
+	Output    string                 `json:"output,omitempty"`
+	Error     string                 `json:"error,omitempty"`
+	// ApprovalID is the approval request of a call waiting for approval
+	ApprovalID string `json:"approval_id,omitempty"`
+}
+
+// reply is what the model is told about the call.
+func (call ActionCall) reply() string {
+	switch call.Status {
+	case actionExecuted:
+		if call.Output == "" {
+			return "Done."
+		}
+		return call.Output
+	case actionLogged:
+		return "The action was recorded but not carried out, as actions are only being logged."
+	case actionPending:
+		return "The action needs a person's approval, which has been asked for. It will be carried out if they approve it."
+	}
+	return "The action failed: " + call.Error
+}
+
+// toolCalls are the tool calls of a chat response.
+func toolCalls(response map[string]interface{}) []ActionCall {
+	message, _ := response["message"].(map[string]interface{})
+	raw, _ := message["tool_calls"].([]interface{})
+	calls := make([]ActionCall, 0, len(raw))
+	for _, item := range raw {
+		call, _ := item.(map[string]interface{})
+		function, _ := call["function"].(map[string]interface{})
+		name, _ := function["name"].(string)
+		var arguments map[string]interface{}
+		switch value := function["arguments"].(type) {
+		case map[string]interface{}:
+			arguments = value
+		case string:
+			// OpenAI-style servers send the arguments as a JSON string
+			json.Unmarshal([]byte(value), &arguments)
+		}
+		if arguments == nil {
+			arguments = map[string]interface{}{}
+		}
+		calls = append(calls, ActionCall{Action: name, Arguments: arguments})
+	}
+	return calls
+}
+
+// runActions carries out the tool calls of a chat response and sends the
+// results back to the model until it answers without calling any, returning
+// that answer with the calls in its actions field. Once the generation's calls
+// reach max_calls, further calls aren't run and the model is asked to answer.
+func runActions(ctx context.Context, config *Config, backend Backend, templateName string, request, response map[string]interface{}, actions map[string]*ActionConfig) (map[string]interface{}, error) {
+	messages, _ := request["messages"].([]map[string]interface{})
+	messages = append([]map[string]interface{}{}, messages...)
+	var made []ActionCall
+	for {
+		calls := toolCalls(response)
+		if len(calls) == 0 {
+			break
+		}
+		message, _ := response["message"].(map[string]interface{})
+		messages = append(messages, message)
+		for _, call := range calls {
+			if len(made) >= config.Actions.maxCalls() {
+				call.Status, call.Error = actionFailed, "too many actions for one request"
+			} else {
+				call = config.Actions.run(ctx, templateName, actions, call)
+			}
+			made = append(made, call)
+			messages = append(messages, map[string]interface{}{"role": "tool", "tool_name": call.Action, "content": call.reply()})
+		}
+
+		next := make(map[string]interface{}, len(request))
+		for key, value := range request {
+			next[key] = value
+		}
+		next["messages"] = messages
+		if len(made) >= config.Actions.maxCalls() {
+			delete(next, "tools")
+		}
+		var err error
+		if response, err = backend.Chat(ctx, next, nil); err != nil {
+			return nil, err
+		}
+	}
+	if len(made) > 0 {
+		response["actions"] = made
+	}
+	return response, nil
+}
+
+// run checks a call's arguments and carries it out as the action's mode says.
+func (c *ActionsConfig) run(ctx context.Context, templateName string, actions map[string]*ActionConfig, call ActionCall) ActionCall {
+	action, ok := actions[call.Action]
+	if !ok {
+		call.Status, call.Error = actionFailed, fmt.Sprintf("unknown action '%s'", call.Action)
+		slog.Warn("Model called an unknown action", "template", templateName, "action", call.Action, "request_id", requestID(ctx))
+		return call
+	}
+	if err := validateSchema(call.Arguments, action.parameters, "arguments"); err != nil {
+		call.Status, call.Error = actionFailed, err.Error()
+		slog.Warn("Model called an action with invalid arguments", "template", templateName, "action", call.Action, "error", err, "request_id", requestID(ctx))
+		return call
+	}
+
+	mode := c.mode(action)
+	slog.Info("Model called an action", "template", templateName, "action", call.Action, "arguments", call.Arguments, "mode", mode, "request_id", requestID(ctx))
+	if mode == actionLog {
+		call.Status = actionLogged
+		return call
+	}
+	if mode == actionApprove {
+		call.Status, call.ApprovalID = actionPending, c.approvals.request(c, templateName, requestID(ctx), call).ID
+		return call
+	}
+
+	start := time.Now()
+	output, err := action.execute(ctx, call.Arguments)
+	if err != nil {
+		call.Status, call.Error = actionFailed, err.Error()
+		slog.Error("Action failed", "template", templateName, "action", call.Action, "duration", time.Since(start), "error", err, "request_id", requestID(ctx))
+		return call
+	}
+	call.Status, call.Output = actionExecuted, output
+	slog.Info("Action executed", "template", templateName, "action", call.Action, "duration", time.Since(start), "request_id", requestID(ctx))
+	return call
+}
+
+// execute runs the action with the arguments within its limits, returning
+// its response or output.
+func (a *ActionConfig) execute(ctx context.Context, arguments map[string]interface{}) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, a.timeout)
+	defer cancel()
+	body, err := json.Marshal(arguments)
+	if err != nil {
+		return "", err
+	}
+	if a.URL != "" {
+		return a.post(ctx, body)
+	}
+	return a.runCommand(ctx, body)
+}
+
+// post sends the arguments to the action's URL.
+func (a *ActionConfig) post(ctx context.Context, body []byte) (string, error) {
+	method := a.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	req, err := http.NewRequestWithContext(ctx, method, a.URL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range a.Headers {
+		req.Header.Set(name, value)
+	}
+
+	// The URL comes from config.json, so it may be on the local network
+	policy := FetchConfig{}.trustHost(req.URL.Hostname())
+	resp, err := newFetchClient(policy, a.timeout).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	output, err := readLimited(resp.Body, a.maxOutputBytes())
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("%s returned %s: %s", req.URL.Host, resp.Status, strings.TrimSpace(output))
+	}
+	return output, nil
+}
+
+// runCommand runs the action's command with the arguments on stdin.
+func (a *ActionConfig) runCommand(ctx context.Context, body []byte) (string, error) {
+	cmd := actionCommand(ctx, a.Command, a.CPUSeconds)
+	cmd.Stdin = bytes.NewReader(body)
+	output := &limitedBuffer{limit: a.maxOutputBytes()}
+	cmd.Stdout, cmd.Stderr = output, output
+	// Children that keep the output open don't hold up the call
+	cmd.WaitDelay = time.Second
+
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return "", fmt.Errorf("timed out after %s", a.timeout)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(output.String()))
+	}
+	return output.String(), nil
+}
+
+// truncatedMarker ends output cut short by max_output_bytes.
+const truncatedMarker = "\n[truncated]"
+
+// readLimited reads up to limit bytes of r, marking the text when there was
+// more.
+func readLimited(r io.Reader, limit int) (string, error) {
+	data, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > limit {
+		return string(data[:limit]) + truncatedMarker, nil
+	}
+	return string(data), nil
+}
+
+// limitedBuffer keeps the first limit bytes written to it and discards the
+// rest, so a chatty command can't use up memory.
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.buf.Len(); room < len(p) {
+		b.truncated = true
+		b.buf.Write(p[:max(room, 0)])
+	} else {
+		b.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+func (b *limitedBuffer) String() string {
+	if b.truncated {
+		return b.buf.String() + truncatedMarker
+	}
+	return b.buf.String()
+}
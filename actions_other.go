@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import (
+	"context"
+	"os/exec"
+)
+
+// CPU limits for commands need ulimit, which needs Unix.
+const cpuLimits = false
+
+func actionCommand(ctx context.Context, argv []string, cpuSeconds int) *exec.Cmd {
+	return exec.CommandContext(ctx, argv[0], argv[1:]...)
+}
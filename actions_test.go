@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestActionsConfigParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		wantErr string
+	}{
+		{"url", `{"tools": {"lights": {"url": "http://ha.local/api/services/light/turn_on"}}}`, ""},
+		{"command", `{"mode": "log", "tools": {"backup": {"command": ["/bin/true"], "cpu_seconds": 2, "timeout": "30s"}}}`, ""},
+		{"parameters", `{"tools": {"lights": {"url": "http://ha.local", "parameters": {"type": "object", "properties": {"room": {"type": "string"}}, "required": ["room"]}}}}`, ""},
+		{"neither", `{"tools": {"lights": {}}}`, "exactly one of url and command"},
+		{"both", `{"tools": {"lights": {"url": "http://ha.local", "command": ["/bin/true"]}}}`, "exactly one of url and command"},
+		{"bad url", `{"tools": {"lights": {"url": "ftp://ha.local"}}}`, "invalid url"},
+		{"cpu for url", `{"tools": {"lights": {"url": "http://ha.local", "cpu_seconds": 1}}}`, "only applies to commands"},
+		{"bad timeout", `{"tools": {"lights": {"url": "http://ha.local", "timeout": "soon"}}}`, "invalid timeout"},
+		{"bad schema", `{"tools": {"lights": {"url": "http://ha.local", "parameters": {"type": "dict"}}}}`, "unknown type"},
+		{"bad mode", `{"mode": "dry_run"}`, "unknown actions mode"},
+		{"bad action mode", `{"tools": {"lights": {"url": "http://ha.local", "mode": "maybe"}}}`, "unknown mode"},
+		{"approve", `{"mode": "approve", "approval": {"expires": "1h", "audit_path": "approvals.jsonl"}}`, ""},
+		{"bad approval expiry", `{"approval": {"expires": "-1m"}}`, "invalid approval expires"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var config ActionsConfig
+			if err := json.Unmarshal([]byte(tt.json), &config); err != nil {
+				t.Fatal(err)
+			}
+			err := config.parse()
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func parsedAction(t *testing.T, action *ActionConfig) *ActionConfig {
+	t.Helper()
+	if err := action.parse(); err != nil {
+		t.Fatal(err)
+	}
+	return action
+}
+
+func TestActionExecuteURL(t *testing.T) {
+	var received map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer ha-token" {
+			http.Error(w, "unauthorised", http.StatusUnauthorized)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&received)
+		if received["room"] == "attic" {
+			w.Write([]byte(strings.Repeat("x", 100)))
+			return
+		}
+		w.Write([]byte(`[{"entity_id": "light.kitchen", "state": "on"}]`))
+	}))
+	defer server.Close()
+
+	action := parsedAction(t, &ActionConfig{URL: server.URL, Headers: map[string]string{"Authorization": "Bearer ha-token"}, MaxOutputBytes: 64})
+	output, err := action.execute(context.Background(), map[string]interface{}{"room": "kitchen"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received["room"] != "kitchen" || !strings.Contains(output, "light.kitchen") {
+		t.Errorf("received %v, output %q", received, output)
+	}
+
+	output, err = action.execute(context.Background(), map[string]interface{}{"room": "attic"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != strings.Repeat("x", 64)+truncatedMarker {
+		t.Errorf("output = %q, want it cut to 64 bytes", output)
+	}
+
+	unauthorised := parsedAction(t, &ActionConfig{URL: server.URL})
+	if _, err := unauthorised.execute(context.Background(), nil); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("error = %v, want the status", err)
+	}
+}
+
+func TestActionExecuteCommand(t *testing.T) {
+	tests := []struct {
+		name       string
+		action     ActionConfig
+		wantOutput string
+		wantErr    string
+		maxTime    time.Duration
+	}{
+		{"stdin", ActionConfig{Command: []string{"cat"}}, `{"room":"kitchen"}`, "", 5 * time.Second},
+		{"output limit", ActionConfig{Command: []string{"/bin/sh", "-c", "printf '%0100d' 0"}, MaxOutputBytes: 10}, "0000000000" + truncatedMarker, "", 5 * time.Second},
+		{"failure", ActionConfig{Command: []string{"/bin/sh", "-c", "echo no such room >&2; exit 3"}}, "", "no such room", 5 * time.Second},
+		{"timeout", ActionConfig{Command: []string{"sleep", "10"}, Timeout: "100ms"}, "", "timed out", 5 * time.Second},
+		{"cpu limit", ActionConfig{Command: []string{"/bin/sh", "-c", "while :; do :; done"}, CPUSeconds: 1, Timeout: "20s"}, "", "signal", 10 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			action := parsedAction(t, &tt.action)
+			start := time.Now()
+			output, err := action.execute(context.Background(), map[string]interface{}{"room": "kitchen"})
+			if elapsed := time.Since(start); elapsed > tt.maxTime {
+				t.Errorf("took %s", elapsed)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if output != tt.wantOutput {
+				t.Errorf("output = %q, want %q", output, tt.wantOutput)
+			}
+		})
+	}
+}
+
+// fakeToolOllama is an Ollama server whose model calls the light action for
+// each room in rooms, all at once, then answers with the last tool result.
+func fakeToolOllama(t *testing.T, rooms ...string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/chat" {
+			http.NotFound(w, r)
+			return
+		}
+		calls.Add(1)
+		var request struct {
+			Messages []map[string]interface{} `json:"messages"`
+			Tools    []interface{}            `json:"tools"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		last := request.Messages[len(request.Messages)-1]
+		message := map[string]interface{}{"role": "assistant", "content": ""}
+		if last["role"] == "tool" || len(request.Tools) == 0 {
+			message["content"] = "Result: " + last["content"].(string)
+		} else {
+			var toolCalls []interface{}
+			for _, room := range rooms {
+				toolCalls = append(toolCalls, map[string]interface{}{"function": map[string]interface{}{"name": "lights", "arguments": map[string]interface{}{"room": room}}})
+			}
+			message["tool_calls"] = toolCalls
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"done": true, "message": message})
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func TestGenerateWithActions(t *testing.T) {
+	var switched []string
+	lights := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		switched = append(switched, string(body))
+		w.Write([]byte("switched on"))
+	}))
+	defer lights.Close()
+
+	tests := []struct {
+		name         string
+		mode         string
+		maxCalls     int
+		rooms        []string
+		wantStatuses []string
+		wantAnswer   string
+		wantSwitched int
+	}{
+		{"execute", "", 0, []string{"kitchen"}, []string{actionExecuted}, "Result: switched on", 1},
+		{"approve", actionApprove, 0, []string{"kitchen"}, []string{actionPending}, "Result: The action needs a person's approval, which has been asked for. It will be carried out if they approve it.", 0},
+		{"log only", actionLog, 0, []string{"kitchen"}, []string{actionLogged}, "Result: The action was recorded but not carried out, as actions are only being logged.", 0},
+		{"invalid arguments", "", 0, []string{""}, []string{actionFailed}, "Result: The action failed: arguments.room is shorter than 1 characters", 0},
+		{"too many calls", "", 1, []string{"kitchen", "hall"}, []string{actionExecuted, actionFailed}, "Result: The action failed: too many actions for one request", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			switched = nil
+			ollama, _ := fakeToolOllama(t, tt.rooms...)
+			actions, _ := json.Marshal(ActionsConfig{Mode: tt.mode, MaxCalls: tt.maxCalls, Tools: map[string]*ActionConfig{
+				"lights": {URL: lights.URL, Parameters: json.RawMessage(`{"type": "object", "properties": {"room": {"type": "string", "minLength": 1}}, "required": ["room"]}`)},
+			}})
+			config := testConfig(t, `{"api_url": "`+ollama.URL+`/api/generate", "default_model": "llama3", "actions": `+string(actions)+`}`)
+			templateConfig := &TemplateConfig{Settings: map[string]*TemplateSettings{"home": {Actions: []string{"lights"}}}}
+
+			response, err := generate(context.Background(), config, templateConfig, "home", TemplateData{Query: "turn on the lights"}, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response["response"] != tt.wantAnswer {
+				t.Errorf("response = %q, want %q", response["response"], tt.wantAnswer)
+			}
+			calls, _ := response["actions"].([]ActionCall)
+			if len(calls) != len(tt.wantStatuses) {
+				t.Fatalf("actions = %+v", calls)
+			}
+			for i, call := range calls {
+				if call.Status != tt.wantStatuses[i] {
+					t.Errorf("action %d status = %s, want %s", i, call.Status, tt.wantStatuses[i])
+				}
+			}
+			if len(switched) != tt.wantSwitched {
+				t.Errorf("lights called %d times, want %d", len(switched), tt.wantSwitched)
+			}
+		})
+	}
+}
+
+func TestActionsFlag(t *testing.T) {
+	ollama, _ := fakeToolOllama(t, "kitchen")
+	config := testConfig(t, `{"api_url": "`+ollama.URL+`/api/generate", "default_model": "llama3", "flags": {"actions": false},
+		"actions": {"tools": {"lights": {"url": "http://127.0.0.1:1"}}}}`)
+	templateConfig := &TemplateConfig{Settings: map[string]*TemplateSettings{"home": {Actions: []string{"lights"}, Chat: true}}}
+
+	response, err := generate(context.Background(), config, templateConfig, "home", TemplateData{Query: "turn on the lights"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := response["actions"]; ok || response["response"] != "Result: turn on the lights" {
+		t.Errorf("response = %v, want no tools offered", response)
+	}
+}
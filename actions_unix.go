@@ -0,0 +1,23 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"os/exec"
+	"strconv"
+)
+
+// cpuLimits reports whether actions can limit the CPU time of commands.
+const cpuLimits = true
+
+// actionCommand is the command for an action, with its CPU time limited to
+// cpuSeconds when that's set. The shell sets the limit, then replaces itself
+// with the command.
+func actionCommand(ctx context.Context, argv []string, cpuSeconds int) *exec.Cmd {
+	if cpuSeconds <= 0 {
+		return exec.CommandContext(ctx, argv[0], argv[1:]...)
+	}
+	args := append([]string{"-c", `ulimit -t "$0" && exec "$@"`, strconv.Itoa(cpuSeconds)}, argv...)
+	return exec.CommandContext(ctx, "/bin/sh", args...)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// authenticateAdmin protects admin endpoints with the admin token. The admin API
+// is disabled entirely when no admin token is configured.
+func authenticateAdmin(config *Config, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config.AdminToken == "" {
+			http.Error(w, "Admin API is disabled", http.StatusNotFound)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !adminTokenValid(config, token) {
+			slog.Warn("Unauthorized admin access attempt", "token_hint", tokenHint(token), "remote_addr", r.RemoteAddr)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		// The flags endpoint stays reachable so the admin API can be switched back on
+		if !config.Flags.Enabled(flagAdminAPI) && !strings.HasPrefix(r.URL.Path, "/admin/flags") {
+			http.Error(w, "Admin API is disabled by feature flag", http.StatusServiceUnavailable)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// tokenHint returns the last character of a token for logging failed attempts.
+func tokenHint(token string) string {
+	if token == "" {
+		return ""
+	}
+	return token[len(token)-1:]
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	body, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+type RouteInfo struct {
+	Path          string   `json:"path"`
+	Methods       []string `json:"methods"`
+	Kind          string   `json:"kind"`
+	Auth          string   `json:"auth"`
+	Template      string   `json:"template,omitempty"`
+	Model         string   `json:"model,omitempty"`
+	AllowedModels []string `json:"allowed_models,omitempty"`
+	Timeout       int      `json:"timeout_seconds,omitempty"`
+}
+
+type ScheduleInfo struct {
+	Name     string   `json:"name"`
+	Template string   `json:"template"`
+	When     string   `json:"when"`
+	Outputs  []string `json:"outputs"`
+}
+
+// ServerSummary describes what the server is running, logged at startup and
+// served at /admin/routes.
+type ServerSummary struct {
+	mu           sync.Mutex
+	Address      string         `json:"address"`
+	Backend      string         `json:"backend"`
+	DefaultModel string         `json:"default_model"`
+	Auth         string         `json:"auth"`
+	AdminAPI     bool           `json:"admin_api"`
+	Routes       []RouteInfo    `json:"routes"`
+	Outputs      []string       `json:"outputs"`
+	Schedules    []ScheduleInfo `json:"schedules"`
+}
+
+func newServerSummary(config *Config) *ServerSummary {
+	summary := &ServerSummary{
+		Address:   config.ServerAddress,
+		Outputs:   []string{},
+		Schedules: []ScheduleInfo{},
+	}
+	summary.setConfig(config)
+	for _, oc := range config.Outputs {
+		summary.Outputs = append(summary.Outputs, fmt.Sprintf("%s (%s)", oc.Name, oc.Type))
+	}
+	for _, sc := range config.Schedules {
+		when := "every " + sc.Every
+		if sc.At != "" {
+			when = "at " + sc.At
+			if len(sc.Days) > 0 {
+				when += " on " + strings.Join(sc.Days, ", ")
+			}
+		}
+		summary.Schedules = append(summary.Schedules, ScheduleInfo{Name: sc.Name, Template: sc.Template, When: when, Outputs: sc.Outputs})
+	}
+	return summary
+}
+
+// setConfig updates the settings that can change when the config is reloaded.
+func (s *ServerSummary) setConfig(config *Config) {
+	auth := "bearer token"
+	if config.AuthToken == "" {
+		auth = "bearer token (empty, set auth_token)"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Backend = config.APIURL
+	if len(config.APIURLs) > 0 {
+		s.Backend = strings.Join(config.APIURLs, ", ")
+	}
+	s.DefaultModel = config.DefaultModel
+	s.Auth = auth
+	s.AdminAPI = config.AdminToken != ""
+}
+
+func (s *ServerSummary) addRoute(route RouteInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Routes = append(s.Routes, route)
+	sort.Slice(s.Routes, func(i, j int) bool { return s.Routes[i].Path < s.Routes[j].Path })
+}
+
+// setTemplateRoutes replaces the per-template routes, after the templates are
+// reloaded.
+func (s *ServerSummary) setTemplateRoutes(config *Config, templateConfig *TemplateConfig) {
+	s.mu.Lock()
+	routes := s.Routes[:0]
+	for _, route := range s.Routes {
+		if route.Kind != "template" && route.Kind != "text" && route.Kind != "batch" {
+			routes = append(routes, route)
+		}
+	}
+	s.Routes = routes
+	s.mu.Unlock()
+
+	for templateName := range templateConfig.Templates {
+		s.addTemplateRoute(config, templateConfig, templateName)
+		s.addRoute(RouteInfo{Path: "/text/" + templateName, Methods: []string{http.MethodPost}, Kind: "text", Auth: "token", Template: templateName, Model: templateConfig.defaultModel(config, templateName)})
+		s.addRoute(RouteInfo{Path: "/batch/" + templateName, Methods: []string{http.MethodPost}, Kind: "batch", Auth: "token", Template: templateName, Model: templateConfig.defaultModel(config, templateName)})
+	}
+}
+
+func (s *ServerSummary) addTemplateRoute(config *Config, templateConfig *TemplateConfig, templateName string) {
+	route := RouteInfo{
+		Path:     "/template/" + templateName,
+		Methods:  []string{http.MethodGet, http.MethodPost},
+		Kind:     "template",
+		Auth:     "token",
+		Template: templateName,
+		Model:    templateConfig.defaultModel(config, templateName),
+		Timeout:  int(templateConfig.requestTimeout(config, templateName).Seconds()),
+	}
+	if settings, ok := templateConfig.Settings[templateName]; ok {
+		route.AllowedModels = settings.AllowedModels
+	}
+	s.addRoute(route)
+}
+
+func (s *ServerSummary) log() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	slog.Info("llamanator listening",
+		"address", s.Address,
+		"backend", s.Backend,
+		"default_model", s.DefaultModel,
+		"auth", s.Auth,
+		"admin_api", s.AdminAPI)
+	for _, route := range s.Routes {
+		attrs := []any{"methods", strings.Join(route.Methods, ","), "path", route.Path, "auth", route.Auth}
+		if route.Model != "" {
+			attrs = append(attrs, "model", route.Model)
+		}
+		if len(route.AllowedModels) > 0 {
+			attrs = append(attrs, "allowed_models", strings.Join(route.AllowedModels, ","))
+		}
+		if route.Timeout > 0 {
+			attrs = append(attrs, "timeout", time.Duration(route.Timeout)*time.Second)
+		}
+		slog.Info("Route", attrs...)
+	}
+	if len(s.Outputs) > 0 {
+		slog.Info("Outputs", "outputs", strings.Join(s.Outputs, ", "))
+	}
+	for _, schedule := range s.Schedules {
+		slog.Info("Schedule", "name", schedule.Name, "template", schedule.Template, "when", schedule.When, "outputs", strings.Join(schedule.Outputs, ", "))
+	}
+}
+
+func (s *ServerSummary) handler(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeJSON(w, http.StatusOK, s)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Records an aggregation reads at most, unless the request says otherwise
+const defaultAggregateRecords = 500
+
+// aggregateRequest is the body of POST /admin/aggregate.
+type aggregateRequest struct {
+	// Template is run over the responses of SourceTemplate
+	Template       string `json:"template"`
+	SourceTemplate string `json:"source_template"`
+	Query          string `json:"query"`
+	Model          string `json:"model"`
+	// From and To are dates (YYYY-MM-DD, to is inclusive) or RFC 3339 times,
+	// defaulting to the start of today and now
+	From       string `json:"from"`
+	To         string `json:"to"`
+	MaxRecords int    `json:"max_records"`
+}
+
+// parseHistoryTime parses a date or RFC 3339 time. A date given as the end of a
+// range includes the whole day.
+func parseHistoryTime(value string, end bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("'%s' must be a date (YYYY-MM-DD) or RFC 3339 time", value)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// between returns the successful records of a template from from up to to,
+// oldest first, keeping the newest limit.
+func (h *History) between(templateName string, from, to time.Time, limit int) []HistoryRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var records []HistoryRecord
+	for _, record := range h.records {
+		if record.Template == templateName && record.Error == "" &&
+			!record.Time.Before(from) && record.Time.Before(to) {
+			records = append(records, record)
+		}
+	}
+	if len(records) > limit {
+		records = records[len(records)-limit:]
+	}
+	return records
+}
+
+// aggregateDocument lists records, one response per paragraph with its time.
+func aggregateDocument(records []HistoryRecord) *Document {
+	entries := make([]string, len(records))
+	for i, record := range records {
+		entries[i] = fmt.Sprintf("[%s] %s", record.Time.Local().Format("2006-01-02 15:04"), strings.TrimSpace(record.Response))
+	}
+	return &Document{Text: strings.Join(entries, "\n\n"), Pages: 1}
+}
+
+// aggregateHandler serves POST /admin/aggregate, which runs a template over the
+// stored responses of another template, such as a summary of all of today's
+// doorbell descriptions. The responses are the template's {{.Document.Text}}.
+func aggregateHandler(config *Config, templateConfig *TemplateConfig, outputs *Outputs, history *History) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if history == nil {
+			http.Error(w, "History is not enabled", http.StatusNotFound)
+			return
+		}
+
+		var request aggregateRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if _, ok := templateConfig.Templates[request.Template]; !ok {
+			http.Error(w, fmt.Sprintf("Unknown template '%s'", request.Template), http.StatusBadRequest)
+			return
+		}
+		if request.SourceTemplate == "" {
+			http.Error(w, "source_template is required", http.StatusBadRequest)
+			return
+		}
+
+		now := time.Now()
+		from := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+		to := now
+		for _, bound := range []struct {
+			value string
+			end   bool
+			t     *time.Time
+		}{{request.From, false, &from}, {request.To, true, &to}} {
+			if bound.value == "" {
+				continue
+			}
+			t, err := parseHistoryTime(bound.value, bound.end)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			*bound.t = t
+		}
+		limit := request.MaxRecords
+		if limit <= 0 {
+			limit = defaultAggregateRecords
+		}
+
+		records := history.between(request.SourceTemplate, from, to, limit)
+		if len(records) == 0 {
+			http.Error(w, fmt.Sprintf("No responses from template %s in that time range", request.SourceTemplate), http.StatusNotFound)
+			return
+		}
+
+		model := request.Model
+		if model == "" {
+			model = templateConfig.defaultModel(config, request.Template)
+		} else if !templateConfig.modelAllowed(request.Template, model) {
+			http.Error(w, fmt.Sprintf("Model '%s' is not allowed for this template", model), http.StatusBadRequest)
+			return
+		}
+		data := TemplateData{Query: request.Query, Document: aggregateDocument(records)}
+		ctx := withGenerationStats(requestTraceContext(r.Context(), config, r), &GenerationStats{})
+		slog.Info("Aggregating responses", "count", len(records), "source_template", request.SourceTemplate, "template", request.Template)
+
+		start := time.Now()
+		filteredResponse, err := generate(ctx, config, templateConfig, request.Template, data, model)
+		recordGeneration(ctx, config, history, "aggregate", request.Template, data, model, HAContext{}, start, filteredResponse, err)
+		if errors.Is(err, context.Canceled) && r.Context().Err() != nil {
+			return
+		}
+		if err != nil {
+			slog.Error("Failed to aggregate responses", "source_template", request.SourceTemplate, "error", err)
+			writeTemplateError(w, err)
+			return
+		}
+
+		setUsageHeaders(ctx, w)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"records": len(records),
+			"from":    records[0].Time,
+			"to":      records[len(records)-1].Time,
+			"result":  filteredResponse,
+		})
+		deliverResponse(config, outputs, request.Template, data, model, HAContext{}, filteredResponse)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AlertsConfig summarises Grafana and Alertmanager alerts. Alerts arriving
+// within group_wait of each other are summarised together, and an alert that
+// was already summarised isn't repeated within repeat_interval unless its
+// status changes.
+type AlertsConfig struct {
+	Template       string `json:"template"`
+	Model          string `json:"model"`
+	GroupWait      string `json:"group_wait"`
+	RepeatInterval string `json:"repeat_interval"`
+}
+
+// alertPayload is the webhook payload shared by Grafana and Alertmanager.
+type alertPayload struct {
+	Alerts []alert `json:"alerts"`
+}
+
+type alert struct {
+	Status      string            `json:"status"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	StartsAt    time.Time         `json:"startsAt"`
+	Fingerprint string            `json:"fingerprint"`
+}
+
+// key identifies the alert, using the labels when the sender has no fingerprint.
+func (a alert) key() string {
+	if a.Fingerprint != "" {
+		return a.Fingerprint
+	}
+	names := make([]string, 0, len(a.Labels))
+	for name := range a.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var key strings.Builder
+	for _, name := range names {
+		key.WriteString(name + "=" + a.Labels[name] + "\x00")
+	}
+	return key.String()
+}
+
+// describe formats the alert as a line of the summary query, e.g.
+// "[firing] DiskFull (instance=nas, severity=critical): Root is 95% full".
+func (a alert) describe() string {
+	var labels []string
+	for name, value := range a.Labels {
+		if name != "alertname" && !strings.HasPrefix(name, "__") {
+			labels = append(labels, name+"="+value)
+		}
+	}
+	sort.Strings(labels)
+
+	line := fmt.Sprintf("[%s] %s", a.Status, a.Labels["alertname"])
+	if len(labels) > 0 {
+		line += " (" + strings.Join(labels, ", ") + ")"
+	}
+	for _, name := range []string{"summary", "description"} {
+		if text := a.Annotations[name]; text != "" {
+			line += ": " + strings.Join(strings.Fields(text), " ")
+			break
+		}
+	}
+	if !a.StartsAt.IsZero() {
+		line += " since " + a.StartsAt.Local().Format("Jan 2 15:04")
+	}
+	return line
+}
+
+// AlertGroups deduplicates incoming alerts and batches them for summarising.
+type AlertGroups struct {
+	configs        *ConfigStore
+	templates      *TemplateStore
+	outputs        *Outputs
+	history        *History
+	groupWait      time.Duration
+	repeatInterval time.Duration
+
+	mu      sync.Mutex
+	pending []alert
+	timer   *time.Timer
+	// Last status summarised per alert key, and when
+	seen map[string]alertSeen
+}
+
+type alertSeen struct {
+	status string
+	at     time.Time
+}
+
+func newAlertGroups(configs *ConfigStore, templates *TemplateStore, outputs *Outputs, history *History) (*AlertGroups, error) {
+	config := configs.get()
+	if _, ok := templates.get().Templates[config.Alerts.Template]; !ok {
+		return nil, fmt.Errorf("unknown template '%s'", config.Alerts.Template)
+	}
+	groups := &AlertGroups{
+		configs:        configs,
+		templates:      templates,
+		outputs:        outputs,
+		history:        history,
+		groupWait:      30 * time.Second,
+		repeatInterval: 4 * time.Hour,
+		seen:           make(map[string]alertSeen),
+	}
+	var err error
+	if config.Alerts.GroupWait != "" {
+		if groups.groupWait, err = time.ParseDuration(config.Alerts.GroupWait); err != nil {
+			return nil, fmt.Errorf("invalid group_wait: %w", err)
+		}
+	}
+	if config.Alerts.RepeatInterval != "" {
+		if groups.repeatInterval, err = time.ParseDuration(config.Alerts.RepeatInterval); err != nil {
+			return nil, fmt.Errorf("invalid repeat_interval: %w", err)
+		}
+	}
+	return groups, nil
+}
+
+// add queues the alerts that haven't been summarised recently with the same
+// status and returns how many were queued.
+func (g *AlertGroups) add(alerts []alert) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	for key, seen := range g.seen {
+		if now.Sub(seen.at) > g.repeatInterval {
+			delete(g.seen, key)
+		}
+	}
+
+	queued := 0
+	for _, a := range alerts {
+		key := a.key()
+		if seen, ok := g.seen[key]; ok && seen.status == a.Status {
+			continue
+		}
+		g.seen[key] = alertSeen{status: a.Status, at: now}
+		g.pending = append(g.pending, a)
+		queued++
+	}
+	if queued > 0 && g.timer == nil {
+		g.timer = time.AfterFunc(g.groupWait, g.flush)
+	}
+	return queued
+}
+
+// flush summarises the pending alerts as one incident note.
+func (g *AlertGroups) flush() {
+	g.mu.Lock()
+	alerts := g.pending
+	g.pending = nil
+	g.timer = nil
+	g.mu.Unlock()
+	if len(alerts) == 0 {
+		return
+	}
+
+	firing := 0
+	lines := make([]string, len(alerts))
+	for i, a := range alerts {
+		if a.Status == "firing" {
+			firing++
+		}
+		lines[i] = "- " + a.describe()
+	}
+	query := fmt.Sprintf("%d alerts firing, %d resolved:\n%s", firing, len(alerts)-firing, strings.Join(lines, "\n"))
+
+	config, templateConfig := g.configs.get(), g.templates.get()
+	templateName := config.Alerts.Template
+	model := config.Alerts.Model
+	if model == "" {
+		model = templateConfig.defaultModel(config, templateName)
+	}
+	ctx := withGenerationStats(context.Background(), &GenerationStats{})
+	data := TemplateData{Query: query}
+	start := time.Now()
+	filteredResponse, err := generate(ctx, config, templateConfig, templateName, data, model)
+	recordGeneration(ctx, config, g.history, "alerts", templateName, data, model, HAContext{}, start, filteredResponse, err)
+	if err != nil {
+		slog.Error("Failed to summarise alerts", "count", len(alerts), "error", err)
+		return
+	}
+	slog.Info("Summarised alerts", "count", len(alerts), "template", templateName)
+	deliverResponse(config, g.outputs, templateName, data, model, HAContext{}, filteredResponse)
+}
+
+// alertsHandler serves POST /alerts for Grafana contact points and Alertmanager
+// webhook receivers. Summaries are delivered to the template's outputs.
+func alertsHandler(config *Config, groups *AlertGroups) http.HandlerFunc {
+	return authenticate(config, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var payload alertPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		queued := groups.add(payload.Alerts)
+		writeJSON(w, http.StatusAccepted, map[string]int{"received": len(payload.Alerts), "queued": queued})
+	})
+}
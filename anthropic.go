@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// anthropicRequest is the subset of the Anthropic Messages API that maps onto
+// Ollama's chat endpoint.
+type anthropicRequest struct {
+	Model         string             `json:"model"`
+	MaxTokens     int                `json:"max_tokens"`
+	System        json.RawMessage    `json:"system"`
+	Messages      []anthropicMessage `json:"messages"`
+	Stream        bool               `json:"stream"`
+	Temperature   *float64           `json:"temperature"`
+	TopP          *float64           `json:"top_p"`
+	TopK          *int               `json:"top_k"`
+	StopSequences []string           `json:"stop_sequences"`
+}
+
+type anthropicMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+// anthropicBlock is a content block. Only text and base64 images are supported.
+type anthropicBlock struct {
+	Type   string `json:"type"`
+	Text   string `json:"text"`
+	Source struct {
+		Type string `json:"type"`
+		Data string `json:"data"`
+	} `json:"source"`
+}
+
+// writeAnthropicError writes an error in the shape Anthropic clients expect.
+func writeAnthropicError(w http.ResponseWriter, status int, errorType, message string) {
+	writeJSON(w, status, anthropicError(errorType, message))
+}
+
+func anthropicError(errorType, message string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":  "error",
+		"error": map[string]string{"type": errorType, "message": message},
+	}
+}
+
+// authenticateAPIKey is authenticate that also accepts the auth_token in the
+// x-api-key header, which is how Anthropic clients send their key.
+func authenticateAPIKey(config *Config, next http.HandlerFunc) http.HandlerFunc {
+	check := authenticate(config, next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if key := r.Header.Get("x-api-key"); key != "" && r.Header.Get("Authorization") == "" {
+			r.Header.Set("Authorization", "Bearer "+key)
+		}
+		check(w, r)
+	}
+}
+
+// anthropicContent flattens message content, a string or a list of blocks, into
+// text and base64 images.
+func anthropicContent(raw json.RawMessage) (string, []string, error) {
+	if len(raw) == 0 {
+		return "", nil, nil
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text, nil, nil
+	}
+
+	var blocks []anthropicBlock
+	if err := json.Unmarshal(raw, &blocks); err != nil {
+		return "", nil, errors.New("content must be a string or a list of content blocks")
+	}
+	var parts, images []string
+	for _, block := range blocks {
+		switch {
+		case block.Type == "text":
+			parts = append(parts, block.Text)
+		case block.Type == "image" && block.Source.Type == "base64":
+			images = append(images, block.Source.Data)
+		default:
+			return "", nil, fmt.Errorf("content blocks of type %q are not supported", block.Type)
+		}
+	}
+	return strings.Join(parts, "\n"), images, nil
+}
+
+// anthropicModel maps the requested model onto a local one. Claude model names
+// that aren't in model_aliases use the default_model, so clients with a
+// hard-coded model still work.
+func anthropicModel(config *Config, model string) string {
+	if alias, ok := config.ModelAliases[model]; ok {
+		return alias
+	}
+	if model == "" || strings.HasPrefix(model, "claude-") {
+		return config.DefaultModel
+	}
+	return model
+}
+
+// anthropicStopReason maps Ollama's done_reason to an Anthropic stop_reason.
+func anthropicStopReason(stats *GenerationStats) string {
+	if stats.Truncated() {
+		return "max_tokens"
+	}
+	return "end_turn"
+}
+
+// buildChatRequest converts a Messages API request into an Ollama chat request.
+// It returns the request and the last user message, for history.
+func buildChatRequest(r *http.Request, config *Config, request anthropicRequest, model string) (map[string]interface{}, string, error) {
+	var messages []map[string]interface{}
+	system, _, err := anthropicContent(request.System)
+	if err != nil {
+		return nil, "", fmt.Errorf("system: %w", err)
+	}
+	if system != "" {
+		messages = append(messages, map[string]interface{}{"role": "system", "content": system})
+	}
+
+	var prompt strings.Builder
+	prompt.WriteString(system)
+	var query string
+	for i, message := range request.Messages {
+		if message.Role != "user" && message.Role != "assistant" {
+			return nil, "", fmt.Errorf("messages.%d.role must be user or assistant", i)
+		}
+		text, images, err := anthropicContent(message.Content)
+		if err != nil {
+			return nil, "", fmt.Errorf("messages.%d.content: %w", i, err)
+		}
+		chatMessage := map[string]interface{}{"role": message.Role, "content": text}
+		if len(images) > 0 {
+			chatMessage["images"] = images
+		}
+		messages = append(messages, chatMessage)
+		prompt.WriteString(text)
+		if message.Role == "user" {
+			query = text
+		}
+	}
+
+	ollamaRequest := make(map[string]interface{}, len(config.OllamaParams)+4)
+	for key, value := range config.OllamaParams {
+		ollamaRequest[key] = value
+	}
+	ollamaRequest["model"] = model
+	ollamaRequest["messages"] = messages
+	ollamaRequest["stream"] = request.Stream
+
+	options := make(map[string]interface{})
+	if configured, ok := config.OllamaParams["options"].(map[string]interface{}); ok {
+		for key, value := range configured {
+			options[key] = value
+		}
+	}
+	// Options are decoded from JSON elsewhere, so numbers are kept as float64
+	options["num_predict"] = float64(request.MaxTokens)
+	if request.Temperature != nil {
+		options["temperature"] = *request.Temperature
+	}
+	if request.TopP != nil {
+		options["top_p"] = *request.TopP
+	}
+	if request.TopK != nil {
+		options["top_k"] = float64(*request.TopK)
+	}
+	if len(request.StopSequences) > 0 {
+		options["stop"] = request.StopSequences
+	}
+	fitContextWindow(r.Context(), config, model, prompt.String(), options)
+	ollamaRequest["options"] = options
+
+	return ollamaRequest, query, nil
+}
+
+// anthropicMessagesHandler serves POST /v1/messages, a subset of the Anthropic
+// Messages API answered by the local models through Ollama's /api/chat.
+func anthropicMessagesHandler(config *Config, history *History) http.HandlerFunc {
+	return authenticateAPIKey(config, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeAnthropicError(w, http.StatusMethodNotAllowed, "invalid_request_error", "Method not allowed")
+			return
+		}
+
+		var request anthropicRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", "Invalid request")
+			return
+		}
+		if request.MaxTokens < 1 {
+			writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", "max_tokens is required")
+			return
+		}
+		if len(request.Messages) == 0 {
+			writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", "messages is required")
+			return
+		}
+		if request.Stream && !config.Flags.Enabled(flagStreaming) {
+			writeAnthropicError(w, http.StatusServiceUnavailable, "api_error", "Streaming is disabled")
+			return
+		}
+
+		ctx := withGenerationStats(requestTraceContext(r.Context(), config, r), &GenerationStats{})
+		r = r.WithContext(ctx)
+		model := anthropicModel(config, request.Model)
+		ollamaRequest, query, err := buildChatRequest(r, config, request, model)
+		if err != nil {
+			writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+			return
+		}
+
+		id := "msg_" + newJobID()
+		start := time.Now()
+		release, err := waitForModel(ctx, config, model)
+		if err != nil {
+			recordGeneration(ctx, config, history, "anthropic", "", TemplateData{Query: query}, model, HAContext{Origin: requestOrigin(r)}, start, nil, err)
+			writeAnthropicError(w, 529, "overloaded_error", "Too many requests are waiting for the model")
+			return
+		}
+		defer release()
+		if request.Stream {
+			streamAnthropic(w, r, config, history, ollamaRequest, id, request.Model, model, query, start)
+			return
+		}
+
+		response, err := postChat(ctx, config, "anthropic", ollamaRequest, nil)
+		var text string
+		if err == nil {
+			message, _ := response["message"].(map[string]interface{})
+			text, _ = message["content"].(string)
+		}
+		recordGeneration(ctx, config, history, "anthropic", "", TemplateData{Query: query}, model, HAContext{Origin: requestOrigin(r)}, start, map[string]interface{}{"response": text}, err)
+		if err != nil {
+			slog.Error("Failed to get a response from the Ollama API", "model", model, "error", err)
+			writeAnthropicError(w, http.StatusBadGateway, "api_error", "Failed to get a response from the Ollama API")
+			return
+		}
+
+		stats := generationStats(ctx)
+		setUsageHeaders(ctx, w)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"id":            id,
+			"type":          "message",
+			"role":          "assistant",
+			"model":         request.Model,
+			"content":       []map[string]string{{"type": "text", "text": text}},
+			"stop_reason":   anthropicStopReason(stats),
+			"stop_sequence": nil,
+			"usage":         map[string]int{"input_tokens": stats.PromptTokens, "output_tokens": stats.CompletionTokens},
+		})
+	})
+}
+
+// streamAnthropic streams a chat response as Messages API server-sent events.
+func streamAnthropic(w http.ResponseWriter, r *http.Request, config *Config, history *History, ollamaRequest map[string]interface{}, id, requestedModel, model, query string, start time.Time) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAnthropicError(w, http.StatusInternalServerError, "api_error", "Streaming is not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	writeEvent(w, "message_start", map[string]interface{}{
+		"type": "message_start",
+		"message": map[string]interface{}{
+			"id": id, "type": "message", "role": "assistant", "model": requestedModel,
+			"content": []interface{}{}, "stop_reason": nil, "stop_sequence": nil,
+			"usage": map[string]int{"input_tokens": 0, "output_tokens": 0},
+		},
+	})
+	writeEvent(w, "content_block_start", map[string]interface{}{
+		"type": "content_block_start", "index": 0,
+		"content_block": map[string]string{"type": "text", "text": ""},
+	})
+	flusher.Flush()
+
+	ctx := r.Context()
+	var text strings.Builder
+	_, err := postChat(ctx, config, "anthropic", ollamaRequest, func(chunk string) {
+		text.WriteString(chunk)
+		writeEvent(w, "content_block_delta", map[string]interface{}{
+			"type": "content_block_delta", "index": 0,
+			"delta": map[string]string{"type": "text_delta", "text": chunk},
+		})
+		flusher.Flush()
+	})
+	recordGeneration(ctx, config, history, "anthropic", "", TemplateData{Query: query}, model, HAContext{Origin: requestOrigin(r)}, start, map[string]interface{}{"response": text.String()}, err)
+	if err != nil {
+		slog.Error("Failed to stream a response from the Ollama API", "model", model, "error", err)
+		writeEvent(w, "error", anthropicError("api_error", "Failed to get a response from the Ollama API"))
+		flusher.Flush()
+		return
+	}
+
+	stats := generationStats(ctx)
+	writeEvent(w, "content_block_stop", map[string]interface{}{"type": "content_block_stop", "index": 0})
+	writeEvent(w, "message_delta", map[string]interface{}{
+		"type":  "message_delta",
+		"delta": map[string]interface{}{"stop_reason": anthropicStopReason(stats), "stop_sequence": nil},
+		"usage": map[string]int{"input_tokens": stats.PromptTokens, "output_tokens": stats.CompletionTokens},
+	})
+	writeEvent(w, "message_stop", map[string]string{"type": "message_stop"})
+	flusher.Flush()
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ApprovalConfig applies to actions in approve mode. Outputs are notified of
+// each action waiting for approval, requests not decided within Expires are
+// dropped, and AuditPath, when set, keeps every decision as a line of JSON.
+type ApprovalConfig struct {
+	Outputs   []string `json:"outputs"`
+	Expires   string   `json:"expires"`
+	AuditPath string   `json:"audit_path"`
+
+	expires time.Duration
+}
+
+const defaultApprovalExpiry = 15 * time.Minute
+
+// Decisions kept for /admin/approvals, beyond which the oldest are dropped
+const maxApprovalDecisions = 100
+
+func (c *ApprovalConfig) parse() error {
+	c.expires = defaultApprovalExpiry
+	if c.Expires != "" {
+		expires, err := time.ParseDuration(c.Expires)
+		if err != nil || expires <= 0 {
+			return fmt.Errorf("invalid approval expires '%s'", c.Expires)
+		}
+		c.expires = expires
+	}
+	return nil
+}
+
+// Statuses of an approval request
+const (
+	approvalPending  = "pending"
+	approvalApproved = "approved"
+	approvalDenied   = "denied"
+	approvalExpired  = "expired"
+)
+
+// Approval is an action the model called that waits for a person to approve
+// or deny it through /admin/approvals.
+type Approval struct {
+	ID          string                 `json:"id"`
+	Template    string                 `json:"template"`
+	Action      string                 `json:"action"`
+	Arguments   map[string]interface{} `json:"arguments"`
+	RequestID   string                 `json:"request_id,omitempty"`
+	Status      string                 `json:"status"`
+	RequestedAt time.Time              `json:"requested_at"`
+	ExpiresAt   time.Time              `json:"expires_at"`
+	DecidedAt   *time.Time             `json:"decided_at,omitempty"`
+	DecidedBy   string                 `json:"decided_by,omitempty"`
+	Reason      string                 `json:"reason,omitempty"`
+	// Result is what running an approved action returned
+	Result *ActionCall `json:"result,omitempty"`
+}
+
+// Approvals keeps the actions waiting for approval and the recent decisions.
+// It lives as long as the server, so reloads don't drop pending requests.
+type Approvals struct {
+	// Set once outputs are loaded, nil in tests
+	outputs *Outputs
+
+	mu      sync.Mutex
+	pending map[string]*Approval
+	decided []*Approval
+}
+
+func newApprovals() *Approvals {
+	return &Approvals{pending: map[string]*Approval{}}
+}
+
+// request queues the call for approval and notifies the approval outputs.
+func (a *Approvals) request(config *ActionsConfig, templateName, requestID string, call ActionCall) *Approval {
+	now := time.Now()
+	approval := &Approval{
+		ID:          newJobID(),
+		Template:    templateName,
+		Action:      call.Action,
+		Arguments:   call.Arguments,
+		RequestID:   requestID,
+		Status:      approvalPending,
+		RequestedAt: now,
+		ExpiresAt:   now.Add(config.Approval.expires),
+	}
+	a.mu.Lock()
+	a.expire(config, now)
+	a.pending[approval.ID] = approval
+	a.mu.Unlock()
+
+	slog.Info("Action waiting for approval", "approval_id", approval.ID, "template", templateName, "action", call.Action, "request_id", requestID)
+	if len(config.Approval.Outputs) > 0 && a.outputs != nil {
+		arguments, _ := json.Marshal(call.Arguments)
+		message := fmt.Sprintf("The model wants to run the action %s with %s. Approve or deny it with /admin/approvals/%s.", call.Action, arguments, approval.ID)
+		a.outputs.deliverTo(config.Approval.Outputs, Delivery{
+			Source:   "approvals",
+			Template: templateName,
+			Response: message,
+			Fields:   map[string]interface{}{"response": message, "approval_id": approval.ID, "action": call.Action, "arguments": call.Arguments},
+			Time:     now,
+		})
+	}
+	return approval
+}
+
+// expire decides the pending requests past their expiry as expired. The
+// caller holds the lock.
+func (a *Approvals) expire(config *ActionsConfig, now time.Time) {
+	for _, approval := range a.pending {
+		if now.After(approval.ExpiresAt) {
+			a.decide(config, approval, approvalExpired, "", "", now)
+		}
+	}
+}
+
+// decide moves the request out of the queue with its decision and audits it.
+// The caller holds the lock.
+func (a *Approvals) decide(config *ActionsConfig, approval *Approval, status, decidedBy, reason string, now time.Time) {
+	delete(a.pending, approval.ID)
+	approval.Status, approval.DecidedAt, approval.DecidedBy, approval.Reason = status, &now, decidedBy, reason
+	a.decided = append(a.decided, approval)
+	if len(a.decided) > maxApprovalDecisions {
+		a.decided = a.decided[len(a.decided)-maxApprovalDecisions:]
+	}
+	slog.Info("Action approval decided", "approval_id", approval.ID, "template", approval.Template, "action", approval.Action, "status", status, "remote_addr", decidedBy, "reason", reason)
+	a.audit(config, approval)
+}
+
+// audit appends the decision to the audit file, when there is one.
+func (a *Approvals) audit(config *ActionsConfig, approval *Approval) {
+	path := config.Approval.AuditPath
+	if path == "" {
+		return
+	}
+	line, err := json.Marshal(approval)
+	if err != nil {
+		slog.Error("Failed to encode approval decision", "error", err)
+		return
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		slog.Error("Failed to write approval audit", "error", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		slog.Error("Failed to write approval audit", "error", err)
+	}
+}
+
+// list returns the pending requests, oldest first, and the recent decisions,
+// newest first.
+func (a *Approvals) list(config *ActionsConfig) ([]Approval, []Approval) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.expire(config, time.Now())
+	pending := make([]Approval, 0, len(a.pending))
+	for _, approval := range a.pending {
+		pending = append(pending, *approval)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].RequestedAt.Before(pending[j].RequestedAt) })
+	decided := make([]Approval, 0, len(a.decided))
+	for i := len(a.decided) - 1; i >= 0; i-- {
+		decided = append(decided, *a.decided[i])
+	}
+	return pending, decided
+}
+
+// Errors deciding an approval request
+var (
+	errApprovalNotFound = errors.New("unknown approval")
+	errApprovalDecided  = errors.New("approval already decided")
+	errApprovalExpired  = errors.New("approval expired")
+)
+
+// take removes a pending request from the queue to decide it, so it can only
+// be decided once.
+func (a *Approvals) take(config *ActionsConfig, id string) (*Approval, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.expire(config, time.Now())
+	if approval, ok := a.pending[id]; ok {
+		delete(a.pending, id)
+		return approval, nil
+	}
+	for _, approval := range a.decided {
+		if approval.ID != id {
+			continue
+		}
+		if approval.Status == approvalExpired {
+			return nil, errApprovalExpired
+		}
+		return nil, errApprovalDecided
+	}
+	return nil, errApprovalNotFound
+}
+
+// approve runs the action of an approved request within its limits, with the
+// current config's action.
+func (a *Approvals) approve(r *http.Request, config *ActionsConfig, approval *Approval) {
+	call := ActionCall{Action: approval.Action, Arguments: approval.Arguments}
+	if action, ok := config.Tools[approval.Action]; !ok {
+		call.Status, call.Error = actionFailed, fmt.Sprintf("unknown action '%s'", approval.Action)
+	} else if err := validateSchema(call.Arguments, action.parameters, "arguments"); err != nil {
+		// The action's parameters may have changed since the call was made
+		call.Status, call.Error = actionFailed, err.Error()
+	} else {
+		start := time.Now()
+		output, err := action.execute(r.Context(), call.Arguments)
+		if err != nil {
+			call.Status, call.Error = actionFailed, err.Error()
+			slog.Error("Approved action failed", "approval_id", approval.ID, "action", approval.Action, "duration", time.Since(start), "error", err)
+		} else {
+			call.Status, call.Output = actionExecuted, output
+			slog.Info("Approved action executed", "approval_id", approval.ID, "action", approval.Action, "duration", time.Since(start))
+		}
+	}
+	approval.Result = &call
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.decide(config, approval, approvalApproved, r.RemoteAddr, "", time.Now())
+}
+
+// deny drops the request without running its action.
+func (a *Approvals) deny(r *http.Request, config *ActionsConfig, approval *Approval, reason string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.decide(config, approval, approvalDenied, r.RemoteAddr, reason, time.Now())
+}
+
+// approvalsHandler lists the actions waiting for approval and recent
+// decisions on GET /admin/approvals, and decides one on
+// POST /admin/approvals/{id}/approve or /deny.
+func approvalsHandler(config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/approvals"), "/")
+		if path == "" {
+			if r.Method != http.MethodGet {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			pending, decided := config.Actions.approvals.list(&config.Actions)
+			writeJSON(w, http.StatusOK, map[string]interface{}{"pending": pending, "decided": decided})
+			return
+		}
+
+		id, decision, _ := strings.Cut(path, "/")
+		if decision != "approve" && decision != "deny" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var body struct {
+			Reason string `json:"reason"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&body); err != nil {
+				http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+				return
+			}
+		}
+
+		approval, err := config.Actions.approvals.take(&config.Actions, id)
+		switch {
+		case errors.Is(err, errApprovalNotFound):
+			http.Error(w, fmt.Sprintf("Unknown approval '%s'", id), http.StatusNotFound)
+			return
+		case errors.Is(err, errApprovalExpired):
+			http.Error(w, fmt.Sprintf("Approval '%s' expired", id), http.StatusGone)
+			return
+		case err != nil:
+			http.Error(w, fmt.Sprintf("Approval '%s' was already decided", id), http.StatusConflict)
+			return
+		}
+		if decision == "approve" {
+			config.Actions.approvals.approve(r, &config.Actions, approval)
+		} else {
+			config.Actions.approvals.deny(r, &config.Actions, approval, body.Reason)
+		}
+		writeJSON(w, http.StatusOK, approval)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pendingApproval has the model call the lights action in approve mode,
+// returning the config and the approval ID.
+func pendingApproval(t *testing.T, lightsURL, auditPath string) (*Config, string) {
+	t.Helper()
+	ollama, _ := fakeToolOllama(t, "kitchen")
+	config := testConfig(t, `{"api_url": "`+ollama.URL+`/api/generate", "default_model": "llama3", "actions": {"mode": "approve",
+		"approval": {"audit_path": "`+auditPath+`"},
+		"tools": {"lights": {"url": "`+lightsURL+`", "parameters": {"type": "object", "properties": {"room": {"type": "string"}}}}}}}`)
+	templateConfig := &TemplateConfig{Settings: map[string]*TemplateSettings{"home": {Actions: []string{"lights"}}}}
+
+	response, err := generate(context.Background(), config, templateConfig, "home", TemplateData{Query: "turn on the lights"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls, _ := response["actions"].([]ActionCall)
+	if len(calls) != 1 || calls[0].Status != actionPending || calls[0].ApprovalID == "" {
+		t.Fatalf("actions = %+v, want one pending call", calls)
+	}
+	return config, calls[0].ApprovalID
+}
+
+func decideApproval(config *Config, id, decision, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/admin/approvals/"+id+"/"+decision, strings.NewReader(body))
+	approvalsHandler(config)(rec, req)
+	return rec
+}
+
+func TestApprovals(t *testing.T) {
+	var switched []string
+	lights := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switched = append(switched, r.URL.Path)
+		w.Write([]byte("switched on"))
+	}))
+	defer lights.Close()
+
+	tests := []struct {
+		name         string
+		decision     string
+		body         string
+		wantStatus   string
+		wantSwitched int
+	}{
+		{"approve", "approve", "", approvalApproved, 1},
+		{"deny", "deny", `{"reason": "nobody is home"}`, approvalDenied, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			switched = nil
+			auditPath := filepath.Join(t.TempDir(), "approvals.jsonl")
+			config, id := pendingApproval(t, lights.URL, auditPath)
+			if len(switched) != 0 {
+				t.Fatal("action ran before it was approved")
+			}
+
+			rec := httptest.NewRecorder()
+			approvalsHandler(config)(rec, httptest.NewRequest(http.MethodGet, "/admin/approvals", nil))
+			var listed struct {
+				Pending []Approval `json:"pending"`
+			}
+			json.Unmarshal(rec.Body.Bytes(), &listed)
+			if len(listed.Pending) != 1 || listed.Pending[0].ID != id || listed.Pending[0].Arguments["room"] != "kitchen" {
+				t.Fatalf("pending = %+v", listed.Pending)
+			}
+
+			rec = decideApproval(config, id, tt.decision, tt.body)
+			var decided Approval
+			json.Unmarshal(rec.Body.Bytes(), &decided)
+			if rec.Code != http.StatusOK || decided.Status != tt.wantStatus {
+				t.Fatalf("decision = %d %s", rec.Code, rec.Body.String())
+			}
+			if len(switched) != tt.wantSwitched {
+				t.Errorf("lights called %d times, want %d", len(switched), tt.wantSwitched)
+			}
+			if tt.wantSwitched > 0 && (decided.Result == nil || decided.Result.Output != "switched on") {
+				t.Errorf("result = %+v", decided.Result)
+			}
+
+			audit, err := os.ReadFile(auditPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var audited Approval
+			if err := json.Unmarshal(audit, &audited); err != nil || audited.ID != id || audited.Status != tt.wantStatus {
+				t.Errorf("audit = %s", audit)
+			}
+
+			if rec := decideApproval(config, id, "approve", ""); rec.Code != http.StatusConflict {
+				t.Errorf("second decision = %d, want %d", rec.Code, http.StatusConflict)
+			}
+			if len(switched) != tt.wantSwitched {
+				t.Error("action ran again")
+			}
+		})
+	}
+}
+
+func TestApprovalErrors(t *testing.T) {
+	config, id := pendingApproval(t, "http://127.0.0.1:1", "")
+
+	if rec := decideApproval(config, "nope", "approve", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown approval = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if rec := decideApproval(config, id, "maybe", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown decision = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if rec := decideApproval(config, id, "deny", "{"); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid body = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	config.Actions.approvals.mu.Lock()
+	config.Actions.approvals.pending[id].ExpiresAt = time.Now().Add(-time.Second)
+	config.Actions.approvals.mu.Unlock()
+	if rec := decideApproval(config, id, "approve", ""); rec.Code != http.StatusGone {
+		t.Errorf("expired approval = %d, want %d", rec.Code, http.StatusGone)
+	}
+	if _, decided := config.Actions.approvals.list(&config.Actions); len(decided) != 1 || decided[0].Status != approvalExpired {
+		t.Errorf("decided = %+v, want one expired", decided)
+	}
+}
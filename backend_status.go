@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How long the backends dashboard waits for each backend
+const backendStatusTimeout = 5 * time.Second
+
+// Name the dashboard gives the Ollama servers at api_url and api_urls
+const defaultBackendName = "default"
+
+// BackendStatus is a backend's state on the dashboard at GET /admin/backends.
+type BackendStatus struct {
+	backendInfo
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+	// Models the Ollama server has loaded
+	LoadedModels []LoadedModel `json:"loaded_models,omitempty"`
+	// Generations in flight, for the servers of api_urls
+	InFlight *int `json:"in_flight,omitempty"`
+	// Queues of the backend's models, by model
+	Queues  map[string]QueueStatus `json:"queues"`
+	Latency BackendLatency         `json:"latency"`
+}
+
+// LoadedModel is a model in memory, as Ollama's /api/ps reports it.
+type LoadedModel struct {
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	SizeVRAM  int64  `json:"size_vram"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+// backendStatuses checks every backend at once: the Ollama servers first, then
+// the named backends in order.
+func backendStatuses(ctx context.Context, config *Config, templateConfig *TemplateConfig) []BackendStatus {
+	var statuses []BackendStatus
+	urls := config.APIURLs
+	if len(urls) == 0 {
+		urls = []string{config.APIURL}
+	}
+	for _, url := range urls {
+		status := BackendStatus{backendInfo: newBackendInfo("", BackendConfig{Type: "ollama", APIURL: url, APIKey: config.APIKey}, templateConfig)}
+		status.Name = defaultBackendName
+		if len(config.APIURLs) > 0 {
+			inFlight, _ := config.balancer.state(url)
+			status.InFlight = &inFlight
+		}
+		statuses = append(statuses, status)
+	}
+	for _, name := range sortedKeys(config.Backends) {
+		statuses = append(statuses, BackendStatus{backendInfo: newBackendInfo(name, config.Backends[name], templateConfig)})
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, backendStatusTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := range statuses {
+		wg.Add(1)
+		go func(status *BackendStatus) {
+			defer wg.Done()
+			status.check(ctx, config)
+		}(&statuses[i])
+	}
+	wg.Wait()
+	return statuses
+}
+
+// check fills in the backend's health, loaded models, queues and latency.
+func (s *BackendStatus) check(ctx context.Context, config *Config) {
+	name := s.Name
+	bc := config.Backends[name]
+	if name == defaultBackendName {
+		name = ""
+		bc = BackendConfig{Type: "ollama", APIURL: s.APIURL, APIKey: config.APIKey, Model: config.DefaultModel}
+	}
+	s.Latency = config.latency.backend(name)
+
+	var err error
+	if bc.Type == "ollama" {
+		s.LoadedModels, err = loadedModels(ctx, bc)
+	} else {
+		err = checkBackendModels(ctx, bc)
+	}
+	s.Healthy = err == nil
+	if err != nil {
+		s.Error = err.Error()
+	}
+
+	queues := config.queues.status()
+	s.Queues = make(map[string]QueueStatus)
+	models := []string{bc.Model}
+	for _, model := range s.LoadedModels {
+		models = append(models, model.Name)
+	}
+	for _, model := range models {
+		if queue, ok := queues[model]; ok {
+			s.Queues[model] = queue
+		}
+	}
+}
+
+// loadedModels asks an Ollama server which models it has in memory.
+func loadedModels(ctx context.Context, bc BackendConfig) ([]LoadedModel, error) {
+	var ps struct {
+		Models []LoadedModel `json:"models"`
+	}
+	if err := ollamaJSON(ctx, &Config{APIURL: bc.APIURL, APIKey: bc.APIKey}, http.MethodGet, "/api/ps", nil, &ps); err != nil {
+		return nil, err
+	}
+	if ps.Models == nil {
+		ps.Models = []LoadedModel{}
+	}
+	return ps.Models, nil
+}
+
+// checkBackendModels lists the models of an OpenAI-compatible or Anthropic
+// backend, to see that it answers and accepts the key.
+func checkBackendModels(ctx context.Context, bc BackendConfig) error {
+	url := apiPath(bc.APIURL, "/models")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if bc.Type == "anthropic" {
+		req.Header.Set("x-api-key", bc.APIKey)
+		req.Header.Set("anthropic-version", "2023-06-01")
+	} else if bc.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+bc.APIKey)
+	}
+	resp, err := sendTraced(http.DefaultClient, req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,561 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Backend is an upstream that generates text. Requests and responses use
+// Ollama's shape (model, prompt or messages, options, and response or message
+// with eval_count and friends), so templates, response_fields and statistics
+// work the same whichever backend serves them. Other APIs translate.
+type Backend interface {
+	Generate(ctx context.Context, request map[string]interface{}, onChunk func(string)) (map[string]interface{}, error)
+	Chat(ctx context.Context, request map[string]interface{}, onChunk func(string)) (map[string]interface{}, error)
+	Embed(ctx context.Context, model string, inputs []string) ([][]float64, int, error)
+}
+
+// BackendConfig is an upstream other than the Ollama server at api_url, chosen
+// per template with "backend" in the template's settings.
+type BackendConfig struct {
+	// ollama, openai (any OpenAI-compatible server), vllm, llamacpp or anthropic
+	Type   string `json:"type"`
+	APIURL string `json:"api_url"`
+	APIKey string `json:"api_key"`
+	// Model used by templates that don't set their own
+	Model string `json:"model"`
+	// Tokens available for the prompt and answer, for prompt trimming
+	ContextLength int `json:"context_length"`
+}
+
+var backendTypes = []string{"ollama", "openai", "vllm", "llamacpp", "anthropic"}
+
+// Tokens an answer may use when num_predict isn't set, for APIs that need a limit
+const defaultMaxTokens = 1024
+
+func checkBackends(backends map[string]BackendConfig) error {
+	for name, bc := range backends {
+		if !containsString(backendTypes, bc.Type) {
+			return fmt.Errorf("backend '%s': type must be one of %s", name, strings.Join(backendTypes, ", "))
+		}
+		if bc.APIURL == "" {
+			return fmt.Errorf("backend '%s': api_url is required", name)
+		}
+	}
+	return nil
+}
+
+// contextLength is the configured context, or a default for the backend type.
+func (bc BackendConfig) contextLength() int {
+	if bc.ContextLength > 0 {
+		return bc.ContextLength
+	}
+	if bc.Type == "anthropic" {
+		return 200000
+	}
+	return 8192
+}
+
+// backendName is the backend the template uses, empty for api_url.
+func (tc *TemplateConfig) backendName(templateName string) string {
+	if settings, ok := tc.Settings[templateName]; ok {
+		return settings.Backend
+	}
+	return ""
+}
+
+// newBackend returns the named backend, or the Ollama server at api_url when
+// name is empty. hedgeAfter only applies to Ollama backends.
+func newBackend(config *Config, name string, hedgeAfter time.Duration) (Backend, error) {
+	if name == "" {
+		return &ollamaBackend{config: config, hedgeAfter: hedgeAfter}, nil
+	}
+	bc, ok := config.Backends[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown backend '%s'", name)
+	}
+	switch bc.Type {
+	case "ollama":
+		backend := *config
+		backend.APIURL = bc.APIURL
+		backend.APIKey = bc.APIKey
+		return &ollamaBackend{config: &backend, hedgeAfter: hedgeAfter}, nil
+	case "anthropic":
+		return &anthropicBackend{config: config, backend: bc}, nil
+	default:
+		return &openAIBackend{config: config, backend: bc}, nil
+	}
+}
+
+// ollamaBackend is an Ollama server. It's the only backend that can be hedged.
+type ollamaBackend struct {
+	config     *Config
+	hedgeAfter time.Duration
+}
+
+func (b *ollamaBackend) Generate(ctx context.Context, request map[string]interface{}, onChunk func(string)) (map[string]interface{}, error) {
+	return postOllamaFailover(ctx, b.config, "/api/generate", request, onChunk, b.hedgeAfter)
+}
+
+func (b *ollamaBackend) Chat(ctx context.Context, request map[string]interface{}, onChunk func(string)) (map[string]interface{}, error) {
+	return postOllamaFailover(ctx, b.config, "/api/chat", request, onChunk, b.hedgeAfter)
+}
+
+func (b *ollamaBackend) Embed(ctx context.Context, model string, inputs []string) ([][]float64, int, error) {
+	var embed struct {
+		Embeddings      [][]float64 `json:"embeddings"`
+		PromptEvalCount int         `json:"prompt_eval_count"`
+	}
+	if err := ollamaJSON(ctx, b.config, http.MethodPost, "/api/embed", map[string]interface{}{"model": model, "input": inputs}, &embed); err != nil {
+		return nil, 0, err
+	}
+	return embed.Embeddings, embed.PromptEvalCount, nil
+}
+
+// requestMessages returns the chat messages of an Ollama request, turning a
+// generate request's system and prompt into messages.
+func requestMessages(request map[string]interface{}) []map[string]interface{} {
+	var messages []map[string]interface{}
+	switch value := request["messages"].(type) {
+	case []map[string]interface{}:
+		messages = value
+	case []interface{}:
+		for _, item := range value {
+			if message, ok := item.(map[string]interface{}); ok {
+				messages = append(messages, message)
+			}
+		}
+	}
+	if prompt, ok := request["prompt"].(string); ok {
+		if system, _ := request["system"].(string); system != "" {
+			messages = append(messages, map[string]interface{}{"role": "system", "content": system})
+		}
+		message := map[string]interface{}{"role": "user", "content": prompt}
+		if images, ok := request["images"]; ok {
+			message["images"] = images
+		}
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+// messageImages returns the base64 images attached to an Ollama message.
+func messageImages(message map[string]interface{}) []string {
+	var images []string
+	switch value := message["images"].(type) {
+	case []string:
+		images = value
+	case []interface{}:
+		for _, item := range value {
+			if image, ok := item.(string); ok {
+				images = append(images, image)
+			}
+		}
+	}
+	return images
+}
+
+// imageMediaType detects the type of a base64 image, such as image/jpeg.
+func imageMediaType(image string) string {
+	head, _ := base64.StdEncoding.DecodeString(image[:min(len(image), 64)])
+	return http.DetectContentType(head)
+}
+
+// ollamaDoneReason maps an upstream finish reason onto Ollama's done_reason.
+func ollamaDoneReason(reason string) string {
+	switch reason {
+	case "length", "max_tokens":
+		return "length"
+	}
+	return "stop"
+}
+
+// generateResponse turns a chat response into a generate response.
+func generateResponse(response map[string]interface{}) map[string]interface{} {
+	message, _ := response["message"].(map[string]interface{})
+	response["response"], _ = message["content"].(string)
+	delete(response, "message")
+	return response
+}
+
+// apiPath joins an API path to a backend's api_url, which may or may not
+// already end in /v1.
+func apiPath(apiURL, path string) string {
+	base := strings.TrimSuffix(apiURL, "/")
+	if strings.HasSuffix(base, "/v1") {
+		return base + path
+	}
+	return base + "/v1" + path
+}
+
+// postBackend sends a JSON request to a backend and returns the response when
+// it succeeded.
+func postBackend(ctx context.Context, config *Config, url string, headers map[string]string, request interface{}) (*http.Response, error) {
+	requestBody, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(requestBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	traceLog(ctx, config, "Upstream request", "url", url, "body", string(requestBody))
+
+	resp, err := sendTraced(http.DefaultClient, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request to %s: %w", url, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		traceLog(ctx, config, "Upstream response", "status", resp.Status, "body", string(body))
+		return nil, fmt.Errorf("%s returned %s: %s", url, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// readSSE calls fn with the data of each server-sent event until the stream
+// ends or sends [DONE].
+func readSSE(ctx context.Context, config *Config, body io.Reader, fn func(data []byte) error) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := bytes.CutPrefix(scanner.Bytes(), []byte("data:"))
+		if !ok {
+			continue
+		}
+		data = bytes.TrimSpace(data)
+		traceLog(ctx, config, "Upstream stream chunk", "data", string(data))
+		if string(data) == "[DONE]" {
+			return nil
+		}
+		if err := fn(data); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// openAIBackend is an OpenAI-compatible chat completions API, such as vLLM or
+// the llama.cpp server.
+type openAIBackend struct {
+	config  *Config
+	backend BackendConfig
+}
+
+func (b *openAIBackend) Generate(ctx context.Context, request map[string]interface{}, onChunk func(string)) (map[string]interface{}, error) {
+	response, err := b.Chat(ctx, request, onChunk)
+	if err != nil {
+		return nil, err
+	}
+	return generateResponse(response), nil
+}
+
+func (b *openAIBackend) Chat(ctx context.Context, request map[string]interface{}, onChunk func(string)) (map[string]interface{}, error) {
+	var messages []map[string]interface{}
+	for _, message := range requestMessages(request) {
+		content := message["content"]
+		if images := messageImages(message); len(images) > 0 {
+			parts := []map[string]interface{}{{"type": "text", "text": content}}
+			for _, image := range images {
+				url := "data:" + imageMediaType(image) + ";base64," + image
+				parts = append(parts, map[string]interface{}{"type": "image_url", "image_url": map[string]string{"url": url}})
+			}
+			content = parts
+		}
+		messages = append(messages, map[string]interface{}{"role": message["role"], "content": content})
+	}
+
+	model, _ := request["model"].(string)
+	body := map[string]interface{}{"model": model, "messages": messages, "stream": onChunk != nil}
+	if onChunk != nil {
+		body["stream_options"] = map[string]bool{"include_usage": true}
+	}
+	options, _ := request["options"].(map[string]interface{})
+	if tokens := intOption(options, "num_predict"); tokens > 0 {
+		body["max_tokens"] = tokens
+	}
+	for _, name := range []string{"temperature", "top_p", "seed", "stop", "presence_penalty", "frequency_penalty"} {
+		if value, ok := options[name]; ok {
+			body[name] = value
+		}
+	}
+	// vLLM and the llama.cpp server accept sampling options beyond OpenAI's
+	extra := map[string]string{}
+	switch b.backend.Type {
+	case "vllm":
+		extra = map[string]string{"top_k": "top_k", "min_p": "min_p", "repeat_penalty": "repetition_penalty"}
+	case "llamacpp":
+		extra = map[string]string{"top_k": "top_k", "min_p": "min_p", "repeat_penalty": "repeat_penalty"}
+	}
+	for option, name := range extra {
+		if value, ok := options[option]; ok {
+			body[name] = value
+		}
+	}
+	if format, _ := request["format"].(string); format == "json" {
+		body["response_format"] = map[string]string{"type": "json_object"}
+	}
+
+	headers := map[string]string{}
+	if b.backend.APIKey != "" {
+		headers["Authorization"] = "Bearer " + b.backend.APIKey
+	}
+	resp, err := postBackend(ctx, b.config, apiPath(b.backend.APIURL, "/chat/completions"), headers, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	type usage struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	}
+	var text strings.Builder
+	var finishReason string
+	var used usage
+	if onChunk != nil {
+		onChunk = timeFirstToken(ctx, onChunk)
+		err = readSSE(ctx, b.config, resp.Body, func(data []byte) error {
+			var chunk struct {
+				Choices []struct {
+					Delta struct {
+						Content string `json:"content"`
+					} `json:"delta"`
+					FinishReason string `json:"finish_reason"`
+				} `json:"choices"`
+				Usage *usage `json:"usage"`
+			}
+			if err := json.Unmarshal(data, &chunk); err != nil {
+				return fmt.Errorf("error unmarshaling stream chunk: %w", err)
+			}
+			if chunk.Usage != nil {
+				used = *chunk.Usage
+			}
+			for _, choice := range chunk.Choices {
+				if choice.Delta.Content != "" {
+					text.WriteString(choice.Delta.Content)
+					onChunk(choice.Delta.Content)
+				}
+				if choice.FinishReason != "" {
+					finishReason = choice.FinishReason
+				}
+			}
+			return nil
+		})
+	} else {
+		var completion struct {
+			Choices []struct {
+				Message struct {
+					Content string `json:"content"`
+				} `json:"message"`
+				FinishReason string `json:"finish_reason"`
+			} `json:"choices"`
+			Usage usage `json:"usage"`
+		}
+		if err = json.NewDecoder(resp.Body).Decode(&completion); err == nil && len(completion.Choices) > 0 {
+			text.WriteString(completion.Choices[0].Message.Content)
+			finishReason = completion.Choices[0].FinishReason
+		}
+		used = completion.Usage
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	response := map[string]interface{}{
+		"model":             model,
+		"message":           map[string]interface{}{"role": "assistant", "content": text.String()},
+		"done":              true,
+		"done_reason":       ollamaDoneReason(finishReason),
+		"prompt_eval_count": float64(used.PromptTokens),
+		"eval_count":        float64(used.CompletionTokens),
+	}
+	collectStats(ctx, response)
+	return response, nil
+}
+
+func (b *openAIBackend) Embed(ctx context.Context, model string, inputs []string) ([][]float64, int, error) {
+	headers := map[string]string{}
+	if b.backend.APIKey != "" {
+		headers["Authorization"] = "Bearer " + b.backend.APIKey
+	}
+	resp, err := postBackend(ctx, b.config, apiPath(b.backend.APIURL, "/embeddings"), headers, map[string]interface{}{"model": model, "input": inputs})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	var embeddings struct {
+		Data []struct {
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+		Usage struct {
+			PromptTokens int `json:"prompt_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&embeddings); err != nil {
+		return nil, 0, err
+	}
+	vectors := make([][]float64, len(embeddings.Data))
+	for i, item := range embeddings.Data {
+		vectors[i] = item.Embedding
+	}
+	return vectors, embeddings.Usage.PromptTokens, nil
+}
+
+// anthropicBackend is Anthropic's Messages API.
+type anthropicBackend struct {
+	config  *Config
+	backend BackendConfig
+}
+
+func (b *anthropicBackend) Generate(ctx context.Context, request map[string]interface{}, onChunk func(string)) (map[string]interface{}, error) {
+	response, err := b.Chat(ctx, request, onChunk)
+	if err != nil {
+		return nil, err
+	}
+	return generateResponse(response), nil
+}
+
+func (b *anthropicBackend) Chat(ctx context.Context, request map[string]interface{}, onChunk func(string)) (map[string]interface{}, error) {
+	// System messages go in the system field
+	var system []string
+	var messages []map[string]interface{}
+	for _, message := range requestMessages(request) {
+		content, _ := message["content"].(string)
+		if message["role"] == "system" {
+			system = append(system, content)
+			continue
+		}
+		var blocks []map[string]interface{}
+		for _, image := range messageImages(message) {
+			blocks = append(blocks, map[string]interface{}{
+				"type":   "image",
+				"source": map[string]string{"type": "base64", "media_type": imageMediaType(image), "data": image},
+			})
+		}
+		blocks = append(blocks, map[string]interface{}{"type": "text", "text": content})
+		messages = append(messages, map[string]interface{}{"role": message["role"], "content": blocks})
+	}
+
+	model, _ := request["model"].(string)
+	options, _ := request["options"].(map[string]interface{})
+	maxTokens := intOption(options, "num_predict")
+	if maxTokens <= 0 {
+		maxTokens = defaultMaxTokens
+	}
+	body := map[string]interface{}{"model": model, "messages": messages, "max_tokens": maxTokens, "stream": onChunk != nil}
+	if len(system) > 0 {
+		body["system"] = strings.Join(system, "\n\n")
+	}
+	for _, name := range []string{"temperature", "top_p", "top_k"} {
+		if value, ok := options[name]; ok {
+			body[name] = value
+		}
+	}
+	if stop, ok := options["stop"]; ok {
+		body["stop_sequences"] = stop
+	}
+
+	headers := map[string]string{"x-api-key": b.backend.APIKey, "anthropic-version": "2023-06-01"}
+	resp, err := postBackend(ctx, b.config, apiPath(b.backend.APIURL, "/messages"), headers, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	type usage struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	}
+	var text strings.Builder
+	var stopReason string
+	var used usage
+	if onChunk != nil {
+		onChunk = timeFirstToken(ctx, onChunk)
+		err = readSSE(ctx, b.config, resp.Body, func(data []byte) error {
+			var event struct {
+				Type    string `json:"type"`
+				Message struct {
+					Usage usage `json:"usage"`
+				} `json:"message"`
+				Delta struct {
+					Text       string `json:"text"`
+					StopReason string `json:"stop_reason"`
+				} `json:"delta"`
+				Usage usage `json:"usage"`
+				Error struct {
+					Message string `json:"message"`
+				} `json:"error"`
+			}
+			if err := json.Unmarshal(data, &event); err != nil {
+				return fmt.Errorf("error unmarshaling stream event: %w", err)
+			}
+			switch event.Type {
+			case "message_start":
+				used.InputTokens = event.Message.Usage.InputTokens
+			case "content_block_delta":
+				if event.Delta.Text != "" {
+					text.WriteString(event.Delta.Text)
+					onChunk(event.Delta.Text)
+				}
+			case "message_delta":
+				stopReason = event.Delta.StopReason
+				used.OutputTokens = event.Usage.OutputTokens
+			case "error":
+				return errors.New(event.Error.Message)
+			}
+			return nil
+		})
+	} else {
+		var message struct {
+			Content []struct {
+				Type string `json:"type"`
+				Text string `json:"text"`
+			} `json:"content"`
+			StopReason string `json:"stop_reason"`
+			Usage      usage  `json:"usage"`
+		}
+		if err = json.NewDecoder(resp.Body).Decode(&message); err == nil {
+			for _, block := range message.Content {
+				if block.Type == "text" {
+					text.WriteString(block.Text)
+				}
+			}
+			stopReason = message.StopReason
+			used = message.Usage
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	response := map[string]interface{}{
+		"model":             model,
+		"message":           map[string]interface{}{"role": "assistant", "content": text.String()},
+		"done":              true,
+		"done_reason":       ollamaDoneReason(stopReason),
+		"prompt_eval_count": float64(used.InputTokens),
+		"eval_count":        float64(used.OutputTokens),
+	}
+	collectStats(ctx, response)
+	return response, nil
+}
+
+func (b *anthropicBackend) Embed(ctx context.Context, model string, inputs []string) ([][]float64, int, error) {
+	return nil, 0, errors.New("Anthropic has no embeddings API")
+}
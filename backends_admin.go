@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+var errBackendNotFound = errors.New("backend not found")
+
+// backendInfo is a backend as the admin API shows it, without its key.
+type backendInfo struct {
+	Name          string `json:"name"`
+	Type          string `json:"type"`
+	APIURL        string `json:"api_url"`
+	APIKeySet     bool   `json:"api_key_set"`
+	Model         string `json:"model,omitempty"`
+	ContextLength int    `json:"context_length,omitempty"`
+	// Templates using the backend
+	Templates []string `json:"templates"`
+}
+
+func newBackendInfo(name string, bc BackendConfig, templateConfig *TemplateConfig) backendInfo {
+	return backendInfo{
+		Name:          name,
+		Type:          bc.Type,
+		APIURL:        bc.APIURL,
+		APIKeySet:     bc.APIKey != "",
+		Model:         bc.Model,
+		ContextLength: bc.ContextLength,
+		Templates:     backendTemplates(templateConfig, name),
+	}
+}
+
+// backendTemplates lists the templates using the named backend.
+func backendTemplates(templateConfig *TemplateConfig, name string) []string {
+	templates := []string{}
+	for _, templateName := range sortedKeys(templateConfig.Templates) {
+		if templateConfig.backendName(templateName) == name {
+			templates = append(templates, templateName)
+		}
+	}
+	return templates
+}
+
+// backendsHandler serves /admin/backends, a dashboard of the Ollama servers and
+// backends with their health, loaded models, queues and latency, and
+// /admin/backends/{name}, where GET shows a backend, PUT adds or replaces it
+// and DELETE removes it. Changes are written to the config file and reloaded,
+// so new requests use them while those already running finish on the backend
+// they started with.
+func backendsHandler(configs *ConfigStore, templates *TemplateStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/backends"), "/")
+		config, templateConfig := configs.get(), templates.get()
+
+		if name == "" {
+			if r.Method != http.MethodGet {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			query, err := parseListQuery(r, 0)
+			if err != nil {
+				writeListError(w, err)
+				return
+			}
+			statuses, err := applyListQuery(w, query, backendStatuses(r.Context(), config, templateConfig))
+			if err != nil {
+				writeListError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{"backends": statuses})
+			return
+		}
+		if !templateNamePattern.MatchString(name) {
+			http.Error(w, "Backend names may only contain letters, digits, '-' and '_'", http.StatusBadRequest)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			bc, ok := config.Backends[name]
+			if !ok {
+				http.Error(w, fmt.Sprintf("Backend '%s' not found", name), http.StatusNotFound)
+				return
+			}
+			status := BackendStatus{backendInfo: newBackendInfo(name, bc, templateConfig)}
+			ctx, cancel := context.WithTimeout(r.Context(), backendStatusTimeout)
+			defer cancel()
+			status.check(ctx, config)
+			writeJSON(w, http.StatusOK, status)
+
+		case http.MethodPut:
+			var bc BackendConfig
+			if err := json.NewDecoder(r.Body).Decode(&bc); err != nil {
+				http.Error(w, "Invalid backend", http.StatusBadRequest)
+				return
+			}
+			if err := checkBackends(map[string]BackendConfig{name: bc}); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			_, existed := config.Backends[name]
+			if _, err := configs.edit(func(raw map[string]json.RawMessage) error {
+				return editBackends(raw, func(backends map[string]BackendConfig) error {
+					// The admin API doesn't show keys, so leaving one out keeps it
+					if bc.APIKey == "" {
+						bc.APIKey = backends[name].APIKey
+					}
+					backends[name] = bc
+					return nil
+				})
+			}); err != nil {
+				slog.Error("Failed to save backend", "backend", name, "error", err)
+				http.Error(w, fmt.Sprintf("Failed to save backend: %v", err), http.StatusInternalServerError)
+				return
+			}
+			slog.Info("Backend saved", "backend", name, "type", bc.Type, "api_url", bc.APIURL, "remote_addr", r.RemoteAddr)
+			status := http.StatusOK
+			if !existed {
+				status = http.StatusCreated
+			}
+			writeJSON(w, status, newBackendInfo(name, bc, templateConfig))
+
+		case http.MethodDelete:
+			if users := backendTemplates(templateConfig, name); len(users) > 0 {
+				http.Error(w, fmt.Sprintf("Backend '%s' is used by templates %s", name, strings.Join(users, ", ")), http.StatusConflict)
+				return
+			}
+			_, err := configs.edit(func(raw map[string]json.RawMessage) error {
+				return editBackends(raw, func(backends map[string]BackendConfig) error {
+					if _, ok := backends[name]; !ok {
+						return errBackendNotFound
+					}
+					delete(backends, name)
+					return nil
+				})
+			})
+			if errors.Is(err, errBackendNotFound) {
+				http.Error(w, fmt.Sprintf("Backend '%s' not found", name), http.StatusNotFound)
+				return
+			} else if err != nil {
+				slog.Error("Failed to remove backend", "backend", name, "error", err)
+				http.Error(w, fmt.Sprintf("Failed to remove backend: %v", err), http.StatusInternalServerError)
+				return
+			}
+			slog.Info("Backend removed", "backend", name, "remote_addr", r.RemoteAddr)
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// editBackends changes the backends of a raw config.
+func editBackends(raw map[string]json.RawMessage, change func(map[string]BackendConfig) error) error {
+	backends := make(map[string]BackendConfig)
+	if data, ok := raw["backends"]; ok {
+		if err := json.Unmarshal(data, &backends); err != nil {
+			return fmt.Errorf("backends: %w", err)
+		}
+	}
+	if err := change(backends); err != nil {
+		return err
+	}
+	data, err := json.Marshal(backends)
+	if err != nil {
+		return err
+	}
+	raw["backends"] = data
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckBackends(t *testing.T) {
+	tests := []struct {
+		name     string
+		backends map[string]BackendConfig
+		wantErr  string
+	}{
+		{"none", nil, ""},
+		{"valid", map[string]BackendConfig{"gpu": {Type: "vllm", APIURL: "http://gpu:8000"}}, ""},
+		{"unknown type", map[string]BackendConfig{"gpu": {Type: "tgi", APIURL: "http://gpu:8000"}}, "type must be one of"},
+		{"no api_url", map[string]BackendConfig{"claude": {Type: "anthropic"}}, "api_url is required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkBackends(tt.backends)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAPIPath(t *testing.T) {
+	tests := []struct {
+		apiURL string
+		want   string
+	}{
+		{"http://gpu:8000", "http://gpu:8000/v1/chat/completions"},
+		{"http://gpu:8000/", "http://gpu:8000/v1/chat/completions"},
+		{"http://gpu:8000/v1", "http://gpu:8000/v1/chat/completions"},
+		{"https://api.example.com/v1/", "https://api.example.com/v1/chat/completions"},
+	}
+	for _, tt := range tests {
+		if got := apiPath(tt.apiURL, "/chat/completions"); got != tt.want {
+			t.Errorf("apiPath(%q) = %q, want %q", tt.apiURL, got, tt.want)
+		}
+	}
+}
+
+func TestRequestMessages(t *testing.T) {
+	tests := []struct {
+		name    string
+		request map[string]interface{}
+		want    []map[string]interface{}
+	}{
+		{
+			"generate",
+			map[string]interface{}{"system": "Be brief.", "prompt": "Is it cold?", "images": []string{"aW1n"}},
+			[]map[string]interface{}{
+				{"role": "system", "content": "Be brief."},
+				{"role": "user", "content": "Is it cold?", "images": []string{"aW1n"}},
+			},
+		},
+		{
+			"chat",
+			map[string]interface{}{"messages": []interface{}{map[string]interface{}{"role": "user", "content": "Hi"}}},
+			[]map[string]interface{}{{"role": "user", "content": "Hi"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := requestMessages(tt.request); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("messages = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeBackend answers every request with answer, keeping the last request body.
+func fakeBackend(t *testing.T, answer string) (*httptest.Server, *map[string]interface{}) {
+	t.Helper()
+	received := map[string]interface{}{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = map[string]interface{}{"path": r.URL.Path, "authorization": r.Header.Get("Authorization"), "x-api-key": r.Header.Get("x-api-key")}
+		json.NewDecoder(r.Body).Decode(&received)
+		w.Write([]byte(answer))
+	}))
+	t.Cleanup(server.Close)
+	return server, &received
+}
+
+func TestOpenAIBackend(t *testing.T) {
+	request := map[string]interface{}{
+		"model":   "qwen",
+		"system":  "Be brief.",
+		"prompt":  "Is it cold?",
+		"format":  "json",
+		"options": map[string]interface{}{"num_predict": float64(64), "temperature": 0.2, "repeat_penalty": 1.1},
+	}
+
+	t.Run("plain", func(t *testing.T) {
+		server, received := fakeBackend(t, `{"choices": [{"message": {"content": "Yes."}, "finish_reason": "length"}], "usage": {"prompt_tokens": 12, "completion_tokens": 3}}`)
+		backend, err := newBackend(&Config{Backends: map[string]BackendConfig{"gpu": {Type: "vllm", APIURL: server.URL, APIKey: "key"}}}, "gpu", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := backend.Generate(context.Background(), request, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response["response"] != "Yes." || response["done_reason"] != "length" || response["eval_count"] != float64(3) || response["prompt_eval_count"] != float64(12) {
+			t.Errorf("response = %v", response)
+		}
+		got := *received
+		if got["path"] != "/v1/chat/completions" || got["authorization"] != "Bearer key" {
+			t.Errorf("request to %v with %v", got["path"], got["authorization"])
+		}
+		if got["max_tokens"] != float64(64) || got["temperature"] != 0.2 || got["repetition_penalty"] != 1.1 || got["stream"] != false {
+			t.Errorf("request = %v", got)
+		}
+		if format, _ := got["response_format"].(map[string]interface{}); format["type"] != "json_object" {
+			t.Errorf("response_format = %v", got["response_format"])
+		}
+		if messages, _ := got["messages"].([]interface{}); len(messages) != 2 {
+			t.Errorf("messages = %v", got["messages"])
+		}
+	})
+
+	t.Run("streamed", func(t *testing.T) {
+		server, _ := fakeBackend(t, "data: {\"choices\": [{\"delta\": {\"content\": \"Ye\"}}]}\n\n"+
+			"data: {\"choices\": [{\"delta\": {\"content\": \"s.\"}, \"finish_reason\": \"stop\"}]}\n\n"+
+			"data: {\"choices\": [], \"usage\": {\"prompt_tokens\": 12, \"completion_tokens\": 2}}\n\n"+
+			"data: [DONE]\n\n")
+		backend, _ := newBackend(&Config{Backends: map[string]BackendConfig{"cpp": {Type: "llamacpp", APIURL: server.URL}}}, "cpp", 0)
+		var chunks []string
+		response, err := backend.Chat(context.Background(), request, func(chunk string) { chunks = append(chunks, chunk) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		message, _ := response["message"].(map[string]interface{})
+		if strings.Join(chunks, "|") != "Ye|s." || message["content"] != "Yes." || response["eval_count"] != float64(2) {
+			t.Errorf("chunks = %v, response = %v", chunks, response)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "model not found", http.StatusNotFound)
+		}))
+		defer server.Close()
+		backend, _ := newBackend(&Config{Backends: map[string]BackendConfig{"gpu": {Type: "openai", APIURL: server.URL}}}, "gpu", 0)
+		if _, err := backend.Chat(context.Background(), request, nil); err == nil || !strings.Contains(err.Error(), "model not found") {
+			t.Errorf("error = %v, want the backend's message", err)
+		}
+	})
+}
+
+func TestAnthropicBackend(t *testing.T) {
+	server, received := fakeBackend(t, `{"content": [{"type": "text", "text": "Yes."}], "stop_reason": "max_tokens", "usage": {"input_tokens": 9, "output_tokens": 2}}`)
+	backend, err := newBackend(&Config{Backends: map[string]BackendConfig{"claude": {Type: "anthropic", APIURL: server.URL, APIKey: "key"}}}, "claude", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := map[string]interface{}{
+		"model":    "claude-haiku",
+		"messages": []map[string]interface{}{{"role": "system", "content": "Be brief."}, {"role": "user", "content": "Is it cold?"}},
+		"options":  map[string]interface{}{"stop": []interface{}{"\n"}},
+	}
+	response, err := backend.Chat(context.Background(), request, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, _ := response["message"].(map[string]interface{})
+	if message["content"] != "Yes." || response["done_reason"] != "length" || response["eval_count"] != float64(2) {
+		t.Errorf("response = %v", response)
+	}
+
+	got := *received
+	if got["path"] != "/v1/messages" || got["x-api-key"] != "key" {
+		t.Errorf("request to %v with key %v", got["path"], got["x-api-key"])
+	}
+	if got["system"] != "Be brief." || got["max_tokens"] != float64(defaultMaxTokens) {
+		t.Errorf("request = %v", got)
+	}
+	if stop, _ := got["stop_sequences"].([]interface{}); len(stop) != 1 {
+		t.Errorf("stop_sequences = %v", got["stop_sequences"])
+	}
+	if messages, _ := got["messages"].([]interface{}); len(messages) != 1 {
+		t.Errorf("messages = %v, want the system message taken out", got["messages"])
+	}
+	if _, _, err := backend.Embed(context.Background(), "claude-haiku", []string{"hi"}); err == nil {
+		t.Error("Anthropic embeddings didn't fail")
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Load balancing strategies for api_urls
+const (
+	balanceRoundRobin    = "round_robin"
+	balanceLeastInFlight = "least_in_flight"
+)
+
+// LoadBalancingConfig spreads generations across the Ollama servers in
+// api_urls. Servers failing their health check, every HealthCheckInterval
+// seconds, are skipped until they pass again.
+type LoadBalancingConfig struct {
+	Strategy            string `json:"strategy"`
+	HealthCheckInterval int    `json:"health_check_interval"`
+}
+
+func (c LoadBalancingConfig) check() error {
+	switch c.Strategy {
+	case "", balanceRoundRobin, balanceLeastInFlight:
+		return nil
+	}
+	return fmt.Errorf("unknown load_balancing strategy '%s', expected %s or %s", c.Strategy, balanceRoundRobin, balanceLeastInFlight)
+}
+
+// Balancer tracks the generations in flight on each server and which servers
+// are down. It lives as long as the server, so reloads keep it.
+type Balancer struct {
+	mu       sync.Mutex
+	next     int
+	inFlight map[string]int
+	down     map[string]bool
+}
+
+func newBalancer() *Balancer {
+	return &Balancer{inFlight: make(map[string]int), down: make(map[string]bool)}
+}
+
+// order returns api_urls in the order to try them: the healthy servers, first
+// the one the strategy picks, then the servers that are down as a last resort.
+func (b *Balancer) order(config *Config) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	urls := config.APIURLs
+	start := b.next % len(urls)
+	b.next++
+
+	ordered := make([]string, 0, len(urls))
+	for i := range urls {
+		ordered = append(ordered, urls[(start+i)%len(urls)])
+	}
+	if config.LoadBalancing.Strategy == balanceLeastInFlight {
+		// Ties go round robin, as the sort is stable
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return b.inFlight[ordered[i]] < b.inFlight[ordered[j]]
+		})
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return !b.down[ordered[i]] && b.down[ordered[j]]
+	})
+	return ordered
+}
+
+// acquire counts a generation in flight on the server until release is called.
+func (b *Balancer) acquire(url string) (release func()) {
+	b.mu.Lock()
+	b.inFlight[url]++
+	b.mu.Unlock()
+	return func() {
+		b.mu.Lock()
+		b.inFlight[url]--
+		b.mu.Unlock()
+	}
+}
+
+// state reports the generations in flight on the server and whether it's down.
+func (b *Balancer) state(url string) (inFlight int, down bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.inFlight[url], b.down[url]
+}
+
+// setDown marks a server down or back up, logging the change.
+func (b *Balancer) setDown(url string, down bool) {
+	b.mu.Lock()
+	changed := b.down[url] != down
+	b.down[url] = down
+	b.mu.Unlock()
+	if changed && down {
+		slog.Warn("Ollama server is down", "url", url)
+	} else if changed {
+		slog.Info("Ollama server is back up", "url", url)
+	}
+}
+
+// checkHealth asks each server in the current config's api_urls for its
+// version every health_check_interval seconds (default 30), marking those
+// that don't answer down.
+func (b *Balancer) checkHealth(configs *ConfigStore) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	for {
+		config := configs.get()
+		interval := 30 * time.Second
+		if config.LoadBalancing.HealthCheckInterval > 0 {
+			interval = time.Duration(config.LoadBalancing.HealthCheckInterval) * time.Second
+		}
+		for _, url := range config.APIURLs {
+			b.setDown(url, !serverHealthy(client, config, url))
+		}
+		time.Sleep(interval)
+	}
+}
+
+// serverHealthy reports whether the Ollama server answers GET /api/version.
+func serverHealthy(client *http.Client, config *Config, url string) bool {
+	req, err := http.NewRequest(http.MethodGet, ollamaEndpoint(&Config{APIURL: url}, "/api/version"), nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Authorization", "Bearer "+config.APIKey)
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Queries a batch request may hold, so one request can't tie up the model for
+// too long
+const maxBatchQueries = 50
+
+// Columns of a CSV batch response when the request doesn't choose them
+var defaultBatchColumns = []string{"query", "response"}
+
+// batchRequestFields are the fields of a batch request that aren't template
+// inputs.
+var batchRequestFields = []string{"queries", "format", "fields"}
+
+// batchHandler serves POST /batch/{name}, which runs each of the request's
+// queries through the template in turn for comparing answers side by side.
+// Other inputs, and the model, are shared by every query. Results are one row
+// per query, as JSON (or XML or YAML) or, with "format": "csv" or Accept:
+// text/csv, as a CSV table.
+func batchHandler(config *Config, templateConfig *TemplateConfig, history *History, templateName string) http.HandlerFunc {
+	return authenticate(config, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var request map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		var queries []string
+		list, _ := request["queries"].([]interface{})
+		for _, item := range list {
+			query, ok := item.(string)
+			if !ok {
+				http.Error(w, "Queries must be a list of strings", http.StatusBadRequest)
+				return
+			}
+			queries = append(queries, query)
+		}
+		if len(queries) == 0 || len(queries) > maxBatchQueries {
+			http.Error(w, fmt.Sprintf("Queries must be a list of 1 to %d strings", maxBatchQueries), http.StatusBadRequest)
+			return
+		}
+		format, _ := request["format"].(string)
+		if format != "" && format != "json" && format != "csv" {
+			http.Error(w, "Format must be json or csv", http.StatusBadRequest)
+			return
+		}
+		var fields []string
+		if raw, ok := request["fields"].([]interface{}); ok {
+			for _, item := range raw {
+				if field, ok := item.(string); ok {
+					fields = append(fields, field)
+				}
+			}
+		}
+
+		for _, field := range batchRequestFields {
+			delete(request, field)
+		}
+		request["query"] = queries[0]
+		if err := checkRequestFields(config, templateConfig.Settings[templateName], request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		templateData, err := buildTemplateData(r.Context(), config, request)
+		if err != nil {
+			var inputErr *inputError
+			if errors.As(err, &inputErr) {
+				http.Error(w, inputErr.msg, http.StatusBadRequest)
+			} else {
+				slog.Error("Failed to prepare inputs for batch", "template", templateName, "error", err)
+				http.Error(w, "Failed to prepare request inputs", http.StatusBadGateway)
+			}
+			return
+		}
+
+		model := templateConfig.defaultModel(config, templateName)
+		if modelFromRequest, ok := request["model"].(string); ok && modelFromRequest != "" {
+			if !templateConfig.modelAllowed(templateName, modelFromRequest) {
+				http.Error(w, fmt.Sprintf("Model '%s' is not allowed for this template", modelFromRequest), http.StatusBadRequest)
+				return
+			}
+			model = modelFromRequest
+		}
+
+		slog.Info("Running a batch", "queries", len(queries), "template", templateName)
+		rows := make([]map[string]interface{}, 0, len(queries))
+		for _, query := range queries {
+			data := templateData
+			data.Query = query
+			// A client that disconnects cancels the rest of the batch
+			ctx := withGenerationStats(requestTraceContext(r.Context(), config, r), &GenerationStats{})
+			start := time.Now()
+			filteredResponse, err := generate(ctx, config, templateConfig, templateName, data, model)
+			recordGeneration(ctx, config, history, "batch", templateName, data, model, HAContext{Origin: requestOrigin(r)}, start, filteredResponse, err)
+			if r.Context().Err() != nil {
+				slog.Info("Client disconnected, cancelled batch", "template", templateName)
+				return
+			}
+
+			row := map[string]interface{}{"query": query, "model": model, "duration_ms": time.Since(start).Milliseconds()}
+			if err != nil {
+				slog.Error("Failed to generate response in batch", "template", templateName, "error", err)
+				_, message := templateError(err)
+				row["error"] = message
+			} else {
+				for field, value := range templateConfig.mapResponse(templateName, filteredResponse) {
+					row[field] = value
+				}
+			}
+			rows = append(rows, row)
+		}
+
+		if format == "csv" || strings.Contains(r.Header.Get("Accept"), "text/csv") {
+			if len(fields) == 0 {
+				fields = defaultBatchColumns
+			}
+			writeBatchCSV(w, rows, fields)
+			return
+		}
+		if len(fields) > 0 {
+			for i, row := range rows {
+				selected := make(map[string]interface{}, len(fields))
+				for _, field := range fields {
+					selected[field] = row[field]
+				}
+				rows[i] = selected
+			}
+		}
+		writeEncoded(w, r, http.StatusOK, map[string]interface{}{"results": rows})
+	})
+}
+
+// writeBatchCSV writes the rows as a CSV table with a header of the columns.
+// Objects and lists are written as JSON, and missing fields as empty cells.
+// Text that a spreadsheet would take for a formula is escaped, while numbers
+// stay numbers.
+func writeBatchCSV(w http.ResponseWriter, rows []map[string]interface{}, columns []string) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	writer := csv.NewWriter(w)
+	header := make([]string, len(columns))
+	for i, column := range columns {
+		header[i] = csvSafe(column)
+	}
+	writer.Write(header)
+	for _, row := range rows {
+		record := make([]string, len(columns))
+		for i, column := range columns {
+			switch value := row[column].(type) {
+			case nil:
+			case string:
+				record[i] = csvSafe(strings.TrimSpace(value))
+			case float64:
+				record[i] = strconv.FormatFloat(value, 'f', -1, 64)
+			case map[string]interface{}, []interface{}:
+				data, _ := json.Marshal(value)
+				record[i] = string(data)
+			default:
+				record[i] = csvSafe(fmt.Sprint(value))
+			}
+		}
+		writer.Write(record)
+	}
+	writer.Flush()
+}
+
+// csvSafe escapes a cell starting with a character spreadsheets read as the
+// start of a formula, so a model's answer such as "=HYPERLINK(...)" opens as
+// text rather than running.
+func csvSafe(cell string) string {
+	if cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+		return "'" + cell
+	}
+	return cell
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBatchResponseMap(t *testing.T) {
+	ollama, _ := fakeOllama(t, http.StatusOK, "it is cold")
+	config := testConfig(t, `{"auth_token": "tok", "default_model": "llama3", "api_url": "`+ollama.URL+`/api/generate"}`)
+	templateConfig := &TemplateConfig{Settings: map[string]*TemplateSettings{"weather": {Chat: true, ResponseMap: map[string]string{"response": "speech.text"}}}}
+
+	batch := func(body string) string {
+		r := httptest.NewRequest(http.MethodPost, "/batch/weather", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer tok")
+		w := httptest.NewRecorder()
+		batchHandler(config, templateConfig, nil, "weather")(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+		}
+		return w.Body.String()
+	}
+
+	for _, body := range []string{`{"queries": ["Is it cold?"]}`, `{"queries": ["Is it cold?"], "fields": ["speech"]}`} {
+		var response struct {
+			Results []map[string]interface{} `json:"results"`
+		}
+		if err := json.Unmarshal([]byte(batch(body)), &response); err != nil || len(response.Results) != 1 {
+			t.Fatalf("response = %+v, %v", response, err)
+		}
+		row := response.Results[0]
+		if speech, _ := row["speech"].(map[string]interface{}); speech["text"] != "it is cold" {
+			t.Errorf("%s: row = %v, want the mapped speech.text", body, row)
+		}
+		if _, ok := row["response"]; ok {
+			t.Errorf("%s: row = %v, want response mapped away", body, row)
+		}
+	}
+
+	csv := batch(`{"queries": ["Is it cold?"], "format": "csv", "fields": ["query", "speech"]}`)
+	if want := "query,speech\nIs it cold?,\"{\"\"text\"\":\"\"it is cold\"\"}\"\n"; csv != want {
+		t.Errorf("csv = %q, want %q", csv, want)
+	}
+}
+
+func TestWriteBatchCSVFormulas(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  string
+	}{
+		{"=HYPERLINK(\"http://evil\")", `"'=HYPERLINK(""http://evil"")"`},
+		{"+1 555 0100", "'+1 555 0100"},
+		{"-rm", "'-rm"},
+		{"@SUM(A1)", "'@SUM(A1)"},
+		{"  =1+1", "'=1+1"},
+		{"it is cold", "it is cold"},
+		{-3.5, "-3.5"},
+		{map[string]interface{}{"a": "=1"}, `"{""a"":""=1""}"`},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		writeBatchCSV(w, []map[string]interface{}{{"response": tt.value}}, []string{"response"})
+		if got := strings.TrimSuffix(strings.TrimPrefix(w.Body.String(), "response\n"), "\n"); got != tt.want {
+			t.Errorf("%v: cell = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// BenchmarkSuite is a set of prompts with simple checks used to compare models.
+type BenchmarkSuite struct {
+	Prompts []BenchmarkPrompt `json:"prompts"`
+}
+
+// BenchmarkPrompt is one prompt of a suite. Expect lists words or phrases a good
+// answer contains (case-insensitive), ExpectJSON requires the answer to be valid
+// JSON and MaxWords flags answers that ramble.
+type BenchmarkPrompt struct {
+	Name       string   `json:"name"`
+	Prompt     string   `json:"prompt"`
+	Expect     []string `json:"expect"`
+	ExpectJSON bool     `json:"expect_json"`
+	MaxWords   int      `json:"max_words"`
+}
+
+// BenchmarkResult summarises one model's run through a suite.
+type BenchmarkResult struct {
+	Model          string  `json:"model"`
+	Runs           int     `json:"runs"`
+	Errors         int     `json:"errors"`
+	ExpectScore    float64 `json:"expect_score"`
+	JSONValid      float64 `json:"json_valid,omitempty"`
+	OverLength     int     `json:"over_length"`
+	AvgWords       float64 `json:"avg_words"`
+	AvgFirstTokenS float64 `json:"avg_first_token_seconds"`
+	AvgTotalS      float64 `json:"avg_total_seconds"`
+	AvgLoadS       float64 `json:"avg_load_seconds"`
+	TokensPerSec   float64 `json:"tokens_per_second"`
+}
+
+// runBenchmarkModels implements `llamanator benchmark-models`, running a prompt
+// suite through each model and reporting quality-proxy metrics and speed.
+func runBenchmarkModels(args []string) error {
+	flags := flag.NewFlagSet("benchmark-models", flag.ContinueOnError)
+	configPath := flags.String("config", envDefault(configPathEnv, "config.json"), "path to config.json")
+	modelList := flags.String("models", "", "comma separated models to compare (default the configured default model)")
+	suitePath := flags.String("suite", "", "path to the prompt suite JSON")
+	runs := flags.Int("runs", 1, "times to run each prompt per model")
+	format := flags.String("format", "table", "output format, table or json")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *suitePath == "" {
+		return fmt.Errorf("-suite is required")
+	}
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	data, err := os.ReadFile(*suitePath)
+	if err != nil {
+		return err
+	}
+	var suite BenchmarkSuite
+	if err := json.Unmarshal(data, &suite); err != nil {
+		return fmt.Errorf("invalid suite %s: %w", *suitePath, err)
+	}
+	if len(suite.Prompts) == 0 {
+		return fmt.Errorf("suite %s has no prompts", *suitePath)
+	}
+
+	models := []string{config.DefaultModel}
+	if *modelList != "" {
+		models = strings.Split(*modelList, ",")
+	}
+
+	var results []BenchmarkResult
+	for _, model := range models {
+		model = strings.TrimSpace(model)
+		fmt.Fprintf(os.Stderr, "Benchmarking %s...\n", model)
+		results = append(results, benchmarkModel(config, model, suite, max(*runs, 1)))
+	}
+
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(results)
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "MODEL\tRUNS\tERRORS\tEXPECT\tJSON\tOVER LENGTH\tWORDS\tFIRST TOKEN\tTOTAL\tLOAD\tTOKENS/S")
+	for _, r := range results {
+		fmt.Fprintf(table, "%s\t%d\t%d\t%.0f%%\t%.0f%%\t%d\t%.0f\t%.2fs\t%.2fs\t%.2fs\t%.1f\n",
+			r.Model, r.Runs, r.Errors, r.ExpectScore*100, r.JSONValid*100, r.OverLength, r.AvgWords,
+			r.AvgFirstTokenS, r.AvgTotalS, r.AvgLoadS, r.TokensPerSec)
+	}
+	return table.Flush()
+}
+
+func benchmarkModel(config *Config, model string, suite BenchmarkSuite, runs int) BenchmarkResult {
+	result := BenchmarkResult{Model: model}
+	var expectHits, expectTotal, jsonValid, jsonTotal, words, succeeded int
+	var firstToken, total, load time.Duration
+	var evalCount, evalNanos float64
+
+	for _, prompt := range suite.Prompts {
+		for run := 0; run < runs; run++ {
+			result.Runs++
+
+			ollamaRequest := make(map[string]interface{}, len(config.OllamaParams)+3)
+			for key, value := range config.OllamaParams {
+				ollamaRequest[key] = value
+			}
+			ollamaRequest["prompt"] = prompt.Prompt
+			ollamaRequest["model"] = model
+			ollamaRequest["stream"] = true
+
+			start := time.Now()
+			var first time.Time
+			response, err := postOllama(context.Background(), config, ollamaRequest, func(string) {
+				if first.IsZero() {
+					first = time.Now()
+				}
+			})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "  %s: %v\n", prompt.Name, err)
+				result.Errors++
+				continue
+			}
+			succeeded++
+			total += time.Since(start)
+			if !first.IsZero() {
+				firstToken += first.Sub(start)
+			}
+
+			text, _ := response["response"].(string)
+			wordCount := len(strings.Fields(text))
+			words += wordCount
+			if prompt.MaxWords > 0 && wordCount > prompt.MaxWords {
+				result.OverLength++
+			}
+			lower := strings.ToLower(text)
+			for _, expected := range prompt.Expect {
+				expectTotal++
+				if strings.Contains(lower, strings.ToLower(expected)) {
+					expectHits++
+				}
+			}
+			if prompt.ExpectJSON {
+				jsonTotal++
+				if json.Valid([]byte(strings.TrimSpace(text))) {
+					jsonValid++
+				}
+			}
+
+			// Ollama reports durations in nanoseconds
+			if count, ok := response["eval_count"].(float64); ok {
+				if nanos, ok := response["eval_duration"].(float64); ok && nanos > 0 {
+					evalCount += count
+					evalNanos += nanos
+				}
+			}
+			if nanos, ok := response["load_duration"].(float64); ok {
+				load += time.Duration(nanos)
+			}
+		}
+	}
+
+	if expectTotal > 0 {
+		result.ExpectScore = float64(expectHits) / float64(expectTotal)
+	}
+	if jsonTotal > 0 {
+		result.JSONValid = float64(jsonValid) / float64(jsonTotal)
+	}
+	if succeeded > 0 {
+		result.AvgWords = float64(words) / float64(succeeded)
+		result.AvgFirstTokenS = firstToken.Seconds() / float64(succeeded)
+		result.AvgTotalS = total.Seconds() / float64(succeeded)
+		result.AvgLoadS = load.Seconds() / float64(succeeded)
+	}
+	if evalNanos > 0 {
+		result.TokensPerSec = evalCount / (evalNanos / 1e9)
+	}
+	return result
+}
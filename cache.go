@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Entries the response cache keeps, unless the config says otherwise
+const defaultCacheEntries = 1000
+
+// CacheConfig caches responses so identical requests within the TTL are
+// answered without calling the model. Path keeps the cache across restarts.
+// Coalesce has identical requests arriving while one is in flight wait for its
+// response, cached or not.
+type CacheConfig struct {
+	TTL        string `json:"ttl"`
+	MaxEntries int    `json:"max_entries"`
+	Path       string `json:"path"`
+	Coalesce   bool   `json:"coalesce"`
+
+	ttl time.Duration
+}
+
+func (c *CacheConfig) parse() error {
+	if c.TTL == "" {
+		return nil
+	}
+	ttl, err := time.ParseDuration(c.TTL)
+	if err != nil || ttl < 0 {
+		return fmt.Errorf("invalid cache ttl '%s'", c.TTL)
+	}
+	c.ttl = ttl
+	return nil
+}
+
+// parseCacheTTL checks the cache TTL of template settings. Zero turns caching
+// off for the template.
+func (s *TemplateSettings) parseCacheTTL() error {
+	if s.CacheTTL == "" {
+		return nil
+	}
+	ttl, err := time.ParseDuration(s.CacheTTL)
+	if err != nil || ttl < 0 {
+		return fmt.Errorf("invalid cache_ttl '%s'", s.CacheTTL)
+	}
+	s.cacheTTL = ttl
+	return nil
+}
+
+// cacheTTL is how long the template's responses are cached, zero for not at all.
+func (tc *TemplateConfig) cacheTTL(config *Config, templateName string) time.Duration {
+	if settings, ok := tc.Settings[templateName]; ok && settings.CacheTTL != "" {
+		return settings.cacheTTL
+	}
+	return config.Cache.ttl
+}
+
+type cacheEntry struct {
+	Response map[string]interface{} `json:"response"`
+	Stored   time.Time              `json:"stored"`
+	Expires  time.Time              `json:"expires"`
+}
+
+// ResponseCache holds raw backend responses by request. It lives as long as the
+// server, so reloads keep it.
+type ResponseCache struct {
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+	dirty   bool
+	// Encrypts the saved cache, when history has a key
+	aead cipher.AEAD
+}
+
+func newResponseCache() *ResponseCache {
+	return &ResponseCache{entries: make(map[string]cacheEntry)}
+}
+
+// responseCacheKey identifies a request by the template, the backend and
+// everything sent to it: the rendered prompt or messages, the model and the
+// parameters. Whether it streams doesn't matter.
+func responseCacheKey(templateName, backend string, request map[string]interface{}) string {
+	params := make(map[string]interface{}, len(request))
+	for key, value := range request {
+		if key != "stream" {
+			params[key] = value
+		}
+	}
+	data, _ := json.Marshal(map[string]interface{}{"template": templateName, "backend": backend, "request": params})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *ResponseCache) get(key string) (map[string]interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.Expires) {
+		return nil, false
+	}
+	return entry.Response, true
+}
+
+// put stores a response, making room by dropping expired entries and then the
+// oldest.
+func (c *ResponseCache) put(key string, response map[string]interface{}, ttl time.Duration, maxEntries int) {
+	if maxEntries <= 0 {
+		maxEntries = defaultCacheEntries
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= maxEntries {
+		for k, entry := range c.entries {
+			if now.After(entry.Expires) {
+				delete(c.entries, k)
+			}
+		}
+		for len(c.entries) >= maxEntries {
+			var oldest string
+			for k, entry := range c.entries {
+				if oldest == "" || entry.Stored.Before(c.entries[oldest].Stored) {
+					oldest = k
+				}
+			}
+			delete(c.entries, oldest)
+		}
+	}
+	c.entries[key] = cacheEntry{Response: response, Stored: now, Expires: now.Add(ttl)}
+	c.dirty = true
+}
+
+// clear empties the cache and returns how many entries it held.
+func (c *ResponseCache) clear() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(c.entries)
+	c.entries = make(map[string]cacheEntry)
+	c.dirty = true
+	return n
+}
+
+// persist loads the cache from path, then saves it there every minute while it
+// changes. With aead, the history cipher, the file is encrypted.
+func (c *ResponseCache) persist(path string, aead cipher.AEAD) error {
+	c.aead = aead
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(data) > 0 {
+		encrypted := bytes.HasPrefix(data, []byte(encryptedRecordPrefix))
+		if data, err = unseal(aead, string(data)); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		var entries map[string]cacheEntry
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		now := time.Now()
+		c.mu.Lock()
+		for key, entry := range entries {
+			if now.Before(entry.Expires) {
+				c.entries[key] = entry
+			}
+		}
+		// Written before the key was set, so encrypt it
+		c.dirty = aead != nil && !encrypted
+		c.mu.Unlock()
+	}
+
+	go func() {
+		for range time.Tick(time.Minute) {
+			if err := c.save(path); err != nil {
+				slog.Error("Failed to save the response cache", "error", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// save writes the unexpired entries to path if the cache changed.
+func (c *ResponseCache) save(path string) error {
+	c.mu.Lock()
+	if !c.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	entries := make(map[string]cacheEntry, len(c.entries))
+	for key, entry := range c.entries {
+		if now.Before(entry.Expires) {
+			entries[key] = entry
+		}
+	}
+	data, err := json.Marshal(entries)
+	c.dirty = false
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if c.aead != nil {
+		sealed, err := seal(c.aead, data)
+		if err != nil {
+			return err
+		}
+		data = []byte(sealed)
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// cacheHandler serves DELETE /admin/cache to empty the response cache.
+func cacheHandler(config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		deleted := config.cache.clear()
+		slog.Info("Cleared cached responses", "count", deleted)
+		writeJSON(w, http.StatusOK, map[string]int{"deleted": deleted})
+	}
+}
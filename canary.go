@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log/slog"
+	"maps"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Rollback thresholds, unless the canary says otherwise
+const (
+	defaultCanaryFailureRate = 0.2
+	defaultCanaryMinRequests = 10
+)
+
+var errNoCanary = errors.New("template has no canary")
+
+// CanaryConfig serves a new version of a template to a percentage of its
+// requests. The canary is rolled back if, after MinRequests, more than
+// MaxFailureRate of its generations fail and it fails more often than the
+// stable version.
+type CanaryConfig struct {
+	Percent        int     `json:"percent"`
+	MaxFailureRate float64 `json:"max_failure_rate"`
+	MinRequests    int     `json:"min_requests"`
+}
+
+// CanaryStatus is a template's canary and how it is doing against the stable
+// version.
+type CanaryStatus struct {
+	CanaryConfig
+	Template       string          `json:"template"`
+	Settings       json.RawMessage `json:"settings,omitempty"`
+	Started        time.Time       `json:"started"`
+	Requests       int             `json:"requests"`
+	Failures       int             `json:"failures"`
+	StableRequests int             `json:"stable_requests"`
+	StableFailures int             `json:"stable_failures"`
+}
+
+type canary struct {
+	status   CanaryStatus
+	tmpl     *template.Template
+	settings *TemplateSettings
+}
+
+// Canaries are kept in memory, so a restart goes back to the stable version
+type canaries struct {
+	mu     sync.Mutex
+	byName map[string]*canary
+}
+
+// startCanary checks a new version of an existing template and starts serving
+// it to the canary's percentage of requests, replacing any canary already
+// running. Settings left out are the stable version's.
+func (s *TemplateStore) startCanary(source TemplateSource) error {
+	s.edit.Lock()
+	defer s.edit.Unlock()
+
+	config := source.Canary.CanaryConfig
+	if config.Percent < 1 || config.Percent > 99 {
+		return badInput("Canary percent must be from 1 to 99")
+	}
+	if config.MaxFailureRate == 0 {
+		config.MaxFailureRate = defaultCanaryFailureRate
+	}
+	if config.MaxFailureRate < 0 || config.MaxFailureRate > 1 {
+		return badInput("Canary max_failure_rate must be from 0 to 1")
+	}
+	if config.MinRequests <= 0 {
+		config.MinRequests = defaultCanaryMinRequests
+	}
+
+	if _, err := os.Stat(filepath.Join(s.dir, source.Name+".json")); os.IsNotExist(err) {
+		return badInput("A canary needs an existing template, create '%s' first", source.Name)
+	}
+	tmpl, err := parsePromptTemplate(source.Name+".json", source.Template)
+	if err != nil {
+		return badInput("Invalid template: %v", err)
+	}
+	rawSettings := source.Settings
+	if len(rawSettings) == 0 {
+		rawSettings, err = os.ReadFile(filepath.Join(s.dir, source.Name+templateSettingsSuffix))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	settings := &TemplateSettings{}
+	if len(rawSettings) > 0 && string(rawSettings) != "null" {
+		if settings, err = parseTemplateSettings(rawSettings); err != nil {
+			return badInput("Invalid settings: %v", err)
+		}
+	} else {
+		rawSettings = nil
+	}
+
+	c := &canary{
+		status: CanaryStatus{
+			CanaryConfig: config,
+			Template:     source.Template,
+			Settings:     rawSettings,
+			Started:      time.Now(),
+		},
+		tmpl:     tmpl,
+		settings: settings,
+	}
+	s.canaries.mu.Lock()
+	if s.canaries.byName == nil {
+		s.canaries.byName = make(map[string]*canary)
+	}
+	s.canaries.byName[source.Name] = c
+	s.canaries.mu.Unlock()
+	return nil
+}
+
+// canaryStatus returns the template's canary, or nil if it has none.
+func (s *TemplateStore) canaryStatus(name string) *CanaryStatus {
+	s.canaries.mu.Lock()
+	defer s.canaries.mu.Unlock()
+	c, ok := s.canaries.byName[name]
+	if !ok {
+		return nil
+	}
+	status := c.status
+	return &status
+}
+
+// stopCanary removes the template's canary and returns it.
+func (s *TemplateStore) stopCanary(name string) (*canary, error) {
+	s.canaries.mu.Lock()
+	defer s.canaries.mu.Unlock()
+	c, ok := s.canaries.byName[name]
+	if !ok {
+		return nil, errNoCanary
+	}
+	delete(s.canaries.byName, name)
+	return c, nil
+}
+
+// promoteCanary makes the template's canary the stable version.
+func (s *TemplateStore) promoteCanary(name string) error {
+	c, err := s.stopCanary(name)
+	if err != nil {
+		return err
+	}
+	settings := c.status.Settings
+	if settings == nil {
+		settings = json.RawMessage("null")
+	}
+	return s.save(TemplateSource{Name: name, Template: c.status.Template, Settings: settings}, false)
+}
+
+type canaryReportKey struct{}
+
+// routeCanary picks the version of a template a request gets. While the
+// template has a canary, the canary's percentage of requests get templates
+// with the canary in place of the stable version, and the request's context
+// reports how its generation went.
+func (s *TemplateStore) routeCanary(r *http.Request, templateConfig *TemplateConfig, name string) (*http.Request, *TemplateConfig) {
+	s.canaries.mu.Lock()
+	c, ok := s.canaries.byName[name]
+	s.canaries.mu.Unlock()
+	if !ok {
+		return r, templateConfig
+	}
+	isCanary := rand.Intn(100) < c.status.Percent
+	report := func(failed bool) { s.reportCanary(name, c, isCanary, failed) }
+	r = r.WithContext(context.WithValue(r.Context(), canaryReportKey{}, report))
+	if !isCanary {
+		return r, templateConfig
+	}
+	return r, templateConfig.withVersion(name, templateVersion(c.status.Template), c.tmpl, c.settings)
+}
+
+// reportCanary counts a generation against the canary or the stable version,
+// rolling the canary back if it is failing too often.
+func (s *TemplateStore) reportCanary(name string, c *canary, isCanary, failed bool) {
+	s.canaries.mu.Lock()
+	defer s.canaries.mu.Unlock()
+	// Ignore requests that started before a rollback, promotion or new canary
+	if s.canaries.byName[name] != c {
+		return
+	}
+	status := &c.status
+	if !isCanary {
+		status.StableRequests++
+		if failed {
+			status.StableFailures++
+		}
+		return
+	}
+	status.Requests++
+	if failed {
+		status.Failures++
+	}
+	if status.Requests < status.MinRequests {
+		return
+	}
+	rate := float64(status.Failures) / float64(status.Requests)
+	stableRate := 0.0
+	if status.StableRequests > 0 {
+		stableRate = float64(status.StableFailures) / float64(status.StableRequests)
+	}
+	if rate > status.MaxFailureRate && rate > stableRate {
+		delete(s.canaries.byName, name)
+		slog.Warn("Rolled back a failing template canary", "template", name, "failures", status.Failures, "requests", status.Requests, "stable_failures", status.StableFailures, "stable_requests", status.StableRequests)
+	}
+}
+
+// reportGeneration tells the canary of the request's template, if any, how
+// its generation went. Generations the client gave up on aren't counted, as
+// they say nothing about the template; timeouts still count as failures.
+func reportGeneration(ctx context.Context, err error) {
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return
+	}
+	if report, ok := ctx.Value(canaryReportKey{}).(func(bool)); ok {
+		report(err != nil)
+	}
+}
+
+// withVersion returns a copy of the templates with another version of one.
+func (tc *TemplateConfig) withVersion(name, version string, tmpl *template.Template, settings *TemplateSettings) *TemplateConfig {
+	clone := &TemplateConfig{
+		Templates:       maps.Clone(tc.Templates),
+		Params:          maps.Clone(tc.Params),
+		Fields:          maps.Clone(tc.Fields),
+		RequestTimeouts: maps.Clone(tc.RequestTimeouts),
+		Settings:        maps.Clone(tc.Settings),
+		Versions:        maps.Clone(tc.Versions),
+	}
+	delete(clone.Params, name)
+	delete(clone.Fields, name)
+	delete(clone.RequestTimeouts, name)
+	clone.Templates[name] = tmpl
+	clone.Versions[name] = version
+	clone.setSettings(name, settings)
+	return clone
+}
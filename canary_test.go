@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReportGeneration(t *testing.T) {
+	tests := []struct {
+		name       string
+		ctx        func(context.Context) (context.Context, context.CancelFunc)
+		err        error
+		wantReport bool
+		wantFailed bool
+	}{
+		{"success", context.WithCancel, nil, true, false},
+		{"failure", context.WithCancel, errors.New("upstream error"), true, true},
+		{"client disconnected", func(ctx context.Context) (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(ctx)
+			cancel()
+			return ctx, cancel
+		}, context.Canceled, false, false},
+		{"timed out", func(ctx context.Context) (context.Context, context.CancelFunc) {
+			return context.WithDeadline(ctx, time.Now().Add(-time.Second))
+		}, context.DeadlineExceeded, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reported, failed := false, false
+			report := func(f bool) { reported, failed = true, f }
+			ctx, cancel := tt.ctx(context.WithValue(context.Background(), canaryReportKey{}, report))
+			defer cancel()
+
+			reportGeneration(ctx, tt.err)
+			if reported != tt.wantReport || failed != tt.wantFailed {
+				t.Errorf("reported = %v, failed = %v, want %v, %v", reported, failed, tt.wantReport, tt.wantFailed)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import "strings"
+
+// ChatMessage is a turn of the conversation sent to chat templates in the
+// request's 'messages'.
+type ChatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// chat reports whether the template uses Ollama's chat endpoint.
+func (tc *TemplateConfig) chat(templateName string) bool {
+	settings, ok := tc.Settings[templateName]
+	return ok && settings.Chat
+}
+
+// addMessagesInput reads the prior conversation from 'messages', oldest first.
+func addMessagesInput(request map[string]interface{}, data *TemplateData) error {
+	raw, ok := request["messages"]
+	if !ok {
+		return nil
+	}
+	list, ok := raw.([]interface{})
+	if !ok {
+		return badInput("Messages must be a list of {role, content} objects")
+	}
+
+	for i, item := range list {
+		message, _ := item.(map[string]interface{})
+		role, _ := message["role"].(string)
+		content, isString := message["content"].(string)
+		if !isString {
+			return badInput("Message %d must have a string content", i)
+		}
+		switch role {
+		case "system", "user", "assistant":
+		default:
+			return badInput("Message %d has role '%s', expected system, user or assistant", i, role)
+		}
+		data.Messages = append(data.Messages, ChatMessage{Role: role, Content: content})
+	}
+	return nil
+}
+
+// messagesText is the text of the messages, for estimating their size.
+func messagesText(messages []ChatMessage) string {
+	var text strings.Builder
+	for _, message := range messages {
+		text.WriteString(message.Content)
+	}
+	return text.String()
+}
+
+// chatRequestMessages converts the system prompt, the conversation and the
+// rendered prompt, sent as the last user message, to Ollama chat messages. A
+// system message at the start of the conversation follows the system prompt.
+func chatRequestMessages(system string, history []ChatMessage, prompt string, images []string) []map[string]interface{} {
+	messages := make([]map[string]interface{}, 0, len(history)+2)
+	if system != "" {
+		if len(history) > 0 && history[0].Role == "system" {
+			system += "\n\n" + history[0].Content
+			history = history[1:]
+		}
+		messages = append(messages, map[string]interface{}{"role": "system", "content": system})
+	}
+	for _, message := range history {
+		messages = append(messages, map[string]interface{}{"role": message.Role, "content": message.Content})
+	}
+	last := map[string]interface{}{"role": "user", "content": prompt}
+	if len(images) > 0 {
+		last["images"] = images
+	}
+	return append(messages, last)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Coalescer shares one upstream request between concurrent identical ones, so
+// automations firing the same prompt at once only use the GPU once. It lives
+// as long as the server.
+type Coalescer struct {
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+type coalescedCall struct {
+	done     chan struct{}
+	response map[string]interface{}
+	err      error
+}
+
+func newCoalescer() *Coalescer {
+	return &Coalescer{calls: make(map[string]*coalescedCall)}
+}
+
+// do calls fn, unless a call with the same key is in flight, in which case it
+// waits for that call's response instead. shared reports whether the response
+// came from another call. When the other caller gives up, it goes ahead itself.
+func (c *Coalescer) do(ctx context.Context, key string, fn func() (map[string]interface{}, error)) (response map[string]interface{}, shared bool, err error) {
+	for {
+		c.mu.Lock()
+		call, ok := c.calls[key]
+		if !ok {
+			call = &coalescedCall{done: make(chan struct{})}
+			c.calls[key] = call
+			c.mu.Unlock()
+
+			call.response, call.err = fn()
+			c.mu.Lock()
+			delete(c.calls, key)
+			c.mu.Unlock()
+			close(call.done)
+			return call.response, false, call.err
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+		if errors.Is(call.err, context.Canceled) && ctx.Err() == nil {
+			continue
+		}
+		return call.response, true, call.err
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Kinds of coercion
+const (
+	coerceEnum    = "enum"
+	coerceBoolean = "boolean"
+)
+
+// Words that answer yes or no, for boolean coercion
+var booleanWords = map[string][]string{
+	"true":  {"yes", "yeah", "yep", "true", "on", "correct", "affirmative", "sure", "ok", "okay"},
+	"false": {"no", "nope", "false", "off", "incorrect", "negative"},
+}
+
+// coerceErrorsField says why boolean fields are null
+const coerceErrorsField = "coerce_errors"
+
+// CoerceRule turns a free-form answer into one of a fixed set of values, for
+// automations that branch on it. From is the field coerced, the response by
+// default or a field from extract. Type enum picks one of Values, and boolean
+// gives true or false. Synonyms are other words for each value, such as
+// "lounge" for "living room". A field that can't be coerced is null.
+type CoerceRule struct {
+	From     string              `json:"from,omitempty"`
+	Type     string              `json:"type,omitempty"`
+	Values   []string            `json:"values,omitempty"`
+	Synonyms map[string][]string `json:"synonyms,omitempty"`
+
+	// Normalised words for each value
+	words map[string][]string
+}
+
+// parseCoerce checks the rules and normalises their values and synonyms.
+func parseCoerce(rules map[string]*CoerceRule) error {
+	for _, field := range sortedKeys(rules) {
+		rule := rules[field]
+		if field == "" || field == "response" || field == coerceErrorsField {
+			return fmt.Errorf("coerce can't set the field '%s'", field)
+		}
+		if rule == nil {
+			return fmt.Errorf("coerce rule for %s is empty", field)
+		}
+		if rule.From == "" {
+			rule.From = "response"
+		}
+		if rule.Type == "" {
+			rule.Type = coerceEnum
+		}
+		rule.words = make(map[string][]string)
+		switch rule.Type {
+		case coerceEnum:
+			if len(rule.Values) == 0 {
+				return fmt.Errorf("coerce rule for %s needs values", field)
+			}
+			for _, value := range rule.Values {
+				rule.words[value] = append(rule.words[value], normalizeWords(value))
+			}
+		case coerceBoolean:
+			for value, words := range booleanWords {
+				rule.words[value] = append([]string{}, words...)
+			}
+		default:
+			return fmt.Errorf("coerce rule for %s has unknown type '%s'", field, rule.Type)
+		}
+		for value, synonyms := range rule.Synonyms {
+			if _, ok := rule.words[value]; !ok {
+				return fmt.Errorf("coerce rule for %s has synonyms for '%s', which isn't one of its values", field, value)
+			}
+			for _, synonym := range synonyms {
+				rule.words[value] = append(rule.words[value], normalizeWords(synonym))
+			}
+		}
+	}
+	return nil
+}
+
+// coerceRules are the template's coercion rules.
+func (tc *TemplateConfig) coerceRules(templateName string) map[string]*CoerceRule {
+	if settings, ok := tc.Settings[templateName]; ok {
+		return settings.Coerce
+	}
+	return nil
+}
+
+// coerceFields sets the field of each rule from the response's fields. Why a
+// boolean field is null goes in coerce_errors.
+func coerceFields(rules map[string]*CoerceRule, response map[string]interface{}) {
+	problems := make(map[string]string)
+	for field, rule := range rules {
+		text, _ := response[rule.From].(string)
+		if rule.Type == coerceBoolean {
+			value, err := rule.coerceYesNo(text)
+			if err != nil {
+				response[field] = nil
+				problems[field] = err.Error()
+				continue
+			}
+			response[field] = value == "true"
+			continue
+		}
+		if value, ok := rule.coerce(text); ok {
+			response[field] = value
+		} else {
+			response[field] = nil
+		}
+	}
+	if len(problems) > 0 {
+		response[coerceErrorsField] = problems
+	}
+}
+
+// coerceYesNo reads a yes or no answer. Its first word has to say which, so
+// "not sure" and "that is not correct" aren't taken as yes, and an answer
+// with words for both, such as "yes, no problem", is ambiguous.
+func (r *CoerceRule) coerceYesNo(text string) (string, error) {
+	normalized := normalizeWords(text)
+	if normalized == "" {
+		return "", errors.New("the answer is empty")
+	}
+	padded := " " + normalized + " "
+	var first string
+	var mentioned []string
+	for _, value := range sortedKeys(r.words) {
+		for _, word := range r.words[value] {
+			if strings.HasPrefix(padded, " "+word+" ") {
+				if first != "" && first != value {
+					return "", fmt.Errorf("the answer starts with a word for both %s and %s", first, value)
+				}
+				first = value
+			}
+			if strings.Contains(padded, " "+word+" ") && !slices.Contains(mentioned, value) {
+				mentioned = append(mentioned, value)
+			}
+		}
+	}
+	if first == "" {
+		return "", errors.New("the answer doesn't start with yes or no")
+	}
+	if len(mentioned) > 1 {
+		return "", errors.New("the answer is ambiguous, it has words for both true and false")
+	}
+	return first, nil
+}
+
+// coerce finds the value the text means. An answer that is a value (or one of
+// its synonyms) wins, then the value mentioned first, then the one a word is
+// closest to spelling, allowing for typos.
+func (r *CoerceRule) coerce(text string) (string, bool) {
+	normalized := normalizeWords(text)
+	if normalized == "" {
+		return "", false
+	}
+	for _, value := range sortedKeys(r.words) {
+		for _, word := range r.words[value] {
+			if normalized == word {
+				return value, true
+			}
+		}
+	}
+
+	padded := " " + normalized + " "
+	best, bestIndex := "", -1
+	for _, value := range sortedKeys(r.words) {
+		for _, word := range r.words[value] {
+			if i := strings.Index(padded, " "+word+" "); i >= 0 && (bestIndex < 0 || i < bestIndex) {
+				best, bestIndex = value, i
+			}
+		}
+	}
+	if bestIndex >= 0 {
+		return best, true
+	}
+
+	// Typos, comparing each run of as many words as the value has
+	words := strings.Fields(normalized)
+	best, bestDistance := "", 0
+	for _, value := range sortedKeys(r.words) {
+		for _, word := range r.words[value] {
+			// Short words are too easily mistaken for one another
+			if len(word) < 4 {
+				continue
+			}
+			size := len(strings.Fields(word))
+			allowed := 1
+			if len(word) > 5 {
+				allowed = 2
+			}
+			for i := 0; i+size <= len(words); i++ {
+				distance := editDistance(strings.Join(words[i:i+size], " "), word)
+				if distance <= allowed && (best == "" || distance < bestDistance) {
+					best, bestDistance = value, distance
+				}
+			}
+		}
+	}
+	return best, best != ""
+}
+
+// normalizeWords lower-cases text and keeps only its words, separated by
+// single spaces.
+func normalizeWords(text string) string {
+	answer, _ := splitReasoning(text)
+	return strings.Join(strings.FieldsFunc(strings.ToLower(answer), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}), " ")
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCoerceEnum(t *testing.T) {
+	rules := map[string]*CoerceRule{"room": {
+		Values:   []string{"kitchen", "living room", "bedroom"},
+		Synonyms: map[string][]string{"living room": {"lounge", "front room"}},
+	}}
+	if err := parseCoerce(rules); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		answer string
+		want   string
+		wantOK bool
+	}{
+		{"Kitchen", "kitchen", true},
+		{"I'd say the Living-Room!", "living room", true},
+		{"the lounge", "living room", true},
+		{"bedroom, then the kitchen", "bedroom", true},
+		{"kitchn", "kitchen", true},
+		{"<think>maybe the bedroom</think>kitchen", "kitchen", true},
+		{"the garage", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.answer, func(t *testing.T) {
+			got, ok := rules["room"].coerce(tt.answer)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("coerce(%q) = %q, %v, want %q, %v", tt.answer, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestCoerceBoolean(t *testing.T) {
+	rules := map[string]*CoerceRule{"confirmed": {Type: coerceBoolean, Synonyms: map[string][]string{"true": {"of course"}}}}
+	if err := parseCoerce(rules); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		answer  string
+		want    interface{}
+		wantErr string
+	}{
+		{"Yes.", true, ""},
+		{"yep, it's locked", true, ""},
+		{"Correct", true, ""},
+		{"Of course it is", true, ""},
+		{"No", false, ""},
+		{"Nope, the door is open", false, ""},
+		{"incorrect", false, ""},
+		{"not sure", nil, "doesn't start with yes or no"},
+		{"That is not correct", nil, "doesn't start with yes or no"},
+		{"y", nil, "doesn't start with yes or no"},
+		{"n", nil, "doesn't start with yes or no"},
+		{"Yes, no problem", nil, "ambiguous"},
+		{"No... actually yes", nil, "ambiguous"},
+		{"", nil, "empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.answer, func(t *testing.T) {
+			response := map[string]interface{}{"response": tt.answer}
+			coerceFields(rules, response)
+			if response["confirmed"] != tt.want {
+				t.Errorf("confirmed = %v, want %v", response["confirmed"], tt.want)
+			}
+			problems, _ := response[coerceErrorsField].(map[string]string)
+			if tt.wantErr == "" {
+				if problems != nil {
+					t.Errorf("coerce_errors = %v, want none", problems)
+				}
+				return
+			}
+			if !strings.Contains(problems["confirmed"], tt.wantErr) {
+				t.Errorf("coerce_errors = %v, want %q", problems, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseCoerce(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   map[string]*CoerceRule
+		wantErr string
+	}{
+		{"response", map[string]*CoerceRule{"response": {Values: []string{"a"}}}, "can't set"},
+		{"coerce_errors", map[string]*CoerceRule{coerceErrorsField: {Type: coerceBoolean}}, "can't set"},
+		{"no values", map[string]*CoerceRule{"room": {}}, "needs values"},
+		{"unknown type", map[string]*CoerceRule{"room": {Type: "number"}}, "unknown type"},
+		{"synonym for no value", map[string]*CoerceRule{"room": {Values: []string{"a"}, Synonyms: map[string][]string{"b": {"c"}}}}, "isn't one of its values"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := parseCoerce(tt.rules); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseCoerce() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
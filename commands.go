@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// commands are the subcommands run with `llamanator <command> [flags]` instead
+// of starting the server.
+var commands = map[string]func(args []string) error{
+	"benchmark-models": runBenchmarkModels,
+	"export-history":   runExportHistory,
+	"export-usage":     runExportUsage,
+	"healthcheck":      runHealthcheck,
+	"lint":             runLint,
+	"validate":         runValidate,
+}
+
+func runCommand(name string, args []string) error {
+	command, ok := commands[name]
+	if !ok {
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown command '%s', available commands: %s", name, strings.Join(names, ", "))
+	}
+	return command(args)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CompactConfig limits the plain-text /text/{name} endpoints used by
+// microcontrollers such as ESPHome displays.
+type CompactConfig struct {
+	MaxQueryBytes    int `json:"max_query_bytes"`
+	MaxResponseChars int `json:"max_response_chars"`
+}
+
+// compactHandler serves POST /text/{name}: the request body is the plain-text
+// query and the response is the model's answer as plain text on a single line,
+// cut to max_response_chars. Errors are short plain-text messages.
+func compactHandler(config *Config, templateConfig *TemplateConfig, outputs *Outputs, history *History, templateName string) http.HandlerFunc {
+	return authenticate(config, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		maxQuery := config.Compact.MaxQueryBytes
+		if maxQuery <= 0 {
+			maxQuery = 512
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, int64(maxQuery)+1))
+		if err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if len(body) > maxQuery {
+			http.Error(w, "Query too long", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		query := strings.TrimSpace(string(body))
+		if query == "" {
+			http.Error(w, "Empty query", http.StatusBadRequest)
+			return
+		}
+
+		data := TemplateData{Query: query}
+		model := templateConfig.defaultModel(config, templateName)
+		// A client that disconnects cancels its generation, freeing the GPU
+		ctx := withGenerationStats(requestTraceContext(r.Context(), config, r), &GenerationStats{})
+
+		start := time.Now()
+		filteredResponse, err := generate(ctx, config, templateConfig, templateName, data, model)
+		recordGeneration(ctx, config, history, "text", templateName, data, model, HAContext{Origin: requestOrigin(r)}, start, filteredResponse, err)
+		if r.Context().Err() != nil {
+			slog.Info("Client disconnected, cancelled generation", "template", templateName)
+			return
+		}
+		if err != nil {
+			slog.Error("Failed to generate response", "template", templateName, "error", err)
+			var limited *rateLimitError
+			if errors.As(err, &limited) {
+				limited.setRetryAfter(w)
+				http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			} else if errors.Is(err, errTemplateProcessing) {
+				http.Error(w, "Template error", http.StatusInternalServerError)
+			} else if errors.Is(err, errPromptTooLong) {
+				http.Error(w, "Query too long", http.StatusRequestEntityTooLarge)
+			} else {
+				http.Error(w, "Model unavailable", http.StatusBadGateway)
+			}
+			return
+		}
+
+		// A response_map can make another field the answer, and one that only
+		// renames the response leaves the answer as it was
+		response, ok := templateConfig.mapResponse(templateName, filteredResponse)["response"].(string)
+		if !ok {
+			response, _ = filteredResponse["response"].(string)
+		}
+		setUsageHeaders(ctx, w)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, compactText(response, config.Compact.MaxResponseChars))
+
+		deliverResponse(config, outputs, templateName, data, model, HAContext{}, filteredResponse)
+	})
+}
+
+// compactText collapses whitespace to single spaces and cuts the text to
+// maxChars runes, ending in "..." when it was shortened.
+func compactText(text string, maxChars int) string {
+	if maxChars <= 0 {
+		maxChars = 256
+	}
+	text = strings.Join(strings.Fields(text), " ")
+	if runes := []rune(text); len(runes) > maxChars {
+		cut := max(maxChars-3, 0)
+		text = strings.TrimSpace(string(runes[:cut])) + "..."
+	}
+	return text
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompactResponseMap(t *testing.T) {
+	ollama, _ := fakeOllama(t, http.StatusOK, "it is cold")
+	config := testConfig(t, `{"auth_token": "tok", "default_model": "llama3", "api_url": "`+ollama.URL+`/api/generate"}`)
+
+	tests := []struct {
+		name        string
+		responseMap map[string]string
+		want        string
+	}{
+		{"unmapped", nil, "it is cold"},
+		{"renamed", map[string]string{"response": "speech"}, "it is cold"},
+		{"other field", map[string]string{"response": "", "model": "response"}, "llama3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			templateConfig := &TemplateConfig{
+				Settings: map[string]*TemplateSettings{"weather": {Chat: true, ResponseMap: tt.responseMap}},
+				Fields:   map[string][]string{"weather": {"model"}},
+			}
+			r := httptest.NewRequest(http.MethodPost, "/text/weather", strings.NewReader("Is it cold?"))
+			r.Header.Set("Authorization", "Bearer tok")
+			w := httptest.NewRecorder()
+			compactHandler(config, templateConfig, &Outputs{}, nil, "weather")(w, r)
+			if w.Body.String() != tt.want {
+				t.Errorf("response = %q, want %q", w.Body.String(), tt.want)
+			}
+		})
+	}
+}
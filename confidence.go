@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Asks the model to rate an answer, unless the config gives its own prompt
+const defaultConfidencePrompt = `Here is a request and the answer given to it.
+
+Request:
+{{prompt}}
+
+Answer:
+{{response}}
+
+How confident are you that the answer is correct and complete? Reply with only a number from 0 (not at all) to 1 (certain).`
+
+var confidenceNumber = regexp.MustCompile(`\d*\.?\d+`)
+
+// ConfidenceConfig adds a confidence field from 0 to 1 to responses, from a
+// second generation asking a model to rate the answer, so automations can
+// ignore low-confidence classifications. Model rates the answers instead of
+// the model that gave them, and Prompt replaces the rating prompt, with
+// {{prompt}} and {{response}} standing for the request and answer.
+type ConfidenceConfig struct {
+	Enabled bool   `json:"enabled"`
+	Model   string `json:"model"`
+	Prompt  string `json:"prompt"`
+}
+
+// confidence is how the template's answers are rated, nil when they aren't.
+func (tc *TemplateConfig) confidence(config *Config, templateName string) *ConfidenceConfig {
+	confidence := &config.Confidence
+	if settings, ok := tc.Settings[templateName]; ok && settings.Confidence != nil {
+		confidence = settings.Confidence
+	}
+	if !confidence.Enabled {
+		return nil
+	}
+	return confidence
+}
+
+// rate asks the model how confident it is in an answer.
+func (c *ConfidenceConfig) rate(ctx context.Context, backend Backend, model, prompt, response string) (float64, error) {
+	if c.Model != "" {
+		model = c.Model
+	}
+	template := c.Prompt
+	if template == "" {
+		template = defaultConfidencePrompt
+	}
+	ratingPrompt := strings.NewReplacer("{{prompt}}", prompt, "{{response}}", response).Replace(template)
+	// The rating's tokens aren't the answer's
+	ctx = withGenerationStats(ctx, &GenerationStats{})
+	rating, err := backend.Generate(ctx, map[string]interface{}{
+		"model":   model,
+		"prompt":  ratingPrompt,
+		"stream":  false,
+		"options": map[string]interface{}{"temperature": 0, "num_predict": 10},
+	}, nil)
+	if err != nil {
+		return 0, err
+	}
+	text := responseContent(rating, false)
+	number := confidenceNumber.FindString(text)
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, fmt.Errorf("expected a number from 0 to 1, got %q", text)
+	}
+	// Some models answer out of 10 or 100 despite being asked
+	for value > 1 && value <= 100 {
+		value /= 10
+	}
+	return min(max(value, 0), 1), nil
+}
+
+// addConfidence rates the answer in an upstream response, adding the rating to
+// it as confidence. A rating that fails leaves the response without one.
+func (c *ConfidenceConfig) addConfidence(ctx context.Context, backend Backend, model, prompt string, ollamaResponseMap map[string]interface{}, chat bool) {
+	value, err := c.rate(ctx, backend, model, prompt, responseContent(ollamaResponseMap, chat))
+	if err != nil {
+		slog.Warn("Failed to rate the answer's confidence", "model", model, "request_id", requestID(ctx), "error", err)
+		return
+	}
+	ollamaResponseMap["confidence"] = value
+}
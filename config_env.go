@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// Environment variables overriding config.json start with this prefix
+const configEnvPrefix = "LLAMANATOR_"
+
+// Environment variables for the defaults of the -config and -templates-dir
+// flags
+const (
+	configPathEnv   = configEnvPrefix + "CONFIG"
+	templatesDirEnv = configEnvPrefix + "TEMPLATES_DIR"
+)
+
+// envDefault is the value of an environment variable, or fallback when it's
+// unset.
+func envDefault(name, fallback string) string {
+	if value, ok := os.LookupEnv(name); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+// applyEnvOverrides sets config fields from environment variables named after
+// their JSON path, such as LLAMANATOR_AUTH_TOKEN for auth_token and
+// LLAMANATOR_HISTORY_PATH for history.path, so secrets needn't be kept in
+// config.json. Text fields take the value as it is, and any other field takes
+// JSON, such as LLAMANATOR_API_URLS='["http://a:11434","http://b:11434"]'. It
+// returns the names of the variables applied.
+func applyEnvOverrides(config *Config) ([]string, error) {
+	var applied []string
+	err := applyEnvStruct(reflect.ValueOf(config).Elem(), configEnvPrefix, &applied)
+	return applied, err
+}
+
+func applyEnvStruct(v reflect.Value, prefix string, applied *[]string) error {
+	for _, field := range reflect.VisibleFields(v.Type()) {
+		if field.Anonymous || !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		envName := prefix + strings.ToUpper(name)
+		target := v.FieldByIndex(field.Index)
+
+		if value, ok := os.LookupEnv(envName); ok {
+			if err := setFromEnv(target, value); err != nil {
+				return fmt.Errorf("%s: %w", envName, err)
+			}
+			*applied = append(*applied, envName)
+		}
+		// Nested settings have their own variables, such as
+		// LLAMANATOR_HISTORY_PATH, unless the type decodes itself
+		if target.Kind() == reflect.Struct && !target.Addr().Type().Implements(reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()) {
+			if err := applyEnvStruct(target, envName+"_", applied); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// setFromEnv sets a field from an environment variable's value.
+func setFromEnv(target reflect.Value, value string) error {
+	if target.Kind() == reflect.String {
+		target.SetString(value)
+		return nil
+	}
+	decoded := reflect.New(target.Type())
+	if err := json.Unmarshal([]byte(value), decoded.Interface()); err != nil {
+		return fmt.Errorf("expected JSON for %s: %w", target.Type(), err)
+	}
+	target.Set(decoded.Elem())
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// currentConfigVersion is the config.json schema version this build expects.
+// Configs without a config_version are treated as version 1.
+const currentConfigVersion = 2
+
+type configMigration struct {
+	description string
+	migrate     func(raw map[string]interface{}) []string
+}
+
+// configMigrations[n] upgrades a version n+1 config to version n+2.
+var configMigrations = []configMigration{
+	{
+		description: "move model options in ollama_params into ollama_params.options",
+		migrate:     migrateOllamaOptions,
+	},
+}
+
+// Model parameters Ollama only reads from the options object
+var ollamaOptionNames = []string{
+	"mirostat", "mirostat_eta", "mirostat_tau", "num_ctx", "num_gpu", "num_keep",
+	"num_predict", "num_thread", "repeat_last_n", "repeat_penalty", "presence_penalty",
+	"frequency_penalty", "seed", "stop", "temperature", "tfs_z", "top_k", "top_p", "min_p",
+	"typical_p",
+}
+
+// Top-level fields of an Ollama generate or chat request
+var ollamaRequestFields = []string{
+	"model", "prompt", "suffix", "images", "format", "options", "system", "template",
+	"context", "stream", "raw", "keep_alive", "messages", "tools", "think",
+}
+
+func migrateOllamaOptions(raw map[string]interface{}) []string {
+	params, ok := raw["ollama_params"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	var changes []string
+	options, _ := params["options"].(map[string]interface{})
+	if options == nil {
+		options = make(map[string]interface{})
+	}
+
+	for key, value := range params {
+		target := ""
+		switch {
+		case key == "max_tokens":
+			target = "num_predict"
+		case containsString(ollamaOptionNames, key):
+			target = key
+		case key == "SYSTEM":
+			delete(params, key)
+			params["system"] = value
+			changes = append(changes, "ollama_params.SYSTEM renamed to ollama_params.system")
+			continue
+		default:
+			continue
+		}
+		delete(params, key)
+		options[target] = value
+		changes = append(changes, fmt.Sprintf("ollama_params.%s moved to ollama_params.options.%s", key, target))
+	}
+
+	if len(options) > 0 {
+		params["options"] = options
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// migrateConfig upgrades a raw config to the current version, returning the
+// upgraded JSON and whether anything changed.
+func migrateConfig(data []byte) ([]byte, bool, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, false, err
+	}
+
+	version := 1
+	if value, ok := raw["config_version"].(float64); ok {
+		version = int(value)
+	}
+	if version > currentConfigVersion {
+		return nil, false, fmt.Errorf("config_version %d is newer than this build supports (%d), please upgrade llamanator", version, currentConfigVersion)
+	}
+	if version == currentConfigVersion {
+		return data, false, nil
+	}
+
+	for v := version; v < currentConfigVersion; v++ {
+		migration := configMigrations[v-1]
+		slog.Info("Migrating config", "from_version", v, "to_version", v+1, "migration", migration.description)
+		for _, change := range migration.migrate(raw) {
+			slog.Info("Deprecated config", "change", change)
+		}
+	}
+	raw["config_version"] = currentConfigVersion
+
+	migrated, err := json.MarshalIndent(raw, "", "  ")
+	if err != nil {
+		return nil, false, err
+	}
+	return append(migrated, '\n'), true, nil
+}
+
+// saveMigratedConfig writes a backup of the original config before replacing it
+// with the migrated version. Failing to write (e.g. a read-only mount) is not
+// fatal, the migrated config is still used for this run.
+func saveMigratedConfig(configPath string, original, migrated []byte, fromVersion int) {
+	backupPath := fmt.Sprintf("%s.v%d.bak", configPath, fromVersion)
+	if err := os.WriteFile(backupPath, original, 0o600); err != nil {
+		slog.Error("Failed to back up config, leaving it unchanged", "backup", backupPath, "path", configPath, "error", err)
+		return
+	}
+	if err := os.WriteFile(configPath, migrated, 0o600); err != nil {
+		slog.Error("Failed to write migrated config", "path", configPath, "error", err)
+		return
+	}
+	slog.Info("Migrated config", "path", configPath, "version", currentConfigVersion, "backup", backupPath)
+}
+
+func configVersion(data []byte) int {
+	var header struct {
+		ConfigVersion int `json:"config_version"`
+	}
+	if json.Unmarshal(data, &header) != nil || header.ConfigVersion == 0 {
+		return 1
+	}
+	return header.ConfigVersion
+}
+
+// warnUnknownConfigFields logs fields that don't match the config schema, which
+// usually means a typo or a setting from a different version.
+func warnUnknownConfigFields(data []byte) {
+	var raw map[string]json.RawMessage
+	if json.Unmarshal(data, &raw) != nil {
+		return
+	}
+
+	known := make(map[string]bool)
+	configType := reflect.TypeOf(Config{})
+	for i := 0; i < configType.NumField(); i++ {
+		name, _, _ := strings.Cut(configType.Field(i).Tag.Get("json"), ",")
+		known[name] = true
+	}
+	for key := range raw {
+		if !known[key] {
+			slog.Warn("Unknown config field is ignored", "field", key)
+		}
+	}
+
+	var params map[string]json.RawMessage
+	if json.Unmarshal(raw["ollama_params"], &params) == nil {
+		for key := range params {
+			if !containsString(ollamaRequestFields, key) {
+				slog.Warn("Field of ollama_params is not an Ollama request field and will be ignored by Ollama", "field", key)
+			}
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ConversationConfig sets up POST /api/conversation/process, Home Assistant's
+// conversation API, so llamanator can be a conversation agent. What was said
+// is the query of Template, answered by Model. An agent_id naming a template
+// picks that template instead.
+type ConversationConfig struct {
+	Template string `json:"template"`
+	Model    string `json:"model"`
+}
+
+type conversationRequest struct {
+	Text           string `json:"text"`
+	Language       string `json:"language"`
+	ConversationID string `json:"conversation_id"`
+	AgentID        string `json:"agent_id"`
+}
+
+// conversationResponse is Home Assistant's ConversationResult.
+type conversationResponse struct {
+	ConversationID       string                 `json:"conversation_id"`
+	ContinueConversation bool                   `json:"continue_conversation"`
+	Response             conversationIntentData `json:"response"`
+}
+
+// conversationIntentData is Home Assistant's IntentResponse, as the
+// conversation API returns it.
+type conversationIntentData struct {
+	ResponseType string                 `json:"response_type"`
+	Language     string                 `json:"language"`
+	Data         map[string]interface{} `json:"data"`
+	Speech       map[string]interface{} `json:"speech"`
+	Card         map[string]interface{} `json:"card"`
+}
+
+func newConversationResponse(conversationID, language, responseType, speech string) conversationResponse {
+	data := map[string]interface{}{"targets": []string{}, "success": []string{}, "failed": []string{}}
+	if responseType == "error" {
+		data = map[string]interface{}{"code": "unknown"}
+	}
+	return conversationResponse{
+		ConversationID: conversationID,
+		Response: conversationIntentData{
+			ResponseType: responseType,
+			Language:     language,
+			Data:         data,
+			Speech:       map[string]interface{}{"plain": map[string]interface{}{"speech": speech, "extra_data": nil}},
+			Card:         map[string]interface{}{},
+		},
+	}
+}
+
+// conversationHandler serves POST /api/conversation/process. Failures are
+// answered in the same shape, with an error response_type and the message as
+// speech, so the voice assistant can say what went wrong.
+func conversationHandler(config *Config, templateConfig *TemplateConfig, history *History) http.HandlerFunc {
+	return authenticate(config, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var request conversationRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || strings.TrimSpace(request.Text) == "" {
+			http.Error(w, "Request needs the text said", http.StatusBadRequest)
+			return
+		}
+		if request.Language == "" {
+			request.Language = "en"
+		}
+		conversationID := request.ConversationID
+		if conversationID == "" {
+			conversationID = newJobID()
+		}
+
+		templateName, model := config.Conversation.Template, config.Conversation.Model
+		if _, ok := templateConfig.Templates[request.AgentID]; ok {
+			templateName, model = request.AgentID, ""
+		}
+		if model == "" {
+			model = templateConfig.defaultModel(config, templateName)
+		}
+		data := TemplateData{Query: request.Text, Language: request.Language, ConversationID: conversationID}
+		haContext := HAContext{Origin: requestOrigin(r)}
+		ctx := withGenerationStats(requestTraceContext(r.Context(), config, r), &GenerationStats{})
+		start := time.Now()
+		filteredResponse, err := generate(ctx, config, templateConfig, templateName, data, model)
+		recordGeneration(ctx, config, history, "conversation", templateName, data, model, haContext, start, filteredResponse, err)
+		if err != nil {
+			slog.Error("Failed to answer conversation", "template", templateName, "model", model, "request_id", requestID(ctx), "error", err)
+			var limited *rateLimitError
+			if errors.As(err, &limited) {
+				limited.setRetryAfter(w)
+			}
+			status, message := templateError(err)
+			writeJSON(w, status, newConversationResponse(conversationID, request.Language, "error", message))
+			return
+		}
+
+		speech, _ := filteredResponse["response"].(string)
+		response := newConversationResponse(conversationID, request.Language, "action_done", speech)
+		// Home Assistant keeps listening after a question
+		response.ContinueConversation = strings.HasSuffix(strings.TrimSpace(speech), "?")
+		setUsageHeaders(ctx, w)
+		writeJSON(w, http.StatusOK, response)
+	})
+}
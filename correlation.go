@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// haContextHeader echoes the Home Assistant context ID back on responses.
+const haContextHeader = "X-Llamanator-Context-ID"
+
+// originHeader names the origin of requests that can't add an origin field,
+// such as /text and OpenAI clients.
+const originHeader = "X-Llamanator-Origin"
+
+// HAContext identifies the Home Assistant context (automation run, script or
+// user action) that triggered a request, so an answer can be traced back to it.
+// Origin is the caller's own name for where the request came from, such as an
+// automation, dashboard or script, so usage can be attributed to it.
+type HAContext struct {
+	ID       string `json:"id,omitempty"`
+	ParentID string `json:"parent_id,omitempty"`
+	UserID   string `json:"user_id,omitempty"`
+	Origin   string `json:"origin,omitempty"`
+}
+
+// requestHAContext reads the optional 'context' object of a request, in the
+// shape of Home Assistant's {{ context }} (id, parent_id and user_id).
+func requestHAContext(request map[string]interface{}) (HAContext, error) {
+	var haContext HAContext
+	if raw, ok := request["origin"]; ok && raw != nil {
+		origin, ok := raw.(string)
+		if !ok || !validOrigin(origin) {
+			return haContext, badInput("origin must be a name of up to 128 characters")
+		}
+		haContext.Origin = origin
+	}
+	value, ok := request["context"]
+	if !ok || value == nil {
+		return haContext, nil
+	}
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return haContext, badInput("context must be an object with id, parent_id and user_id")
+	}
+
+	for key, target := range map[string]*string{"id": &haContext.ID, "parent_id": &haContext.ParentID, "user_id": &haContext.UserID} {
+		raw, ok := fields[key]
+		if !ok || raw == nil {
+			continue
+		}
+		id, ok := raw.(string)
+		if !ok || len(id) > 128 || strings.ContainsFunc(id, func(r rune) bool { return r < 0x21 || r > 0x7e }) {
+			return haContext, badInput("context.%s must be a short ID string", key)
+		}
+		*target = id
+	}
+	return haContext, nil
+}
+
+// validOrigin reports whether an origin is a short name without control
+// characters, such as "Morning briefing" or "script.doorbell".
+func validOrigin(origin string) bool {
+	return origin != "" && len(origin) <= 128 && !strings.ContainsFunc(origin, unicode.IsControl)
+}
+
+// requestOrigin returns the origin named by the request's header, or "".
+func requestOrigin(r *http.Request) string {
+	origin := strings.TrimSpace(r.Header.Get(originHeader))
+	if !validOrigin(origin) {
+		return ""
+	}
+	return origin
+}
+
+// logAttrs returns the context IDs and origin as log attributes, none without
+// a context.
+func (c HAContext) logAttrs() []any {
+	var attrs []any
+	if c.ID != "" {
+		attrs = append(attrs, "context_id", c.ID)
+	}
+	if c.ParentID != "" {
+		attrs = append(attrs, "parent_id", c.ParentID)
+	}
+	if c.Origin != "" {
+		attrs = append(attrs, "origin", c.Origin)
+	}
+	return attrs
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestHAContext(t *testing.T) {
+	tests := []struct {
+		name    string
+		request map[string]interface{}
+		want    HAContext
+		wantErr string
+	}{
+		{name: "none", request: map[string]interface{}{"query": "hi"}},
+		{
+			name:    "origin",
+			request: map[string]interface{}{"origin": "Morning briefing"},
+			want:    HAContext{Origin: "Morning briefing"},
+		},
+		{
+			name: "context and origin",
+			request: map[string]interface{}{
+				"origin":  "script.doorbell",
+				"context": map[string]interface{}{"id": "01ABC", "parent_id": "01XYZ", "user_id": nil},
+			},
+			want: HAContext{ID: "01ABC", ParentID: "01XYZ", Origin: "script.doorbell"},
+		},
+		{name: "empty origin", request: map[string]interface{}{"origin": ""}, wantErr: "origin must be"},
+		{name: "origin not a string", request: map[string]interface{}{"origin": 3.0}, wantErr: "origin must be"},
+		{name: "long origin", request: map[string]interface{}{"origin": strings.Repeat("a", 129)}, wantErr: "origin must be"},
+		{name: "origin with newline", request: map[string]interface{}{"origin": "a\nb"}, wantErr: "origin must be"},
+		{name: "context not an object", request: map[string]interface{}{"context": "01ABC"}, wantErr: "context must be an object"},
+		{
+			name:    "id with a space",
+			request: map[string]interface{}{"context": map[string]interface{}{"id": "01 ABC"}},
+			wantErr: "context.id must be",
+		},
+		{
+			name:    "user_id not a string",
+			request: map[string]interface{}{"context": map[string]interface{}{"user_id": 7.0}},
+			wantErr: "context.user_id must be",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := requestHAContext(tt.request)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestOrigin(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"  Kitchen dashboard ", "Kitchen dashboard"},
+		{strings.Repeat("a", 129), ""},
+		{"bad\x01origin", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/text", nil)
+		r.Header.Set(originHeader, tt.header)
+		if got := requestOrigin(r); got != tt.want {
+			t.Errorf("requestOrigin(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestOriginLogAttrs(t *testing.T) {
+	if attrs := (HAContext{}).logAttrs(); len(attrs) != 0 {
+		t.Errorf("empty context gave %v", attrs)
+	}
+	attrs := HAContext{ID: "01ABC", Origin: "script.doorbell"}.logAttrs()
+	want := []any{"context_id", "01ABC", "origin", "script.doorbell"}
+	if len(attrs) != len(want) {
+		t.Fatalf("got %v, want %v", attrs, want)
+	}
+	for i := range want {
+		if attrs[i] != want[i] {
+			t.Errorf("got %v, want %v", attrs, want)
+		}
+	}
+}
+
+func TestAggregateUsageByOrigin(t *testing.T) {
+	day := time.Date(2024, 5, 1, 12, 0, 0, 0, time.Local)
+	records := []HistoryRecord{
+		{Time: day, Template: "chat", Model: "llama3", DurationMS: 100, Context: HAContext{Origin: "briefing"}},
+		{Time: day, Template: "chat", Model: "llama3", DurationMS: 300, Context: HAContext{Origin: "briefing"}, Error: "timeout"},
+		{Time: day, Template: "chat", Model: "llama3", DurationMS: 50},
+		{Time: day.AddDate(0, 0, 5), Template: "chat", Model: "llama3", DurationMS: 10, Context: HAContext{Origin: "briefing"}},
+	}
+	from := time.Date(2024, 5, 1, 0, 0, 0, 0, time.Local)
+	usage := aggregateUsage(records, from, from)
+	want := []UsageRow{
+		{Date: "2024-05-01", Template: "chat", Model: "llama3", Requests: 1, TotalDurationMS: 50, AvgDurationMS: 50},
+		{Date: "2024-05-01", Template: "chat", Model: "llama3", Origin: "briefing", Requests: 2, Errors: 1, TotalDurationMS: 400, AvgDurationMS: 200},
+	}
+	if len(usage) != len(want) {
+		t.Fatalf("got %+v, want %+v", usage, want)
+	}
+	for i := range want {
+		if usage[i] != want[i] {
+			t.Errorf("row %d = %+v, want %+v", i, usage[i], want[i])
+		}
+	}
+}
+
+func TestMetricsOrigins(t *testing.T) {
+	m := newMetrics()
+	m.record("api", "chat", "llama3", "briefing", "ok", &GenerationStats{PromptTokens: 10, CompletionTokens: 4}, time.Second)
+	m.record("api", "chat", "llama3", "briefing", "error", nil, time.Second)
+	m.record("api", "chat", "llama3", "", "ok", &GenerationStats{PromptTokens: 99}, time.Second)
+
+	var out strings.Builder
+	m.write(&out)
+	for _, line := range []string{
+		`llamanator_origin_requests_total{origin="briefing",status="ok"} 1`,
+		`llamanator_origin_requests_total{origin="briefing",status="error"} 1`,
+		`llamanator_origin_tokens_total{origin="briefing",type="prompt"} 10`,
+		`llamanator_origin_tokens_total{origin="briefing",type="completion"} 4`,
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("metrics missing %s\n%s", line, out.String())
+		}
+	}
+	if strings.Contains(out.String(), `origin=""`) {
+		t.Errorf("requests without an origin were counted:\n%s", out.String())
+	}
+}
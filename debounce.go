@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// jobBatch collects the queries of requests to a debounced template until its
+// window closes.
+type jobBatch struct {
+	job     *Job
+	queries []string
+}
+
+// debounce is the template's debounce window, or 0 when requests run on their
+// own.
+func (tc *TemplateConfig) debounce(templateName string) time.Duration {
+	if settings, ok := tc.Settings[templateName]; ok {
+		return settings.debounce
+	}
+	return 0
+}
+
+// parseDebounce checks the debounce window of template settings.
+func (s *TemplateSettings) parseDebounce() error {
+	if s.Debounce == "" {
+		return nil
+	}
+	debounce, err := time.ParseDuration(s.Debounce)
+	if err != nil || debounce <= 0 {
+		return fmt.Errorf("invalid debounce duration '%s'", s.Debounce)
+	}
+	s.debounce = debounce
+	return nil
+}
+
+// batch adds a query to the template's open batch and returns the batch's job.
+// The first request opens the batch, and once window has passed run is called
+// with the job and every query that arrived in the meantime, in order.
+func (j *Jobs) batch(templateName, query string, window time.Duration, haContext HAContext, run func(job *Job, queries []string)) *Job {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if b, ok := j.batches[templateName]; ok {
+		b.queries = append(b.queries, query)
+		return b.job
+	}
+
+	job := &Job{ID: newJobID(), Template: templateName, Context: haContext, Created: time.Now(), updated: make(chan struct{})}
+	j.jobs[job.ID] = job
+	j.batches[templateName] = &jobBatch{job: job, queries: []string{query}}
+	time.AfterFunc(window, func() {
+		j.mu.Lock()
+		b := j.batches[templateName]
+		delete(j.batches, templateName)
+		j.mu.Unlock()
+		if len(b.queries) > 1 {
+			slog.Info("Running debounced template once", "template", templateName, "requests", len(b.queries))
+		}
+		run(b.job, b.queries)
+	})
+	return job
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// FieldSchema describes a request or response field for tools that build
+// forms, such as a Node-RED node. Type is string, integer, number, boolean,
+// object or array.
+type FieldSchema struct {
+	Name        string   `json:"name"`
+	Type        string   `json:"type"`
+	Required    bool     `json:"required,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Enum        []string `json:"enum,omitempty"`
+}
+
+// TemplateSchema describes how to call a template and what it returns.
+type TemplateSchema struct {
+	Name        string        `json:"name"`
+	Description string        `json:"description,omitempty"`
+	Path        string        `json:"path"`
+	Method      string        `json:"method"`
+	Model       string        `json:"model"`
+	Chat        bool          `json:"chat"`
+	Streaming   bool          `json:"streaming"`
+	Disabled    bool          `json:"disabled,omitempty"`
+	Inputs      []FieldSchema `json:"inputs"`
+	Outputs     []FieldSchema `json:"outputs"`
+}
+
+// TemplateExample is a sample request for a template and what it returns.
+type TemplateExample struct {
+	Request  map[string]interface{} `json:"request"`
+	Response map[string]interface{} `json:"response,omitempty"`
+}
+
+// TemplateDocs is what GET /template/{name} returns: the template's schema,
+// the inputs a request needs, an example and how to send it with curl.
+type TemplateDocs struct {
+	TemplateSchema
+	Required []string        `json:"required"`
+	Example  TemplateExample `json:"example"`
+	Curl     string          `json:"curl"`
+}
+
+// requestFieldSchemas describes each of requestFields.
+var requestFieldSchemas = map[string]FieldSchema{
+	"query":           {Type: "string", Description: "The question or text for the template"},
+	"model":           {Type: "string", Description: "Model to use instead of the template's default"},
+	"stream":          {Type: "boolean", Description: "Stream the response as server-sent events, or NDJSON with Accept: application/x-ndjson"},
+	"async":           {Type: "boolean", Description: "Return a job ID straight away and poll /jobs/{id} for the result"},
+	"mqtt_topic":      {Type: "string", Description: "MQTT topic to publish tokens and the result to"},
+	"context":         {Type: "object", Description: "Home Assistant context with id, parent_id and user_id"},
+	"ics":             {Type: "string", Description: "iCalendar payload"},
+	"calendar_url":    {Type: "string", Description: "URL of an iCalendar feed to fetch"},
+	"calendar_days":   {Type: "integer", Description: "Days of calendar events to include"},
+	"csv":             {Type: "string", Description: "CSV table"},
+	"tsv":             {Type: "string", Description: "Tab separated table"},
+	"csv_delimiter":   {Type: "string", Description: "Single character CSV delimiter"},
+	"csv_columns":     {Type: "array", Description: "Columns of the table to keep"},
+	"csv_max_rows":    {Type: "integer", Description: "Rows of the table to keep"},
+	"document":        {Type: "string", Description: "Base64 encoded PDF, DOCX or text document"},
+	"document_type":   {Type: "string", Description: "Document type when it can't be detected", Enum: []string{"pdf", "docx", "text"}},
+	"pages":           {Type: "string", Description: "Pages of the document to keep, such as 1-3,5"},
+	"url":             {Type: "string", Description: "Web page to fetch"},
+	"log":             {Type: "string", Description: "Name of a configured log source"},
+	"log_since":       {Type: "string", Description: "How far back to read the log, such as 1h"},
+	"log_priority":    {Type: "string", Description: "Lowest log priority to include", Enum: logPriorities},
+	"messages":        {Type: "array", Description: "Earlier messages of the conversation, each with role and content"},
+	"conversation_id": {Type: "string", Description: "Conversation to continue, remembered by the server"},
+}
+
+// responseFieldTypes are the types of Ollama response fields.
+var responseFieldTypes = map[string]string{
+	"done":                 "boolean",
+	"context":              "array",
+	"total_duration":       "integer",
+	"load_duration":        "integer",
+	"prompt_eval_count":    "integer",
+	"prompt_eval_duration": "integer",
+	"eval_count":           "integer",
+	"eval_duration":        "integer",
+}
+
+// templateInputs are the request fields the template accepts: those it
+// declares, or every request field.
+func templateInputs(config *Config, templateConfig *TemplateConfig, templateName string) []FieldSchema {
+	names := requestFields
+	if settings, ok := templateConfig.Settings[templateName]; ok && len(settings.Inputs) > 0 {
+		names = append([]string{"query"}, settings.Inputs...)
+	}
+	var inputs []FieldSchema
+	for _, name := range names {
+		if name == "messages" && !templateConfig.chat(templateName) {
+			continue
+		}
+		if name == "conversation_id" && !config.Memory.Enabled {
+			continue
+		}
+		field, ok := requestFieldSchemas[name]
+		if !ok {
+			field = FieldSchema{Type: "string"}
+		}
+		field.Name = name
+		field.Required = name == "query"
+		switch name {
+		case "model":
+			if settings, ok := templateConfig.Settings[templateName]; ok {
+				field.Enum = settings.AllowedModels
+			}
+		case "log":
+			field.Enum = sortedKeys(config.Inputs.LogSources)
+		}
+		inputs = append(inputs, field)
+	}
+	return inputs
+}
+
+// templateOutputs are the fields of the template's response, named as its
+// response_map says. Nested fields are named by their dotted path.
+func templateOutputs(config *Config, templateConfig *TemplateConfig, templateName string) []FieldSchema {
+	fields := []FieldSchema{{Name: "response", Type: "string", Required: true, Description: "The model's answer"}}
+	for _, name := range templateConfig.responseFields(config, templateName) {
+		if name == "response" {
+			continue
+		}
+		fieldType, ok := responseFieldTypes[name]
+		if !ok {
+			fieldType = "string"
+		}
+		fields = append(fields, FieldSchema{Name: name, Type: fieldType})
+	}
+	if templateConfig.confidence(config, templateName) != nil {
+		fields = append(fields, FieldSchema{Name: "confidence", Type: "number", Description: "How confident the model is in the answer, from 0 to 1"})
+	}
+	if templateConfig.refusals(config, templateName) != nil {
+		fields = append(fields, FieldSchema{Name: "status", Type: "string", Required: true, Enum: []string{statusAnswered, statusDeclined}, Description: "Whether the model answered or declined"})
+	}
+	rules := templateConfig.extractRules(templateName)
+	for _, name := range sortedKeys(rules) {
+		description := "Extracted from the answer with " + rules[name].Pattern
+		if rules[name].Path != "" {
+			description = "Extracted from JSON in the answer at " + rules[name].Path
+		}
+		fields = append(fields, FieldSchema{Name: name, Type: "string", Description: description})
+	}
+	coercions := templateConfig.coerceRules(templateName)
+	for _, name := range sortedKeys(coercions) {
+		rule := coercions[name]
+		field := FieldSchema{Name: name, Type: "string", Enum: rule.Values, Description: "The " + rule.From + " as one of a fixed set of values, or null"}
+		if rule.Type == coerceBoolean {
+			field.Type, field.Description = "boolean", "The "+rule.From+" as true or false, or null"
+		}
+		fields = append(fields, field)
+	}
+	for _, rule := range coercions {
+		if rule.Type == coerceBoolean {
+			fields = append(fields, FieldSchema{Name: coerceErrorsField, Type: "object", Description: "Why boolean fields are null, by field"})
+			break
+		}
+	}
+	if settings, ok := templateConfig.Settings[templateName]; ok && len(settings.Actions) > 0 {
+		fields = append(fields, FieldSchema{Name: "actions", Type: "array", Description: "Actions the model called, each with its arguments, status and output or error"})
+	}
+	if templateConfig.watermark(config, templateName).Field {
+		fields = append(fields, FieldSchema{Name: "watermark", Type: "object", Required: true, Description: "The template, template version and model that produced the response"})
+	}
+
+	var responseMap map[string]string
+	if settings, ok := templateConfig.Settings[templateName]; ok {
+		responseMap = settings.ResponseMap
+	}
+	var outputs []FieldSchema
+	for _, field := range fields {
+		if target, ok := responseMap[field.Name]; ok {
+			if target == "" {
+				continue
+			}
+			field.Name = target
+		}
+		outputs = append(outputs, field)
+	}
+	return outputs
+}
+
+// templatesHandler serves GET /templates, describing each template's inputs and
+// outputs so low-code tools can generate forms for calling them.
+func templatesHandler(config *Config, templateConfig *TemplateConfig) http.HandlerFunc {
+	return authenticate(config, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		schemas := []TemplateSchema{}
+		for _, name := range sortedKeys(templateConfig.Templates) {
+			schemas = append(schemas, templateSchema(config, templateConfig, name))
+		}
+		writeEncoded(w, r, http.StatusOK, map[string]interface{}{"templates": schemas})
+	})
+}
+
+func templateSchema(config *Config, templateConfig *TemplateConfig, templateName string) TemplateSchema {
+	schema := TemplateSchema{
+		Name:      templateName,
+		Path:      "/template/" + templateName,
+		Method:    http.MethodPost,
+		Model:     templateConfig.defaultModel(config, templateName),
+		Chat:      templateConfig.chat(templateName),
+		Streaming: config.Flags.Enabled(flagStreaming),
+		Disabled:  templateConfig.disabled(templateName),
+		Inputs:    templateInputs(config, templateConfig, templateName),
+		Outputs:   templateOutputs(config, templateConfig, templateName),
+	}
+	if settings, ok := templateConfig.Settings[templateName]; ok {
+		schema.Description = settings.Description
+	}
+	return schema
+}
+
+// templateDocs documents a template for GET /template/{name}. The example is
+// the one in its settings, or one made up from its inputs and outputs.
+func templateDocs(r *http.Request, config *Config, templateConfig *TemplateConfig, templateName string) TemplateDocs {
+	docs := TemplateDocs{TemplateSchema: templateSchema(config, templateConfig, templateName), Required: []string{}}
+	for _, input := range docs.Inputs {
+		if input.Required {
+			docs.Required = append(docs.Required, input.Name)
+		}
+	}
+	if settings, ok := templateConfig.Settings[templateName]; ok && settings.Example != nil {
+		docs.Example = *settings.Example
+	}
+	if docs.Example.Request == nil {
+		docs.Example.Request = map[string]interface{}{"query": "..."}
+	}
+	if docs.Example.Response == nil {
+		docs.Example.Response = make(map[string]interface{})
+		for _, output := range docs.Outputs {
+			setPath(docs.Example.Response, strings.Split(output.Name, "."), exampleValue(output.Type))
+		}
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	body, _ := json.Marshal(docs.Example.Request)
+	docs.Curl = fmt.Sprintf(`curl -X POST %s://%s%s -H "Authorization: Bearer $LLAMANATOR_TOKEN" -H 'Content-Type: application/json' -d '%s'`,
+		scheme, r.Host, docs.Path, strings.ReplaceAll(string(body), "'", `'\''`))
+	return docs
+}
+
+// exampleValue is a placeholder value of a field type.
+func exampleValue(fieldType string) interface{} {
+	switch fieldType {
+	case "integer", "number":
+		return 0
+	case "boolean":
+		return false
+	case "object":
+		return map[string]interface{}{}
+	case "array":
+		return []interface{}{}
+	}
+	return "..."
+}
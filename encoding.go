@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Response encodings other than JSON, chosen by the Accept header
+const (
+	xmlType  = "application/xml"
+	yamlType = "application/yaml"
+)
+
+// responseType is the content type to encode a response as: the first of the
+// Accept header's types that is XML or YAML, or else JSON.
+func responseType(r *http.Request) string {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case xmlType, "text/xml":
+			return xmlType
+		case yamlType, "application/x-yaml", "text/yaml":
+			return yamlType
+		case "application/json", "*/*":
+			return "application/json"
+		}
+	}
+	return "application/json"
+}
+
+// writeEncoded writes value as JSON, XML or YAML as the request accepts. XML
+// and YAML are encoded from value's JSON, so every encoding has the same
+// fields.
+func writeEncoded(w http.ResponseWriter, r *http.Request, status int, value interface{}) {
+	contentType := responseType(r)
+	if contentType == "application/json" {
+		writeJSON(w, status, value)
+		return
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var tree interface{}
+	if err := decoder.Decode(&tree); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+
+	var body bytes.Buffer
+	if contentType == xmlType {
+		body.WriteString(xml.Header)
+		encodeXML(&body, "response", tree, 0)
+	} else {
+		encodeYAML(&body, tree, 0)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	w.Write(body.Bytes())
+}
+
+var invalidXMLName = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// xmlName makes a JSON key a valid element name.
+func xmlName(key string) string {
+	name := invalidXMLName.ReplaceAllString(key, "_")
+	if name == "" || strings.IndexAny(name[:1], "0123456789.-") == 0 || strings.HasPrefix(strings.ToLower(name), "xml") {
+		name = "_" + name
+	}
+	return name
+}
+
+// encodeXML writes a JSON value as an element. Object keys become child
+// elements, and each item of an array an <item> element.
+func encodeXML(buf *bytes.Buffer, name string, value interface{}, depth int) {
+	indent := strings.Repeat("  ", depth)
+	switch value := value.(type) {
+	case map[string]interface{}:
+		if len(value) == 0 {
+			buf.WriteString(indent + "<" + name + "/>\n")
+			return
+		}
+		buf.WriteString(indent + "<" + name + ">\n")
+		for _, key := range sortedKeys(value) {
+			encodeXML(buf, xmlName(key), value[key], depth+1)
+		}
+		buf.WriteString(indent + "</" + name + ">\n")
+	case []interface{}:
+		if len(value) == 0 {
+			buf.WriteString(indent + "<" + name + "/>\n")
+			return
+		}
+		buf.WriteString(indent + "<" + name + ">\n")
+		for _, item := range value {
+			encodeXML(buf, "item", item, depth+1)
+		}
+		buf.WriteString(indent + "</" + name + ">\n")
+	case nil:
+		buf.WriteString(indent + "<" + name + "/>\n")
+	default:
+		// Newlines are kept so multi-line answers stay readable
+		var text bytes.Buffer
+		xml.EscapeText(&text, []byte(scalarText(value)))
+		buf.WriteString(indent + "<" + name + ">" + strings.ReplaceAll(text.String(), "&#xA;", "\n") + "</" + name + ">\n")
+	}
+}
+
+// scalarText is the text of a JSON string, number or boolean.
+func scalarText(value interface{}) string {
+	switch value := value.(type) {
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	case bool:
+		if value {
+			return "true"
+		}
+		return "false"
+	}
+	return ""
+}
+
+// encodeYAML writes a JSON value as block style YAML, with multi-line strings
+// as literal blocks so they read naturally in a terminal.
+func encodeYAML(buf *bytes.Buffer, value interface{}, depth int) {
+	indent := strings.Repeat("  ", depth)
+	switch value := value.(type) {
+	case map[string]interface{}:
+		if len(value) == 0 {
+			buf.WriteString(indent + "{}\n")
+			return
+		}
+		for _, key := range sortedKeys(value) {
+			buf.WriteString(indent + yamlString(key) + ":")
+			encodeYAMLValue(buf, value[key], depth)
+		}
+	case []interface{}:
+		if len(value) == 0 {
+			buf.WriteString(indent + "[]\n")
+			return
+		}
+		for _, item := range value {
+			// Collections start on the item's line, as in "- key: value"
+			if yamlCollection(item) {
+				var itemBuf bytes.Buffer
+				encodeYAML(&itemBuf, item, depth+1)
+				buf.WriteString(indent + "- ")
+				buf.Write(itemBuf.Bytes()[len(indent)+2:])
+				continue
+			}
+			buf.WriteString(indent + "-")
+			encodeYAMLValue(buf, item, depth)
+		}
+	default:
+		buf.WriteString(indent)
+		encodeYAMLValue(buf, value, depth)
+	}
+}
+
+// yamlCollection reports whether a value is a non-empty object or array.
+func yamlCollection(value interface{}) bool {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		return len(value) > 0
+	case []interface{}:
+		return len(value) > 0
+	}
+	return false
+}
+
+// encodeYAMLValue writes the value of a key or array item, after its "key:" or
+// "-", nesting collections below it.
+func encodeYAMLValue(buf *bytes.Buffer, value interface{}, depth int) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			buf.WriteString(" {}\n")
+			return
+		}
+		buf.WriteString("\n")
+		encodeYAML(buf, v, depth+1)
+	case []interface{}:
+		if len(v) == 0 {
+			buf.WriteString(" []\n")
+			return
+		}
+		buf.WriteString("\n")
+		encodeYAML(buf, v, depth+1)
+	case nil:
+		buf.WriteString(" null\n")
+	case string:
+		if literalBlock(v) {
+			indicator := "|-"
+			if strings.HasSuffix(v, "\n") {
+				indicator = "|"
+			}
+			buf.WriteString(" " + indicator + "\n")
+			indent := strings.Repeat("  ", depth+1)
+			for _, line := range strings.Split(strings.TrimSuffix(v, "\n"), "\n") {
+				if line != "" {
+					buf.WriteString(indent + line)
+				}
+				buf.WriteString("\n")
+			}
+			return
+		}
+		buf.WriteString(" " + yamlString(v) + "\n")
+	default:
+		buf.WriteString(" " + scalarText(v) + "\n")
+	}
+}
+
+// literalBlock reports whether a string can be written as a literal block and
+// read back unchanged.
+func literalBlock(s string) bool {
+	if !strings.Contains(s, "\n") || strings.ContainsAny(s, "\r\t") || strings.HasSuffix(s, "\n\n") {
+		return false
+	}
+	first := strings.TrimLeft(s, "\n")
+	return first != "" && !strings.HasPrefix(first, " ")
+}
+
+var plainYAML = regexp.MustCompile(`^[A-Za-z_/(][^:#\n\r\t"'{}\[\],&*!|>%@` + "`" + `]*$`)
+
+// yamlString writes a string plain when YAML would read it back as the same
+// string, and double quoted otherwise.
+func yamlString(s string) string {
+	switch strings.ToLower(s) {
+	case "true", "false", "yes", "no", "on", "off", "null", "~", "y", "n":
+		return strconv.Quote(s)
+	}
+	if plainYAML.MatchString(s) && !strings.HasSuffix(s, " ") {
+		return s
+	}
+	return strconv.Quote(s)
+}
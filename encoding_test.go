@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func decodeTree(t *testing.T, s string) interface{} {
+	t.Helper()
+	decoder := json.NewDecoder(strings.NewReader(s))
+	decoder.UseNumber()
+	var tree interface{}
+	if err := decoder.Decode(&tree); err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestEncodeYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want string
+	}{
+		{"scalars", `{"a": "plain", "b": 2, "c": true, "d": null}`, "a: plain\nb: 2\nc: true\nd: null\n"},
+		{"quoted", `{"yes": "no", "colon": "a: b", "space": "trailing ", "num": "42"}`,
+			"colon: \"a: b\"\nnum: \"42\"\nspace: \"trailing \"\n\"yes\": \"no\"\n"},
+		{"literal block", `{"text": "line one\nline two\n"}`, "text: |\n  line one\n  line two\n"},
+		{"nested", `{"items": [{"name": "a"}, "b", []], "empty": {}}`,
+			"empty: {}\nitems:\n  - name: a\n  - b\n  - []\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			encodeYAML(&buf, decodeTree(t, tt.json), 0)
+			if buf.String() != tt.want {
+				t.Errorf("got %q, want %q", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeXML(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want string
+	}{
+		{"scalars", `{"a": "x < y & z", "b": 1.5, "c": false, "d": null}`,
+			"<response>\n  <a>x &lt; y &amp; z</a>\n  <b>1.5</b>\n  <c>false</c>\n  <d/>\n</response>\n"},
+		{"names", `{"1st": "a", "my key": "b", "xmlns": "c"}`,
+			"<response>\n  <_1st>a</_1st>\n  <my_key>b</my_key>\n  <_xmlns>c</_xmlns>\n</response>\n"},
+		{"arrays", `{"list": ["a", "b"], "empty": []}`,
+			"<response>\n  <empty/>\n  <list>\n    <item>a</item>\n    <item>b</item>\n  </list>\n</response>\n"},
+		{"newlines", `{"text": "one\ntwo"}`, "<response>\n  <text>one\ntwo</text>\n</response>\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			encodeXML(&buf, "response", decodeTree(t, tt.json), 0)
+			if buf.String() != tt.want {
+				t.Errorf("got %q, want %q", buf.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ExtractRule takes a response field out of the model's answer. Pattern is a
+// regular expression, whose first group (or whole match, without groups) is
+// the value. Path is a JSON path such as $.lights[0].state into the first JSON
+// object or array in the answer, whose value keeps its JSON type.
+type ExtractRule struct {
+	Pattern string `json:"pattern,omitempty"`
+	Path    string `json:"path,omitempty"`
+
+	pattern *regexp.Regexp
+	path    []interface{}
+}
+
+// parseExtract checks the rules and compiles their patterns and paths.
+func parseExtract(rules map[string]*ExtractRule) error {
+	for _, field := range sortedKeys(rules) {
+		rule := rules[field]
+		if field == "" || field == "response" {
+			return fmt.Errorf("extract can't set the field '%s'", field)
+		}
+		if rule == nil || (rule.Pattern == "") == (rule.Path == "") {
+			return fmt.Errorf("extract rule for %s needs either a pattern or a path", field)
+		}
+		if rule.Pattern != "" {
+			pattern, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return fmt.Errorf("extract rule for %s has invalid pattern '%s'", field, rule.Pattern)
+			}
+			rule.pattern = pattern
+			continue
+		}
+		path, err := parseJSONPath(rule.Path)
+		if err != nil {
+			return fmt.Errorf("extract rule for %s has invalid path '%s': %v", field, rule.Path, err)
+		}
+		rule.path = path
+	}
+	return nil
+}
+
+// extractRules are the template's extraction rules.
+func (tc *TemplateConfig) extractRules(templateName string) map[string]*ExtractRule {
+	if settings, ok := tc.Settings[templateName]; ok {
+		return settings.Extract
+	}
+	return nil
+}
+
+// extractFields applies the rules to the answer. Fields whose rule finds
+// nothing are left out.
+func extractFields(rules map[string]*ExtractRule, text string) map[string]interface{} {
+	fields := make(map[string]interface{}, len(rules))
+	var embedded interface{}
+	var searched bool
+	for field, rule := range rules {
+		if rule.pattern != nil {
+			match := rule.pattern.FindStringSubmatch(text)
+			if match == nil {
+				continue
+			}
+			value := match[0]
+			if len(match) > 1 {
+				value = match[1]
+			}
+			fields[field] = strings.TrimSpace(value)
+			continue
+		}
+		if !searched {
+			embedded, searched = embeddedJSON(text), true
+		}
+		if value, ok := lookupJSONPath(embedded, rule.path); ok {
+			fields[field] = value
+		}
+	}
+	return fields
+}
+
+// embeddedJSON is the first JSON object or array in text, such as one in a
+// Markdown code block, or nil without one.
+func embeddedJSON(text string) interface{} {
+	for i := 0; i < len(text); i++ {
+		if text[i] != '{' && text[i] != '[' {
+			continue
+		}
+		var value interface{}
+		if err := json.NewDecoder(strings.NewReader(text[i:])).Decode(&value); err == nil {
+			return value
+		}
+	}
+	return nil
+}
+
+// parseJSONPath splits a path such as $.lights[0].state, with or without the
+// leading $, into object keys (strings) and array indexes (ints).
+func parseJSONPath(path string) ([]interface{}, error) {
+	rest := strings.TrimPrefix(path, "$")
+	var steps []interface{}
+	for rest != "" {
+		switch {
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed [")
+			}
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("invalid index '%s'", rest[1:end])
+			}
+			steps = append(steps, index)
+			rest = rest[end+1:]
+		default:
+			rest = strings.TrimPrefix(rest, ".")
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("empty key")
+			}
+			steps = append(steps, rest[:end])
+			rest = rest[end:]
+		}
+	}
+	return steps, nil
+}
+
+// lookupJSONPath follows a parsed path through a decoded JSON value.
+func lookupJSONPath(value interface{}, path []interface{}) (interface{}, bool) {
+	for _, step := range path {
+		switch step := step.(type) {
+		case string:
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if value, ok = object[step]; !ok {
+				return nil, false
+			}
+		case int:
+			array, ok := value.([]interface{})
+			if !ok || step >= len(array) {
+				return nil, false
+			}
+			value = array[step]
+		}
+	}
+	return value, value != nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// FetchConfig restricts which hosts llamanator will fetch on behalf of a request
+// (calendar URLs, web pages). Private, loopback and link-local addresses are
+// blocked unless allow_private_networks is set or the host is in private_hosts,
+// so untrusted queries can't be used to reach internal services.
+type FetchConfig struct {
+	AllowedHosts         []string `json:"allowed_hosts"`
+	DeniedHosts          []string `json:"denied_hosts"`
+	PrivateHosts         []string `json:"private_hosts"`
+	AllowPrivateNetworks bool     `json:"allow_private_networks"`
+
+	// inputHosts narrows allowed_hosts for one kind of input
+	inputHosts []string
+}
+
+// trustHost is the policy with a host from config.json, such as frigate.url's,
+// allowed even when it's on a private network or missing from allowed_hosts.
+func (c FetchConfig) trustHost(host string) FetchConfig {
+	c.PrivateHosts = append(slices.Clip(c.PrivateHosts), host)
+	if len(c.AllowedHosts) > 0 {
+		c.AllowedHosts = append(slices.Clip(c.AllowedHosts), host)
+	}
+	return c
+}
+
+// withInputHosts is the policy for an input with its own allow list, such as
+// inputs.allowed_url_hosts. Hosts must be in both lists, on every redirect.
+func (c FetchConfig) withInputHosts(allowed []string) FetchConfig {
+	c.inputHosts = allowed
+	return c
+}
+
+var errBlockedAddress = errors.New("address is not allowed")
+
+var blockedNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+		"172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/4",
+		"240.0.0.0/4", "::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+	} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+func isBlockedIP(ip net.IP) bool {
+	if mapped := ip.To4(); mapped != nil {
+		ip = mapped
+	}
+	for _, network := range blockedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkFetchHost applies the allow and deny lists to a host name.
+func checkFetchHost(policy FetchConfig, host string) error {
+	if hostMatches(host, policy.DeniedHosts) {
+		return badInput("Fetching from '%s' is not allowed", host)
+	}
+	if !hostAllowed(host, policy.AllowedHosts) || !hostAllowed(host, policy.inputHosts) {
+		return badInput("Fetching from '%s' is not allowed", host)
+	}
+	return nil
+}
+
+// newFetchClient returns an HTTP client that enforces the fetch policy on every
+// connection, including redirects. Addresses are checked after DNS resolution so
+// hostnames pointing at internal addresses are caught too.
+func newFetchClient(policy FetchConfig, timeout time.Duration) *http.Client {
+	guarded := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || isBlockedIP(ip) {
+				return fmt.Errorf("%w: %s", errBlockedAddress, host)
+			}
+			return nil
+		},
+	}
+	unguarded := &net.Dialer{Timeout: timeout}
+
+	transport := &http.Transport{
+		// Proxies would hide the real destination from the address check
+		Proxy: nil,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return nil, err
+			}
+			if policy.AllowPrivateNetworks || hostMatches(host, policy.PrivateHosts) {
+				return unguarded.DialContext(ctx, network, address)
+			}
+			return guarded.DialContext(ctx, network, address)
+		},
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+	}
+
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("stopped after 5 redirects")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return badInput("Redirect to unsupported scheme '%s'", req.URL.Scheme)
+			}
+			return checkFetchHost(policy, req.URL.Hostname())
+		},
+	}
+}
+
+func validateFetchURL(policy FetchConfig, rawURL string) (*url.URL, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, badInput("Invalid URL '%s'", rawURL)
+	}
+	if err := checkFetchHost(policy, parsed.Hostname()); err != nil {
+		return nil, err
+	}
+	return parsed, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCheckFetchHost(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  FetchConfig
+		host    string
+		wantErr bool
+	}{
+		{"no lists", FetchConfig{}, "example.com", false},
+		{"allowed subdomain", FetchConfig{AllowedHosts: []string{"example.com"}}, "www.example.com", false},
+		{"not allowed", FetchConfig{AllowedHosts: []string{"example.com"}}, "example.org", true},
+		{"denied wins", FetchConfig{AllowedHosts: []string{"example.com"}, DeniedHosts: []string{"bad.example.com"}}, "bad.example.com", true},
+		{"input list alone", FetchConfig{}.withInputHosts([]string{"bbc.co.uk"}), "www.bbc.co.uk", false},
+		{"input list rejects", FetchConfig{}.withInputHosts([]string{"bbc.co.uk"}), "example.com", true},
+		{"in both lists", FetchConfig{AllowedHosts: []string{"bbc.co.uk", "example.com"}}.withInputHosts([]string{"bbc.co.uk"}), "bbc.co.uk", false},
+		{"only in fetch list", FetchConfig{AllowedHosts: []string{"bbc.co.uk", "example.com"}}.withInputHosts([]string{"bbc.co.uk"}), "example.com", true},
+		{"only in input list", FetchConfig{AllowedHosts: []string{"example.com"}}.withInputHosts([]string{"bbc.co.uk"}), "bbc.co.uk", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkFetchHost(tt.policy, tt.host); (err != nil) != tt.wantErr {
+				t.Errorf("checkFetchHost(%q) = %v, want error: %v", tt.host, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestURLInputRedirectAllowList(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("internal"))
+	}))
+	defer target.Close()
+	// The same server under another name, which the allow list doesn't have
+	targetURL, _ := url.Parse(target.URL)
+	elsewhere := "http://localhost:" + targetURL.Port()
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, elsewhere+r.URL.Path, http.StatusFound)
+	}))
+	defer redirect.Close()
+
+	config := testConfig(t, `{"fetch": {"allow_private_networks": true}, "inputs": {"allowed_url_hosts": ["127.0.0.1"]}}`)
+	tests := []struct {
+		name    string
+		url     string
+		wantErr string
+	}{
+		{"allowed host", target.URL + "/page", ""},
+		{"redirect to another host", redirect.URL + "/page", "not allowed"},
+		{"other host", elsewhere + "/page", "not allowed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var data TemplateData
+			err := addURLInput(context.Background(), config, map[string]interface{}{"url": tt.url}, &data)
+			if tt.wantErr == "" {
+				if err != nil || data.Page == nil || data.Page.Text != "internal" {
+					t.Fatalf("addURLInput() = %v, page %+v", err, data.Page)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("addURLInput() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
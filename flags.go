@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Feature flags let risky subsystems be switched off at runtime through the admin
+// API without a deploy. Every flag defaults to enabled.
+const (
+	flagAdminAPI  = "admin_api"
+	flagOutputs   = "outputs"
+	flagSchedules = "schedules"
+	flagFetch     = "fetch"
+	flagDocuments = "documents"
+	flagStreaming = "streaming"
+	flagCaching   = "caching"
+	flagActions   = "actions"
+)
+
+var knownFlags = []string{flagAdminAPI, flagOutputs, flagSchedules, flagFetch, flagDocuments, flagStreaming, flagCaching, flagActions}
+
+type FeatureFlags struct {
+	mu    sync.RWMutex
+	flags map[string]bool
+	// configured is what config.json set, which reloads compare against
+	configured map[string]bool
+}
+
+func (f *FeatureFlags) UnmarshalJSON(data []byte) error {
+	var flags map[string]bool
+	if err := json.Unmarshal(data, &flags); err != nil {
+		return err
+	}
+	for name := range flags {
+		if !containsString(knownFlags, name) {
+			slog.Warn("Ignoring unknown feature flag", "flag", name)
+			delete(flags, name)
+		}
+	}
+	f.flags = flags
+	f.configured = make(map[string]bool, len(flags))
+	for name, enabled := range flags {
+		f.configured[name] = enabled
+	}
+	return nil
+}
+
+func (f *FeatureFlags) MarshalJSON() ([]byte, error) {
+	return json.Marshal(f.all())
+}
+
+// Enabled reports whether the named feature is on. Flags missing from the config
+// (or no flags section at all) are enabled.
+func (f *FeatureFlags) Enabled(name string) bool {
+	if f == nil {
+		return true
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	enabled, ok := f.flags[name]
+	return !ok || enabled
+}
+
+func (f *FeatureFlags) set(name string, enabled bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.flags == nil {
+		f.flags = make(map[string]bool)
+	}
+	f.flags[name] = enabled
+}
+
+// reload applies the flags config.json changed since it was last loaded.
+// Flags it didn't change keep their runtime value, so toggles made with
+// /admin/flags survive reloads. It returns the flags that changed.
+func (f *FeatureFlags) reload(reloaded *FeatureFlags) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.flags == nil {
+		f.flags = make(map[string]bool)
+	}
+	var changed []string
+	for _, name := range knownFlags {
+		was, ok := f.configured[name]
+		now, nowOK := reloaded.configured[name]
+		if (!ok || was) != (!nowOK || now) {
+			f.flags[name] = !nowOK || now
+			changed = append(changed, name)
+		}
+	}
+	f.configured = reloaded.configured
+	return changed
+}
+
+func (f *FeatureFlags) all() map[string]bool {
+	flags := make(map[string]bool, len(knownFlags))
+	for _, name := range knownFlags {
+		flags[name] = f.Enabled(name)
+	}
+	return flags
+}
+
+// flagsHandler serves GET /admin/flags and PUT /admin/flags/{name} with a body
+// of {"enabled": false}. Changes last until the server restarts, or a reload
+// changes the flag in config.json.
+func flagsHandler(config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/flags"), "/")
+
+		if name == "" {
+			if r.Method != http.MethodGet {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			writeJSON(w, http.StatusOK, config.Flags.all())
+			return
+		}
+
+		if !containsString(knownFlags, name) {
+			sorted := append([]string(nil), knownFlags...)
+			sort.Strings(sorted)
+			http.Error(w, "Unknown feature flag, expected one of: "+strings.Join(sorted, ", "), http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, map[string]bool{name: config.Flags.Enabled(name)})
+		case http.MethodPut, http.MethodPost:
+			var body struct {
+				Enabled *bool `json:"enabled"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Enabled == nil {
+				http.Error(w, `Expected a body of {"enabled": true|false}`, http.StatusBadRequest)
+				return
+			}
+			config.Flags.set(name, *body.Enabled)
+			slog.Info("Feature flag set", "flag", name, "enabled", *body.Enabled, "remote_addr", r.RemoteAddr)
+			writeJSON(w, http.StatusOK, map[string]bool{name: *body.Enabled})
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func testFlags(t *testing.T, flagsJSON string) *FeatureFlags {
+	t.Helper()
+	var flags FeatureFlags
+	if err := json.Unmarshal([]byte(flagsJSON), &flags); err != nil {
+		t.Fatal(err)
+	}
+	return &flags
+}
+
+func TestFeatureFlagsReload(t *testing.T) {
+	tests := []struct {
+		name        string
+		loaded      string
+		toggled     map[string]bool
+		reloaded    string
+		wantEnabled map[string]bool
+		wantChanged []string
+	}{
+		{
+			name:        "config turns a flag off",
+			loaded:      `{}`,
+			reloaded:    `{"streaming": false}`,
+			wantEnabled: map[string]bool{flagStreaming: false, flagCaching: true},
+			wantChanged: []string{flagStreaming},
+		},
+		{
+			name:        "config turns a flag back on",
+			loaded:      `{"caching": false}`,
+			reloaded:    `{}`,
+			wantEnabled: map[string]bool{flagCaching: true},
+			wantChanged: []string{flagCaching},
+		},
+		{
+			name:        "runtime toggle survives an unrelated reload",
+			loaded:      `{}`,
+			toggled:     map[string]bool{flagOutputs: false},
+			reloaded:    `{"caching": false}`,
+			wantEnabled: map[string]bool{flagOutputs: false, flagCaching: false},
+			wantChanged: []string{flagCaching},
+		},
+		{
+			name:        "setting the default isn't a change",
+			loaded:      `{}`,
+			toggled:     map[string]bool{flagSchedules: false},
+			reloaded:    `{"schedules": true, "fetch": true}`,
+			wantEnabled: map[string]bool{flagSchedules: false, flagFetch: true},
+		},
+		{
+			name:        "config change wins over the runtime value",
+			loaded:      `{"schedules": false}`,
+			toggled:     map[string]bool{flagSchedules: true},
+			reloaded:    `{"schedules": true}`,
+			wantEnabled: map[string]bool{flagSchedules: true},
+			wantChanged: []string{flagSchedules},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags := testFlags(t, tt.loaded)
+			for name, enabled := range tt.toggled {
+				flags.set(name, enabled)
+			}
+			changed := flags.reload(testFlags(t, tt.reloaded))
+			if !slices.Equal(changed, tt.wantChanged) {
+				t.Errorf("reload() = %v, want %v", changed, tt.wantChanged)
+			}
+			for name, want := range tt.wantEnabled {
+				if got := flags.Enabled(name); got != want {
+					t.Errorf("Enabled(%s) = %v, want %v", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestStreamingFlag(t *testing.T) {
+	config := testConfig(t, `{"auth_token": "tok", "flags": {"streaming": false}}`)
+	jobs := newJobs(config)
+	job := jobs.create("default", HAContext{})
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		path    string
+		body    string
+	}{
+		{"OpenAI", openAIChatHandler(config, &TemplateConfig{}, nil), http.MethodPost, "/v1/chat/completions", `{"stream": true, "messages": [{"role": "user", "content": "hi"}]}`},
+		{"Anthropic", anthropicMessagesHandler(config, nil), http.MethodPost, "/v1/messages", `{"stream": true, "max_tokens": 10, "messages": [{"role": "user", "content": "hi"}]}`},
+		{"Ollama", ollamaChatIngressHandler(config), http.MethodPost, "/api/chat", `{"messages": [{"role": "user", "content": "hi"}]}`},
+		{"job stream", jobsHandler(config, jobs), http.MethodGet, "/jobs/" + job.ID + "/stream", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			r.Header.Set("Authorization", "Bearer tok")
+			r.Header.Set("x-api-key", "tok")
+			w := httptest.NewRecorder()
+			tt.handler(w, r)
+			if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "Streaming is disabled") {
+				t.Errorf("got %d %q, want 503 Streaming is disabled", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestCachingFlag(t *testing.T) {
+	server, calls := fakeOllama(t, http.StatusOK, "cached?")
+	config := testConfig(t, `{"api_url": "`+server.URL+`/api/generate", "cache": {"ttl": "1m"}, "flags": {"caching": false}}`)
+	request := map[string]interface{}{"model": "llama3", "messages": []interface{}{}}
+	for i := 0; i < 2; i++ {
+		if _, err := postChat(context.Background(), config, "test", request, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls.Load() != 2 {
+		t.Errorf("backend called %d times, want 2 with caching off", calls.Load())
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// FrigateConfig describes Frigate detection events with a vision template. The
+// description is published to mqtt_topic and sent to the template's outputs.
+type FrigateConfig struct {
+	URL       string   `json:"url"`
+	Template  string   `json:"template"`
+	Model     string   `json:"model"`
+	Image     string   `json:"image"`
+	Types     []string `json:"types"`
+	Cameras   []string `json:"cameras"`
+	Labels    []string `json:"labels"`
+	MQTTTopic string   `json:"mqtt_topic"`
+}
+
+// frigateEvent is the part of a Frigate event that's used in the description.
+type frigateEvent struct {
+	ID           string   `json:"id"`
+	Camera       string   `json:"camera"`
+	Label        string   `json:"label"`
+	TopScore     float64  `json:"top_score"`
+	CurrentZones []string `json:"current_zones"`
+	EnteredZones []string `json:"entered_zones"`
+	HasSnapshot  bool     `json:"has_snapshot"`
+}
+
+// frigatePayload accepts both the messages Frigate publishes to frigate/events,
+// with the event in 'after', and a bare event.
+type frigatePayload struct {
+	Type  string        `json:"type"`
+	After *frigateEvent `json:"after"`
+	frigateEvent
+}
+
+// checkFrigateConfig validates the Frigate settings when they're in use.
+func checkFrigateConfig(config FrigateConfig, templateConfig *TemplateConfig) error {
+	if _, ok := templateConfig.Templates[config.Template]; !ok {
+		return fmt.Errorf("unknown template '%s'", config.Template)
+	}
+	switch config.Image {
+	case "", "snapshot", "thumbnail":
+	default:
+		return fmt.Errorf("image must be snapshot or thumbnail")
+	}
+	return nil
+}
+
+// frigateQuery describes the detection for the template, e.g. "person detected
+// by the front_door camera in driveway".
+func frigateQuery(event frigateEvent) string {
+	query := fmt.Sprintf("%s detected by the %s camera", event.Label, event.Camera)
+	zones := event.CurrentZones
+	if len(zones) == 0 {
+		zones = event.EnteredZones
+	}
+	if len(zones) > 0 {
+		query += " in " + strings.Join(zones, ", ")
+	}
+	return query
+}
+
+// fetchFrigateImage downloads the event's snapshot, or its thumbnail when there's
+// no snapshot yet, as base64 for the vision model.
+func fetchFrigateImage(ctx context.Context, config *Config, event frigateEvent) (string, error) {
+	image := "snapshot"
+	if config.Frigate.Image == "thumbnail" || !event.HasSnapshot {
+		image = "thumbnail"
+	}
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout(config))
+	defer cancel()
+
+	imageURL := strings.TrimSuffix(config.Frigate.URL, "/") + "/api/events/" + url.PathEscape(event.ID) + "/" + image + ".jpg"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, imageURL, nil)
+	if err != nil {
+		return "", err
+	}
+	// Frigate is usually on the local network, but redirects go through the
+	// fetch policy like any other fetch
+	resp, err := newFetchClient(config.Fetch.trustHost(req.URL.Hostname()), fetchTimeout(config)).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Frigate returned %s for %s", resp.Status, imageURL)
+	}
+
+	limit := maxFetchBytes(config)
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(body)) > limit {
+		return "", fmt.Errorf("%s exceeds the %d byte limit", imageURL, limit)
+	}
+	return base64.StdEncoding.EncodeToString(body), nil
+}
+
+// frigateHandler serves POST /frigate. Matching events are described in the
+// background, as vision models are slow, and the request returns 202 at once.
+// Events filtered out by type, camera or label get 204.
+func frigateHandler(config *Config, templateConfig *TemplateConfig, outputs *Outputs, mqtt *MQTTClient, history *History) http.HandlerFunc {
+	types := config.Frigate.Types
+	if len(types) == 0 {
+		types = []string{"new"}
+	}
+
+	return authenticate(config, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var payload frigatePayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		event := payload.frigateEvent
+		if payload.After != nil {
+			event = *payload.After
+		}
+		if event.ID == "" || event.Camera == "" || event.Label == "" {
+			http.Error(w, "Event id, camera and label are required", http.StatusBadRequest)
+			return
+		}
+
+		if (payload.Type != "" && !containsString(types, payload.Type)) ||
+			(len(config.Frigate.Cameras) > 0 && !containsString(config.Frigate.Cameras, event.Camera)) ||
+			(len(config.Frigate.Labels) > 0 && !containsString(config.Frigate.Labels, event.Label)) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		go describeFrigateEvent(config, templateConfig, outputs, mqtt, history, event)
+		writeJSON(w, http.StatusAccepted, map[string]string{"event_id": event.ID, "status": "running"})
+	})
+}
+
+// describeFrigateEvent runs the vision template on the event's image and
+// publishes the description.
+func describeFrigateEvent(config *Config, templateConfig *TemplateConfig, outputs *Outputs, mqtt *MQTTClient, history *History, event frigateEvent) {
+	templateName := config.Frigate.Template
+	model := config.Frigate.Model
+	if model == "" {
+		model = templateConfig.defaultModel(config, templateName)
+	}
+	haContext := HAContext{ID: event.ID}
+	ctx := withGenerationStats(context.Background(), &GenerationStats{})
+	data := TemplateData{Query: frigateQuery(event)}
+	start := time.Now()
+
+	image, err := fetchFrigateImage(ctx, config, event)
+	if err != nil {
+		slog.Error("Failed to fetch the image for Frigate event", "event", event.ID, "error", err)
+		return
+	}
+	data.Images = []string{image}
+
+	filteredResponse, err := generate(ctx, config, templateConfig, templateName, data, model)
+	recordGeneration(ctx, config, history, "frigate", templateName, data, model, haContext, start, filteredResponse, err)
+	if err != nil {
+		slog.Error("Failed to describe Frigate event", "event", event.ID, "error", err)
+		return
+	}
+
+	description, _ := filteredResponse["response"].(string)
+	if topic := config.Frigate.MQTTTopic; topic != "" && mqtt.enabled() {
+		message, _ := json.Marshal(map[string]string{
+			"event_id":    event.ID,
+			"camera":      event.Camera,
+			"label":       event.Label,
+			"description": strings.TrimSpace(description),
+		})
+		if err := mqtt.publish(topic, message); err != nil {
+			slog.Error("Failed to publish the description of Frigate event", "event", event.ID, "error", err)
+		}
+	}
+	deliverResponse(config, outputs, templateName, data, model, haContext, filteredResponse)
+}
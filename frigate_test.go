@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFetchFrigateImage(t *testing.T) {
+	var paths []string
+	frigate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.EscapedPath())
+		w.Write([]byte("jpeg"))
+	}))
+	defer frigate.Close()
+	// Frigate is on a private address, which only its own host is allowed
+	config := testConfig(t, `{"frigate": {"url": "`+frigate.URL+`/"}}`)
+
+	tests := []struct {
+		name     string
+		event    frigateEvent
+		wantPath string
+	}{
+		{"snapshot", frigateEvent{ID: "1718-abc", HasSnapshot: true}, "/api/events/1718-abc/snapshot.jpg"},
+		{"thumbnail without a snapshot", frigateEvent{ID: "1718-abc"}, "/api/events/1718-abc/thumbnail.jpg"},
+		{"id can't leave the event path", frigateEvent{ID: "../../config?x=", HasSnapshot: true}, "/api/events/..%2F..%2Fconfig%3Fx=/snapshot.jpg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			paths = nil
+			image, err := fetchFrigateImage(context.Background(), config, tt.event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if image != base64.StdEncoding.EncodeToString([]byte("jpeg")) {
+				t.Errorf("image = %q", image)
+			}
+			if len(paths) != 1 || paths[0] != tt.wantPath {
+				t.Errorf("requested %v, want %s", paths, tt.wantPath)
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// GitHubConfig summarises pull requests and issues from GitHub webhooks and
+// posts the result back as a comment. Deliveries must be signed with secret.
+type GitHubConfig struct {
+	Secret string `json:"secret"`
+	Token  string `json:"token"`
+	Model  string `json:"model"`
+	// Templates maps a webhook event (pull_request or issues) to a template
+	Templates map[string]string `json:"templates"`
+	Actions   []string          `json:"actions"`
+}
+
+const githubSignatureHeader = "X-Hub-Signature-256"
+
+// githubItem is the pull request or issue a webhook is about.
+type githubItem struct {
+	Number      int    `json:"number"`
+	Title       string `json:"title"`
+	Body        string `json:"body"`
+	URL         string `json:"url"`
+	HTMLURL     string `json:"html_url"`
+	CommentsURL string `json:"comments_url"`
+	User        struct {
+		Login string `json:"login"`
+	} `json:"user"`
+}
+
+type githubPayload struct {
+	Action      string      `json:"action"`
+	PullRequest *githubItem `json:"pull_request"`
+	Issue       *githubItem `json:"issue"`
+	Repository  struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+}
+
+func checkGitHubConfig(config GitHubConfig, templateConfig *TemplateConfig) error {
+	if config.Secret == "" {
+		return errors.New("secret is required to verify deliveries")
+	}
+	for event, templateName := range config.Templates {
+		if event != "pull_request" && event != "issues" {
+			return fmt.Errorf("unsupported event '%s', use pull_request or issues", event)
+		}
+		if _, ok := templateConfig.Templates[templateName]; !ok {
+			return fmt.Errorf("unknown template '%s' for %s", templateName, event)
+		}
+	}
+	return nil
+}
+
+// verifyGitHubSignature checks the HMAC-SHA256 signature GitHub sends with
+// each delivery.
+func verifyGitHubSignature(secret string, body []byte, signature string) bool {
+	hexSignature, ok := strings.CutPrefix(signature, "sha256=")
+	if !ok {
+		return false
+	}
+	expected, err := hex.DecodeString(hexSignature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// githubRequest calls the GitHub API with the configured token.
+func githubRequest(ctx context.Context, config *Config, method, url, accept string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", accept)
+	req.Header.Set("User-Agent", "llamanator")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	if config.GitHub.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+config.GitHub.Token)
+	}
+	// The URLs come from the webhook, so they're held to the fetch policy
+	// before the token is sent anywhere
+	if _, err := validateFetchURL(config.Fetch, url); err != nil {
+		return nil, err
+	}
+	resp, err := newFetchClient(config.Fetch, fetchTimeout(config)).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("GitHub API returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return resp, nil
+}
+
+// fetchPullRequestDiff downloads the diff of a pull request, truncated to the
+// fetch size limit.
+func fetchPullRequestDiff(ctx context.Context, config *Config, item *githubItem) (*Document, error) {
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout(config))
+	defer cancel()
+	resp, err := githubRequest(ctx, config, http.MethodGet, item.URL, "application/vnd.github.diff", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	limit := maxFetchBytes(config)
+	diff, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	document := &Document{Text: string(diff), Pages: 1}
+	if int64(len(diff)) > limit {
+		document.Text = truncateText(document.Text, int(limit))
+		document.Truncated = true
+	}
+	return document, nil
+}
+
+// githubHandler serves POST /github for GitHub webhooks. Deliveries are
+// authenticated by their signature rather than the auth_token, and matching
+// pull requests and issues are summarised in the background.
+func githubHandler(config *Config, templateConfig *TemplateConfig, outputs *Outputs, history *History) http.HandlerFunc {
+	actions := config.GitHub.Actions
+	if len(actions) == 0 {
+		actions = []string{"opened", "reopened"}
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, 25<<20))
+		if err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if !verifyGitHubSignature(config.GitHub.Secret, body, r.Header.Get(githubSignatureHeader)) {
+			slog.Warn("Rejected GitHub delivery with an invalid signature", "remote_addr", r.RemoteAddr)
+			http.Error(w, "Invalid signature", http.StatusUnauthorized)
+			return
+		}
+
+		event := r.Header.Get("X-GitHub-Event")
+		if event == "ping" {
+			writeJSON(w, http.StatusOK, map[string]string{"status": "pong"})
+			return
+		}
+		var payload githubPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		item := payload.Issue
+		if event == "pull_request" {
+			item = payload.PullRequest
+		}
+		templateName, ok := config.GitHub.Templates[event]
+		if !ok || item == nil || !containsString(actions, payload.Action) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		go summariseGitHubItem(config, templateConfig, outputs, history, templateName, event, payload.Repository.FullName, item)
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "running"})
+	}
+}
+
+// summariseGitHubItem runs the template on a pull request or issue and comments
+// with the result.
+func summariseGitHubItem(config *Config, templateConfig *TemplateConfig, outputs *Outputs, history *History, templateName, event, repository string, item *githubItem) {
+	model := config.GitHub.Model
+	if model == "" {
+		model = templateConfig.defaultModel(config, templateName)
+	}
+	name := fmt.Sprintf("%s#%d", repository, item.Number)
+	haContext := HAContext{ID: name}
+	ctx := withGenerationStats(context.Background(), &GenerationStats{})
+	data := TemplateData{Query: fmt.Sprintf("%s by %s\n\n%s", item.Title, item.User.Login, item.Body)}
+	start := time.Now()
+
+	if event == "pull_request" {
+		document, err := fetchPullRequestDiff(ctx, config, item)
+		if err != nil {
+			slog.Error("Failed to fetch the diff", "pull_request", name, "error", err)
+			return
+		}
+		data.Document = document
+	}
+
+	filteredResponse, err := generate(ctx, config, templateConfig, templateName, data, model)
+	recordGeneration(ctx, config, history, "github", templateName, data, model, haContext, start, filteredResponse, err)
+	if err != nil {
+		slog.Error("Failed to summarise pull request", "pull_request", name, "error", err)
+		return
+	}
+
+	if config.GitHub.Token != "" {
+		comment := map[string]string{"body": strings.TrimSpace(filteredResponse["response"].(string))}
+		ctx, cancel := context.WithTimeout(ctx, fetchTimeout(config))
+		resp, err := githubRequest(ctx, config, http.MethodPost, item.CommentsURL, "application/vnd.github+json", comment)
+		cancel()
+		if err != nil {
+			slog.Error("Failed to comment on pull request", "pull_request", name, "error", err)
+		} else {
+			resp.Body.Close()
+			slog.Info("Commented on pull request", "pull_request", name, "template", templateName)
+		}
+	}
+	deliverResponse(config, outputs, templateName, data, model, haContext, filteredResponse)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGitHubRequestFetchPolicy(t *testing.T) {
+	var tokens []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens = append(tokens, r.Header.Get("Authorization"))
+		w.Write([]byte("diff"))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name      string
+		fetch     string
+		wantErr   string
+		wantCalls int
+	}{
+		{"private address blocked", `{}`, "not allowed", 0},
+		{"denied host", `{"allow_private_networks": true, "denied_hosts": ["127.0.0.1"]}`, "not allowed", 0},
+		{"allowed", `{"private_hosts": ["127.0.0.1"]}`, "", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens = nil
+			config := testConfig(t, `{"github": {"token": "secret"}, "fetch": `+tt.fetch+`}`)
+			resp, err := githubRequest(context.Background(), config, http.MethodGet, server.URL+"/repos/a/b/pulls/1", "application/vnd.github.diff", nil)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("githubRequest() = %v, want %q", err, tt.wantErr)
+			}
+			if len(tokens) != tt.wantCalls {
+				t.Errorf("token sent %d times, want %d", len(tokens), tt.wantCalls)
+			}
+		})
+	}
+}
@@ -1,3 +1,10 @@
 module llamanator
 
 go 1.21.0
+
+require golang.org/x/crypto v0.33.0
+
+require (
+	golang.org/x/net v0.21.0 // indirect
+	golang.org/x/text v0.22.0 // indirect
+)
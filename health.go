@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// How long readiness waits for the Ollama API
+const readyTimeout = 5 * time.Second
+
+// healthHandler serves GET /healthz, which returns 200 whenever the process is
+// up and serving, for liveness probes.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyHandler serves GET /readyz for readiness probes. It returns 503 unless
+// the Ollama API answers and has the default model. Status turns "degraded",
+// still with 200, while a template breaches its SLO.
+func readyHandler(config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+		defer cancel()
+		checks := map[string]string{"ollama": "ok"}
+		ready := true
+		var tags struct {
+			Models []struct {
+				Name string `json:"name"`
+			} `json:"models"`
+		}
+		if err := ollamaJSON(ctx, config, http.MethodGet, "/api/tags", nil, &tags); err != nil {
+			checks["ollama"] = err.Error()
+			ready = false
+		} else if config.DefaultModel != "" {
+			checks["default_model"] = fmt.Sprintf("'%s' is not pulled", config.DefaultModel)
+			ready = false
+			for _, model := range tags.Models {
+				if modelMatches(model.Name, config.DefaultModel) {
+					checks["default_model"] = "ok"
+					ready = true
+				}
+			}
+		}
+
+		breached := config.latency.breachedSLOs()
+		status := "ok"
+		switch {
+		case !ready:
+			status = "unavailable"
+		case len(breached) > 0:
+			status = "degraded"
+		}
+		code := http.StatusOK
+		if !ready {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, map[string]interface{}{"status": status, "checks": checks, "slo_breached": breached})
+	}
+}
+
+// modelMatches reports whether a model Ollama lists is the configured one,
+// which may leave out the :latest tag.
+func modelMatches(listed, configured string) bool {
+	return listed == configured || !strings.Contains(configured, ":") && listed == configured+":latest"
+}
+
+// runHealthcheck implements `llamanator healthcheck`, which exits non-zero
+// unless the server answers /healthz (or /readyz with -ready). Images without
+// curl, such as distroless ones, can use it as their health check.
+func runHealthcheck(args []string) error {
+	flags := flag.NewFlagSet("healthcheck", flag.ContinueOnError)
+	configPath := flags.String("config", envDefault(configPathEnv, "config.json"), "path to config.json, for the server address")
+	ready := flags.Bool("ready", false, "check /readyz instead of /healthz")
+	url := flags.String("url", "", "URL to check instead of the one config.json gives")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *url == "" {
+		config, err := loadConfig(*configPath)
+		if err != nil {
+			return fmt.Errorf("failed to load configuration: %w", err)
+		}
+		address := config.ServerAddress
+		if strings.HasPrefix(address, ":") {
+			address = "localhost" + address
+		}
+		*url = "http://" + address + "/healthz"
+		if *ready {
+			*url = "http://" + address + "/readyz"
+		}
+	}
+
+	client := &http.Client{Timeout: readyTimeout + 5*time.Second}
+	resp, err := client.Get(*url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", *url, resp.Status)
+	}
+	return nil
+}
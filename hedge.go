@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// HedgeConfig is a second backend that latency-sensitive templates (those with
+// hedge_after_ms set) fall back to when the primary is slow to respond.
+type HedgeConfig struct {
+	APIURL string `json:"api_url"`
+	APIKey string `json:"api_key"`
+	// AfterMS hedges requests that aren't made by a template, such as those
+	// from the Anthropic and Ollama APIs
+	AfterMS int `json:"after_ms"`
+}
+
+// after is how long requests that aren't made by a template wait for the
+// first token before also asking the hedge backend, or 0 for no hedging.
+func (h HedgeConfig) after() time.Duration {
+	if h.AfterMS <= 0 || h.APIURL == "" {
+		return 0
+	}
+	return time.Duration(h.AfterMS) * time.Millisecond
+}
+
+// hedgeAfter is how long the template waits for the first token from the
+// primary backend before also asking the hedge backend, or 0 for no hedging.
+func (tc *TemplateConfig) hedgeAfter(config *Config, templateName string) time.Duration {
+	settings, ok := tc.Settings[templateName]
+	if !ok || settings.HedgeAfterMS <= 0 || config.Hedge.APIURL == "" {
+		return 0
+	}
+	return time.Duration(settings.HedgeAfterMS) * time.Millisecond
+}
+
+// hedgeBackend is the config with the hedge backend in place of the primary.
+func hedgeBackend(config *Config) *Config {
+	backend := *config
+	backend.APIURL = config.Hedge.APIURL
+	backend.APIKey = config.Hedge.APIKey
+	return &backend
+}
+
+// backendURL is the URL of an API path, such as /api/chat, on a backend.
+// Generate requests go to api_url itself.
+func backendURL(backend *Config, path string) string {
+	if path == "/api/generate" {
+		return backend.APIURL
+	}
+	return ollamaEndpoint(backend, path)
+}
+
+// postOllamaHedged sends the request to the primary backend and, if no token has
+// arrived after 'after', to the hedge backend as well. Whichever produces a
+// token first is used and the other request is cancelled. A primary that fails
+// before producing a token is hedged straight away. With no hedging it is
+// postOllamaURL.
+func postOllamaHedged(ctx context.Context, config *Config, path string, ollamaRequest map[string]interface{}, onChunk func(string), after time.Duration) (map[string]interface{}, error) {
+	if after <= 0 {
+		return postOllamaURL(ctx, config, backendURL(config, path), ollamaRequest, onChunk)
+	}
+
+	// Tokens can only be seen as they arrive when streaming
+	request := make(map[string]interface{}, len(ollamaRequest))
+	for key, value := range ollamaRequest {
+		request[key] = value
+	}
+	request["stream"] = true
+
+	type result struct {
+		response map[string]interface{}
+		err      error
+		attempt  int
+	}
+	backends := []*Config{config, hedgeBackend(config)}
+	names := []string{"primary", "hedge"}
+	results := make(chan result, len(backends))
+	start := time.Now()
+
+	var mu sync.Mutex
+	winner := -1
+	cancels := make([]context.CancelFunc, len(backends))
+	stats := make([]*GenerationStats, len(backends))
+	started := make([]time.Time, len(backends))
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, cancel := range cancels {
+			if cancel != nil {
+				cancel()
+			}
+		}
+	}()
+
+	launch := func(attempt int) {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		// Each attempt has its own stats so they don't race; the winner's are kept
+		mu.Lock()
+		cancels[attempt] = cancel
+		stats[attempt] = &GenerationStats{}
+		started[attempt] = time.Now()
+		attemptCtx = withGenerationStats(attemptCtx, stats[attempt])
+		mu.Unlock()
+
+		backend := backends[attempt]
+		go func() {
+			response, err := postOllamaURL(attemptCtx, backend, backendURL(backend, path), request, func(chunk string) {
+				mu.Lock()
+				if winner < 0 {
+					winner = attempt
+					for other, cancel := range cancels {
+						if other != attempt && cancel != nil {
+							cancel()
+						}
+					}
+				}
+				won := winner == attempt
+				mu.Unlock()
+				if won && onChunk != nil {
+					onChunk(chunk)
+				}
+			})
+			results <- result{response: response, err: err, attempt: attempt}
+		}()
+	}
+
+	launch(0)
+	launched, finished := 1, 0
+	timer := time.NewTimer(after)
+	defer timer.Stop()
+	var firstErr error
+	for {
+		select {
+		case <-timer.C:
+			mu.Lock()
+			waiting := winner < 0
+			mu.Unlock()
+			if waiting && launched == 1 {
+				slog.Info("No token from the primary backend, hedging", "after", after, "url", config.Hedge.APIURL)
+				launch(1)
+				launched++
+			}
+
+		case res := <-results:
+			finished++
+			mu.Lock()
+			won := winner
+			mu.Unlock()
+			if res.err == nil && (won == res.attempt || won < 0) {
+				if won < 0 {
+					mu.Lock()
+					winner = res.attempt
+					mu.Unlock()
+				}
+				if res.attempt > 0 {
+					slog.Info("Hedged backend answered first", "backend", names[res.attempt])
+				}
+				if total := generationStats(ctx); total != nil {
+					*total = *stats[res.attempt]
+					if total.FirstToken > 0 {
+						total.FirstToken += started[res.attempt].Sub(start)
+					}
+				}
+				return res.response, nil
+			}
+			// Once tokens have been passed on the other backend can't take over
+			if won == res.attempt {
+				return nil, res.err
+			}
+			if firstErr == nil && !errors.Is(res.err, context.Canceled) {
+				firstErr = res.err
+			}
+			if res.attempt == 0 && launched == 1 && ctx.Err() == nil {
+				slog.Warn("Primary backend failed, hedging", "url", config.Hedge.APIURL, "error", res.err)
+				launch(1)
+				launched++
+			}
+			if finished == launched {
+				if firstErr == nil {
+					firstErr = res.err
+				}
+				return nil, firstErr
+			}
+		}
+	}
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Records kept when history.max_records isn't set
+const defaultHistoryMaxRecords = 10000
+
+// historyKeyEnv holds the history encryption key when it isn't set in config.json.
+const historyKeyEnv = "LLAMANATOR_HISTORY_KEY"
+
+// Encrypted history lines start with this prefix, followed by base64 of the
+// AES-GCM nonce and ciphertext.
+const encryptedRecordPrefix = "enc:v1:"
+
+// HistoryConfig enables recording of requests and responses to a JSONL file.
+// When a key is set (or LLAMANATOR_HISTORY_KEY) every record is encrypted.
+// Records older than retention_days, or beyond the newest max_records (10000
+// unless set, -1 for no limit), are purged hourly.
+type HistoryConfig struct {
+	Path          string `json:"path"`
+	Key           string `json:"key"`
+	RetentionDays int    `json:"retention_days"`
+	MaxRecords    int    `json:"max_records"`
+}
+
+// HistoryRecord is one generation: who asked what, and what the model answered.
+type HistoryRecord struct {
+	ID         string    `json:"id"`
+	Time       time.Time `json:"time"`
+	Source     string    `json:"source"`
+	Template   string    `json:"template"`
+	Model      string    `json:"model"`
+	Query      string    `json:"query"`
+	Response   string    `json:"response,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+	Context    HAContext `json:"context"`
+
+	FirstTokenMS     int64 `json:"first_token_ms,omitempty"`
+	PromptTokens     int   `json:"prompt_tokens,omitempty"`
+	CompletionTokens int   `json:"completion_tokens,omitempty"`
+	Truncated        bool  `json:"truncated,omitempty"`
+	Cached           bool  `json:"cached,omitempty"`
+	Coalesced        bool  `json:"coalesced,omitempty"`
+	Declined         bool  `json:"declined,omitempty"`
+}
+
+// History keeps the records in memory and appends new ones to disk. A nil
+// *History records nothing.
+type History struct {
+	path       string
+	aead       cipher.AEAD
+	retention  time.Duration
+	maxRecords int
+
+	mu      sync.Mutex
+	records []HistoryRecord
+}
+
+// loadHistory opens the history file, decrypting existing records. Plain text
+// records written before a key was configured are re-written encrypted.
+func loadHistory(config HistoryConfig) (*History, error) {
+	if config.Path == "" {
+		return nil, nil
+	}
+
+	history := &History{
+		path:       config.Path,
+		retention:  time.Duration(config.RetentionDays) * 24 * time.Hour,
+		maxRecords: config.MaxRecords,
+	}
+	switch {
+	case config.MaxRecords == 0:
+		history.maxRecords = defaultHistoryMaxRecords
+	case config.MaxRecords < 0:
+		history.maxRecords = 0
+	}
+	aead, err := historyCipher(config)
+	if err != nil {
+		return nil, err
+	}
+	history.aead = aead
+
+	data, err := os.ReadFile(config.Path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	plaintext := 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		if !strings.HasPrefix(text, encryptedRecordPrefix) {
+			plaintext++
+		}
+		record, err := history.decode(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", config.Path, line, err)
+		}
+		history.records = append(history.records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if history.aead != nil && plaintext > 0 {
+		slog.Info("Encrypting plain text history records", "count", plaintext, "path", config.Path)
+		if err := history.rewrite(); err != nil {
+			return nil, fmt.Errorf("failed to encrypt history: %w", err)
+		}
+	}
+
+	if history.retention > 0 || history.maxRecords > 0 {
+		history.applyRetention()
+		go func() {
+			for range time.Tick(time.Hour) {
+				history.applyRetention()
+			}
+		}()
+	}
+	return history, nil
+}
+
+// applyRetention purges records past the retention period or record limit.
+func (h *History) applyRetention() {
+	h.mu.Lock()
+	keepFrom := 0
+	if h.maxRecords > 0 && len(h.records) > h.maxRecords {
+		keepFrom = len(h.records) - h.maxRecords
+	}
+	cutoff := time.Now().Add(-h.retention)
+	h.mu.Unlock()
+
+	deleted, err := h.purge(func(i int, record HistoryRecord) bool {
+		return i < keepFrom || (h.retention > 0 && record.Time.Before(cutoff))
+	})
+	if err != nil {
+		slog.Error("Failed to apply history retention", "error", err)
+	} else if deleted > 0 {
+		slog.Info("Purged history records past the retention policy", "count", deleted)
+	}
+}
+
+// purge deletes the records matching remove and rewrites the history file.
+func (h *History) purge(remove func(i int, record HistoryRecord) bool) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	kept := h.records[:0:0]
+	for i, record := range h.records {
+		if !remove(i, record) {
+			kept = append(kept, record)
+		}
+	}
+	deleted := len(h.records) - len(kept)
+	if deleted == 0 {
+		return 0, nil
+	}
+
+	previous := h.records
+	h.records = kept
+	if err := h.rewrite(); err != nil {
+		h.records = previous
+		return 0, err
+	}
+	return deleted, nil
+}
+
+// historyCipher is the cipher for the history key, which also encrypts the
+// saved conversations and response cache. It's nil without a key.
+func historyCipher(config HistoryConfig) (cipher.AEAD, error) {
+	key := config.Key
+	if key == "" {
+		key = os.Getenv(historyKeyEnv)
+	}
+	if key == "" {
+		return nil, nil
+	}
+	return newHistoryCipher(key)
+}
+
+func newHistoryCipher(key string) (cipher.AEAD, error) {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(raw) != 32 {
+		return nil, fmt.Errorf("history key must be 32 bytes, base64 encoded")
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (h *History) encode(record HistoryRecord) (string, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return "", err
+	}
+	if h.aead == nil {
+		return string(data), nil
+	}
+	return seal(h.aead, data)
+}
+
+func (h *History) decode(line string) (HistoryRecord, error) {
+	var record HistoryRecord
+	data, err := unseal(h.aead, line)
+	if err != nil {
+		return record, err
+	}
+	err = json.Unmarshal(data, &record)
+	return record, err
+}
+
+// seal encrypts data with a fresh nonce, as encryptedRecordPrefix followed by
+// base64.
+func seal(aead cipher.AEAD, data []byte) (string, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, data, nil)
+	return encryptedRecordPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// unseal decrypts text written by seal. Text without encryptedRecordPrefix is
+// plain, and returned as it is.
+func unseal(aead cipher.AEAD, text string) ([]byte, error) {
+	encoded, ok := strings.CutPrefix(text, encryptedRecordPrefix)
+	if !ok {
+		return []byte(text), nil
+	}
+	if aead == nil {
+		return nil, fmt.Errorf("data is encrypted but no history key is configured")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("invalid encrypted data")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	data, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt, is the history key correct?")
+	}
+	return data, nil
+}
+
+// rewrite replaces the history file with the records in memory. Callers other
+// than loadHistory must hold h.mu.
+func (h *History) rewrite() error {
+	var buf bytes.Buffer
+	for _, record := range h.records {
+		line, err := h.encode(record)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(line + "\n")
+	}
+
+	tmp := h.path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.path)
+}
+
+// record stores a finished generation. Failures are logged, never returned, so
+// history problems can't break requests.
+func (h *History) record(record HistoryRecord) {
+	if h == nil {
+		return
+	}
+	if record.ID == "" {
+		record.ID = newJobID()
+	}
+
+	line, err := h.encode(record)
+	if err != nil {
+		slog.Error("Failed to encode history record", "error", err)
+		return
+	}
+
+	h.mu.Lock()
+	h.records = append(h.records, record)
+	h.appendLine(line)
+	// Records beyond max_records are purged in batches, which keeps memory
+	// bounded between the hourly purges
+	over := h.maxRecords > 0 && len(h.records) >= h.maxRecords+h.maxRecords/10+1
+	h.mu.Unlock()
+	if over {
+		h.applyRetention()
+	}
+}
+
+// appendLine appends an encoded record to the history file. The caller holds
+// the lock.
+func (h *History) appendLine(line string) {
+	file, err := os.OpenFile(h.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		slog.Error("Failed to write history", "error", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.WriteString(line + "\n"); err != nil {
+		slog.Error("Failed to write history", "error", err)
+	}
+}
+
+// newestFirst returns a copy of the records, newest first.
+func (h *History) newestFirst() []HistoryRecord {
+	records := []HistoryRecord{}
+	if h == nil {
+		return records
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := len(h.records) - 1; i >= 0; i-- {
+		records = append(records, h.records[i])
+	}
+	return records
+}
+
+// recordGeneration adds a history record for a generation that started at
+// start, including the upstream metrics attached to ctx, tracks its latency and
+// logs it.
+func recordGeneration(ctx context.Context, config *Config, history *History, source, templateName string, data TemplateData, model string, haContext HAContext, start time.Time, filteredResponse map[string]interface{}, err error) {
+	// Rate limited requests never reached the model, and a storm of them would
+	// crowd everything else out of the history
+	var limited *rateLimitError
+	if errors.As(err, &limited) {
+		config.metrics.record(source, templateName, model, haContext.Origin, "rate_limited", nil, 0)
+		return
+	}
+	reportGeneration(ctx, err)
+	record := HistoryRecord{
+		Time:       start,
+		Source:     source,
+		Template:   templateName,
+		Model:      model,
+		Query:      data.Query,
+		DurationMS: time.Since(start).Milliseconds(),
+		Context:    haContext,
+	}
+	if err != nil {
+		record.Error = err.Error()
+	} else {
+		record.Response, _ = filteredResponse["response"].(string)
+	}
+	var firstToken time.Duration
+	if stats := generationStats(ctx); stats != nil {
+		firstToken = stats.FirstToken
+		record.FirstTokenMS = stats.FirstToken.Milliseconds()
+		record.PromptTokens = stats.PromptTokens
+		record.CompletionTokens = stats.CompletionTokens
+		record.Truncated = stats.Truncated()
+		record.Cached = stats.Cached
+		record.Coalesced = stats.Coalesced
+		record.Declined = stats.Declined
+	}
+	// Cached and shared responses say nothing about how fast the model is
+	if record.Cached {
+		config.metrics.record(source, templateName, model, haContext.Origin, "cached", nil, 0)
+	} else if record.Coalesced && err == nil {
+		config.metrics.record(source, templateName, model, haContext.Origin, "coalesced", nil, 0)
+	} else if err == nil {
+		config.latency.record(templateName, firstToken, time.Since(start))
+		config.metrics.record(source, templateName, model, haContext.Origin, "ok", generationStats(ctx), time.Since(start))
+	} else {
+		config.metrics.record(source, templateName, model, haContext.Origin, "error", nil, 0)
+	}
+	history.record(record)
+
+	attrs := []any{
+		"request_id", requestID(ctx),
+		"source", source,
+		"template", templateName,
+		"model", model,
+		"duration_ms", record.DurationMS,
+		"first_token_ms", record.FirstTokenMS,
+		"prompt_tokens", record.PromptTokens,
+		"completion_tokens", record.CompletionTokens,
+		"cached", record.Cached,
+	}
+	if record.Coalesced {
+		attrs = append(attrs, "coalesced", true)
+	}
+	if record.Declined {
+		attrs = append(attrs, "declined", true)
+	}
+	attrs = append(attrs, haContext.logAttrs()...)
+	if err != nil {
+		slog.Warn("Generation failed", append(attrs, "error", err)...)
+	} else {
+		slog.Info("Generation", attrs...)
+	}
+}
+
+// historyHandler serves GET /admin/history?template=&limit= and
+// DELETE /admin/history to purge records.
+func historyHandler(history *History) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if history == nil {
+			http.Error(w, "History is not enabled", http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodDelete:
+			purgeHistory(history, w, r)
+			return
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		query, err := parseListQuery(r, 50, "origin")
+		if err != nil {
+			writeListError(w, err)
+			return
+		}
+		if origins := r.URL.Query()["origin"]; len(origins) > 0 {
+			query.Filters["context.origin"] = origins
+		}
+		records, err := applyListQuery(w, query, history.newestFirst())
+		if err != nil {
+			writeListError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, records)
+	}
+}
+
+// purgeHistory deletes records matching every given filter: 'id', 'template' and
+// 'before' (a date or RFC 3339 time). Without filters 'all=true' is required so
+// the whole history isn't wiped by accident.
+func purgeHistory(history *History, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	id, templateName := query.Get("id"), query.Get("template")
+
+	var before time.Time
+	if value := query.Get("before"); value != "" {
+		var err error
+		if before, err = time.Parse(time.RFC3339, value); err != nil {
+			if before, err = time.ParseInLocation("2006-01-02", value, time.Local); err != nil {
+				http.Error(w, "before must be a date (YYYY-MM-DD) or RFC 3339 time", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	if id == "" && templateName == "" && before.IsZero() && query.Get("all") != "true" {
+		http.Error(w, "Specify id, template or before, or all=true to purge everything", http.StatusBadRequest)
+		return
+	}
+
+	deleted, err := history.purge(func(_ int, record HistoryRecord) bool {
+		return (id == "" || record.ID == id) &&
+			(templateName == "" || record.Template == templateName) &&
+			(before.IsZero() || record.Time.Before(before))
+	})
+	if err != nil {
+		slog.Error("Failed to purge history", "error", err)
+		http.Error(w, "Failed to purge history", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Purged history records", "count", deleted, "remote_addr", r.RemoteAddr)
+	writeJSON(w, http.StatusOK, map[string]int{"deleted": deleted})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Formats of a history export
+const (
+	exportRecords = "jsonl"
+	exportChat    = "chat"
+)
+
+// ChatExample is one history record as a chat fine-tuning example, in the
+// messages format most fine-tuning tools read.
+type ChatExample struct {
+	Messages []ChatMessage `json:"messages"`
+}
+
+// writeHistoryExport writes records as JSON lines. The jsonl format writes
+// every record whole, and chat writes a fine-tuning example for each answered
+// one, leaving out errors, refusals and empty answers.
+func writeHistoryExport(w io.Writer, records []HistoryRecord, format string) error {
+	encoder := json.NewEncoder(w)
+	for _, record := range records {
+		var line interface{} = record
+		if format == exportChat {
+			if record.Error != "" || record.Declined || strings.TrimSpace(record.Response) == "" {
+				continue
+			}
+			line = ChatExample{Messages: []ChatMessage{
+				{Role: "user", Content: record.Query},
+				{Role: "assistant", Content: record.Response},
+			}}
+		}
+		if err := encoder.Encode(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkExportFormat reports an unknown export format.
+func checkExportFormat(format string) error {
+	if format != exportRecords && format != exportChat {
+		return fmt.Errorf("unknown format '%s', use %s or %s", format, exportRecords, exportChat)
+	}
+	return nil
+}
+
+// oldestFirst returns a copy of the records, oldest first.
+func (h *History) oldestFirst() []HistoryRecord {
+	if h == nil {
+		return []HistoryRecord{}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return slices.Clone(h.records)
+}
+
+// historyExportHandler serves GET /admin/history/export?format=jsonl|chat,
+// streaming the whole history oldest first. It takes the same filters as
+// /admin/history, but isn't limited unless asked.
+func historyExportHandler(history *History) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if history == nil {
+			http.Error(w, "History is not enabled", http.StatusNotFound)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = exportRecords
+		}
+		if err := checkExportFormat(format); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		query, err := parseListQuery(r, 0, "origin", "format")
+		if err != nil {
+			writeListError(w, err)
+			return
+		}
+		if origins := r.URL.Query()["origin"]; len(origins) > 0 {
+			query.Filters["context.origin"] = origins
+		}
+		records, err := applyListQuery(w, query, history.oldestFirst())
+		if err != nil {
+			writeListError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", ndjsonType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="history-%s.jsonl"`, format))
+		if err := writeHistoryExport(w, records, format); err != nil {
+			slog.Error("Failed to export history", "error", err)
+		}
+	}
+}
+
+// runExportHistory implements `llamanator export-history`, writing the history
+// records, or fine-tuning examples made from them, as JSON lines.
+func runExportHistory(args []string) error {
+	flags := flag.NewFlagSet("export-history", flag.ContinueOnError)
+	configPath := flags.String("config", envDefault(configPathEnv, "config.json"), "path to config.json")
+	fromText := flags.String("from", "", "first day to include, YYYY-MM-DD (default the oldest record)")
+	toText := flags.String("to", "", "last day to include, YYYY-MM-DD (default the newest record)")
+	templateName := flags.String("template", "", "only export records of this template")
+	format := flags.String("format", exportRecords, "output format, jsonl for whole records or chat for fine-tuning examples")
+	output := flags.String("output", "", "file to write (default stdout)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := checkExportFormat(*format); err != nil {
+		return err
+	}
+	from, to, err := parseDays(*fromText, *toText, time.Time{}, time.Time{})
+	if err != nil {
+		return err
+	}
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+	history, err := loadHistory(config.History)
+	if err != nil {
+		return fmt.Errorf("failed to load history: %w", err)
+	}
+	if history == nil {
+		return fmt.Errorf("history is not enabled, set history.path in %s", *configPath)
+	}
+
+	var records []HistoryRecord
+	for _, record := range history.oldestFirst() {
+		if (!from.IsZero() && record.Time.Before(from)) ||
+			(!to.IsZero() && !record.Time.Before(to.AddDate(0, 0, 1))) ||
+			(*templateName != "" && record.Template != *templateName) {
+			continue
+		}
+		records = append(records, record)
+	}
+
+	w := io.Writer(os.Stdout)
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	return writeHistoryExport(w, records, *format)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testHistoryKey  = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	otherHistoryKey = "ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA="
+)
+
+func testCipher(t *testing.T, key string) cipher.AEAD {
+	t.Helper()
+	aead, err := newHistoryCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead
+}
+
+func TestSealUnseal(t *testing.T) {
+	aead := testCipher(t, testHistoryKey)
+	sealed, err := seal(aead, []byte(`{"query":"unlock the door"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sealed, encryptedRecordPrefix) || strings.Contains(sealed, "unlock") {
+		t.Fatalf("sealed = %q, want encrypted text", sealed)
+	}
+
+	tests := []struct {
+		name    string
+		aead    cipher.AEAD
+		text    string
+		want    string
+		wantErr string
+	}{
+		{"round trip", aead, sealed, `{"query":"unlock the door"}`, ""},
+		{"trailing newline", aead, sealed + "\n", `{"query":"unlock the door"}`, ""},
+		{"plain text passes through", aead, `{"a":1}`, `{"a":1}`, ""},
+		{"plain text without a key", nil, `{"a":1}`, `{"a":1}`, ""},
+		{"encrypted without a key", nil, sealed, "", "no history key"},
+		{"wrong key", testCipher(t, otherHistoryKey), sealed, "", "is the history key correct"},
+		{"corrupt", aead, encryptedRecordPrefix + "!!", "", "invalid encrypted data"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := unseal(tt.aead, tt.text)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("unseal() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || string(got) != tt.want {
+				t.Fatalf("unseal() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestHistoryCipher(t *testing.T) {
+	t.Setenv(historyKeyEnv, "")
+	tests := []struct {
+		name    string
+		config  HistoryConfig
+		env     string
+		wantNil bool
+		wantErr bool
+	}{
+		{"no key", HistoryConfig{}, "", true, false},
+		{"config key", HistoryConfig{Key: testHistoryKey}, "", false, false},
+		{"environment key", HistoryConfig{}, testHistoryKey, false, false},
+		{"short key", HistoryConfig{Key: "c2hvcnQ="}, "", true, true},
+		{"not base64", HistoryConfig{Key: "not base64!"}, "", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(historyKeyEnv, tt.env)
+			aead, err := historyCipher(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("historyCipher() error = %v, want error: %v", err, tt.wantErr)
+			}
+			if (aead == nil) != tt.wantNil {
+				t.Fatalf("historyCipher() = %v, want nil: %v", aead, tt.wantNil)
+			}
+		})
+	}
+}
+
+func TestMemoryPersistEncrypted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conversations.json")
+	config := MemoryConfig{Enabled: true}
+	config.parse()
+	aead := testCipher(t, testHistoryKey)
+
+	memory := newMemory()
+	if err := memory.persist(path, config, aead); err != nil {
+		t.Fatal(err)
+	}
+	memory.remember("default", "kitchen", "is the oven on?", "No.", config)
+	if err := memory.save(path); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+	if !bytes.HasPrefix(data, []byte(encryptedRecordPrefix)) || bytes.Contains(data, []byte("oven")) {
+		t.Fatalf("saved conversations aren't encrypted: %q", data)
+	}
+
+	reloaded := newMemory()
+	if err := reloaded.persist(path, config, aead); err != nil {
+		t.Fatal(err)
+	}
+	if got := reloaded.recall("default", "kitchen", config); len(got) != 2 || got[0].Content != "is the oven on?" {
+		t.Fatalf("recall() = %v", got)
+	}
+	if err := newMemory().persist(path, config, nil); err == nil {
+		t.Fatal("persist() without the key read encrypted conversations")
+	}
+}
+
+func TestMemoryPersistEncryptsPlainFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conversations.json")
+	updated := time.Now().Format(time.RFC3339Nano)
+	os.WriteFile(path, []byte(`{"kitchen":{"messages":[{"role":"user","content":"hi"}],"updated":"`+updated+`"}}`), 0o600)
+	config := MemoryConfig{Enabled: true}
+	config.parse()
+
+	memory := newMemory()
+	if err := memory.persist(path, config, testCipher(t, testHistoryKey)); err != nil {
+		t.Fatal(err)
+	}
+	if err := memory.save(path); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+	if !bytes.HasPrefix(data, []byte(encryptedRecordPrefix)) {
+		t.Fatalf("plain text conversations weren't encrypted: %q", data)
+	}
+}
+
+func TestResponseCachePersistEncrypted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	aead := testCipher(t, testHistoryKey)
+
+	cache := newResponseCache()
+	if err := cache.persist(path, aead); err != nil {
+		t.Fatal(err)
+	}
+	cache.put("key", map[string]interface{}{"response": "the garage is open"}, time.Hour, 10)
+	if err := cache.save(path); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+	if !bytes.HasPrefix(data, []byte(encryptedRecordPrefix)) || bytes.Contains(data, []byte("garage")) {
+		t.Fatalf("saved cache isn't encrypted: %q", data)
+	}
+
+	reloaded := newResponseCache()
+	if err := reloaded.persist(path, aead); err != nil {
+		t.Fatal(err)
+	}
+	if response, ok := reloaded.get("key"); !ok || response["response"] != "the garage is open" {
+		t.Fatalf("get() = %v, %v", response, ok)
+	}
+}
+
+func TestLoadHistoryEncryptsPlainRecords(t *testing.T) {
+	t.Setenv(historyKeyEnv, "")
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	os.WriteFile(path, []byte(`{"id":"1","template":"default","query":"is the door locked?"}`+"\n"), 0o600)
+
+	history, err := loadHistory(HistoryConfig{Path: path, Key: testHistoryKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history.records) != 1 || history.records[0].Query != "is the door locked?" {
+		t.Fatalf("records = %v", history.records)
+	}
+	data, _ := os.ReadFile(path)
+	if !bytes.HasPrefix(data, []byte(encryptedRecordPrefix)) || bytes.Contains(data, []byte("door")) {
+		t.Fatalf("history wasn't encrypted: %q", data)
+	}
+
+	if _, err := loadHistory(HistoryConfig{Path: path}); err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Fatalf("loadHistory() without the key = %v, want an error for line 1", err)
+	}
+	reloaded, err := loadHistory(HistoryConfig{Path: path, Key: testHistoryKey})
+	if err != nil || len(reloaded.records) != 1 {
+		t.Fatalf("loadHistory() = %v, %v", reloaded, err)
+	}
+}
+
+func TestHistoryMaxRecords(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxRecords int
+		records    int
+		wantMax    int
+		wantKept   int
+	}{
+		{"default", 0, 5, defaultHistoryMaxRecords, 5},
+		{"within slack", 10, 11, 10, 11},
+		{"trimmed past slack", 10, 12, 10, 10},
+		{"no limit", -1, 30, 0, 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "history.jsonl")
+			history, err := loadHistory(HistoryConfig{Path: path, MaxRecords: tt.maxRecords})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if history.maxRecords != tt.wantMax {
+				t.Errorf("maxRecords = %d, want %d", history.maxRecords, tt.wantMax)
+			}
+			for i := 0; i < tt.records; i++ {
+				history.record(HistoryRecord{Query: string(rune('a' + i%26))})
+			}
+			if kept := len(history.newestFirst()); kept != tt.wantKept {
+				t.Errorf("kept %d records, want %d", kept, tt.wantKept)
+			}
+
+			reloaded, err := loadHistory(HistoryConfig{Path: path, MaxRecords: -1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kept := len(reloaded.newestFirst()); kept != tt.wantKept {
+				t.Errorf("file has %d records, want %d", kept, tt.wantKept)
+			}
+		})
+	}
+}
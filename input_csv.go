@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Table is a bounded, structured view of CSV/TSV input passed to templates.
+type Table struct {
+	Columns   []string
+	Rows      [][]string
+	TotalRows int
+	Truncated bool
+	Stats     []ColumnStats
+}
+
+// ColumnStats summarises a numeric column across all rows, not just the kept ones.
+type ColumnStats struct {
+	Column string
+	Count  int
+	Min    float64
+	Max    float64
+	Mean   float64
+}
+
+// TableText renders the kept rows as pipe separated lines with a header.
+func (d TemplateData) TableText() string {
+	if d.Table == nil {
+		return ""
+	}
+
+	var buf strings.Builder
+	buf.WriteString(strings.Join(d.Table.Columns, " | "))
+	buf.WriteString("\n")
+	for _, row := range d.Table.Rows {
+		buf.WriteString(strings.Join(row, " | "))
+		buf.WriteString("\n")
+	}
+	if d.Table.Truncated {
+		fmt.Fprintf(&buf, "(showing %d of %d rows)\n", len(d.Table.Rows), d.Table.TotalRows)
+	}
+	return buf.String()
+}
+
+// TableSummary renders the row count and numeric column statistics.
+func (d TemplateData) TableSummary() string {
+	if d.Table == nil {
+		return ""
+	}
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "%d rows, columns: %s\n", d.Table.TotalRows, strings.Join(d.Table.Columns, ", "))
+	for _, stats := range d.Table.Stats {
+		fmt.Fprintf(&buf, "%s: min %s, max %s, mean %s\n", stats.Column,
+			formatStat(stats.Min), formatStat(stats.Max), formatStat(stats.Mean))
+	}
+	return buf.String()
+}
+
+func formatStat(value float64) string {
+	return strconv.FormatFloat(math.Round(value*100)/100, 'f', -1, 64)
+}
+
+// addTableInput parses a 'csv' (or 'tsv') payload, keeping only the selected
+// 'csv_columns' and at most 'csv_max_rows' rows.
+func addTableInput(config *Config, request map[string]interface{}, data *TemplateData) error {
+	delimiter := ','
+	payload, _ := request["csv"].(string)
+	if tsv, ok := request["tsv"].(string); ok && tsv != "" {
+		payload, delimiter = tsv, '\t'
+	}
+	if payload == "" {
+		return nil
+	}
+	if d, ok := request["csv_delimiter"].(string); ok && len([]rune(d)) == 1 {
+		delimiter = []rune(d)[0]
+	}
+
+	reader := csv.NewReader(strings.NewReader(payload))
+	reader.Comma = delimiter
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return badInput("Invalid CSV: %v", err)
+	}
+	if len(records) == 0 {
+		return badInput("Invalid CSV: no header row")
+	}
+
+	header := records[0]
+	indexes := make([]int, 0, len(header))
+	if columns, ok := request["csv_columns"].([]interface{}); ok && len(columns) > 0 {
+		for _, column := range columns {
+			name, _ := column.(string)
+			index := -1
+			for i, h := range header {
+				if strings.EqualFold(strings.TrimSpace(h), strings.TrimSpace(name)) {
+					index = i
+					break
+				}
+			}
+			if index < 0 {
+				return badInput("Unknown CSV column '%v'", column)
+			}
+			indexes = append(indexes, index)
+		}
+	} else {
+		for i := range header {
+			indexes = append(indexes, i)
+		}
+	}
+
+	maxRows := config.Inputs.MaxCSVRows
+	if maxRows <= 0 {
+		maxRows = 100
+	}
+	if requested := requestInt(request, "csv_max_rows", maxRows); requested < maxRows {
+		maxRows = requested
+	}
+
+	table := &Table{TotalRows: len(records) - 1}
+	for _, index := range indexes {
+		table.Columns = append(table.Columns, header[index])
+	}
+
+	stats := make([]ColumnStats, len(indexes))
+	numeric := make([]bool, len(indexes))
+	for i := range numeric {
+		numeric[i] = true
+		stats[i].Column = header[indexes[i]]
+	}
+
+	for _, record := range records[1:] {
+		row := make([]string, len(indexes))
+		for i, index := range indexes {
+			if index < len(record) {
+				row[i] = record[index]
+			}
+			collectStat(&stats[i], &numeric[i], row[i])
+		}
+		if len(table.Rows) < maxRows {
+			table.Rows = append(table.Rows, row)
+		}
+	}
+	table.Truncated = len(table.Rows) < table.TotalRows
+
+	for i := range stats {
+		if numeric[i] && stats[i].Count > 0 {
+			stats[i].Mean /= float64(stats[i].Count)
+			table.Stats = append(table.Stats, stats[i])
+		}
+	}
+
+	data.Table = table
+	return nil
+}
+
+// collectStat accumulates numeric statistics, marking the column as non-numeric
+// as soon as a value fails to parse. Empty cells are ignored.
+func collectStat(stats *ColumnStats, numeric *bool, value string) {
+	if !*numeric || strings.TrimSpace(value) == "" {
+		return
+	}
+	number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		*numeric = false
+		return
+	}
+	if stats.Count == 0 || number < stats.Min {
+		stats.Min = number
+	}
+	if stats.Count == 0 || number > stats.Max {
+		stats.Max = number
+	}
+	stats.Mean += number
+	stats.Count++
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Document is the text extracted from an uploaded PDF, Word or plain text file.
+type Document struct {
+	Text      string
+	Pages     int
+	Truncated bool
+}
+
+// Most a document's compressed parts may expand to, so a small upload can't
+// decompress to gigabytes
+const maxDocumentExpansion = 64 << 20
+
+var errDocumentTooLarge = fmt.Errorf("document expands to more than %d MB", maxDocumentExpansion>>20)
+
+// expansionLimit reads at most left bytes of decompressed data, failing with
+// errDocumentTooLarge beyond them rather than stopping quietly.
+type expansionLimit struct {
+	r    io.Reader
+	left int64
+}
+
+func (l *expansionLimit) Read(p []byte) (int, error) {
+	if l.left < 0 {
+		return 0, errDocumentTooLarge
+	}
+	if int64(len(p)) > l.left+1 {
+		p = p[:l.left+1]
+	}
+	n, err := l.r.Read(p)
+	l.left -= int64(n)
+	if l.left < 0 {
+		return n - 1, errDocumentTooLarge
+	}
+	return n, err
+}
+
+// addDocumentInput decodes a base64 'document', extracts its text and keeps the
+// requested 'pages' (e.g. "1-3,5").
+func addDocumentInput(config *Config, request map[string]interface{}, data *TemplateData) error {
+	encoded, _ := request["document"].(string)
+	if encoded == "" {
+		return nil
+	}
+	if !config.Flags.Enabled(flagDocuments) {
+		return badInput("Document inputs are disabled")
+	}
+
+	maxBytes := config.Inputs.MaxDocumentBytes
+	if maxBytes <= 0 {
+		maxBytes = 10 << 20
+	}
+	if int64(base64.StdEncoding.DecodedLen(len(encoded))) > maxBytes {
+		return badInput("Document exceeds the %d byte limit", maxBytes)
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return badInput("Document must be base64 encoded: %v", err)
+	}
+
+	documentType, _ := request["document_type"].(string)
+	if documentType == "" {
+		documentType = detectDocumentType(raw)
+	}
+
+	var pages []string
+	switch strings.ToLower(documentType) {
+	case "pdf", "application/pdf":
+		pages, err = extractPDFPages(raw)
+	case "docx", "application/vnd.openxmlformats-officedocument.wordprocessingml.document":
+		pages, err = extractDocxPages(raw)
+	case "text", "txt", "text/plain", "markdown", "md":
+		if !utf8.Valid(raw) {
+			return badInput("Text documents must be UTF-8")
+		}
+		pages = strings.Split(string(raw), "\f")
+	default:
+		return badInput("Unsupported document type '%s'", documentType)
+	}
+	if err != nil {
+		return badInput("Failed to extract text from document: %v", err)
+	}
+
+	if pageRange, ok := request["pages"].(string); ok && pageRange != "" {
+		pages, err = selectPages(pages, pageRange)
+		if err != nil {
+			return badInput("Invalid page range: %v", err)
+		}
+	}
+
+	maxChars := config.Inputs.MaxDocumentChars
+	if maxChars <= 0 {
+		maxChars = 20000
+	}
+
+	document := &Document{Pages: len(pages), Text: strings.TrimSpace(strings.Join(pages, "\n\n"))}
+	if runes := []rune(document.Text); len(runes) > maxChars {
+		document.Text = string(runes[:maxChars]) + "\n[...truncated]"
+		document.Truncated = true
+	}
+
+	data.Document = document
+	return nil
+}
+
+func detectDocumentType(raw []byte) string {
+	switch contentType := http.DetectContentType(raw); {
+	case contentType == "application/pdf":
+		return "pdf"
+	case contentType == "application/zip":
+		return "docx"
+	case strings.HasPrefix(contentType, "text/plain"):
+		return "text"
+	default:
+		return contentType
+	}
+}
+
+// selectPages keeps the 1-indexed pages listed in a range such as "1-3,5".
+func selectPages(pages []string, pageRange string) ([]string, error) {
+	var selected []string
+	for _, part := range strings.Split(pageRange, ",") {
+		part = strings.TrimSpace(part)
+		startText, endText, isRange := strings.Cut(part, "-")
+
+		start, err := strconv.Atoi(strings.TrimSpace(startText))
+		if err != nil || start < 1 {
+			return nil, fmt.Errorf("'%s' is not a valid page", part)
+		}
+		end := start
+		if isRange {
+			if strings.TrimSpace(endText) == "" {
+				end = len(pages)
+			} else if end, err = strconv.Atoi(strings.TrimSpace(endText)); err != nil || end < start {
+				return nil, fmt.Errorf("'%s' is not a valid page range", part)
+			}
+		}
+
+		for page := start; page <= end && page <= len(pages); page++ {
+			selected = append(selected, pages[page-1])
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no pages in range, the document has %d", len(pages))
+	}
+	return selected, nil
+}
+
+// extractDocxPages reads the text of a Word document, splitting pages on explicit
+// and last-rendered page breaks.
+func extractDocxPages(raw []byte) ([]string, error) {
+	archive, err := zip.NewReader(bytes.NewReader(raw), int64(len(raw)))
+	if err != nil {
+		return nil, err
+	}
+
+	var documentXML io.ReadCloser
+	for _, file := range archive.File {
+		if file.Name == "word/document.xml" {
+			documentXML, err = file.Open()
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	if documentXML == nil {
+		return nil, fmt.Errorf("word/document.xml not found, is this a .docx file?")
+	}
+	defer documentXML.Close()
+
+	var pages []string
+	var page strings.Builder
+	inText := false
+
+	// Word often records a rendered break right after an explicit one, so empty
+	// pages are never started
+	breakPage := func() {
+		if text := strings.TrimSpace(page.String()); text != "" {
+			pages = append(pages, text)
+			page.Reset()
+		}
+	}
+
+	decoder := xml.NewDecoder(&expansionLimit{r: documentXML, left: maxDocumentExpansion})
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "t":
+				inText = true
+			case "tab":
+				page.WriteString("\t")
+			case "br":
+				isPageBreak := false
+				for _, attr := range t.Attr {
+					if attr.Name.Local == "type" && attr.Value == "page" {
+						isPageBreak = true
+					}
+				}
+				if isPageBreak {
+					breakPage()
+				} else {
+					page.WriteString("\n")
+				}
+			case "lastRenderedPageBreak":
+				breakPage()
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "t":
+				inText = false
+			case "p":
+				page.WriteString("\n")
+			}
+		case xml.CharData:
+			if inText {
+				page.Write(t)
+			}
+		}
+	}
+	breakPage()
+
+	if len(pages) == 0 {
+		return nil, fmt.Errorf("document contains no text")
+	}
+	return pages, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// buildDocx zips document.xml up as a Word document.
+func buildDocx(t *testing.T, documentXML string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	file, err := archive.Create("word/document.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte(documentXML))
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractDocxPages(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "one paragraph",
+			body: `<w:p><w:r><w:t>Hello</w:t></w:r></w:p>`,
+			want: []string{"Hello"},
+		},
+		{
+			name: "explicit page break",
+			body: `<w:p><w:r><w:t>One</w:t></w:r></w:p><w:p><w:r><w:br w:type="page"/><w:t>Two</w:t></w:r></w:p>`,
+			want: []string{"One", "Two"},
+		},
+		{
+			name: "line break and tab",
+			body: `<w:p><w:r><w:t>a</w:t><w:tab/><w:t>b</w:t><w:br/><w:t>c</w:t></w:r></w:p>`,
+			want: []string{"a\tb\nc"},
+		},
+		{
+			name:    "no text",
+			body:    `<w:p></w:p>`,
+			wantErr: "no text",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docx := buildDocx(t, `<w:document xmlns:w="w"><w:body>`+tt.body+`</w:body></w:document>`)
+			pages, err := extractDocxPages(docx)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("extractDocxPages() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("extractDocxPages() error = %v", err)
+			}
+			if strings.Join(pages, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("pages = %q, want %q", pages, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractDocxPagesDecompressionBomb(t *testing.T) {
+	filler := strings.Repeat(" ", maxDocumentExpansion)
+	docx := buildDocx(t, `<w:document xmlns:w="w"><w:body>`+filler+`</w:body></w:document>`)
+	if _, err := extractDocxPages(docx); !errors.Is(err, errDocumentTooLarge) {
+		t.Fatalf("extractDocxPages() error = %v, want errDocumentTooLarge", err)
+	}
+}
+
+func TestSelectPages(t *testing.T) {
+	pages := []string{"1", "2", "3", "4", "5"}
+	tests := []struct {
+		pageRange string
+		want      string
+		wantErr   bool
+	}{
+		{"2", "2", false},
+		{"1-3,5", "1,2,3,5", false},
+		{"4-9", "4,5", false},
+		{"9", "", true},
+		{"x", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pageRange, func(t *testing.T) {
+			got, err := selectPages(pages, tt.pageRange)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("selectPages(%q) error = %v, want error: %v", tt.pageRange, err, tt.wantErr)
+			}
+			if err == nil && strings.Join(got, ",") != tt.want {
+				t.Errorf("selectPages(%q) = %q, want %s", tt.pageRange, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,606 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CalendarEvent is a compact representation of a VEVENT passed to templates.
+type CalendarEvent struct {
+	Summary     string
+	Location    string
+	Description string
+	Start       time.Time
+	End         time.Time
+	AllDay      bool
+
+	uid  string
+	rule *recurrence
+	// utc marks a start given in UTC, which recurs at the same UTC time
+	utc          bool
+	exdates      []icsDate
+	rdates       []time.Time
+	recurrenceID time.Time
+}
+
+func (e CalendarEvent) String() string {
+	var when string
+	switch {
+	case e.AllDay:
+		when = e.Start.Format("Mon 2 Jan") + " (all day)"
+	case e.End.IsZero():
+		when = e.Start.Format("Mon 2 Jan 15:04")
+	case e.End.YearDay() == e.Start.YearDay() && e.End.Year() == e.Start.Year():
+		when = e.Start.Format("Mon 2 Jan 15:04") + "-" + e.End.Format("15:04")
+	default:
+		when = e.Start.Format("Mon 2 Jan 15:04") + " - " + e.End.Format("Mon 2 Jan 15:04")
+	}
+
+	line := when + ": " + e.Summary
+	if e.Location != "" {
+		line += " @ " + e.Location
+	}
+	return line
+}
+
+// EventList renders the calendar events one per line for use in prompts.
+func (d TemplateData) EventList() string {
+	lines := make([]string, len(d.Events))
+	for i, event := range d.Events {
+		lines[i] = "- " + event.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// addCalendarInput parses an 'ics' payload or fetches 'calendar_url' and keeps the
+// events within the requested window.
+func addCalendarInput(ctx context.Context, config *Config, request map[string]interface{}, data *TemplateData) error {
+	ics, _ := request["ics"].(string)
+	if calendarURL, ok := request["calendar_url"].(string); ok && calendarURL != "" {
+		body, _, err := fetchURL(ctx, config, config.Fetch, calendarURL)
+		if err != nil {
+			return err
+		}
+		ics = string(body)
+	}
+	if ics == "" {
+		return nil
+	}
+
+	events, err := parseICS(ics)
+	if err != nil {
+		return badInput("Invalid calendar: %v", err)
+	}
+
+	days := config.Inputs.CalendarDays
+	if days <= 0 {
+		days = 7
+	}
+	days = requestInt(request, "calendar_days", days)
+
+	maxEvents := config.Inputs.MaxCalendarEvents
+	if maxEvents <= 0 {
+		maxEvents = 50
+	}
+
+	now := time.Now()
+	data.Events = expandEvents(events, now, now.AddDate(0, 0, days), maxEvents)
+	sort.Slice(data.Events, func(i, j int) bool { return data.Events[i].Start.Before(data.Events[j].Start) })
+	if len(data.Events) > maxEvents {
+		data.Events = data.Events[:maxEvents]
+	}
+
+	return nil
+}
+
+// parseICS extracts VEVENTs from an iCalendar document. Recurring events are
+// returned once, with their rule, for expandEvents to expand.
+func parseICS(ics string) ([]CalendarEvent, error) {
+	if !strings.Contains(ics, "BEGIN:VCALENDAR") {
+		return nil, fmt.Errorf("missing BEGIN:VCALENDAR")
+	}
+
+	// Unfold continuation lines (RFC 5545 section 3.1)
+	ics = strings.ReplaceAll(ics, "\r\n", "\n")
+	ics = strings.ReplaceAll(ics, "\n ", "")
+	ics = strings.ReplaceAll(ics, "\n\t", "")
+
+	var events []CalendarEvent
+	var current *CalendarEvent
+	var rule string
+	for _, line := range strings.Split(ics, "\n") {
+		switch line {
+		case "BEGIN:VEVENT":
+			current = &CalendarEvent{}
+			rule = ""
+			continue
+		case "END:VEVENT":
+			if current != nil && !current.Start.IsZero() {
+				if rule != "" {
+					recur, err := parseRRULE(rule, current.Start)
+					if err != nil {
+						return nil, fmt.Errorf("event '%s': %w", current.Summary, err)
+					}
+					current.rule = recur
+				}
+				events = append(events, *current)
+			}
+			current = nil
+			continue
+		}
+		if current == nil {
+			continue
+		}
+
+		nameAndParams, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		params := strings.Split(nameAndParams, ";")
+		switch strings.ToUpper(params[0]) {
+		case "SUMMARY":
+			current.Summary = unescapeICSText(value)
+		case "LOCATION":
+			current.Location = unescapeICSText(value)
+		case "DESCRIPTION":
+			current.Description = unescapeICSText(value)
+		case "DTSTART":
+			start, allDay, err := parseICSTime(value, params[1:])
+			if err != nil {
+				return nil, err
+			}
+			current.Start, current.AllDay = start, allDay
+			current.utc = strings.HasSuffix(value, "Z")
+		case "DTEND":
+			end, _, err := parseICSTime(value, params[1:])
+			if err != nil {
+				return nil, err
+			}
+			current.End = end
+		case "UID":
+			current.uid = value
+		case "RRULE":
+			rule = value
+		case "EXDATE":
+			for _, exdate := range strings.Split(value, ",") {
+				t, allDay, err := parseICSTime(exdate, params[1:])
+				if err != nil {
+					return nil, err
+				}
+				current.exdates = append(current.exdates, icsDate{t, allDay})
+			}
+		case "RDATE":
+			for _, rdate := range strings.Split(value, ",") {
+				t, _, err := parseICSTime(rdate, params[1:])
+				if err != nil {
+					return nil, fmt.Errorf("unsupported RDATE '%s'", rdate)
+				}
+				current.rdates = append(current.rdates, t)
+			}
+		case "RECURRENCE-ID":
+			recurrenceID, _, err := parseICSTime(value, params[1:])
+			if err != nil {
+				return nil, err
+			}
+			current.recurrenceID = recurrenceID
+		}
+	}
+
+	// An occurrence that was moved or changed is its own VEVENT, which takes
+	// the place of the occurrence in the series
+	for _, override := range events {
+		if override.recurrenceID.IsZero() {
+			continue
+		}
+		for i := range events {
+			if events[i].rule != nil && events[i].uid == override.uid {
+				events[i].exdates = append(events[i].exdates, icsDate{override.recurrenceID, false})
+			}
+		}
+	}
+	return events, nil
+}
+
+func parseICSTime(value string, params []string) (time.Time, bool, error) {
+	location := time.Local
+	allDay := false
+	for _, param := range params {
+		key, paramValue, _ := strings.Cut(param, "=")
+		switch strings.ToUpper(key) {
+		case "TZID":
+			if loc, err := time.LoadLocation(strings.Trim(paramValue, `"`)); err == nil {
+				location = loc
+			}
+		case "VALUE":
+			allDay = strings.EqualFold(paramValue, "DATE")
+		}
+	}
+
+	switch {
+	case allDay || len(value) == 8:
+		t, err := time.ParseInLocation("20060102", value, location)
+		return t, true, err
+	case strings.HasSuffix(value, "Z"):
+		t, err := time.Parse("20060102T150405Z", value)
+		return t.In(time.Local), false, err
+	default:
+		t, err := time.ParseInLocation("20060102T150405", value, location)
+		return t, false, err
+	}
+}
+
+func unescapeICSText(value string) string {
+	replacer := strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`)
+	return replacer.Replace(value)
+}
+
+// icsDate is an EXDATE, which with VALUE=DATE excludes a whole day.
+type icsDate struct {
+	time   time.Time
+	allDay bool
+}
+
+func (d icsDate) matches(t time.Time) bool {
+	if !d.allDay {
+		return d.time.Equal(t)
+	}
+	y, m, day := t.In(d.time.Location()).Date()
+	dy, dm, dd := d.time.Date()
+	return y == dy && m == dm && day == dd
+}
+
+// recurrence is an RRULE. The parts that can't be expanded are rejected when
+// it's parsed, so recurring events are never silently shown once.
+type recurrence struct {
+	freq       string
+	interval   int
+	count      int
+	until      time.Time
+	byDay      []weekdayNum
+	byMonthDay []int
+	byMonth    []time.Month
+	weekStart  time.Weekday
+}
+
+// weekdayNum is a BYDAY entry such as TU, 2TU or -1FR. n is 0 for every
+// such weekday of the period.
+type weekdayNum struct {
+	n   int
+	day time.Weekday
+}
+
+var icsWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+// maxRecurrencePeriods bounds the periods walked for one rule, such as a
+// monthly rule for the 31st of February that never occurs.
+const maxRecurrencePeriods = 100000
+
+func parseRRULE(value string, start time.Time) (*recurrence, error) {
+	r := &recurrence{interval: 1, weekStart: time.Monday}
+	for _, part := range strings.Split(value, ";") {
+		name, partValue, _ := strings.Cut(part, "=")
+		var err error
+		switch strings.ToUpper(name) {
+		case "FREQ":
+			r.freq = strings.ToUpper(partValue)
+			if r.freq != "DAILY" && r.freq != "WEEKLY" && r.freq != "MONTHLY" && r.freq != "YEARLY" {
+				return nil, fmt.Errorf("unsupported recurrence FREQ=%s", partValue)
+			}
+		case "INTERVAL":
+			r.interval, err = strconv.Atoi(partValue)
+			if err == nil && r.interval < 1 {
+				err = fmt.Errorf("must be at least 1")
+			}
+		case "COUNT":
+			r.count, err = strconv.Atoi(partValue)
+			if err == nil && r.count < 1 {
+				err = fmt.Errorf("must be at least 1")
+			}
+		case "UNTIL":
+			var allDay bool
+			r.until, allDay, err = parseICSTime(partValue, nil)
+			if allDay {
+				// A date includes the whole day
+				r.until = r.until.AddDate(0, 0, 1).Add(-time.Nanosecond)
+			}
+		case "BYDAY":
+			for _, day := range strings.Split(partValue, ",") {
+				day = strings.ToUpper(day)
+				weekday, ok := icsWeekdays[day[max(len(day)-2, 0):]]
+				if !ok {
+					return nil, fmt.Errorf("invalid recurrence BYDAY=%s", partValue)
+				}
+				n := 0
+				if prefix := day[:len(day)-2]; prefix != "" {
+					if n, err = strconv.Atoi(prefix); err != nil || n == 0 {
+						return nil, fmt.Errorf("invalid recurrence BYDAY=%s", partValue)
+					}
+				}
+				r.byDay = append(r.byDay, weekdayNum{n, weekday})
+			}
+		case "BYMONTHDAY":
+			for _, day := range strings.Split(partValue, ",") {
+				n, convErr := strconv.Atoi(day)
+				if convErr != nil || n == 0 || n < -31 || n > 31 {
+					return nil, fmt.Errorf("invalid recurrence BYMONTHDAY=%s", partValue)
+				}
+				r.byMonthDay = append(r.byMonthDay, n)
+			}
+		case "BYMONTH":
+			for _, month := range strings.Split(partValue, ",") {
+				n, convErr := strconv.Atoi(month)
+				if convErr != nil || n < 1 || n > 12 {
+					return nil, fmt.Errorf("invalid recurrence BYMONTH=%s", partValue)
+				}
+				r.byMonth = append(r.byMonth, time.Month(n))
+			}
+		case "WKST":
+			weekday, ok := icsWeekdays[strings.ToUpper(partValue)]
+			if !ok {
+				return nil, fmt.Errorf("invalid recurrence WKST=%s", partValue)
+			}
+			r.weekStart = weekday
+		default:
+			return nil, fmt.Errorf("unsupported recurrence rule part %s", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid recurrence %s: %v", part, err)
+		}
+	}
+
+	if r.freq == "" {
+		return nil, fmt.Errorf("recurrence rule has no FREQ")
+	}
+	for _, day := range r.byDay {
+		if day.n != 0 && r.freq != "MONTHLY" && r.freq != "YEARLY" {
+			return nil, fmt.Errorf("unsupported recurrence BYDAY=%d%s with FREQ=%s", day.n, day.day.String()[:2], r.freq)
+		}
+	}
+	if r.freq == "YEARLY" && len(r.byDay) > 0 && len(r.byMonth) == 0 {
+		return nil, fmt.Errorf("unsupported recurrence: yearly BYDAY needs BYMONTH")
+	}
+	if r.freq == "YEARLY" && len(r.byMonthDay) > 0 && len(r.byMonth) == 0 {
+		r.byMonth = []time.Month{start.Month()}
+	}
+	return r, nil
+}
+
+// occurrences returns the starts of the rule's occurrences from start that
+// are up to to and end after from, at most limit of them. COUNT and UNTIL
+// count from start, and the start itself is the first occurrence.
+func (r *recurrence) occurrences(start time.Time, duration time.Duration, from, to time.Time, limit int) []time.Time {
+	var starts []time.Time
+	add := func(t time.Time) bool {
+		if !t.Add(duration).Before(from) {
+			starts = append(starts, t)
+		}
+		return len(starts) < limit
+	}
+	if start.After(to) || !add(start) {
+		return starts
+	}
+
+	// Without a COUNT the periods long before the window can be skipped
+	first := 0
+	if r.count == 0 {
+		first = max(r.periodsBetween(start, from.Add(-duration))-1, 0)
+	}
+	generated := 1
+	for k := first; k < first+maxRecurrencePeriods; k++ {
+		for _, t := range r.period(start, k) {
+			if !t.After(start) {
+				continue
+			}
+			generated++
+			if (r.count > 0 && generated > r.count) || (!r.until.IsZero() && t.After(r.until)) || t.After(to) {
+				return starts
+			}
+			if !add(t) {
+				return starts
+			}
+		}
+	}
+	return starts
+}
+
+// periodsBetween is roughly how many whole periods of the rule lie between
+// start and t.
+func (r *recurrence) periodsBetween(start, t time.Time) int {
+	if !t.After(start) {
+		return 0
+	}
+	days := int(t.Sub(start).Hours() / 24)
+	months := (t.Year()-start.Year())*12 + int(t.Month()-start.Month())
+	switch r.freq {
+	case "DAILY":
+		return days / r.interval
+	case "WEEKLY":
+		return days / 7 / r.interval
+	case "MONTHLY":
+		return months / r.interval
+	}
+	return months / 12 / r.interval
+}
+
+// period returns the candidate starts, in order, of the kth period of the
+// rule from start: a day, week, month or year, at start's time of day.
+func (r *recurrence) period(start time.Time, k int) []time.Time {
+	hour, minute, second := start.Clock()
+	at := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, hour, minute, second, 0, start.Location())
+	}
+
+	var starts []time.Time
+	switch r.freq {
+	case "DAILY":
+		day := at(start.Year(), start.Month(), start.Day()+k*r.interval)
+		if r.inMonths(day.Month()) && r.onMonthDay(day) && r.onWeekday(day.Weekday()) {
+			starts = append(starts, day)
+		}
+	case "WEEKLY":
+		offset := (int(start.Weekday()) - int(r.weekStart) + 7) % 7
+		week := at(start.Year(), start.Month(), start.Day()-offset+7*k*r.interval)
+		days := r.byDay
+		if len(days) == 0 {
+			days = []weekdayNum{{0, start.Weekday()}}
+		}
+		for _, day := range days {
+			t := at(week.Year(), week.Month(), week.Day()+(int(day.day)-int(r.weekStart)+7)%7)
+			if r.inMonths(t.Month()) {
+				starts = append(starts, t)
+			}
+		}
+	case "MONTHLY":
+		month := at(start.Year(), start.Month()+time.Month(k*r.interval), 1)
+		if r.inMonths(month.Month()) {
+			starts = r.monthDays(month, start.Day(), at)
+		}
+	case "YEARLY":
+		year := start.Year() + k*r.interval
+		months := r.byMonth
+		if len(months) == 0 {
+			months = []time.Month{start.Month()}
+		}
+		for _, month := range months {
+			starts = append(starts, r.monthDays(at(year, month, 1), start.Day(), at)...)
+		}
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+	return starts
+}
+
+// monthDays returns the days of the month starting at first that match
+// BYMONTHDAY and BYDAY, or the start's day of the month without either.
+func (r *recurrence) monthDays(first time.Time, startDay int, at func(int, time.Month, int) time.Time) []time.Time {
+	year, month := first.Year(), first.Month()
+	daysIn := time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+
+	var days []int
+	switch {
+	case len(r.byDay) > 0:
+		for _, weekday := range r.byDay {
+			var matching []int
+			for day := 1 + (int(weekday.day)-int(first.Weekday())+7)%7; day <= daysIn; day += 7 {
+				matching = append(matching, day)
+			}
+			switch {
+			case weekday.n == 0:
+				days = append(days, matching...)
+			case weekday.n > 0 && weekday.n <= len(matching):
+				days = append(days, matching[weekday.n-1])
+			case weekday.n < 0 && -weekday.n <= len(matching):
+				days = append(days, matching[len(matching)+weekday.n])
+			}
+		}
+	case len(r.byMonthDay) > 0:
+		for day := 1; day <= daysIn; day++ {
+			days = append(days, day)
+		}
+	case startDay <= daysIn:
+		days = []int{startDay}
+	}
+
+	var starts []time.Time
+	for _, day := range days {
+		t := at(year, month, day)
+		if r.onMonthDay(t) {
+			starts = append(starts, t)
+		}
+	}
+	return starts
+}
+
+func (r *recurrence) inMonths(month time.Month) bool {
+	return len(r.byMonth) == 0 || slices.Contains(r.byMonth, month)
+}
+
+func (r *recurrence) onMonthDay(t time.Time) bool {
+	if len(r.byMonthDay) == 0 {
+		return true
+	}
+	daysIn := time.Date(t.Year(), t.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	for _, day := range r.byMonthDay {
+		if day == t.Day() || daysIn+day+1 == t.Day() {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *recurrence) onWeekday(weekday time.Weekday) bool {
+	if len(r.byDay) == 0 {
+		return true
+	}
+	for _, day := range r.byDay {
+		if day.day == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+// expandEvents returns the events, and occurrences of recurring events, that
+// end after from and start by to. Each recurring event gives at most limit
+// occurrences, the earliest.
+func expandEvents(events []CalendarEvent, from, to time.Time, limit int) []CalendarEvent {
+	var expanded []CalendarEvent
+	for _, event := range events {
+		if event.rule == nil {
+			end := event.End
+			if end.IsZero() {
+				end = event.Start
+			}
+			if !end.Before(from) && !event.Start.After(to) {
+				expanded = append(expanded, event)
+			}
+			continue
+		}
+
+		// A start in UTC recurs at the same UTC time, others at the same
+		// local time in their own time zone
+		start := event.Start
+		if event.utc {
+			start = start.UTC()
+		}
+		var duration time.Duration
+		if !event.End.IsZero() {
+			duration = event.End.Sub(event.Start)
+		}
+		starts := event.rule.occurrences(start, duration, from, to, limit)
+		for _, rdate := range event.rdates {
+			if !rdate.Add(duration).Before(from) && !rdate.After(to) {
+				starts = append(starts, rdate)
+			}
+		}
+
+	occurrences:
+		for _, occurrence := range starts {
+			for _, exdate := range event.exdates {
+				if exdate.matches(occurrence) {
+					continue occurrences
+				}
+			}
+			instance := event
+			instance.Start = occurrence.In(event.Start.Location())
+			if !event.End.IsZero() {
+				if event.AllDay {
+					days := int(math.Round(duration.Hours() / 24))
+					instance.End = instance.Start.AddDate(0, 0, days)
+				} else {
+					instance.End = instance.Start.Add(duration)
+				}
+			}
+			expanded = append(expanded, instance)
+		}
+	}
+	return expanded
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// calendar wraps VEVENT lines in a VCALENDAR.
+func calendar(events ...string) string {
+	var ics strings.Builder
+	ics.WriteString("BEGIN:VCALENDAR\r\nVERSION:2.0\r\n")
+	for _, event := range events {
+		ics.WriteString("BEGIN:VEVENT\r\n" + event + "\r\nEND:VEVENT\r\n")
+	}
+	ics.WriteString("END:VCALENDAR\r\n")
+	return ics.String()
+}
+
+func TestParseICS(t *testing.T) {
+	ics := calendar(
+		"UID:1\r\nSUMMARY:Dentist\\, checkup\r\nLOCATION:High St\r\nDTSTART:20240610T090000Z\r\nDTEND:20240610T093000Z",
+		"UID:2\r\nSUMMARY:Holiday\r\nDTSTART;VALUE=DATE:20240612\r\nDTEND;VALUE=DATE:20240613",
+		"UID:3\r\nSUMMARY:Long descrip\r\n tion\r\nDTSTART;TZID=Europe/London:20240611T180000",
+	)
+	events, err := parseICS(ics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("got %d events, want 3", len(events))
+	}
+	tests := []struct {
+		event     CalendarEvent
+		summary   string
+		location  string
+		start     string
+		allDay    bool
+		zoneShort string
+	}{
+		{events[0], "Dentist, checkup", "High St", "2024-06-10T09:00:00Z", false, ""},
+		{events[1], "Holiday", "", "2024-06-12", true, ""},
+		{events[2], "Long description", "", "2024-06-11T17:00:00Z", false, "BST"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.summary, func(t *testing.T) {
+			if tt.event.Summary != tt.summary || tt.event.Location != tt.location || tt.event.AllDay != tt.allDay {
+				t.Errorf("event = %+v", tt.event)
+			}
+			got := tt.event.Start.UTC().Format(time.RFC3339)
+			if tt.allDay {
+				got = tt.event.Start.Format(time.DateOnly)
+			}
+			if got != tt.start {
+				t.Errorf("start = %s, want %s", got, tt.start)
+			}
+			if zone, _ := tt.event.Start.Zone(); tt.zoneShort != "" && zone != tt.zoneShort {
+				t.Errorf("zone = %s, want %s", zone, tt.zoneShort)
+			}
+		})
+	}
+}
+
+func TestParseICSRejectsUnsupportedRules(t *testing.T) {
+	tests := []struct {
+		rule    string
+		wantErr string
+	}{
+		{"FREQ=HOURLY", "unsupported recurrence FREQ=HOURLY"},
+		{"FREQ=MONTHLY;BYSETPOS=-1;BYDAY=MO,TU,WE,TH,FR", "unsupported recurrence rule part BYSETPOS"},
+		{"FREQ=WEEKLY;BYDAY=2TU", "unsupported recurrence BYDAY=2Tu"},
+		{"FREQ=YEARLY;BYDAY=1MO", "needs BYMONTH"},
+		{"INTERVAL=2", "no FREQ"},
+		{"FREQ=DAILY;INTERVAL=0", "invalid recurrence INTERVAL=0"},
+		{"FREQ=DAILY;BYDAY=XX", "invalid recurrence BYDAY=XX"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rule, func(t *testing.T) {
+			_, err := parseICS(calendar("SUMMARY:Standup\r\nDTSTART:20240610T090000Z\r\nRRULE:" + tt.rule))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) || !strings.Contains(err.Error(), "Standup") {
+				t.Fatalf("parseICS() = %v, want an error about %q naming the event", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExpandEvents(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skip("no time zone data")
+	}
+	// Monday 10 June 2024 to Sunday 7 July 2024
+	from := time.Date(2024, 6, 10, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2024, 7, 7, 23, 59, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		event string
+		limit int
+		want  []string
+	}{
+		{
+			name:  "single event in the window",
+			event: "DTSTART:20240612T090000Z\r\nDTEND:20240612T100000Z",
+			want:  []string{"2024-06-12T09:00:00Z"},
+		},
+		{
+			name:  "single event before the window",
+			event: "DTSTART:20240601T090000Z",
+		},
+		{
+			name:  "weekly since last year",
+			event: "DTSTART:20230103T090000Z\r\nRRULE:FREQ=WEEKLY",
+			want:  []string{"2024-06-11T09:00:00Z", "2024-06-18T09:00:00Z", "2024-06-25T09:00:00Z", "2024-07-02T09:00:00Z"},
+		},
+		{
+			name:  "weekdays with exceptions",
+			event: "DTSTART:20240603T083000Z\r\nRRULE:FREQ=WEEKLY;BYDAY=MO,WE,FR;UNTIL=20240621T235959Z\r\nEXDATE:20240612T083000Z,20240619T083000Z",
+			want:  []string{"2024-06-10T08:30:00Z", "2024-06-14T08:30:00Z", "2024-06-17T08:30:00Z", "2024-06-21T08:30:00Z"},
+		},
+		{
+			name:  "fortnightly with a count",
+			event: "DTSTART:20240527T120000Z\r\nRRULE:FREQ=WEEKLY;INTERVAL=2;COUNT=3",
+			want:  []string{"2024-06-10T12:00:00Z", "2024-06-24T12:00:00Z"},
+		},
+		{
+			name:  "daily count ends before the window",
+			event: "DTSTART:20240601T070000Z\r\nRRULE:FREQ=DAILY;COUNT=5",
+		},
+		{
+			name:  "daily limited",
+			event: "DTSTART:20240101T070000Z\r\nRRULE:FREQ=DAILY",
+			limit: 3,
+			want:  []string{"2024-06-10T07:00:00Z", "2024-06-11T07:00:00Z", "2024-06-12T07:00:00Z"},
+		},
+		{
+			name:  "ongoing occurrence that started before the window",
+			event: "DTSTART:20240101T230000Z\r\nDTEND:20240102T020000Z\r\nRRULE:FREQ=DAILY;UNTIL=20240610T000000Z",
+			want:  []string{"2024-06-09T23:00:00Z"},
+		},
+		{
+			name:  "second Tuesday of the month",
+			event: "DTSTART:20240109T190000Z\r\nRRULE:FREQ=MONTHLY;BYDAY=2TU",
+			want:  []string{"2024-06-11T19:00:00Z"},
+		},
+		{
+			name:  "last Friday of the month",
+			event: "DTSTART:20240126T170000Z\r\nRRULE:FREQ=MONTHLY;BYDAY=-1FR",
+			want:  []string{"2024-06-28T17:00:00Z"},
+		},
+		{
+			name:  "last day of the month",
+			event: "DTSTART:20240131T090000Z\r\nRRULE:FREQ=MONTHLY;BYMONTHDAY=-1",
+			want:  []string{"2024-06-30T09:00:00Z"},
+		},
+		{
+			name:  "the 31st skips short months",
+			event: "DTSTART:20240131T090000Z\r\nRRULE:FREQ=MONTHLY",
+		},
+		{
+			name:  "yearly birthday",
+			event: "DTSTART;VALUE=DATE:19900620\r\nRRULE:FREQ=YEARLY",
+			want:  []string{"2024-06-20"},
+		},
+		{
+			name:  "local time kept across daylight saving",
+			event: "DTSTART;TZID=Europe/London:20240101T090000\r\nRRULE:FREQ=MONTHLY;BYMONTHDAY=15",
+			want:  []string{"2024-06-15T08:00:00Z"},
+		},
+		{
+			name:  "moved occurrence replaces the original",
+			event: "UID:standup\r\nDTSTART:20240603T090000Z\r\nRRULE:FREQ=WEEKLY;COUNT=3\r\nEND:VEVENT\r\nBEGIN:VEVENT\r\nUID:standup\r\nRECURRENCE-ID:20240610T090000Z\r\nDTSTART:20240611T100000Z",
+			want:  []string{"2024-06-11T10:00:00Z", "2024-06-17T09:00:00Z"},
+		},
+		{
+			name:  "extra date",
+			event: "DTSTART:20240601T090000Z\r\nRRULE:FREQ=YEARLY\r\nRDATE:20240615T090000Z",
+			want:  []string{"2024-06-15T09:00:00Z"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, err := parseICS(calendar(tt.event))
+			if err != nil {
+				t.Fatal(err)
+			}
+			limit := tt.limit
+			if limit == 0 {
+				limit = 50
+			}
+			var got []string
+			for _, event := range expandEvents(events, from, to, limit) {
+				if event.AllDay {
+					got = append(got, event.Start.Format(time.DateOnly))
+				} else {
+					got = append(got, event.Start.UTC().Format(time.RFC3339))
+				}
+				if event.Start.Location() == london && event.Start.Hour() != 9 {
+					t.Errorf("local start = %s, want 09:00", event.Start)
+				}
+			}
+			// addCalendarInput sorts the events
+			sort.Strings(got)
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("occurrences = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
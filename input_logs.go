@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LogSource is a log that templates can read with the 'log' request field:
+// a file such as /var/log/syslog, or the systemd journal (optionally one unit).
+type LogSource struct {
+	File    string `json:"file"`
+	Journal bool   `json:"journal"`
+	Unit    string `json:"unit"`
+}
+
+// Logs are the recent lines of a log source passed to a template, oldest first.
+type Logs struct {
+	Source    string
+	Since     time.Time
+	Priority  string
+	Lines     []string
+	Truncated bool
+}
+
+// Syslog priorities, most severe first
+var logPriorities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// Words that mark the severity of a line in a plain log file
+var (
+	criticalLine = regexp.MustCompile(`(?i)\b(emerg|emergency|alert|crit|critical|fatal|panic)\b`)
+	errorLine    = regexp.MustCompile(`(?i)\b(err|error|errors|fail|failed|failure|exception|segfault|oom|denied|timed out)\b`)
+	warningLine  = regexp.MustCompile(`(?i)\b(warn|warning)\b`)
+)
+
+// How much of the end of a log file is read at most
+const maxLogFileBytes = 8 << 20
+
+// LogText renders the log lines, noting when older lines were left out.
+func (d TemplateData) LogText() string {
+	if d.Logs == nil {
+		return ""
+	}
+	var buf strings.Builder
+	if d.Logs.Truncated {
+		buf.WriteString("(older lines omitted)\n")
+	}
+	for _, line := range d.Logs.Lines {
+		buf.WriteString(line)
+		buf.WriteString("\n")
+	}
+	return buf.String()
+}
+
+// addLogInput reads the configured log source named by 'log', keeping lines
+// from the last 'log_since' (default 24h) at 'log_priority' (default warning)
+// or more severe.
+func addLogInput(ctx context.Context, config *Config, request map[string]interface{}, data *TemplateData) error {
+	name, _ := request["log"].(string)
+	if name == "" {
+		return nil
+	}
+	source, ok := config.Inputs.LogSources[name]
+	if !ok {
+		return badInput("Unknown log source '%s'", name)
+	}
+
+	since := 24 * time.Hour
+	if value, _ := request["log_since"].(string); value != "" {
+		var err error
+		if since, err = time.ParseDuration(value); err != nil || since <= 0 {
+			return badInput("Invalid log_since '%s', expected a duration such as 24h", value)
+		}
+	}
+	priority := "warning"
+	if value, _ := request["log_priority"].(string); value != "" {
+		priority = value
+	}
+	level := logPriorityLevel(priority)
+	if level < 0 {
+		return badInput("Invalid log_priority '%s', expected one of %s", priority, strings.Join(logPriorities, ", "))
+	}
+
+	maxLines := config.Inputs.MaxLogLines
+	if maxLines <= 0 {
+		maxLines = 300
+	}
+	logs := &Logs{Source: name, Since: time.Now().Add(-since), Priority: priority}
+
+	var lines []string
+	var err error
+	if source.Journal || source.Unit != "" {
+		lines, err = readJournal(ctx, source, logs.Since, priority, maxLines+1)
+	} else {
+		lines, err = readLogFile(source.File, logs.Since, level)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read log source '%s': %w", name, err)
+	}
+
+	// The most recent lines matter most
+	if len(lines) > maxLines {
+		lines = lines[len(lines)-maxLines:]
+		logs.Truncated = true
+	}
+	logs.Lines = lines
+	data.Logs = logs
+	return nil
+}
+
+func logPriorityLevel(priority string) int {
+	for level, name := range logPriorities {
+		if name == priority {
+			return level
+		}
+	}
+	return -1
+}
+
+// readJournal reads matching entries from the systemd journal with journalctl.
+func readJournal(ctx context.Context, source LogSource, since time.Time, priority string, maxLines int) ([]string, error) {
+	args := []string{"--no-pager", "--quiet", "--output=short-iso",
+		"--since=" + since.Format("2006-01-02 15:04:05"),
+		"--priority=" + priority,
+		"--lines=" + strconv.Itoa(maxLines)}
+	if source.Unit != "" {
+		args = append(args, "--unit="+source.Unit)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, "journalctl", args...).Output()
+	if err != nil {
+		return nil, err
+	}
+	text := strings.TrimRight(string(output), "\n")
+	if text == "" {
+		return nil, nil
+	}
+	return strings.Split(text, "\n"), nil
+}
+
+// readLogFile reads the end of a log file, keeping lines since the given time
+// whose severity is at least level. Lines without a timestamp or starting with
+// whitespace, such as stack traces, follow the line before them.
+func readLogFile(path string, since time.Time, level int) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := max(info.Size()-maxLogFileBytes, 0)
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		// Skip the partial first line
+		if i := bytes.IndexByte(content, '\n'); i >= 0 {
+			content = content[i+1:]
+		}
+	}
+
+	var lines []string
+	keep := false
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		continuation := line[0] == ' ' || line[0] == '\t'
+		if !continuation {
+			at, timestamped := logLineTime(line)
+			if timestamped {
+				keep = !at.Before(since) && logLineLevel(line) <= level
+			} else if !keep {
+				keep = logLineLevel(line) <= level
+			}
+		}
+		if keep {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// logLineTime parses the timestamp at the start of a line, in ISO 8601 form or
+// the classic syslog "Jan _2 15:04:05", which has no year.
+func logLineTime(line string) (time.Time, bool) {
+	if field, _, _ := strings.Cut(line, " "); len(field) >= 19 {
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05-0700"} {
+			if at, err := time.Parse(layout, field); err == nil {
+				return at, true
+			}
+		}
+	}
+	if len(line) >= 15 {
+		if at, err := time.ParseInLocation(time.Stamp, line[:15], time.Local); err == nil {
+			now := time.Now()
+			at = at.AddDate(now.Year(), 0, 0)
+			// A date later than now is from last year
+			if at.After(now.Add(24 * time.Hour)) {
+				at = at.AddDate(-1, 0, 0)
+			}
+			return at, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// logLineLevel guesses the priority of a plain log line from its words.
+func logLineLevel(line string) int {
+	switch {
+	case criticalLine.MatchString(line):
+		return 2
+	case errorLine.MatchString(line):
+		return 3
+	case warningLine.MatchString(line):
+		return 4
+	}
+	return 6
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// WebPage is the readable content of a URL passed to a template.
+type WebPage struct {
+	URL       string
+	Title     string
+	Text      string
+	Truncated bool
+}
+
+// Elements that never contain the main content of a page
+var skippedElements = map[string]bool{
+	"script": true, "style": true, "noscript": true, "nav": true, "header": true,
+	"footer": true, "aside": true, "form": true, "svg": true, "iframe": true,
+	"template": true, "button": true, "select": true, "canvas": true,
+}
+
+// Class and id words that mark boilerplate such as menus, cookie banners and ads
+var boilerplateWords = map[string]bool{
+	"nav": true, "navbar": true, "navigation": true, "menu": true, "sidebar": true,
+	"footer": true, "header": true, "cookie": true, "cookies": true, "consent": true,
+	"banner": true, "ad": true, "ads": true, "advert": true, "advertisement": true,
+	"promo": true, "social": true, "share": true, "related": true, "comments": true,
+	"subscribe": true, "newsletter": true, "breadcrumb": true, "breadcrumbs": true, "popup": true,
+}
+
+var blockElements = map[string]bool{
+	"p": true, "div": true, "section": true, "article": true, "main": true, "br": true,
+	"li": true, "ul": true, "ol": true, "tr": true, "table": true, "blockquote": true,
+	"pre": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"dd": true, "dt": true, "figcaption": true,
+}
+
+var (
+	unparseableHTML = regexp.MustCompile(`(?is)<script\b.*?</script>|<style\b.*?</style>|<!--.*?-->|<!\[CDATA\[.*?\]\]>`)
+	repeatedSpace   = regexp.MustCompile(`[ \t\r\f\v\x{00A0}]+`)
+	repeatedLines   = regexp.MustCompile(`\n\s*\n+`)
+)
+
+// addURLInput fetches 'url', extracts the readable text and length-limits it.
+func addURLInput(ctx context.Context, config *Config, request map[string]interface{}, data *TemplateData) error {
+	rawURL, _ := request["url"].(string)
+	if rawURL == "" {
+		return nil
+	}
+
+	body, contentType, err := fetchURL(ctx, config, config.Fetch.withInputHosts(config.Inputs.AllowedURLHosts), rawURL)
+	if err != nil {
+		return err
+	}
+
+	page := &WebPage{URL: rawURL}
+	switch {
+	case strings.Contains(contentType, "html") || (contentType == "" && bytes.Contains(body, []byte("<html"))):
+		page.Title, page.Text = extractReadableText(body)
+	case strings.Contains(contentType, "pdf"):
+		pages, err := extractPDFPages(body)
+		if err != nil {
+			return badInput("Failed to extract text from %s: %v", rawURL, err)
+		}
+		page.Text = strings.Join(pages, "\n\n")
+	case strings.HasPrefix(contentType, "text/") || strings.Contains(contentType, "json") || strings.Contains(contentType, "xml"):
+		if !utf8.Valid(body) {
+			return badInput("Content at %s is not UTF-8 text", rawURL)
+		}
+		page.Text = string(body)
+	default:
+		return badInput("Unsupported content type '%s' at %s", contentType, rawURL)
+	}
+
+	maxChars := config.Inputs.MaxURLChars
+	if maxChars <= 0 {
+		maxChars = 12000
+	}
+	if runes := []rune(page.Text); len(runes) > maxChars {
+		page.Text = string(runes[:maxChars]) + "\n[...truncated]"
+		page.Truncated = true
+	}
+
+	data.Page = page
+	return nil
+}
+
+// hostAllowed reports whether host matches the allow list. Entries match the host
+// itself and its subdomains, and an empty list allows every host.
+func hostAllowed(host string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	return hostMatches(host, allowed)
+}
+
+func hostMatches(host string, patterns []string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(pattern), "*."))
+		if host == pattern || strings.HasSuffix(host, "."+pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+func isBoilerplate(element xml.StartElement) bool {
+	for _, attr := range element.Attr {
+		if attr.Name.Local != "class" && attr.Name.Local != "id" && attr.Name.Local != "role" {
+			continue
+		}
+		if attr.Name.Local == "role" && (attr.Value == "navigation" || attr.Value == "banner" || attr.Value == "contentinfo") {
+			return true
+		}
+		words := strings.FieldsFunc(strings.ToLower(attr.Value), func(r rune) bool {
+			return r == ' ' || r == '-' || r == '_'
+		})
+		for _, word := range words {
+			if boilerplateWords[word] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// extractReadableText strips navigation, ads and other boilerplate from an HTML
+// page, preferring the contents of <article> or <main> when the page has one.
+func extractReadableText(body []byte) (string, string) {
+	body = unparseableHTML.ReplaceAll(body, nil)
+
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+
+	var title, all, main strings.Builder
+	var stack []string
+	skipDepth, mainDepth := 0, 0
+	inTitle := false
+
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			// Keep whatever was extracted before malformed markup
+			break
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			name := strings.ToLower(t.Name.Local)
+			stack = append(stack, name)
+			if skipDepth == 0 && (skippedElements[name] || isBoilerplate(t)) {
+				skipDepth = len(stack)
+			}
+			if mainDepth == 0 && (name == "article" || name == "main") {
+				mainDepth = len(stack)
+			}
+			if name == "title" {
+				inTitle = true
+			}
+			if skipDepth == 0 && blockElements[name] {
+				all.WriteString("\n")
+				if mainDepth > 0 {
+					main.WriteString("\n")
+				}
+				if name == "li" {
+					all.WriteString("- ")
+					if mainDepth > 0 {
+						main.WriteString("- ")
+					}
+				}
+			}
+		case xml.EndElement:
+			if len(stack) == 0 {
+				continue
+			}
+			if len(stack) == skipDepth {
+				skipDepth = 0
+			}
+			if len(stack) == mainDepth {
+				mainDepth = 0
+			}
+			if stack[len(stack)-1] == "title" {
+				inTitle = false
+			}
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if inTitle && title.Len() == 0 {
+				title.WriteString(strings.TrimSpace(string(t)))
+				continue
+			}
+			if skipDepth > 0 || inTitle {
+				continue
+			}
+			all.Write(t)
+			if mainDepth > 0 {
+				main.Write(t)
+			}
+		}
+	}
+
+	text := all.String()
+	// Only trust <article>/<main> when it holds a meaningful amount of the text
+	if mainText := main.String(); len(strings.TrimSpace(mainText)) > 200 {
+		text = mainText
+	}
+
+	text = repeatedSpace.ReplaceAllString(text, " ")
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	text = repeatedLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+	return title.String(), strings.TrimSpace(text)
+}
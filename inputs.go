@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// InputConfig bounds the structured inputs (calendars, tables, documents) that
+// requests can pass to templates, so raw payloads never blow the model's context.
+type InputConfig struct {
+	CalendarDays      int   `json:"calendar_days"`
+	MaxCalendarEvents int   `json:"max_calendar_events"`
+	MaxCSVRows        int   `json:"max_csv_rows"`
+	MaxDocumentBytes  int64 `json:"max_document_bytes"`
+	MaxDocumentChars  int   `json:"max_document_chars"`
+	MaxURLChars       int   `json:"max_url_chars"`
+	MaxFetchBytes     int64 `json:"max_fetch_bytes"`
+	FetchTimeout      int   `json:"fetch_timeout"`
+
+	AllowedURLHosts []string `json:"allowed_url_hosts"`
+
+	LogSources  map[string]LogSource `json:"log_sources"`
+	MaxLogLines int                  `json:"max_log_lines"`
+}
+
+type inputError struct {
+	msg string
+}
+
+func (e *inputError) Error() string {
+	return e.msg
+}
+
+func badInput(format string, args ...interface{}) error {
+	return &inputError{msg: fmt.Sprintf(format, args...)}
+}
+
+// requestFields are the fields templates accept in a request body
+var requestFields = []string{
+	"query", "model", "stream", "async", "mqtt_topic", "context", "origin",
+	"ics", "calendar_url", "calendar_days",
+	"csv", "tsv", "csv_delimiter", "csv_columns", "csv_max_rows",
+	"document", "document_type", "pages",
+	"url",
+	"log", "log_since", "log_priority",
+	"messages", "conversation_id",
+}
+
+// checkRequestFields rejects fields the template doesn't declare when strict
+// inputs are enabled, catching typos such as "querry". Templates declare their
+// fields with 'inputs', otherwise every known request field is accepted.
+func checkRequestFields(config *Config, settings *TemplateSettings, request map[string]interface{}) error {
+	strict := config.StrictInputs
+	declared := requestFields
+	if settings != nil {
+		if settings.StrictInputs != nil {
+			strict = *settings.StrictInputs
+		}
+		if len(settings.Inputs) > 0 {
+			// The query is always required so never needs declaring
+			declared = append([]string{"query"}, settings.Inputs...)
+		}
+	}
+	if !strict {
+		return nil
+	}
+
+	var unknown []string
+	for field := range request {
+		if !containsString(declared, field) {
+			unknown = append(unknown, field)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+
+	sort.Strings(unknown)
+	messages := make([]string, len(unknown))
+	for i, field := range unknown {
+		messages[i] = "'" + field + "'"
+		if suggestion := closestString(field, declared); suggestion != "" {
+			messages[i] += fmt.Sprintf(" (did you mean '%s'?)", suggestion)
+		}
+	}
+	return badInput("Unknown request field %s", strings.Join(messages, ", "))
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// closestString returns the candidate within two edits of value, if any.
+func closestString(value string, candidates []string) string {
+	best, bestDistance := "", 3
+	for _, candidate := range candidates {
+		if distance := editDistance(value, candidate); distance < bestDistance {
+			best, bestDistance = candidate, distance
+		}
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+// buildTemplateData extracts the query and any structured inputs from the request.
+// Errors caused by the request itself are returned as *inputError.
+func buildTemplateData(ctx context.Context, config *Config, request map[string]interface{}) (TemplateData, error) {
+	var data TemplateData
+
+	query, ok := request["query"].(string)
+	if !ok {
+		return data, badInput("Query parameter missing or not a string")
+	}
+	data.Query = query
+	data.Fields = make(map[string]interface{}, len(request))
+	for field, value := range request {
+		if field != "query" {
+			data.Fields[field] = value
+		}
+	}
+
+	if err := addCalendarInput(ctx, config, request, &data); err != nil {
+		return data, err
+	}
+	if err := addTableInput(config, request, &data); err != nil {
+		return data, err
+	}
+	if err := addDocumentInput(config, request, &data); err != nil {
+		return data, err
+	}
+	if err := addURLInput(ctx, config, request, &data); err != nil {
+		return data, err
+	}
+	if err := addLogInput(ctx, config, request, &data); err != nil {
+		return data, err
+	}
+	if err := addMessagesInput(request, &data); err != nil {
+		return data, err
+	}
+	if err := addConversationInput(request, &data); err != nil {
+		return data, err
+	}
+
+	return data, nil
+}
+
+func requestInt(request map[string]interface{}, key string, fallback int) int {
+	if value, ok := request[key].(float64); ok && value > 0 {
+		return int(value)
+	}
+	return fallback
+}
+
+func fetchTimeout(config *Config) time.Duration {
+	if config.Inputs.FetchTimeout > 0 {
+		return time.Duration(config.Inputs.FetchTimeout) * time.Second
+	}
+	return 10 * time.Second
+}
+
+func maxFetchBytes(config *Config) int64 {
+	if config.Inputs.MaxFetchBytes > 0 {
+		return config.Inputs.MaxFetchBytes
+	}
+	return 2 << 20
+}
+
+// fetchURL retrieves a remote input, bounded by the configured timeout and size
+// and subject to the fetch policy.
+func fetchURL(ctx context.Context, config *Config, policy FetchConfig, rawURL string) ([]byte, string, error) {
+	if !config.Flags.Enabled(flagFetch) {
+		return nil, "", badInput("Fetching URLs is disabled")
+	}
+	if _, err := validateFetchURL(policy, rawURL); err != nil {
+		return nil, "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout(config))
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, "", badInput("Invalid URL: %v", err)
+	}
+	req.Header.Set("User-Agent", "llamanator")
+
+	resp, err := newFetchClient(policy, fetchTimeout(config)).Do(req)
+	if err != nil {
+		var inputErr *inputError
+		if errors.Is(err, errBlockedAddress) {
+			return nil, "", badInput("Fetching %s is not allowed: it resolves to a private address", rawURL)
+		} else if errors.As(err, &inputErr) {
+			return nil, "", inputErr
+		}
+		return nil, "", fmt.Errorf("failed to fetch %s: %w", rawURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("failed to fetch %s: %s", rawURL, resp.Status)
+	}
+
+	limit := maxFetchBytes(config)
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read %s: %w", rawURL, err)
+	}
+	if int64(len(body)) > limit {
+		return nil, "", badInput("Content at %s exceeds the %d byte limit", rawURL, limit)
+	}
+
+	return body, resp.Header.Get("Content-Type"), nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTemplateFields(t *testing.T) {
+	tmpl, err := parsePromptTemplate("heating.json", `It is {{ .Fields.temp | default "unknown" }} in the {{ .Fields.room }}.`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := testConfig(t, `{"default_model": "llama3"}`)
+
+	tests := []struct {
+		name    string
+		request map[string]interface{}
+		want    string
+	}{
+		{"set", map[string]interface{}{"query": "warm enough?", "temp": "19°C", "room": "lounge"}, "It is 19°C in the lounge."},
+		{"missing", map[string]interface{}{"query": "warm enough?", "room": "lounge"}, "It is unknown in the lounge."},
+		{"empty", map[string]interface{}{"query": "warm enough?", "temp": "", "room": "lounge"}, "It is unknown in the lounge."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := buildTemplateData(context.Background(), config, tt.request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := data.Fields["query"]; ok {
+				t.Error("Fields has the query")
+			}
+			prompt, err := processTemplate(tmpl, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if prompt != tt.want {
+				t.Errorf("prompt = %q, want %q", prompt, tt.want)
+			}
+		})
+	}
+}
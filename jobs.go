@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jobIDHeader is set on streamed responses so other clients can attach to the
+// same generation.
+const jobIDHeader = "X-Llamanator-Job-ID"
+
+// Job is a generation in progress (or recently finished). Streamed text is
+// buffered so clients attaching late still receive it from the beginning.
+type Job struct {
+	ID       string
+	Template string
+	Context  HAContext
+	Created  time.Time
+
+	mu       sync.Mutex
+	chunks   []string
+	done     bool
+	finished time.Time
+	result   map[string]interface{}
+	err      error
+	updated  chan struct{}
+}
+
+type Jobs struct {
+	retention time.Duration
+
+	mu      sync.Mutex
+	jobs    map[string]*Job
+	batches map[string]*jobBatch
+}
+
+func newJobs(config *Config) *Jobs {
+	retention := 10 * time.Minute
+	if config.JobRetention > 0 {
+		retention = time.Duration(config.JobRetention) * time.Second
+	}
+	jobs := &Jobs{retention: retention, jobs: make(map[string]*Job), batches: make(map[string]*jobBatch)}
+	go jobs.cleanup()
+	return jobs
+}
+
+func newJobID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(fmt.Sprintf("failed to generate job ID: %v", err))
+	}
+	return hex.EncodeToString(id)
+}
+
+func (j *Jobs) create(templateName string, haContext HAContext) *Job {
+	job := &Job{ID: newJobID(), Template: templateName, Context: haContext, Created: time.Now(), updated: make(chan struct{})}
+	j.mu.Lock()
+	j.jobs[job.ID] = job
+	j.mu.Unlock()
+	return job
+}
+
+func (j *Jobs) get(id string) (*Job, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	job, ok := j.jobs[id]
+	return job, ok
+}
+
+// cleanup forgets finished jobs once they are older than the retention period.
+func (j *Jobs) cleanup() {
+	for range time.Tick(time.Minute) {
+		j.mu.Lock()
+		for id, job := range j.jobs {
+			job.mu.Lock()
+			expired := job.done && time.Since(job.finished) > j.retention
+			job.mu.Unlock()
+			if expired {
+				delete(j.jobs, id)
+			}
+		}
+		j.mu.Unlock()
+	}
+}
+
+// notify wakes everyone waiting on the job. Callers must hold job.mu.
+func (job *Job) notify() {
+	close(job.updated)
+	job.updated = make(chan struct{})
+}
+
+func (job *Job) append(chunk string) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.chunks = append(job.chunks, chunk)
+	job.notify()
+}
+
+func (job *Job) finish(result map[string]interface{}, err error) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.done = true
+	job.finished = time.Now()
+	job.result = result
+	job.err = err
+	job.notify()
+}
+
+// next returns the chunks after index from, waiting until there are new chunks,
+// the job finishes or ctx is cancelled.
+func (job *Job) next(ctx context.Context, from int) ([]string, bool) {
+	for {
+		job.mu.Lock()
+		if len(job.chunks) > from || job.done {
+			chunks := append([]string(nil), job.chunks[min(from, len(job.chunks)):]...)
+			done := job.done
+			job.mu.Unlock()
+			return chunks, done
+		}
+		updated := job.updated
+		job.mu.Unlock()
+
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+func (job *Job) outcome() (map[string]interface{}, error) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	return job.result, job.err
+}
+
+// JobStatus is the JSON representation of a job returned by GET /jobs/{id}.
+type JobStatus struct {
+	JobID    string                 `json:"job_id"`
+	Template string                 `json:"template"`
+	Context  *HAContext             `json:"context,omitempty"`
+	Status   string                 `json:"status"`
+	Partial  string                 `json:"partial,omitempty"`
+	Result   map[string]interface{} `json:"result,omitempty"`
+	Error    string                 `json:"error,omitempty"`
+	// ErrorStatus is the HTTP status the request would have failed with had
+	// it not been async, such as 429 or 503
+	ErrorStatus int `json:"error_status,omitempty"`
+}
+
+func (job *Job) status() JobStatus {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	status := JobStatus{JobID: job.ID, Template: job.Template, Status: "running"}
+	if job.Context.ID != "" {
+		status.Context = &job.Context
+	}
+	switch {
+	case job.done && job.err != nil:
+		status.Status = "failed"
+		status.ErrorStatus, status.Error = templateError(job.err)
+	case job.done:
+		status.Status = "done"
+		status.Result = job.result
+	default:
+		status.Partial = strings.Join(job.chunks, "")
+	}
+	return status
+}
+
+// waitDone blocks until the job finishes or ctx is done.
+func (job *Job) waitDone(ctx context.Context) {
+	seen := 0
+	for {
+		chunks, done := job.next(ctx, seen)
+		if done || ctx.Err() != nil {
+			return
+		}
+		seen += len(chunks)
+	}
+}
+
+// pollJob long-polls a job: it waits up to ?wait= seconds (capped by
+// max_poll_wait) for the job to finish, then returns its status. Finished jobs
+// return 200, failed jobs the status the request would have failed with and
+// jobs still running 202.
+func pollJob(config *Config, w http.ResponseWriter, r *http.Request, job *Job) {
+	maxWait := 60
+	if config.MaxPollWait > 0 {
+		maxWait = config.MaxPollWait
+	}
+
+	wait := 0
+	if value := r.URL.Query().Get("wait"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			http.Error(w, "wait must be a number of seconds", http.StatusBadRequest)
+			return
+		}
+		wait = min(seconds, maxWait)
+	}
+
+	if wait > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(wait)*time.Second)
+		job.waitDone(ctx)
+		cancel()
+		if r.Context().Err() != nil {
+			return
+		}
+	}
+
+	status := job.status()
+	code := http.StatusAccepted
+	switch status.Status {
+	case "done":
+		code = http.StatusOK
+	case "failed":
+		code = status.ErrorStatus
+		var limited *rateLimitError
+		if _, err := job.outcome(); errors.As(err, &limited) {
+			limited.setRetryAfter(w)
+		}
+	}
+	writeEncoded(w, r, code, status)
+}
+
+func writeEvent(w http.ResponseWriter, event string, data interface{}) {
+	payload, _ := json.Marshal(data)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+}
+
+// ndjsonType is the content type of newline delimited JSON streams, which
+// clients such as Node-RED and Benthos handle more easily than event streams.
+const ndjsonType = "application/x-ndjson"
+
+// streamJob sends a job to the client as server-sent events: a "token" event per
+// chunk from the start of the generation, then "done" with the full response or
+// "error". Clients that accept application/x-ndjson get a JSON object per line
+// instead, as Ollama streams: {"response": chunk, "done": false} per chunk,
+// then the full response with "done": true, or an "error".
+func streamJob(w http.ResponseWriter, r *http.Request, job *Job) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ndjson := strings.Contains(r.Header.Get("Accept"), ndjsonType)
+	if ndjson {
+		w.Header().Set("Content-Type", ndjsonType)
+	} else {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Connection", "keep-alive")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set(jobIDHeader, job.ID)
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	encoder := json.NewEncoder(w)
+	sent := 0
+	for {
+		chunks, done := job.next(r.Context(), sent)
+		if r.Context().Err() != nil {
+			return
+		}
+		for _, chunk := range chunks {
+			if ndjson {
+				encoder.Encode(map[string]interface{}{"response": chunk, "done": false})
+			} else {
+				writeEvent(w, "token", map[string]string{"response": chunk})
+			}
+		}
+		sent += len(chunks)
+
+		if done {
+			result, err := job.outcome()
+			var failure map[string]interface{}
+			if err != nil {
+				code, message := templateError(err)
+				failure = map[string]interface{}{"error": message, "error_status": code}
+			}
+			switch {
+			case ndjson && err != nil:
+				failure["done"] = true
+				encoder.Encode(failure)
+			case ndjson:
+				final := map[string]interface{}{"done": true}
+				for key, value := range result {
+					final[key] = value
+				}
+				encoder.Encode(final)
+			case err != nil:
+				writeEvent(w, "error", failure)
+			default:
+				writeEvent(w, "done", result)
+			}
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// jobsHandler serves GET /jobs/{id} to poll for a job's result and
+// GET /jobs/{id}/stream to attach to a generation in progress.
+func jobsHandler(config *Config, jobs *Jobs) http.HandlerFunc {
+	return authenticate(config, func(w http.ResponseWriter, r *http.Request) {
+		id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
+		job, ok := jobs.get(id)
+		if !ok {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
+		}
+
+		switch {
+		case r.Method != http.MethodGet:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		case action == "":
+			pollJob(config, w, r, job)
+		case action == "stream" && !config.Flags.Enabled(flagStreaming):
+			http.Error(w, "Streaming is disabled", http.StatusServiceUnavailable)
+		case action == "stream":
+			streamJob(w, r, job)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFailedJobStatus(t *testing.T) {
+	config := testConfig(t, `{"auth_token": "tok"}`)
+	tests := []struct {
+		name           string
+		err            error
+		wantStatus     int
+		wantError      string
+		wantRetryAfter string
+	}{
+		{"upstream", errors.New("connection refused"), http.StatusBadGateway, "Failed to get a response from the Ollama API", ""},
+		{"rate limited", &rateLimitError{template: "default", retryAfter: 90 * time.Second}, http.StatusTooManyRequests, "Too many requests for this template", "90"},
+		{"queue full", fmt.Errorf("waiting for the model: %w", errQueueFull), http.StatusServiceUnavailable, "Too many requests are waiting for the model, try again later", ""},
+		{"disabled", errTemplateDisabled, http.StatusServiceUnavailable, "This template is disabled", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobs := newJobs(config)
+			job := jobs.create("default", HAContext{})
+			job.finish(nil, tt.err)
+			handler := jobsHandler(config, jobs)
+
+			req := httptest.NewRequest(http.MethodGet, "/jobs/"+job.ID, nil)
+			req.Header.Set("Authorization", "Bearer tok")
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("poll status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.wantRetryAfter)
+			}
+			var status JobStatus
+			if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+				t.Fatal(err)
+			}
+			if status.Status != "failed" || status.Error != tt.wantError || status.ErrorStatus != tt.wantStatus {
+				t.Errorf("poll body = %+v", status)
+			}
+
+			req = httptest.NewRequest(http.MethodGet, "/jobs/"+job.ID+"/stream", nil)
+			req.Header.Set("Authorization", "Bearer tok")
+			req.Header.Set("Accept", ndjsonType)
+			rec = httptest.NewRecorder()
+			handler(rec, req)
+
+			var final map[string]interface{}
+			if err := json.Unmarshal([]byte(strings.TrimSpace(rec.Body.String())), &final); err != nil {
+				t.Fatal(err)
+			}
+			if final["error"] != tt.wantError || final["error_status"] != float64(tt.wantStatus) || final["done"] != true {
+				t.Errorf("stream = %v", final)
+			}
+		})
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Retries of an answer that doesn't match the schema, unless the template says
+// otherwise
+const defaultJSONOutputRetries = 2
+
+var errInvalidJSONOutput = errors.New("the model's answer didn't match the JSON schema")
+
+// JSONOutputConfig makes a template answer in JSON. The model is asked for
+// JSON, and its answer is checked against Schema, a JSON Schema. An answer
+// that doesn't match is sent back with what's wrong, up to Retries times,
+// before the request fails.
+type JSONOutputConfig struct {
+	Schema  json.RawMessage `json:"schema"`
+	Retries *int            `json:"retries"`
+
+	schema map[string]interface{}
+}
+
+func (c *JSONOutputConfig) parse() error {
+	if len(c.Schema) == 0 {
+		return errors.New("json_output needs a schema")
+	}
+	if err := json.Unmarshal(c.Schema, &c.schema); err != nil {
+		return fmt.Errorf("json_output schema must be a JSON object: %w", err)
+	}
+	if err := checkSchema(c.schema, "schema"); err != nil {
+		return fmt.Errorf("json_output %w", err)
+	}
+	if c.Retries != nil && *c.Retries < 0 {
+		return errors.New("json_output retries can't be negative")
+	}
+	return nil
+}
+
+func (c *JSONOutputConfig) retries() int {
+	if c.Retries == nil {
+		return defaultJSONOutputRetries
+	}
+	return *c.Retries
+}
+
+// jsonOutput is the template's JSON output config, nil when it answers in text.
+func (tc *TemplateConfig) jsonOutput(templateName string) *JSONOutputConfig {
+	if settings, ok := tc.Settings[templateName]; ok {
+		return settings.JSONOutput
+	}
+	return nil
+}
+
+// check reports what's wrong with an answer, ignoring the thinking of
+// reasoning models.
+func (c *JSONOutputConfig) check(text string) error {
+	answer, _ := splitReasoning(text)
+	var value interface{}
+	if err := json.Unmarshal([]byte(answer), &value); err != nil {
+		return fmt.Errorf("not valid JSON: %v", err)
+	}
+	return validateSchema(value, c.schema, "$")
+}
+
+// enforce checks the response, asking the model again while its answer doesn't
+// match the schema.
+func (c *JSONOutputConfig) enforce(ctx context.Context, backend Backend, ollamaRequest map[string]interface{}, chat bool, response map[string]interface{}) (map[string]interface{}, error) {
+	for attempt := 0; ; attempt++ {
+		text := responseContent(response, chat)
+		problem := c.check(text)
+		if problem == nil {
+			return response, nil
+		}
+		if attempt == c.retries() {
+			return nil, fmt.Errorf("%w: %v", errInvalidJSONOutput, problem)
+		}
+		slog.Info("Answer didn't match the JSON schema, retrying", "problem", problem, "attempt", attempt+1, "request_id", requestID(ctx))
+		retry := followUpRequest(ollamaRequest, chat, text, c.correction(problem))
+		var err error
+		if chat {
+			response, err = backend.Chat(ctx, retry, nil)
+		} else {
+			response, err = backend.Generate(ctx, retry, nil)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// correction asks the model to answer again with JSON matching the schema.
+func (c *JSONOutputConfig) correction(problem error) string {
+	return fmt.Sprintf("That answer is wrong: %v. Answer again with only JSON matching this schema:\n%s", problem, c.Schema)
+}
+
+// Types JSON Schema knows
+var schemaTypes = []string{"object", "array", "string", "number", "integer", "boolean", "null"}
+
+// checkSchema checks the keywords validateSchema understands, so mistakes in a
+// schema show up when it's loaded rather than as failing answers.
+func checkSchema(schema map[string]interface{}, path string) error {
+	for _, t := range schemaTypeList(schema) {
+		if !slices.Contains(schemaTypes, t) {
+			return fmt.Errorf("%s has unknown type '%s'", path, t)
+		}
+	}
+	if pattern, ok := schema["pattern"].(string); ok {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("%s has invalid pattern '%s'", path, pattern)
+		}
+	}
+	if properties, ok := schema["properties"].(map[string]interface{}); ok {
+		for name, property := range properties {
+			sub, ok := property.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%s.properties.%s must be a schema", path, name)
+			}
+			if err := checkSchema(sub, path+".properties."+name); err != nil {
+				return err
+			}
+		}
+	}
+	for _, key := range []string{"items", "additionalProperties"} {
+		if sub, ok := schema[key].(map[string]interface{}); ok {
+			if err := checkSchema(sub, path+"."+key); err != nil {
+				return err
+			}
+		}
+	}
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok {
+		for i, option := range anyOf {
+			sub, ok := option.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%s.anyOf[%d] must be a schema", path, i)
+			}
+			if err := checkSchema(sub, fmt.Sprintf("%s.anyOf[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func schemaTypeList(schema map[string]interface{}) []string {
+	switch t := schema["type"].(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		var types []string
+		for _, item := range t {
+			if s, ok := item.(string); ok {
+				types = append(types, s)
+			}
+		}
+		return types
+	}
+	return nil
+}
+
+// validateSchema checks a decoded JSON value against the commonly used part of
+// JSON Schema: type, enum, const, properties, required, additionalProperties,
+// items, anyOf and the length, size and range limits.
+func validateSchema(value interface{}, schema map[string]interface{}, path string) error {
+	if types := schemaTypeList(schema); len(types) > 0 {
+		actual := jsonType(value)
+		if !slices.Contains(types, actual) && !(actual == "integer" && slices.Contains(types, "number")) {
+			return fmt.Errorf("%s is %s, expected %s", path, actual, strings.Join(types, " or "))
+		}
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, option := range enum {
+			if jsonEqual(option, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s must be one of %s", path, compactJSON(enum))
+		}
+	}
+	if constant, ok := schema["const"]; ok && !jsonEqual(constant, value) {
+		return fmt.Errorf("%s must be %s", path, compactJSON(constant))
+	}
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok {
+		var problems []string
+		for _, option := range anyOf {
+			sub, _ := option.(map[string]interface{})
+			err := validateSchema(value, sub, path)
+			if err == nil {
+				problems = nil
+				break
+			}
+			problems = append(problems, err.Error())
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("%s matches none of the options: %s", path, strings.Join(problems, "; "))
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		properties, _ := schema["properties"].(map[string]interface{})
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, name := range required {
+				if key, _ := name.(string); key != "" {
+					if _, ok := v[key]; !ok {
+						return fmt.Errorf("%s is missing required property '%s'", path, key)
+					}
+				}
+			}
+		}
+		for _, key := range sortedKeys(v) {
+			if sub, ok := properties[key].(map[string]interface{}); ok {
+				if err := validateSchema(v[key], sub, path+"."+key); err != nil {
+					return err
+				}
+				continue
+			}
+			switch additional := schema["additionalProperties"].(type) {
+			case bool:
+				if !additional {
+					return fmt.Errorf("%s has unexpected property '%s'", path, key)
+				}
+			case map[string]interface{}:
+				if err := validateSchema(v[key], additional, path+"."+key); err != nil {
+					return err
+				}
+			}
+		}
+	case []interface{}:
+		if limit, ok := schema["minItems"].(float64); ok && float64(len(v)) < limit {
+			return fmt.Errorf("%s has %d items, at least %g expected", path, len(v), limit)
+		}
+		if limit, ok := schema["maxItems"].(float64); ok && float64(len(v)) > limit {
+			return fmt.Errorf("%s has %d items, at most %g expected", path, len(v), limit)
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				if err := validateSchema(item, items, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		length := len([]rune(v))
+		if limit, ok := schema["minLength"].(float64); ok && float64(length) < limit {
+			return fmt.Errorf("%s is shorter than %g characters", path, limit)
+		}
+		if limit, ok := schema["maxLength"].(float64); ok && float64(length) > limit {
+			return fmt.Errorf("%s is longer than %g characters", path, limit)
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			if re, err := regexp.Compile(pattern); err == nil && !re.MatchString(v) {
+				return fmt.Errorf("%s doesn't match the pattern %s", path, pattern)
+			}
+		}
+	case float64:
+		if limit, ok := schema["minimum"].(float64); ok && v < limit {
+			return fmt.Errorf("%s is less than %g", path, limit)
+		}
+		if limit, ok := schema["maximum"].(float64); ok && v > limit {
+			return fmt.Errorf("%s is more than %g", path, limit)
+		}
+	}
+	return nil
+}
+
+// jsonType is the JSON Schema type of a decoded value.
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case bool:
+		return "boolean"
+	}
+	return "null"
+}
+
+func jsonEqual(a, b interface{}) bool {
+	return compactJSON(a) == compactJSON(b)
+}
+
+func compactJSON(value interface{}) string {
+	data, _ := json.Marshal(value)
+	return string(data)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestValidateSchema(t *testing.T) {
+	schema := `{
+		"type": "object",
+		"required": ["room", "level"],
+		"additionalProperties": false,
+		"properties": {
+			"room": {"type": "string", "enum": ["kitchen", "lounge"]},
+			"level": {"type": "integer", "minimum": 0, "maximum": 100},
+			"scene": {"type": ["string", "null"], "minLength": 2, "maxLength": 8, "pattern": "^[a-z]+$"},
+			"lights": {"type": "array", "minItems": 1, "maxItems": 2, "items": {"type": "string"}},
+			"kind": {"const": "light"},
+			"target": {"anyOf": [{"type": "number"}, {"type": "string", "pattern": "^light\\."}]}
+		}
+	}`
+	var parsed map[string]interface{}
+	if err := json.Unmarshal([]byte(schema), &parsed); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		value   string
+		wantErr string
+	}{
+		{name: "minimal", value: `{"room": "kitchen", "level": 40}`},
+		{name: "everything", value: `{"room": "lounge", "level": 0, "scene": "movie", "lights": ["a", "b"], "kind": "light", "target": "light.lamp"}`},
+		{name: "null scene", value: `{"room": "lounge", "level": 1, "scene": null}`},
+		{name: "number target", value: `{"room": "lounge", "level": 1, "target": 2.5}`},
+		{name: "not an object", value: `"kitchen"`, wantErr: "$ is string, expected object"},
+		{name: "missing required", value: `{"room": "kitchen"}`, wantErr: "$ is missing required property 'level'"},
+		{name: "enum", value: `{"room": "garage", "level": 1}`, wantErr: `$.room must be one of ["kitchen","lounge"]`},
+		{name: "integer", value: `{"room": "kitchen", "level": 1.5}`, wantErr: "$.level is number, expected integer"},
+		{name: "minimum", value: `{"room": "kitchen", "level": -1}`, wantErr: "$.level is less than 0"},
+		{name: "maximum", value: `{"room": "kitchen", "level": 101}`, wantErr: "$.level is more than 100"},
+		{name: "minLength", value: `{"room": "kitchen", "level": 1, "scene": "a"}`, wantErr: "$.scene is shorter than 2 characters"},
+		{name: "maxLength", value: `{"room": "kitchen", "level": 1, "scene": "abcdefghi"}`, wantErr: "$.scene is longer than 8 characters"},
+		{name: "pattern", value: `{"room": "kitchen", "level": 1, "scene": "Movie"}`, wantErr: "$.scene doesn't match the pattern"},
+		{name: "minItems", value: `{"room": "kitchen", "level": 1, "lights": []}`, wantErr: "$.lights has 0 items, at least 1 expected"},
+		{name: "maxItems", value: `{"room": "kitchen", "level": 1, "lights": ["a", "b", "c"]}`, wantErr: "$.lights has 3 items, at most 2 expected"},
+		{name: "items", value: `{"room": "kitchen", "level": 1, "lights": ["a", 2]}`, wantErr: "$.lights[1] is integer, expected string"},
+		{name: "const", value: `{"room": "kitchen", "level": 1, "kind": "switch"}`, wantErr: `$.kind must be "light"`},
+		{name: "anyOf", value: `{"room": "kitchen", "level": 1, "target": "switch.fan"}`, wantErr: "$.target matches none of the options"},
+		{name: "additionalProperties", value: `{"room": "kitchen", "level": 1, "colour": "red"}`, wantErr: "$ has unexpected property 'colour'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var value interface{}
+			if err := json.Unmarshal([]byte(tt.value), &value); err != nil {
+				t.Fatal(err)
+			}
+			err := validateSchema(value, parsed, "$")
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestJSONOutputParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{name: "valid", config: `{"schema": {"type": "object", "properties": {"a": {"type": "array", "items": {"type": "string", "pattern": "^x"}}}}}`},
+		{name: "no schema", config: `{}`, wantErr: "json_output needs a schema"},
+		{name: "schema not an object", config: `{"schema": ["object"]}`, wantErr: "schema must be a JSON object"},
+		{name: "unknown type", config: `{"schema": {"type": "text"}}`, wantErr: "schema has unknown type 'text'"},
+		{name: "unknown nested type", config: `{"schema": {"properties": {"a": {"items": {"type": "float"}}}}}`, wantErr: "schema.properties.a.items has unknown type 'float'"},
+		{name: "invalid pattern", config: `{"schema": {"type": "string", "pattern": "("}}`, wantErr: "schema has invalid pattern '('"},
+		{name: "property not a schema", config: `{"schema": {"properties": {"a": "string"}}}`, wantErr: "schema.properties.a must be a schema"},
+		{name: "anyOf option not a schema", config: `{"schema": {"anyOf": [{"type": "string"}, 3]}}`, wantErr: "schema.anyOf[1] must be a schema"},
+		{name: "negative retries", config: `{"schema": {"type": "object"}, "retries": -1}`, wantErr: "retries can't be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var config JSONOutputConfig
+			if err := json.Unmarshal([]byte(tt.config), &config); err != nil {
+				t.Fatal(err)
+			}
+			err := config.parse()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestJSONOutputCheck(t *testing.T) {
+	config := JSONOutputConfig{Schema: json.RawMessage(`{"type": "object", "required": ["ok"]}`)}
+	if err := config.parse(); err != nil {
+		t.Fatal(err)
+	}
+	if config.retries() != defaultJSONOutputRetries {
+		t.Errorf("retries = %d, want the default", config.retries())
+	}
+	if err := config.check(`<think>The user wants JSON.</think>{"ok": true}`); err != nil {
+		t.Errorf("answer after thinking: %v", err)
+	}
+	if err := config.check(`Sure! {"ok": true}`); err == nil || !strings.Contains(err.Error(), "not valid JSON") {
+		t.Errorf("answer with prose: %v", err)
+	}
+	if err := config.check(`{}`); err == nil || !strings.Contains(err.Error(), "missing required property 'ok'") {
+		t.Errorf("answer without ok: %v", err)
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LatencyConfig sets the window latency percentiles are computed over and the
+// SLOs templates are held to.
+type LatencyConfig struct {
+	Window     string `json:"window"`
+	MinSamples int    `json:"min_samples"`
+	// SLOs maps a template name to its thresholds
+	SLOs map[string]SLOConfig `json:"slos"`
+	// AlertOutputs are notified when a template breaches or recovers its SLO
+	AlertOutputs []string `json:"alert_outputs"`
+}
+
+// SLOConfig is the latency a template must stay under at the given percentile
+// (p50, p95 or p99, default p95). Zero thresholds aren't checked.
+type SLOConfig struct {
+	Percentile   string `json:"percentile"`
+	FirstTokenMS int64  `json:"first_token_ms"`
+	TotalMS      int64  `json:"total_ms"`
+}
+
+// Samples kept per template at most, whatever the window
+const maxLatencySamples = 10000
+
+// LatencyPercentiles are in milliseconds.
+type LatencyPercentiles struct {
+	P50 int64 `json:"p50_ms"`
+	P95 int64 `json:"p95_ms"`
+	P99 int64 `json:"p99_ms"`
+}
+
+func (p LatencyPercentiles) at(percentile string) int64 {
+	switch percentile {
+	case "p50":
+		return p.P50
+	case "p99":
+		return p.P99
+	}
+	return p.P95
+}
+
+// TemplateLatency reports a template's latency over the window.
+type TemplateLatency struct {
+	Template   string             `json:"template"`
+	Requests   int                `json:"requests"`
+	FirstToken LatencyPercentiles `json:"first_token"`
+	Total      LatencyPercentiles `json:"total"`
+	SLO        *SLOConfig         `json:"slo,omitempty"`
+	Breached   bool               `json:"breached"`
+	Breaches   []string           `json:"breaches,omitempty"`
+}
+
+type latencySample struct {
+	at         time.Time
+	firstToken time.Duration
+	total      time.Duration
+}
+
+// LatencyTracker keeps recent per-template latencies and checks them against
+// the SLOs after every generation.
+type LatencyTracker struct {
+	config     LatencyConfig
+	window     time.Duration
+	minSamples int
+	outputs    *Outputs
+
+	mu       sync.Mutex
+	samples  map[string][]latencySample
+	breached map[string]bool
+	// Upstream requests by backend name, "" for api_url
+	backends map[string][]latencySample
+}
+
+func newLatencyTracker(config LatencyConfig, outputs *Outputs) (*LatencyTracker, error) {
+	tracker := &LatencyTracker{
+		config:     config,
+		window:     time.Hour,
+		minSamples: 10,
+		outputs:    outputs,
+		samples:    make(map[string][]latencySample),
+		breached:   make(map[string]bool),
+		backends:   make(map[string][]latencySample),
+	}
+	if config.Window != "" {
+		var err error
+		if tracker.window, err = time.ParseDuration(config.Window); err != nil || tracker.window <= 0 {
+			return nil, fmt.Errorf("invalid window '%s'", config.Window)
+		}
+	}
+	if config.MinSamples > 0 {
+		tracker.minSamples = config.MinSamples
+	}
+	for templateName, slo := range config.SLOs {
+		switch slo.Percentile {
+		case "", "p50", "p95", "p99":
+		default:
+			return nil, fmt.Errorf("slo '%s': percentile must be p50, p95 or p99", templateName)
+		}
+	}
+	for _, name := range config.AlertOutputs {
+		if !outputs.has(name) {
+			return nil, fmt.Errorf("unknown alert output '%s'", name)
+		}
+	}
+	return tracker, nil
+}
+
+// record adds a successful generation and re-evaluates the template's SLO.
+func (t *LatencyTracker) record(templateName string, firstToken, total time.Duration) {
+	if t == nil || templateName == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	samples := append(t.samples[templateName], latencySample{at: now, firstToken: firstToken, total: total})
+	t.samples[templateName] = t.prune(samples, now)
+
+	slo, ok := t.config.SLOs[templateName]
+	if !ok {
+		return
+	}
+	report := t.report(templateName, &slo)
+	if report.Breached == t.breached[templateName] {
+		return
+	}
+	t.breached[templateName] = report.Breached
+	t.notify(report)
+}
+
+// BackendLatency reports the latency of a backend's upstream requests over the
+// window.
+type BackendLatency struct {
+	Requests   int                `json:"requests"`
+	FirstToken LatencyPercentiles `json:"first_token"`
+	Total      LatencyPercentiles `json:"total"`
+}
+
+// recordBackend adds a successful upstream request to the named backend.
+func (t *LatencyTracker) recordBackend(backend string, firstToken, total time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	t.backends[backend] = t.prune(append(t.backends[backend], latencySample{at: now, firstToken: firstToken, total: total}), now)
+}
+
+// backend reports the named backend's latency.
+func (t *LatencyTracker) backend(name string) BackendLatency {
+	if t == nil {
+		return BackendLatency{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	samples := t.prune(t.backends[name], time.Now())
+	t.backends[name] = samples
+	var firstTokens, totals []int64
+	for _, sample := range samples {
+		totals = append(totals, sample.total.Milliseconds())
+		if sample.firstToken > 0 {
+			firstTokens = append(firstTokens, sample.firstToken.Milliseconds())
+		}
+	}
+	return BackendLatency{Requests: len(samples), FirstToken: latencyPercentiles(firstTokens), Total: latencyPercentiles(totals)}
+}
+
+// prune drops samples older than the window, and the oldest beyond the cap.
+func (t *LatencyTracker) prune(samples []latencySample, now time.Time) []latencySample {
+	i := 0
+	for i < len(samples) && now.Sub(samples[i].at) > t.window {
+		i++
+	}
+	if len(samples)-i > maxLatencySamples {
+		i = len(samples) - maxLatencySamples
+	}
+	return samples[i:]
+}
+
+// report computes the template's percentiles; t.mu must be held.
+func (t *LatencyTracker) report(templateName string, slo *SLOConfig) TemplateLatency {
+	samples := t.samples[templateName]
+	report := TemplateLatency{Template: templateName, Requests: len(samples), SLO: slo}
+
+	var firstTokens, totals []int64
+	for _, sample := range samples {
+		totals = append(totals, sample.total.Milliseconds())
+		// Generations without a measured first token don't count towards it
+		if sample.firstToken > 0 {
+			firstTokens = append(firstTokens, sample.firstToken.Milliseconds())
+		}
+	}
+	report.FirstToken = latencyPercentiles(firstTokens)
+	report.Total = latencyPercentiles(totals)
+
+	if slo == nil || len(samples) < t.minSamples {
+		return report
+	}
+	percentile := slo.Percentile
+	if percentile == "" {
+		percentile = "p95"
+	}
+	if value := report.FirstToken.at(percentile); slo.FirstTokenMS > 0 && len(firstTokens) >= t.minSamples && value > slo.FirstTokenMS {
+		report.Breaches = append(report.Breaches, fmt.Sprintf("%s time to first token %dms exceeds %dms", percentile, value, slo.FirstTokenMS))
+	}
+	if value := report.Total.at(percentile); slo.TotalMS > 0 && value > slo.TotalMS {
+		report.Breaches = append(report.Breaches, fmt.Sprintf("%s latency %dms exceeds %dms", percentile, value, slo.TotalMS))
+	}
+	report.Breached = len(report.Breaches) > 0
+	return report
+}
+
+func latencyPercentiles(values []int64) LatencyPercentiles {
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	return LatencyPercentiles{P50: percentile(values, 0.5), P95: percentile(values, 0.95), P99: percentile(values, 0.99)}
+}
+
+// notify logs a change of SLO status and sends it to the alert outputs.
+func (t *LatencyTracker) notify(report TemplateLatency) {
+	message := fmt.Sprintf("Template %s is within its latency SLO again", report.Template)
+	if report.Breached {
+		message = fmt.Sprintf("Template %s breached its latency SLO over the last %s: %s", report.Template, t.window, strings.Join(report.Breaches, "; "))
+	}
+	if report.Breached {
+		slog.Warn("Template breached its latency SLO", "template", report.Template, "window", t.window, "breaches", report.Breaches)
+	} else {
+		slog.Info("Template is within its latency SLO again", "template", report.Template)
+	}
+	if len(t.config.AlertOutputs) > 0 {
+		t.outputs.deliverTo(t.config.AlertOutputs, Delivery{
+			Source:   "slo",
+			Template: report.Template,
+			Response: message,
+			Fields:   map[string]interface{}{"response": message, "breached": report.Breached},
+			Time:     time.Now(),
+		})
+	}
+}
+
+// reports returns every template's latency, sorted by name.
+func (t *LatencyTracker) reports() []TemplateLatency {
+	reports := []TemplateLatency{}
+	if t == nil {
+		return reports
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for templateName, samples := range t.samples {
+		t.samples[templateName] = t.prune(samples, now)
+	}
+	for templateName := range t.config.SLOs {
+		if _, ok := t.samples[templateName]; !ok {
+			t.samples[templateName] = nil
+		}
+	}
+	for templateName := range t.samples {
+		var slo *SLOConfig
+		if config, ok := t.config.SLOs[templateName]; ok {
+			slo = &config
+		}
+		reports = append(reports, t.report(templateName, slo))
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Template < reports[j].Template })
+	return reports
+}
+
+// latencyHandler serves GET /admin/latency.
+func latencyHandler(config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		query, err := parseListQuery(r, 0)
+		if err != nil {
+			writeListError(w, err)
+			return
+		}
+		reports, err := applyListQuery(w, query, config.latency.reports())
+		if err != nil {
+			writeListError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, reports)
+	}
+}
+
+// breachedSLOs lists the templates in breach of their latency SLO.
+func (t *LatencyTracker) breachedSLOs() []string {
+	breached := []string{}
+	for _, report := range t.reports() {
+		if report.Breached {
+			breached = append(breached, report.Template)
+		}
+	}
+	return breached
+}
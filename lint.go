@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template/parse"
+)
+
+// Checks a lint problem comes from
+const (
+	lintUndefined = "undefined_variable"
+	lintUnused    = "unused_variable"
+	lintLength    = "length"
+	lintEscaping  = "html_escaping"
+)
+
+// LintProblem is something in a template that's probably a mistake, although
+// the template works.
+type LintProblem struct {
+	Check   string `json:"check"`
+	Line    int    `json:"line,omitempty"`
+	Message string `json:"message"`
+}
+
+// inputVariables are the template data each request field fills in. Messages
+// aren't listed as chat templates send them without using them.
+var inputVariables = map[string]string{
+	"query":        "Query",
+	"ics":          "Events",
+	"calendar_url": "Events",
+	"csv":          "Table",
+	"tsv":          "Table",
+	"document":     "Document",
+	"url":          "Page",
+	"log":          "Logs",
+}
+
+// A query with the characters HTML escaping changes, rendered to find out
+// whether the template escapes what it inserts
+const lintProbe = `It's "quoted" & <tagged>`
+
+var htmlEntity = regexp.MustCompile(`&(amp|lt|gt|quot|apos|nbsp|#[0-9]+|#[xX][0-9a-fA-F]+);`)
+
+var templateDataType = reflect.TypeOf(TemplateData{})
+
+// templateLinter collects the problems found walking a template.
+type templateLinter struct {
+	text     string
+	problems []LintProblem
+	// Line each template data field is first used on
+	used map[string]int
+	// The template's own text, without what it inserts
+	fixed strings.Builder
+}
+
+// lintTemplate checks a template's text for unused and undefined variables,
+// text too long for the model's context window and HTML escaping the model
+// would see.
+func lintTemplate(ctx context.Context, config *Config, templateConfig *TemplateConfig, name, text string) ([]LintProblem, error) {
+	tmpl, err := parsePromptTemplate(name+".json", text)
+	if err != nil {
+		return nil, err
+	}
+	l := &templateLinter{text: text, used: make(map[string]int)}
+	if tmpl.Tree != nil {
+		l.walk(tmpl.Tree.Root, templateDataType)
+	}
+	l.checkInputs(config, templateConfig.Settings[name])
+	l.checkLength(ctx, config, templateConfig, name)
+	// Rendering escapes the template, so it comes after the walk
+	l.checkEscaping(tmpl)
+	// In the order of the text, then those about the whole template
+	sort.SliceStable(l.problems, func(i, j int) bool {
+		a, b := l.problems[i].Line, l.problems[j].Line
+		return a != 0 && (b == 0 || a < b)
+	})
+	return l.problems, nil
+}
+
+// singleTemplateConfig is a template config with only the given template's
+// settings, for linting a template that isn't loaded.
+func singleTemplateConfig(name string, settings *TemplateSettings) *TemplateConfig {
+	templateConfig := &TemplateConfig{
+		Params:          make(map[string]map[string]interface{}),
+		Fields:          make(map[string][]string),
+		RequestTimeouts: make(map[string]int),
+		Settings:        make(map[string]*TemplateSettings),
+	}
+	templateConfig.setSettings(name, settings)
+	return templateConfig
+}
+
+func (l *templateLinter) report(check string, pos parse.Pos, format string, args ...interface{}) {
+	problem := LintProblem{Check: check, Message: fmt.Sprintf(format, args...)}
+	if pos >= 0 {
+		problem.Line = l.line(pos)
+	}
+	l.problems = append(l.problems, problem)
+}
+
+func (l *templateLinter) line(pos parse.Pos) int {
+	return strings.Count(l.text[:min(int(pos), len(l.text))], "\n") + 1
+}
+
+// walk checks the fields used in a node, with dot of the given type. Inside
+// range and with, dot is the element or value when its type is known, and nil
+// otherwise, which skips the checks.
+func (l *templateLinter) walk(node parse.Node, dot reflect.Type) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			l.walk(child, dot)
+		}
+	case *parse.TextNode:
+		l.fixed.Write(n.Text)
+		l.checkEntities(n)
+	case *parse.ActionNode:
+		l.pipe(n.Pipe, dot)
+	case *parse.IfNode:
+		l.pipe(n.Pipe, dot)
+		l.walk(n.List, dot)
+		l.walk(n.ElseList, dot)
+	case *parse.RangeNode:
+		l.walk(n.List, elemType(l.pipe(n.Pipe, dot)))
+		l.walk(n.ElseList, dot)
+	case *parse.WithNode:
+		l.walk(n.List, l.pipe(n.Pipe, dot))
+		l.walk(n.ElseList, dot)
+	case *parse.TemplateNode:
+		if n.Pipe != nil {
+			l.pipe(n.Pipe, dot)
+		}
+	}
+}
+
+// pipe checks a pipeline, returning its type when it's a lone field.
+func (l *templateLinter) pipe(pipe *parse.PipeNode, dot reflect.Type) reflect.Type {
+	var result reflect.Type
+	for _, cmd := range pipe.Cmds {
+		result = nil
+		for _, arg := range cmd.Args {
+			result = l.arg(arg, dot)
+		}
+		if len(cmd.Args) != 1 {
+			result = nil
+		}
+	}
+	return result
+}
+
+func (l *templateLinter) arg(node parse.Node, dot reflect.Type) reflect.Type {
+	switch n := node.(type) {
+	case *parse.FieldNode:
+		return l.fields(n.Pos, ".", n.Ident, dot)
+	case *parse.VariableNode:
+		// $ is the template data wherever it's used
+		if n.Ident[0] == "$" {
+			return l.fields(n.Pos, "$.", n.Ident[1:], templateDataType)
+		}
+	case *parse.ChainNode:
+		return l.fields(n.Pos, "(...).", n.Field, l.arg(n.Node, dot))
+	case *parse.PipeNode:
+		l.pipe(n, dot)
+	}
+	return nil
+}
+
+// fields follows field names from a value of type t, reporting the first that
+// doesn't exist. The type is unknown past maps and interfaces.
+func (l *templateLinter) fields(pos parse.Pos, prefix string, idents []string, t reflect.Type) reflect.Type {
+	for i, ident := range idents {
+		if t == nil {
+			return nil
+		}
+		if t == templateDataType {
+			if _, ok := l.used[ident]; !ok {
+				l.used[ident] = l.line(pos)
+			}
+		}
+		for t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+		if method, ok := reflect.PointerTo(t).MethodByName(ident); ok {
+			t = nil
+			if method.Type.NumOut() > 0 {
+				t = method.Type.Out(0)
+			}
+			continue
+		}
+		switch t.Kind() {
+		case reflect.Map, reflect.Interface:
+			return nil
+		case reflect.Struct:
+			field, ok := t.FieldByName(ident)
+			if ok && field.IsExported() {
+				t = field.Type
+				continue
+			}
+		}
+		name := prefix + strings.Join(idents[:i+1], ".")
+		if suggestion := closestString(ident, structFields(t)); suggestion != "" {
+			l.report(lintUndefined, pos, "%s isn't defined (did you mean '%s'?)", name, suggestion)
+		} else {
+			l.report(lintUndefined, pos, "%s isn't defined", name)
+		}
+		return nil
+	}
+	return t
+}
+
+func structFields(t reflect.Type) []string {
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	var names []string
+	for _, field := range reflect.VisibleFields(t) {
+		if field.IsExported() {
+			names = append(names, field.Name)
+		}
+	}
+	return names
+}
+
+// elemType is the type range sets dot to when ranging over a value of type t.
+func elemType(t reflect.Type) reflect.Type {
+	if t == nil {
+		return nil
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return t.Elem()
+	}
+	return nil
+}
+
+// checkInputs compares the inputs a template declares with the variables it
+// uses. Declared inputs should be used, and with strict inputs a variable only
+// has a value when an input filling it is declared.
+func (l *templateLinter) checkInputs(config *Config, settings *TemplateSettings) {
+	if settings == nil || len(settings.Inputs) == 0 {
+		return
+	}
+	for _, input := range settings.Inputs {
+		if variable, ok := inputVariables[input]; ok {
+			if _, used := l.used[variable]; !used {
+				l.report(lintUnused, -1, "the input '%s' is declared but .%s isn't used", input, variable)
+			}
+		}
+	}
+
+	strict := config.StrictInputs
+	if settings.StrictInputs != nil {
+		strict = *settings.StrictInputs
+	}
+	if !strict {
+		return
+	}
+	for _, variable := range sortedKeys(l.used) {
+		var fillers []string
+		for _, input := range sortedKeys(inputVariables) {
+			if inputVariables[input] == variable {
+				fillers = append(fillers, input)
+			}
+		}
+		if len(fillers) == 0 || variable == "Query" {
+			continue
+		}
+		declared := false
+		for _, input := range fillers {
+			declared = declared || containsString(settings.Inputs, input)
+		}
+		if !declared {
+			l.problems = append(l.problems, LintProblem{
+				Check:   lintUndefined,
+				Line:    l.used[variable],
+				Message: fmt.Sprintf(".%s is always empty, as strict inputs rejects %s", variable, strings.Join(fillers, " and ")),
+			})
+		}
+	}
+}
+
+// checkLength compares the template's own text and the system prompt with the
+// context window its requests get, with room for the answer.
+func (l *templateLinter) checkLength(ctx context.Context, config *Config, templateConfig *TemplateConfig, name string) {
+	options, _ := templateConfig.ollamaParams(config, name)["options"].(map[string]interface{})
+	budget := intOption(options, "num_ctx")
+	if budget > 0 || config.AutoNumCtx {
+		model := templateConfig.defaultModel(config, name)
+		if maxContext := config.models.contextLength(ctx, config, model); maxContext > 0 && (budget == 0 || budget > maxContext) {
+			budget = maxContext
+		}
+	}
+	if budget == 0 {
+		budget = defaultNumCtx
+	}
+
+	tokens := estimateTokens(l.fixed.String()) + estimateTokens(templateConfig.systemPrompt(config, name))
+	available := budget - answerTokens(options)
+	switch {
+	case tokens > available:
+		l.report(lintLength, -1, "the template's text is about %d tokens, more than the %d a %d token context window leaves after the answer", tokens, available, budget)
+	case tokens > available/2:
+		l.report(lintLength, -1, "the template's text is about %d of the %d tokens available for the prompt, leaving little room for inputs", tokens, available)
+	}
+}
+
+// checkEntities reports HTML entities in the template's text, which the model
+// sees as they are, usually from text pasted from a web page.
+func (l *templateLinter) checkEntities(text *parse.TextNode) {
+	seen := make(map[string]bool)
+	for _, match := range htmlEntity.FindAllIndex(text.Text, -1) {
+		entity := string(text.Text[match[0]:match[1]])
+		if seen[entity] {
+			continue
+		}
+		seen[entity] = true
+		l.report(lintEscaping, text.Pos+parse.Pos(match[0]), "%s is an HTML entity, which the model sees as it is", entity)
+	}
+}
+
+// checkEscaping renders the template with a query that HTML escaping would
+// change. Entities the template's text doesn't have come from escaping what it
+// inserts, so a query of "it's" reaches the model as "it&#39;s".
+func (l *templateLinter) checkEscaping(tmpl *template.Template) {
+	prompt, err := processTemplate(tmpl, TemplateData{Query: lintProbe})
+	if err != nil {
+		// Templates that need more than a query can't be checked this way
+		return
+	}
+	if len(htmlEntity.FindAllString(prompt, -1)) > len(htmlEntity.FindAllString(l.fixed.String(), -1)) {
+		l.report(lintEscaping, -1, "inserted values are HTML-escaped, so the model sees entities such as &#39; for quotes; insert them with toJson")
+	}
+}
+
+// runLint lints every template, or the named ones, failing if it finds any
+// problems.
+func runLint(args []string) error {
+	flags := flag.NewFlagSet("lint", flag.ContinueOnError)
+	configPath := flags.String("config", envDefault(configPathEnv, "config.json"), "path to config.json")
+	templatesDir := flags.String("templates", envDefault(templatesDirEnv, "templates"), "path to the templates directory")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	names := flags.Args()
+	if len(names) == 0 {
+		if names, err = templateNames(*templatesDir); err != nil {
+			return err
+		}
+	}
+
+	var found int
+	for _, name := range names {
+		text, err := os.ReadFile(filepath.Join(*templatesDir, name+".json"))
+		if err != nil {
+			return err
+		}
+		settings, err := loadTemplateSettings(*templatesDir, name)
+		if err != nil {
+			return fmt.Errorf("%s: settings: %w", name, err)
+		}
+		problems, err := lintTemplate(context.Background(), config, singleTemplateConfig(name, settings), name, string(text))
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if len(problems) == 0 {
+			fmt.Printf("ok   %s\n", name)
+		}
+		for _, problem := range problems {
+			location := name
+			if problem.Line > 0 {
+				location = fmt.Sprintf("%s:%d", name, problem.Line)
+			}
+			fmt.Printf("LINT %s: %s (%s)\n", location, problem.Message, problem.Check)
+		}
+		found += len(problems)
+	}
+	if found > 0 {
+		return fmt.Errorf("%d problems found", found)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLintTemplate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"config_version": 2, "request_timeout": 10, "default_model": "llama3"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	strict := true
+
+	tests := []struct {
+		name     string
+		text     string
+		settings *TemplateSettings
+		want     []LintProblem
+	}{
+		{name: "clean", text: "Answer briefly.\n{{ .Query | toJson }}"},
+		{
+			name: "undefined field",
+			text: "Answer briefly.\n{{ .Qurey | toJson }}",
+			want: []LintProblem{{Check: lintUndefined, Line: 2, Message: ".Qurey isn't defined (did you mean 'Query'?)"}},
+		},
+		{
+			name: "undefined field in range",
+			text: "{{ .Query | toJson }}\n{{ range .Events }}\n{{ .Sumary | toJson }}{{ end }}",
+			want: []LintProblem{{Check: lintUndefined, Line: 3, Message: ".Sumary isn't defined (did you mean 'Summary'?)"}},
+		},
+		{
+			name: "undefined field from $",
+			text: "{{ range .Events }}{{ $.Qery | toJson }}{{ end }}",
+			want: []LintProblem{{Check: lintUndefined, Line: 1, Message: "$.Qery isn't defined (did you mean 'Query'?)"}},
+		},
+		{
+			name:     "unused input",
+			text:     "{{ .Query | toJson }}",
+			settings: &TemplateSettings{Inputs: []string{"ics"}},
+			want:     []LintProblem{{Check: lintUnused, Message: "the input 'ics' is declared but .Events isn't used"}},
+		},
+		{
+			name:     "strict inputs",
+			text:     "{{ .Query | toJson }}\n{{ with .Table }}table{{ end }}\n{{ with .Document }}document{{ end }}",
+			settings: &TemplateSettings{Inputs: []string{"csv"}, StrictInputs: &strict},
+			want:     []LintProblem{{Check: lintUndefined, Line: 3, Message: ".Document is always empty, as strict inputs rejects document"}},
+		},
+		{
+			name: "entity in the text",
+			text: "Tom &amp; Jerry\n{{ .Query | toJson }}",
+			want: []LintProblem{{Check: lintEscaping, Line: 1, Message: "&amp; is an HTML entity, which the model sees as it is"}},
+		},
+		{
+			name: "escaped query",
+			text: "Answer briefly.\n{{ .Query }}",
+			want: []LintProblem{{Check: lintEscaping, Message: "inserted values are HTML-escaped, so the model sees entities such as &#39; for quotes; insert them with toJson"}},
+		},
+		{
+			name: "too long",
+			text: strings.Repeat("Answer briefly. ", 2000) + "{{ .Query | toJson }}",
+			want: []LintProblem{{Check: lintLength}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := tt.settings
+			if settings == nil {
+				settings = &TemplateSettings{}
+			}
+			problems, err := lintTemplate(context.Background(), config, singleTemplateConfig("test", settings), "test", tt.text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(problems) != len(tt.want) {
+				t.Fatalf("got %+v, want %+v", problems, tt.want)
+			}
+			for i, want := range tt.want {
+				got := problems[i]
+				if got.Check != want.Check || got.Line != want.Line || (want.Message != "" && got.Message != want.Message) {
+					t.Errorf("problem %d = %+v, want %+v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLintTemplateParseError(t *testing.T) {
+	if _, err := lintTemplate(context.Background(), &Config{}, singleTemplateConfig("test", &TemplateSettings{}), "test", "{{ .Query "); err == nil {
+		t.Error("expected an error for a template that doesn't parse")
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// LoggingConfig sets the lowest level logged (debug, info, warn or error) and
+// the format: text, or json for collectors such as Loki or Elasticsearch.
+type LoggingConfig struct {
+	Level  string `json:"level"`
+	Format string `json:"format"`
+}
+
+// logLevel is shared by the handler so reloads can change it
+var logLevel = new(slog.LevelVar)
+
+func (c LoggingConfig) level() (slog.Level, error) {
+	var level slog.Level
+	if c.Level == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := level.UnmarshalText([]byte(c.Level)); err != nil {
+		return 0, fmt.Errorf("unknown logging level '%s', expected debug, info, warn or error", c.Level)
+	}
+	return level, nil
+}
+
+func (c LoggingConfig) check() error {
+	switch c.Format {
+	case "", "text", "json":
+	default:
+		return fmt.Errorf("unknown logging format '%s', expected text or json", c.Format)
+	}
+	_, err := c.level()
+	return err
+}
+
+// setupLogging sends the server's logs, including anything written with the
+// log package, to a text or JSON handler on stderr.
+func setupLogging(c LoggingConfig) {
+	level, _ := c.level()
+	logLevel.Set(level)
+	options := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, options)
+	if c.Format == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// fatal logs an error and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// Header carrying the request ID. A client or proxy may set it, otherwise one
+// is generated, and it is returned in the response.
+const requestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// requestID returns the ID of the request the context belongs to, or "".
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(data)
+}
+
+// Flush keeps streamed responses working through the recorder.
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// assignRequestID gives each request an ID, carried in its context.
+func assignRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" || len(id) > 128 || strings.ContainsAny(id, "\r\n") {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// logRequests logs each request once it is served.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		args := []any{
+			"request_id", requestID(r.Context()),
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", recorder.status,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"remote_addr", r.RemoteAddr,
+		}
+		if trace := traceID(r.Context()); trace != "" {
+			args = append(args, "trace_id", trace)
+		}
+		slog.Info("Request", args...)
+	})
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"html/template"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -15,16 +19,80 @@ import (
 )
 
 type Config struct {
-	ServerAddress  string                 `json:"server_address"`
-	APIURL         string                 `json:"api_url"`
-	APIKey         string                 `json:"api_key"`
-	SystemPrompt   string                 `json:"system_prompt"`
-	AuthToken      string                 `json:"auth_token"`
-	DefaultModel   string                 `json:"default_model"`
-	OllamaParams   map[string]interface{} `json:"ollama_params"`
-	ResponseFields []string               `json:"response_fields"`
-	RequestTimeout int                    `json:"request_timeout"`
-	StripNewline   bool                   `json:"strip_newline"`
+	ConfigVersion   int                      `json:"config_version"`
+	ServerAddress   string                   `json:"server_address"`
+	APIURL          string                   `json:"api_url"`
+	APIURLs         []string                 `json:"api_urls"`
+	LoadBalancing   LoadBalancingConfig      `json:"load_balancing"`
+	APIKey          string                   `json:"api_key"`
+	SystemPrompt    string                   `json:"system_prompt"`
+	AuthToken       string                   `json:"auth_token"`
+	AdminToken      string                   `json:"admin_token"`
+	DefaultModel    string                   `json:"default_model"`
+	ModelAliases    map[string]string        `json:"model_aliases"`
+	OllamaParams    map[string]interface{}   `json:"ollama_params"`
+	ResponseFields  []string                 `json:"response_fields"`
+	RequestTimeout  int                      `json:"request_timeout"`
+	StripNewline    bool                     `json:"strip_newline"`
+	PostProcess     []PostProcessStep        `json:"post_process"`
+	Reasoning       ReasoningConfig          `json:"reasoning"`
+	WatchTemplates  bool                     `json:"watch_templates"`
+	AutoNumCtx      bool                     `json:"auto_num_ctx"`
+	PromptTrimming  []string                 `json:"prompt_trimming"`
+	StrictInputs    bool                     `json:"strict_inputs"`
+	Trace           bool                     `json:"trace"`
+	Flags           *FeatureFlags            `json:"flags"`
+	JobRetention    int                      `json:"job_retention"`
+	MaxPollWait     int                      `json:"max_poll_wait"`
+	Outputs         []OutputConfig           `json:"outputs"`
+	Schedules       []ScheduleConfig         `json:"schedules"`
+	Scheduling      SchedulingConfig         `json:"scheduling"`
+	Webhooks        []WebhookConfig          `json:"webhooks"`
+	Inputs          InputConfig              `json:"inputs"`
+	Fetch           FetchConfig              `json:"fetch"`
+	Compact         CompactConfig            `json:"compact"`
+	MQTT            MQTTConfig               `json:"mqtt"`
+	Signing         SigningConfig            `json:"signing"`
+	History         HistoryConfig            `json:"history"`
+	Frigate         FrigateConfig            `json:"frigate"`
+	Alerts          AlertsConfig             `json:"alerts"`
+	GitHub          GitHubConfig             `json:"github"`
+	OpenAI          OpenAIConfig             `json:"openai"`
+	OllamaIngress   OllamaIngressConfig      `json:"ollama_ingress"`
+	Conversation    ConversationConfig       `json:"conversation"`
+	Memory          MemoryConfig             `json:"memory"`
+	Latency         LatencyConfig            `json:"latency"`
+	Hedge           HedgeConfig              `json:"hedge"`
+	FailoverURLs    []string                 `json:"failover_urls"`
+	Retry           RetryConfig              `json:"retry"`
+	AdaptiveTimeout AdaptiveTimeoutConfig    `json:"adaptive_timeout"`
+	Backends        map[string]BackendConfig `json:"backends"`
+	Metrics         MetricsConfig            `json:"metrics"`
+	TLSCert         string                   `json:"tls_cert"`
+	TLSKey          string                   `json:"tls_key"`
+	Autocert        AutocertConfig           `json:"autocert"`
+	Cache           CacheConfig              `json:"cache"`
+	Logging         LoggingConfig            `json:"logging"`
+	OpenTelemetry   OpenTelemetryConfig      `json:"opentelemetry"`
+	Watermark       WatermarkConfig          `json:"watermark"`
+	Refusals        RefusalConfig            `json:"refusals"`
+	Confidence      ConfidenceConfig         `json:"confidence"`
+	Queue           QueueConfig              `json:"queue"`
+	Moderation      ModerationConfig         `json:"moderation"`
+	Routes          map[string]*RouteConfig  `json:"routes"`
+	Actions         ActionsConfig            `json:"actions"`
+
+	models     *ModelCatalog
+	latency    *LatencyTracker
+	limits     *RateLimiter
+	metrics    *Metrics
+	cache      *ResponseCache
+	balancer   *Balancer
+	queues     *Queues
+	pools      *Queues
+	routeCache *RouteCache
+	coalescer  *Coalescer
+	memory     *Memory
 }
 
 type TemplateConfig struct {
@@ -32,6 +100,83 @@ type TemplateConfig struct {
 	Params          map[string]map[string]interface{}
 	Fields          map[string][]string
 	RequestTimeouts map[string]int
+	Settings        map[string]*TemplateSettings
+	// Versions identify each template's text, for watermarks
+	Versions map[string]string
+}
+
+// TemplateSettings are optional per-template settings, read from a sidecar
+// <name>.config.json file next to the template.
+type TemplateSettings struct {
+	AllowedModels []string `json:"allowed_models"`
+	StrictInputs  *bool    `json:"strict_inputs"`
+	Inputs        []string `json:"inputs"`
+	Chat          bool     `json:"chat"`
+	// Disabled takes the template out of service without deleting it
+	Disabled bool `json:"disabled"`
+	// Description and Example document the template at GET /template/{name}
+	Description string           `json:"description"`
+	Example     *TemplateExample `json:"example"`
+
+	// Overrides of the global config for this template
+	Model          string                 `json:"model"`
+	OllamaParams   map[string]interface{} `json:"ollama_params"`
+	SystemPrompt   string                 `json:"system_prompt"`
+	ResponseFields []string               `json:"response_fields"`
+	RequestTimeout int                    `json:"request_timeout"`
+	HedgeAfterMS   int                    `json:"hedge_after_ms"`
+	// Backend is a name from the config's backends, empty for api_url
+	Backend string `json:"backend"`
+	// Pool is a worker pool from the config's queue, whose limits the
+	// template's generations share
+	Pool string `json:"pool"`
+
+	// ResponseMap renames response fields, such as response to speech, or
+	// nests them with a dotted path such as stats.eval_count
+	ResponseMap map[string]string `json:"response_map"`
+
+	// Extract takes response fields out of the answer, such as on_off for
+	// an automation
+	Extract map[string]*ExtractRule `json:"extract"`
+	// Coerce turns the answer, or an extracted field, into one of a fixed
+	// set of values such as on or off
+	Coerce map[string]*CoerceRule `json:"coerce"`
+
+	// Reasoning overrides how the thinking of reasoning models is handled
+	Reasoning *ReasoningConfig `json:"reasoning"`
+
+	// PostProcess replaces the post_process chain, with [] for none
+	PostProcess []PostProcessStep `json:"post_process"`
+
+	// CacheTTL overrides the cache ttl, with 0s for no caching
+	CacheTTL string `json:"cache_ttl"`
+
+	// Watermark overrides how responses are tagged
+	Watermark *WatermarkConfig `json:"watermark"`
+
+	// Refusals overrides how declined responses are detected
+	Refusals *RefusalConfig `json:"refusals"`
+
+	// Confidence overrides how answers are rated
+	Confidence *ConfidenceConfig `json:"confidence"`
+
+	// JSONOutput makes the template answer in JSON matching a schema
+	JSONOutput *JSONOutputConfig `json:"json_output"`
+
+	// Limits on how often the template runs, to keep event storms off the GPU
+	RateLimit *RateLimitConfig `json:"rate_limit"`
+	Cooldown  string           `json:"cooldown"`
+
+	// Debounce collects requests arriving within the window and runs the
+	// template once over all of them
+	Debounce string `json:"debounce"`
+
+	// Actions are the config's actions the model may call
+	Actions []string `json:"actions"`
+
+	cooldown time.Duration
+	debounce time.Duration
+	cacheTTL time.Duration
 }
 
 type OllamaResponse struct {
@@ -49,7 +194,25 @@ type OllamaResponse struct {
 }
 
 type TemplateData struct {
-	Query string
+	Query    string
+	Events   []CalendarEvent
+	Table    *Table
+	Document *Document
+	Page     *WebPage
+	Logs     *Logs
+	// Base64 encoded images for vision models
+	Images []string
+	// Prior conversation for chat templates
+	Messages []ChatMessage
+	// Ollama options set by the request, such as num_predict from OpenAI clients
+	Options map[string]interface{}
+	// Language of the request, such as "en" from Home Assistant's conversation API
+	Language string
+	// Conversation the request continues, when memory is enabled
+	ConversationID string
+	// Fields are the request's fields other than the query, such as a
+	// temperature sent by an automation, as {{ .Fields.temp }}
+	Fields map[string]interface{}
 }
 
 func loadConfig(configPath string) (*Config, error) {
@@ -64,20 +227,106 @@ func loadConfig(configPath string) (*Config, error) {
 		return nil, err
 	}
 
+	migrated, changed, err := migrateConfig(bytes)
+	if err != nil {
+		return nil, err
+	}
+	if changed {
+		saveMigratedConfig(configPath, bytes, migrated, configVersion(bytes))
+		bytes = migrated
+	}
+	warnUnknownConfigFields(bytes)
+
 	var config Config
 	err = json.Unmarshal(bytes, &config)
 	if err != nil {
 		return nil, err
 	}
+	overrides, err := applyEnvOverrides(&config)
+	if err != nil {
+		return nil, err
+	}
+	if len(overrides) > 0 {
+		slog.Info("Config overridden by environment", "variables", overrides)
+	}
+	if config.Flags == nil {
+		config.Flags = &FeatureFlags{}
+	}
+	config.models = newModelCatalog()
+	config.limits = newRateLimiter()
+	config.metrics = newMetrics()
+	config.cache = newResponseCache()
+	config.balancer = newBalancer()
+	config.queues = newQueues()
+	config.pools = newQueues()
+	config.routeCache = newRouteCache()
+	config.coalescer = newCoalescer()
+	config.memory = newMemory()
+	config.Actions.approvals = newApprovals()
+
+	for _, strategy := range config.PromptTrimming {
+		if strategy != trimData && strategy != trimPrompt && strategy != trimReject && strategy != trimHistory {
+			return nil, fmt.Errorf("unknown prompt_trimming strategy '%s'", strategy)
+		}
+	}
+	if err := checkBackends(config.Backends); err != nil {
+		return nil, err
+	}
+	if err := config.Cache.parse(); err != nil {
+		return nil, err
+	}
+	if err := config.LoadBalancing.check(); err != nil {
+		return nil, err
+	}
+	if err := config.Logging.check(); err != nil {
+		return nil, err
+	}
+	if err := config.OpenTelemetry.check(); err != nil {
+		return nil, err
+	}
+	if err := config.Refusals.parse(); err != nil {
+		return nil, err
+	}
+	if err := config.Queue.parse(); err != nil {
+		return nil, err
+	}
+	if err := config.Memory.parse(); err != nil {
+		return nil, err
+	}
+	if err := parsePostProcess(config.PostProcess); err != nil {
+		return nil, err
+	}
+	if err := config.Actions.parse(); err != nil {
+		return nil, err
+	}
+	if err := config.Moderation.check(config.Outputs); err != nil {
+		return nil, err
+	}
+	for path, route := range config.Routes {
+		if err := route.parse(path); err != nil {
+			return nil, err
+		}
+	}
+	// Model details are looked up on the first of api_urls
+	if config.APIURL == "" && len(config.APIURLs) > 0 {
+		config.APIURL = ollamaEndpoint(&Config{APIURL: config.APIURLs[0]}, "/api/generate")
+	}
 
 	return &config, nil
 }
 
 func loadAndCacheTemplates(templatesDir string) (*TemplateConfig, error) {
-	templateConfig := &TemplateConfig{Templates: make(map[string]*template.Template)}
+	templateConfig := &TemplateConfig{
+		Templates:       make(map[string]*template.Template),
+		Params:          make(map[string]map[string]interface{}),
+		Fields:          make(map[string][]string),
+		RequestTimeouts: make(map[string]int),
+		Settings:        make(map[string]*TemplateSettings),
+		Versions:        make(map[string]string),
+	}
 
 	if _, err := os.Stat(templatesDir); os.IsNotExist(err) {
-		log.Printf("Templates directory '%s' does not exist, creating it...", templatesDir)
+		slog.Info("Templates directory does not exist, creating it", "path", templatesDir)
 		if err := os.MkdirAll(templatesDir, os.ModePerm); err != nil {
 			return nil, err
 		}
@@ -90,51 +339,222 @@ func loadAndCacheTemplates(templatesDir string) (*TemplateConfig, error) {
 
 	for _, file := range files {
 		templateName := file.Name()
+		if strings.HasSuffix(templateName, templateSettingsSuffix) || strings.HasSuffix(templateName, templateTestSuffix) {
+			continue
+		}
 		if filepath.Ext(templateName) == ".json" {
 			templatePath := filepath.Join(templatesDir, templateName)
 			templateString, err := os.ReadFile(templatePath)
 			if err != nil {
-				log.Printf("Failed to load template file %s: %v", templatePath, err)
+				slog.Error("Failed to load template file", "path", templatePath, "error", err)
 				continue
 			}
 
-			tmpl, err := template.New(templateName).Parse(string(templateString))
+			tmpl, err := parsePromptTemplate(templateName, string(templateString))
 			if err != nil {
-				log.Printf("Failed to parse template %s: %v", templateName, err)
+				slog.Error("Failed to parse template", "template", templateName, "error", err)
 				continue
 			}
 
-			templateConfig.Templates[templateName[:len(templateName)-len(".json")]] = tmpl
+			name := templateName[:len(templateName)-len(".json")]
+			templateConfig.Templates[name] = tmpl
+			templateConfig.Versions[name] = templateVersion(string(templateString))
+
+			settings, err := loadTemplateSettings(templatesDir, name)
+			if err != nil {
+				slog.Error("Failed to load template settings", "template", name, "error", err)
+				continue
+			}
+			templateConfig.setSettings(name, settings)
 		}
 	}
 
 	if len(templateConfig.Templates) == 0 {
-		log.Println("No templates found, creating a default template...")
+		slog.Info("No templates found, creating a default template")
 		defaultTemplateContent := `{{.Query}} Default template response.`
-		tmpl, err := template.New("default").Parse(defaultTemplateContent)
+		tmpl, err := parsePromptTemplate("default", defaultTemplateContent)
 		if err != nil {
 			return nil, err
 		}
 		templateConfig.Templates["default"] = tmpl
+		templateConfig.Versions["default"] = templateVersion(defaultTemplateContent)
 
 		defaultTemplatePath := filepath.Join(templatesDir, "default.json")
 		if err := os.WriteFile(defaultTemplatePath, []byte(defaultTemplateContent), os.ModePerm); err != nil {
-			log.Printf("Failed to save default template to disk: %v", err)
+			slog.Error("Failed to save default template to disk", "error", err)
 		}
 	}
 
 	return templateConfig, nil
 }
 
+// setSettings applies a template's settings.
+func (tc *TemplateConfig) setSettings(name string, settings *TemplateSettings) {
+	tc.Settings[name] = settings
+	if settings.OllamaParams != nil {
+		tc.Params[name] = settings.OllamaParams
+	}
+	if settings.ResponseFields != nil {
+		tc.Fields[name] = settings.ResponseFields
+	}
+	if settings.RequestTimeout > 0 {
+		tc.RequestTimeouts[name] = settings.RequestTimeout
+	}
+}
+
+const templateSettingsSuffix = ".config.json"
+
+func loadTemplateSettings(templatesDir, name string) (*TemplateSettings, error) {
+	data, err := os.ReadFile(filepath.Join(templatesDir, name+templateSettingsSuffix))
+	if os.IsNotExist(err) {
+		return &TemplateSettings{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseTemplateSettings(data)
+}
+
+// parseTemplateSettings parses and checks the contents of a settings file.
+func parseTemplateSettings(data []byte) (*TemplateSettings, error) {
+	settings := &TemplateSettings{}
+	if err := json.Unmarshal(data, settings); err != nil {
+		return nil, err
+	}
+	if err := settings.parseLimits(); err != nil {
+		return nil, err
+	}
+	if err := settings.parseDebounce(); err != nil {
+		return nil, err
+	}
+	if err := settings.checkResponseMap(); err != nil {
+		return nil, err
+	}
+	if err := settings.parseCacheTTL(); err != nil {
+		return nil, err
+	}
+	if err := parsePostProcess(settings.PostProcess); err != nil {
+		return nil, err
+	}
+	if err := parseExtract(settings.Extract); err != nil {
+		return nil, err
+	}
+	if err := parseCoerce(settings.Coerce); err != nil {
+		return nil, err
+	}
+	if settings.Refusals != nil {
+		if err := settings.Refusals.parse(); err != nil {
+			return nil, err
+		}
+	}
+	if settings.JSONOutput != nil {
+		if err := settings.JSONOutput.parse(); err != nil {
+			return nil, err
+		}
+	}
+	return settings, nil
+}
+
+// defaultModel is the model used for the template when a request doesn't choose one.
+func (tc *TemplateConfig) defaultModel(config *Config, templateName string) string {
+	if settings, ok := tc.Settings[templateName]; ok && settings.Model != "" {
+		return settings.Model
+	}
+	if backend, ok := config.Backends[tc.backendName(templateName)]; ok && backend.Model != "" {
+		return backend.Model
+	}
+	return config.DefaultModel
+}
+
+// ollamaParams returns the global Ollama parameters with the template's own
+// merged over them. Options are merged key by key. The result is a copy.
+func (tc *TemplateConfig) ollamaParams(config *Config, templateName string) map[string]interface{} {
+	params := make(map[string]interface{}, len(config.OllamaParams))
+	for key, value := range config.OllamaParams {
+		params[key] = value
+	}
+	options := make(map[string]interface{})
+	if configured, ok := config.OllamaParams["options"].(map[string]interface{}); ok {
+		for key, value := range configured {
+			options[key] = value
+		}
+	}
+
+	for key, value := range tc.Params[templateName] {
+		if key == "options" {
+			overrides, _ := value.(map[string]interface{})
+			for option, optionValue := range overrides {
+				options[option] = optionValue
+			}
+			continue
+		}
+		params[key] = value
+	}
+	params["options"] = options
+	return params
+}
+
+// systemPrompt is the system prompt sent with the template's requests, which
+// replaces any system set in ollama_params.
+func (tc *TemplateConfig) systemPrompt(config *Config, templateName string) string {
+	if settings, ok := tc.Settings[templateName]; ok && settings.SystemPrompt != "" {
+		return settings.SystemPrompt
+	}
+	return config.SystemPrompt
+}
+
+// responseFields are the Ollama response fields returned for the template.
+func (tc *TemplateConfig) responseFields(config *Config, templateName string) []string {
+	if fields, ok := tc.Fields[templateName]; ok {
+		return fields
+	}
+	return config.ResponseFields
+}
+
+// requestTimeout is the Ollama request timeout for the template.
+func (tc *TemplateConfig) requestTimeout(config *Config, templateName string) time.Duration {
+	if timeout, ok := tc.RequestTimeouts[templateName]; ok {
+		return time.Duration(timeout) * time.Second
+	}
+	return time.Duration(config.RequestTimeout) * time.Second
+}
+
+// modelAllowed reports whether a request may select the model for the template.
+func (tc *TemplateConfig) modelAllowed(templateName, model string) bool {
+	settings, ok := tc.Settings[templateName]
+	if !ok || len(settings.AllowedModels) == 0 {
+		return true
+	}
+	for _, name := range settings.AllowedModels {
+		if name == model {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate requires the auth token, unless the route's own middleware
+// decides about it.
 func authenticate(config *Config, next http.HandlerFunc) http.HandlerFunc {
+	check := requireToken(config, next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if routeChecksAuth(r.Context()) {
+			next(w, r)
+			return
+		}
+		check(w, r)
+	}
+}
+
+func requireToken(config *Config, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		token := r.Header.Get("Authorization")
 		if token != "Bearer "+config.AuthToken {
-			log.Printf("Unauthorized access attempt from token ending in: '%s', from: %s", token[len(token)-1:], r.RemoteAddr)
+			slog.Warn("Unauthorized access attempt", "token_hint", tokenHint(token), "remote_addr", r.RemoteAddr)
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
-		log.Println("Successful authentication from:", r.RemoteAddr)
+		slog.Debug("Successful authentication", "remote_addr", r.RemoteAddr)
 		next(w, r)
 	}
 }
@@ -147,142 +567,1011 @@ func processTemplate(tmpl *template.Template, data TemplateData) (string, error)
 	return processedTemplate.String(), nil
 }
 
-func templateHandler(config *Config, templateConfig *TemplateConfig, templateName string) http.HandlerFunc {
-	return authenticate(config, func(w http.ResponseWriter, r *http.Request) {
-		var haRequest map[string]interface{}
-		if err := json.NewDecoder(r.Body).Decode(&haRequest); err != nil {
-			http.Error(w, "Invalid request", http.StatusBadRequest)
-			return
+var errTemplateProcessing = errors.New("template processing failed")
+
+var errTemplateDisabled = errors.New("template is disabled")
+
+// generate renders the named template with the given data, sends the prompt to the
+// Ollama API and returns the response filtered down to the configured fields.
+func generate(ctx context.Context, config *Config, templateConfig *TemplateConfig, templateName string, data TemplateData, model string) (map[string]interface{}, error) {
+	return generateStream(ctx, config, templateConfig, templateName, data, model, nil)
+}
+
+// generateStream is generate with streaming: when onChunk is set the response is
+// streamed from Ollama and each piece of text is passed to onChunk as it arrives.
+func generateStream(ctx context.Context, config *Config, templateConfig *TemplateConfig, templateName string, data TemplateData, model string, onChunk func(string)) (_ map[string]interface{}, err error) {
+	if templateConfig.disabled(templateName) {
+		return nil, errTemplateDisabled
+	}
+	defer config.metrics.start(templateName)()
+	ctx, generation := startSpan(ctx, "generate", spanKindInternal, "template", templateName)
+	defer func() {
+		generation.set("model", model)
+		generation.end(err)
+	}()
+
+	// Prepare the prompt using the template, if needed, or directly from the 'query'
+	var fullPrompt string
+	tmpl, ok := templateConfig.Templates[templateName]
+	if ok {
+		_, render := startSpan(ctx, "render template", spanKindInternal, "template", templateName)
+		processedPrompt, err := processTemplate(tmpl, data)
+		render.end(err)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errTemplateProcessing, err)
 		}
+		fullPrompt = processedPrompt
+	} else {
+		fullPrompt = data.Query // Use the query as the prompt directly if no template processing is required
+	}
 
-		// Extract 'query' directly to use as the 'prompt' in the Ollama request
-		query, ok := haRequest["query"].(string)
-		if !ok {
-			http.Error(w, "Query parameter missing or not a string", http.StatusBadRequest)
-			return
+	if model == "" {
+		model = templateConfig.defaultModel(config, templateName)
+	}
+	// Prepare the Ollama request from a copy of the global and template Ollama
+	// parameters, so checking the context window never changes the config
+	ollamaRequest := templateConfig.ollamaParams(config, templateName)
+	ollamaRequest["model"] = model
+	if system := templateConfig.systemPrompt(config, templateName); system != "" {
+		ollamaRequest["system"] = system
+	}
+	system, _ := ollamaRequest["system"].(string)
+	// Thoughts are held back from streams as they arrive
+	reasoning := templateConfig.reasoning(config, templateName)
+	var thoughtFilter *thinkFilter
+	if reasoning.Strip && onChunk != nil {
+		thoughtFilter = newThinkFilter(onChunk)
+		onChunk = thoughtFilter.write
+	}
+	// JSON answers are checked before any of them is sent, so they stream as a
+	// single chunk
+	upstreamChunk := onChunk
+	jsonOutput := templateConfig.jsonOutput(templateName)
+	if jsonOutput != nil {
+		ollamaRequest["format"] = "json"
+		upstreamChunk = nil
+	}
+	// Tool calls are only found in the model's whole answer
+	var actions map[string]*ActionConfig
+	if config.Flags.Enabled(flagActions) {
+		if actions, err = templateConfig.actions(config, templateName); err != nil {
+			return nil, err
+		}
+	}
+	if len(actions) > 0 {
+		ollamaRequest["tools"] = actionTools(actions)
+		upstreamChunk = nil
+	}
+	ollamaRequest["stream"] = upstreamChunk != nil
+	options := ollamaRequest["options"].(map[string]interface{})
+	delete(ollamaRequest, "options")
+	for key, value := range data.Options {
+		options[key] = value
+	}
+	// Chat templates, and requests with a conversation, send the conversation so
+	// far ahead of the prompt
+	history := withRecalled(config.memory.recall(templateName, data.ConversationID, config.Memory), data.Messages)
+	chat := templateConfig.chat(templateName) || len(history) > 0 || len(actions) > 0
+	backend, err := newBackend(config, templateConfig.backendName(templateName), templateConfig.hedgeAfter(config, templateName))
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := backend.(*ollamaBackend); !ok && len(actions) > 0 {
+		return nil, fmt.Errorf("template '%s' has actions, which need an Ollama backend", templateName)
+	}
+	// Only Ollama can say how large a model's context window is
+	var budget int
+	if ollama, ok := backend.(*ollamaBackend); ok {
+		budget = fitContextWindow(ctx, ollama.config, model, system+messagesText(history)+fullPrompt, options)
+	} else {
+		budget = config.Backends[templateConfig.backendName(templateName)].contextLength()
+	}
+	budget -= estimateTokens(system)
+	if len(options) > 0 {
+		ollamaRequest["options"] = options
+	}
+	if chat {
+		if containsString(config.PromptTrimming, trimHistory) {
+			history = dropHistory(history, estimateTokens(fullPrompt), budget-answerTokens(options))
 		}
+		budget -= estimateTokens(messagesText(history))
+	}
 
-		// Prepare the prompt using the template, if needed, or directly from the 'query'
-		var fullPrompt string
-		if tmpl, ok := templateConfig.Templates[templateName]; ok {
-			templateData := TemplateData{Query: query}
-			processedPrompt, err := processTemplate(tmpl, templateData)
+	fullPrompt, err = fitPrompt(ctx, config, tmpl, data, fullPrompt, budget, options)
+	if err != nil {
+		return nil, err
+	}
+	timeout := generationTimeout(ctx, config, templateConfig, templateName, model, estimateTokens(messagesText(history)+fullPrompt), answerTokens(options))
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if chat {
+		// Chat has no system field, so the system prompt is the first message
+		delete(ollamaRequest, "system")
+		ollamaRequest["messages"] = chatRequestMessages(system, history, fullPrompt, data.Images)
+	} else {
+		ollamaRequest["prompt"] = fullPrompt
+		if len(data.Images) > 0 {
+			ollamaRequest["images"] = data.Images
+		}
+	}
+
+	// Identical requests within the cache TTL get the earlier response, without
+	// calling the model or counting against the template's rate limit
+	var ollamaResponseMap map[string]interface{}
+	var cacheKey string
+	var cached bool
+	cacheTTL := templateConfig.cacheTTL(config, templateName)
+	// Answers that took actions can't be reused without taking them again
+	if !config.Flags.Enabled(flagCaching) || len(actions) > 0 {
+		cacheTTL = 0
+	}
+	if cacheTTL > 0 {
+		cacheKey = responseCacheKey(templateName, templateConfig.backendName(templateName), ollamaRequest)
+		ollamaResponseMap, cached = config.cache.get(cacheKey)
+		if stats := generationStats(ctx); stats != nil {
+			stats.Cached = cached
+		}
+		generation.set("cached", cached)
+	}
+	var coalesced bool
+	if !cached {
+		upstreamRequest := func() (map[string]interface{}, error) {
+			if err := config.limits.allow(templateName, templateConfig.Settings[templateName]); err != nil {
+				return nil, err
+			}
+			releasePool, err := waitForPool(ctx, config, templateConfig, templateName)
 			if err != nil {
-				http.Error(w, "Template processing failed", http.StatusInternalServerError)
-				return
+				return nil, err
+			}
+			defer releasePool()
+			release, err := waitForModel(ctx, config, model)
+			if err != nil {
+				return nil, err
+			}
+			defer release()
+			var response map[string]interface{}
+			upstreamCtx, upstream := startSpan(ctx, "upstream request", spanKindInternal,
+				"backend", templateConfig.backendName(templateName),
+				"model", model,
+				"stream", upstreamChunk != nil,
+				"chat", chat)
+			upstreamStart := time.Now()
+			if chat {
+				response, err = backend.Chat(upstreamCtx, ollamaRequest, upstreamChunk)
+			} else {
+				response, err = backend.Generate(upstreamCtx, ollamaRequest, upstreamChunk)
+			}
+			upstream.end(err)
+			if err != nil {
+				return nil, err
+			}
+			var firstToken time.Duration
+			if stats := generationStats(ctx); stats != nil {
+				firstToken = stats.FirstToken
+			}
+			config.latency.recordBackend(templateConfig.backendName(templateName), firstToken, time.Since(upstreamStart))
+			if len(actions) > 0 {
+				if response, err = runActions(ctx, config, backend, templateName, ollamaRequest, response, actions); err != nil {
+					return nil, err
+				}
+			}
+			// A model that declined is asked once more, unless its answer has
+			// already been streamed
+			if refusals := templateConfig.refusals(config, templateName); refusals != nil && refusals.RetryPrompt != "" && upstreamChunk == nil {
+				if text := responseContent(response, chat); refusals.declined(text) {
+					slog.Info("Model declined, retrying", "template", templateName, "model", model, "request_id", requestID(ctx))
+					retryRequest := followUpRequest(ollamaRequest, chat, text, refusals.RetryPrompt)
+					if chat {
+						response, err = backend.Chat(ctx, retryRequest, nil)
+					} else {
+						response, err = backend.Generate(ctx, retryRequest, nil)
+					}
+					if err != nil {
+						return nil, err
+					}
+				}
+			}
+			if jsonOutput != nil {
+				if response, err = jsonOutput.enforce(ctx, backend, ollamaRequest, chat, response); err != nil {
+					return nil, err
+				}
+			}
+			// Ratings are cached with the answer they rate
+			if confidence := templateConfig.confidence(config, templateName); confidence != nil {
+				confidence.addConfidence(ctx, backend, model, fullPrompt, response, chat)
+			}
+			if cacheTTL > 0 {
+				config.cache.put(cacheKey, response, cacheTTL, config.Cache.MaxEntries)
 			}
-			fullPrompt = processedPrompt
+			return response, nil
+		}
+		// Identical requests in flight share the first one's response, which
+		// streams to the others as a single chunk
+		if config.Cache.Coalesce && len(actions) == 0 {
+			ollamaResponseMap, coalesced, err = config.coalescer.do(ctx, responseCacheKey(templateName, templateConfig.backendName(templateName), ollamaRequest), upstreamRequest)
+			if stats := generationStats(ctx); stats != nil {
+				stats.Coalesced = coalesced
+			}
+			generation.set("coalesced", coalesced)
 		} else {
-			fullPrompt = query // Use the query as the prompt directly if no template processing is required
+			ollamaResponseMap, err = upstreamRequest()
+		}
+		if err != nil {
+			return nil, err
 		}
+	}
 
-		// Ensure the model is correctly set from the config or request
-		model := config.DefaultModel
-		if modelFromRequest, ok := haRequest["model"].(string); ok && modelFromRequest != "" {
-			model = modelFromRequest
+	_, filtering := startSpan(ctx, "filter response", spanKindInternal)
+	defer filtering.end(nil)
+	responseText := responseContent(ollamaResponseMap, chat)
+	// A cached response streams as a single chunk
+	if (cached || coalesced || upstreamChunk == nil) && onChunk != nil {
+		onChunk(responseText)
+	}
+	if thoughtFilter != nil {
+		thoughtFilter.flush()
+	}
+	thoughts := responseThinking(ollamaResponseMap, chat)
+	if reasoning.Strip {
+		var blocks string
+		responseText, blocks = splitReasoning(responseText)
+		thoughts = strings.TrimSpace(thoughts + "\n\n" + blocks)
+	}
+	// What was asked is remembered rather than the rendered template, which
+	// would repeat the template's instructions and inputs in every turn
+	config.memory.remember(templateName, data.ConversationID, data.Query, responseText, config.Memory)
+
+	// Create a filtered response based on what's needed
+	filteredResponse := map[string]interface{}{
+		"response": responseText,
+	}
+
+	// If filteredResponse contains any of the fields from the config, add them
+	for _, field := range templateConfig.responseFields(config, templateName) {
+		if value, ok := ollamaResponseMap[field]; ok {
+			filteredResponse[field] = value
 		}
+	}
 
-		// Prepare the Ollama request with corrected fields
-		ollamaRequest := config.OllamaParams // Start with global Ollama parameters
-		ollamaRequest["prompt"] = fullPrompt
-		ollamaRequest["model"] = model // Ensure the model is correctly assigned
+	if reasoning.Field != "" {
+		if !reasoning.Strip {
+			_, blocks := splitReasoning(responseText)
+			thoughts = strings.TrimSpace(thoughts + "\n\n" + blocks)
+		}
+		filteredResponse[reasoning.Field] = thoughts
+	}
 
-		requestBody, err := json.Marshal(ollamaRequest)
-		if err != nil {
-			log.Printf("Error marshaling Ollama request: %v", err)
-			return
+	if value, ok := ollamaResponseMap["actions"]; ok {
+		filteredResponse["actions"] = value
+	}
+	if value, ok := ollamaResponseMap["confidence"]; ok && templateConfig.confidence(config, templateName) != nil {
+		filteredResponse["confidence"] = value
+	}
+	if refusals := templateConfig.refusals(config, templateName); refusals != nil {
+		filteredResponse["status"] = statusAnswered
+		if refusals.declined(responseText) {
+			filteredResponse["status"] = statusDeclined
+			if stats := generationStats(ctx); stats != nil {
+				stats.Declined = true
+			}
+		}
+	}
+
+	if rules := templateConfig.extractRules(templateName); len(rules) > 0 {
+		for field, value := range extractFields(rules, responseText) {
+			filteredResponse[field] = value
 		}
+	}
+	if rules := templateConfig.coerceRules(templateName); len(rules) > 0 {
+		coerceFields(rules, filteredResponse)
+	}
+
+	if steps := templateConfig.postProcess(config, templateName); len(steps) > 0 {
+		responseText = applyPostProcess(steps, responseText)
+		filteredResponse["response"] = responseText
+	}
+
+	// If the config has strip_newline set to true, remove newlines
+	if config.StripNewline {
+		filteredResponse["response"] = strings.ReplaceAll(responseText, "\n", " ")
+	}
+
+	if watermark := templateConfig.watermark(config, templateName); watermark.Field || watermark.ZeroWidth {
+		tag := Watermark{Template: templateName, Version: templateConfig.Versions[templateName], Model: model}
+		if watermark.Field {
+			filteredResponse["watermark"] = tag
+		}
+		if watermark.ZeroWidth {
+			filteredResponse["response"] = filteredResponse["response"].(string) + tag.encode()
+			if onChunk != nil {
+				onChunk(tag.encode())
+			}
+		}
+	}
 
-		// Setup the HTTP request to Ollama API
-		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.RequestTimeout)*time.Second)
+	return filteredResponse, nil
+}
+
+// responseContent is the text of a generate or chat response.
+func responseContent(ollamaResponseMap map[string]interface{}, chat bool) string {
+	if chat {
+		message, _ := ollamaResponseMap["message"].(map[string]interface{})
+		text, _ := message["content"].(string)
+		return text
+	}
+	text, _ := ollamaResponseMap["response"].(string)
+	return text
+}
+
+// postOllama sends a generate request to the Ollama API and returns the raw
+// response, streaming chunks to onChunk when it is set.
+func postOllama(ctx context.Context, config *Config, ollamaRequest map[string]interface{}, onChunk func(string)) (map[string]interface{}, error) {
+	return postOllamaURL(ctx, config, config.APIURL, ollamaRequest, onChunk)
+}
+
+// postOllamaURL is postOllama for another endpoint of the same API, such as
+// /api/chat.
+func postOllamaURL(ctx context.Context, config *Config, url string, ollamaRequest map[string]interface{}, onChunk func(string)) (map[string]interface{}, error) {
+	requestBody, err := json.Marshal(ollamaRequest)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling Ollama request: %w", err)
+	}
+
+	// Setup the HTTP request to Ollama API, with the request_timeout unless the
+	// caller has set its own deadline
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(config.RequestTimeout)*time.Second)
 		defer cancel()
+	}
 
-		req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.APIURL, bytes.NewBuffer(requestBody))
-		if err != nil {
-			log.Printf("Error creating request to Ollama API: %v", err)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(requestBody))
+	if err != nil {
+		return nil, fmt.Errorf("error creating request to Ollama API: %w", err)
+	}
+	req.Header.Add("Authorization", "Bearer "+config.APIKey)
+	req.Header.Add("Content-Type", "application/json")
+
+	traceLog(ctx, config, "Upstream request", "url", url, "body", string(requestBody))
+
+	// Send the request to Ollama API
+	resp, err := sendTraced(&http.Client{}, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request to Ollama API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		traceLog(ctx, config, "Upstream response", "status", resp.Status, "body", string(body))
+		return nil, &upstreamStatusError{status: resp.StatusCode, msg: fmt.Sprintf("Ollama API returned %s: %s", resp.Status, strings.TrimSpace(string(body)))}
+	}
+
+	var ollamaResponseMap map[string]interface{}
+	if onChunk != nil {
+		ollamaResponseMap, err = readOllamaStream(ctx, config, resp.Body, timeFirstToken(ctx, onChunk))
+	} else {
+		ollamaResponseMap, err = readOllamaResponse(ctx, config, resp)
+	}
+	if err != nil {
+		return nil, err
+	}
+	collectStats(ctx, ollamaResponseMap)
+	model, _ := ollamaRequest["model"].(string)
+	config.models.recordSpeed(model, ollamaResponseMap)
+	return ollamaResponseMap, nil
+}
+
+func readOllamaResponse(ctx context.Context, config *Config, resp *http.Response) (map[string]interface{}, error) {
+	// Read and unmarshal the response body
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	traceLog(ctx, config, "Upstream response", "status", resp.Status, "body", string(body))
+
+	ollamaResponseMap := make(map[string]interface{})
+	if err := json.Unmarshal(body, &ollamaResponseMap); err != nil {
+		return nil, fmt.Errorf("error unmarshaling response from Ollama API: %w", err)
+	}
+	return ollamaResponseMap, nil
+}
+
+// readOllamaStream reads newline delimited JSON chunks from a streaming Ollama
+// response. The final chunk carries the statistics, and its response (or chat
+// message) is replaced with the full text so the result matches a non-streamed
+// response.
+func readOllamaStream(ctx context.Context, config *Config, body io.Reader, onChunk func(string)) (map[string]interface{}, error) {
+	var text, thinking strings.Builder
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		traceLog(ctx, config, "Upstream stream chunk", "data", string(line))
+
+		var chunk map[string]interface{}
+		if err := json.Unmarshal(line, &chunk); err != nil {
+			return nil, fmt.Errorf("error unmarshaling stream chunk from Ollama API: %w", err)
+		}
+		if message, ok := chunk["error"].(string); ok {
+			return nil, fmt.Errorf("Ollama API returned an error: %s", message)
+		}
+
+		// Generate responses carry text in "response", chat ones in "message"
+		message, isChat := chunk["message"].(map[string]interface{})
+		piece, _ := chunk["response"].(string)
+		if isChat {
+			piece, _ = message["content"].(string)
+		}
+		if piece != "" {
+			text.WriteString(piece)
+			onChunk(piece)
+		}
+		// Thinking, with think set, comes apart from the text
+		thought, _ := chunk["thinking"].(string)
+		if isChat {
+			thought, _ = message["thinking"].(string)
+		}
+		thinking.WriteString(thought)
+		if done, _ := chunk["done"].(bool); done {
+			if isChat {
+				message["content"] = text.String()
+			} else {
+				chunk["response"] = text.String()
+			}
+			if thinking.Len() > 0 {
+				if isChat {
+					message["thinking"] = thinking.String()
+				} else {
+					chunk["thinking"] = thinking.String()
+				}
+			}
+			return chunk, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read stream from Ollama API: %w", err)
+	}
+	return nil, fmt.Errorf("stream from Ollama API ended before completion")
+}
+
+// deliverResponse sends a generated response to the outputs attached to the template.
+func deliverResponse(config *Config, outputs *Outputs, templateName string, data TemplateData, model string, haContext HAContext, filteredResponse map[string]interface{}) {
+	if !config.Flags.Enabled(flagOutputs) {
+		return
+	}
+	outputs.deliverForTemplate(templateName, Delivery{
+		Source:   templateName,
+		Template: templateName,
+		Query:    data.Query,
+		Model:    model,
+		Response: filteredResponse["response"].(string),
+		Fields:   filteredResponse,
+		Context:  haContext,
+		Time:     time.Now(),
+	})
+}
+
+func templateHandler(config *Config, templateConfig *TemplateConfig, outputs *Outputs, jobs *Jobs, mqtt *MQTTClient, history *History, templateName string) http.HandlerFunc {
+	return authenticate(config, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			writeEncoded(w, r, http.StatusOK, templateDocs(r, config, templateConfig, templateName))
+			return
+		}
+
+		var haRequest map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&haRequest); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
 			return
 		}
-		req.Header.Add("Authorization", "Bearer "+config.APIKey)
-		req.Header.Add("Content-Type", "application/json")
 
-		// Send the request to Ollama API
-		// Send the request to Ollama API
-		client := &http.Client{}
-		resp, err := client.Do(req)
+		if err := checkRequestFields(config, templateConfig.Settings[templateName], haRequest); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		haContext, err := requestHAContext(haRequest)
 		if err != nil {
-			log.Printf("Failed to send request to Ollama API: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		defer resp.Body.Close()
+		if haContext.Origin == "" {
+			haContext.Origin = requestOrigin(r)
+		}
+		if haContext.ID != "" {
+			w.Header().Set(haContextHeader, haContext.ID)
+			slog.Debug("Handling template", append([]any{"template", templateName, "remote_addr", r.RemoteAddr, "request_id", requestID(r.Context())}, haContext.logAttrs()...)...)
+		}
 
-		// Read and unmarshal the response body
-		body, err := io.ReadAll(resp.Body)
+		// Extract 'query' and any structured inputs for the template
+		templateData, err := buildTemplateData(r.Context(), config, haRequest)
 		if err != nil {
-			log.Printf("Failed to read response body: %v", err)
+			var inputErr *inputError
+			if errors.As(err, &inputErr) {
+				http.Error(w, inputErr.msg, http.StatusBadRequest)
+			} else {
+				slog.Error("Failed to prepare inputs", append([]any{"template", templateName, "request_id", requestID(r.Context()), "error", err}, haContext.logAttrs()...)...)
+				http.Error(w, "Failed to prepare request inputs", http.StatusBadGateway)
+			}
 			return
 		}
 
-		var ollamaResponse OllamaResponse
-		if err := json.Unmarshal(body, &ollamaResponse); err != nil {
-			log.Printf("Error unmarshaling response from Ollama API: %v", err)
+		if len(templateData.Messages) > 0 && !templateConfig.chat(templateName) {
+			http.Error(w, "Messages are only accepted by chat templates", http.StatusBadRequest)
 			return
 		}
 
-		// Create a filtered response based on what's needed
-		filteredResponse := map[string]interface{}{
-			"response": ollamaResponse.Response,
+		// Ensure the model is correctly set from the config or request
+		model := templateConfig.defaultModel(config, templateName)
+		if modelFromRequest, ok := haRequest["model"].(string); ok && modelFromRequest != "" {
+			if !templateConfig.modelAllowed(templateName, modelFromRequest) {
+				slog.Warn("Rejected model for template", "model", modelFromRequest, "template", templateName, "remote_addr", r.RemoteAddr)
+				http.Error(w, fmt.Sprintf("Model '%s' is not allowed for this template", modelFromRequest), http.StatusBadRequest)
+				return
+			}
+			model = modelFromRequest
 		}
 
-		// If filteredResponse contains any of the fields from the config, add them
-		// Convert ollamaResponse to a map
-		ollamaResponseMap := make(map[string]interface{})
-		err = json.Unmarshal(body, &ollamaResponseMap)
-		if err != nil {
-			log.Printf("Error unmarshaling response from Ollama API: %v", err)
+		// Tokens can also be published to an MQTT topic for live displays
+		var mqttReply *mqttReply
+		if topic, _ := haRequest["mqtt_topic"].(string); topic != "" {
+			if mqttReply, err = mqtt.reply(topic, haContext); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		// A client that disconnects cancels its generation, freeing the GPU
+		ctx := withGenerationStats(requestTraceContext(r.Context(), config, r), &GenerationStats{})
+
+		// Streamed and async generations run as jobs so other clients can attach
+		// to them or poll for the result
+		stream, _ := haRequest["stream"].(bool)
+		async, _ := haRequest["async"].(bool)
+		if stream && !config.Flags.Enabled(flagStreaming) {
+			http.Error(w, "Streaming is disabled", http.StatusServiceUnavailable)
 			return
 		}
+		// Jobs outlive the request that started them
+		runJob := func(job *Job, data TemplateData) {
+			ctx := context.WithoutCancel(ctx)
+			onChunk := job.append
+			if mqttReply != nil {
+				onChunk = mqttReply.wrap(job.append)
+			}
+			start := time.Now()
+			filteredResponse, err := generateStream(ctx, config, templateConfig, templateName, data, model, onChunk)
+			recordGeneration(ctx, config, history, "template", templateName, data, model, haContext, start, filteredResponse, err)
+			if err != nil {
+				slog.Error("Failed to generate response for job", append([]any{"job_id", job.ID, "template", templateName, "request_id", requestID(ctx), "error", err}, haContext.logAttrs()...)...)
+			}
+			job.finish(templateConfig.mapResponse(templateName, filteredResponse), err)
+			if mqttReply != nil {
+				mqttReply.finish(filteredResponse, err)
+			}
+			if err == nil {
+				deliverResponse(config, outputs, templateName, data, model, haContext, filteredResponse)
+			}
+		}
 
-		for _, field := range config.ResponseFields {
-			if value, ok := ollamaResponseMap[field]; ok {
-				filteredResponse[field] = value
+		// Debounced templates answer a burst of requests with one generation over
+		// all their queries, one per line. Other inputs come from the first request
+		if window := templateConfig.debounce(templateName); window > 0 {
+			job := jobs.batch(templateName, templateData.Query, window, haContext, func(job *Job, queries []string) {
+				data := templateData
+				data.Query = strings.Join(queries, "\n")
+				runJob(job, data)
+			})
+			switch {
+			case stream:
+				streamJob(w, r, job)
+			case async:
+				w.Header().Set("Location", "/jobs/"+job.ID)
+				writeEncoded(w, r, http.StatusAccepted, job.status())
+			default:
+				job.waitDone(r.Context())
+				if r.Context().Err() != nil {
+					return
+				}
+				filteredResponse, err := job.outcome()
+				if err != nil {
+					writeTemplateError(w, err)
+					return
+				}
+				writeTemplateResponse(w, r, filteredResponse)
 			}
+			return
 		}
 
-		// If the config has strip_newline set to true, remove newlines
-		if config.StripNewline {
-			filteredResponse["response"] = strings.ReplaceAll(ollamaResponse.Response, "\n", " ")
+		if stream || async {
+			job := jobs.create(templateName, haContext)
+			go runJob(job, templateData)
+			if stream {
+				streamJob(w, r, job)
+			} else {
+				w.Header().Set("Location", "/jobs/"+job.ID)
+				writeEncoded(w, r, http.StatusAccepted, job.status())
+			}
+			return
 		}
 
-		// Send the filtered response back to the client
-		responseBody, err := json.Marshal(filteredResponse)
+		start := time.Now()
+		var filteredResponse map[string]interface{}
+		if mqttReply != nil {
+			filteredResponse, err = generateStream(ctx, config, templateConfig, templateName, templateData, model, mqttReply.token)
+			mqttReply.finish(filteredResponse, err)
+		} else {
+			filteredResponse, err = generate(ctx, config, templateConfig, templateName, templateData, model)
+		}
+		recordGeneration(ctx, config, history, "template", templateName, templateData, model, haContext, start, filteredResponse, err)
+		if r.Context().Err() != nil {
+			slog.Info("Client disconnected, cancelled generation", append([]any{"template", templateName, "request_id", requestID(ctx)}, haContext.logAttrs()...)...)
+			return
+		}
 		if err != nil {
-			log.Printf("Error marshaling filtered response: %v", err)
+			slog.Error("Failed to generate response", append([]any{"template", templateName, "request_id", requestID(ctx), "error", err}, haContext.logAttrs()...)...)
+			writeTemplateError(w, err)
 			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(responseBody)
+		// Send the filtered response back to the client
+		setUsageHeaders(ctx, w)
+		writeTemplateResponse(w, r, templateConfig.mapResponse(templateName, filteredResponse))
+
+		deliverResponse(config, outputs, templateName, templateData, model, haContext, filteredResponse)
 	})
 }
 
+// writeTemplateResponse writes a template's response as compact JSON, or as XML
+// or YAML when the request accepts them.
+func writeTemplateResponse(w http.ResponseWriter, r *http.Request, response map[string]interface{}) {
+	if responseType(r) != "application/json" {
+		writeEncoded(w, r, http.StatusOK, response)
+		return
+	}
+	responseBody, err := json.Marshal(response)
+	if err != nil {
+		slog.Error("Failed to encode filtered response", "error", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseBody)
+}
+
+// writeTemplateError responds to a template request whose generation failed.
+func writeTemplateError(w http.ResponseWriter, err error) {
+	var limited *rateLimitError
+	if errors.As(err, &limited) {
+		limited.setRetryAfter(w)
+	}
+	status, message := templateError(err)
+	http.Error(w, message, status)
+}
+
+// templateError is the status and message for a failed generation.
+func templateError(err error) (int, string) {
+	var limited *rateLimitError
+	if errors.As(err, &limited) {
+		return http.StatusTooManyRequests, "Too many requests for this template"
+	} else if errors.Is(err, errTemplateProcessing) {
+		return http.StatusInternalServerError, "Template processing failed"
+	} else if errors.Is(err, errTemplateDisabled) {
+		return http.StatusServiceUnavailable, "This template is disabled"
+	} else if errors.Is(err, errPromptTooLong) {
+		return http.StatusRequestEntityTooLarge, "Prompt is too long for the model's context window"
+	} else if errors.Is(err, errQueueFull) || errors.Is(err, errQueueTimeout) {
+		return http.StatusServiceUnavailable, "Too many requests are waiting for the model, try again later"
+	} else if errors.Is(err, errInvalidJSONOutput) {
+		return http.StatusBadGateway, err.Error()
+	}
+	return http.StatusBadGateway, "Failed to get a response from the Ollama API"
+}
+
 func main() {
-	config, err := loadConfig("config.json")
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			fatal("Command failed", "command", os.Args[1], "error", err)
+		}
+		return
+	}
+
+	flags := flag.NewFlagSet("llamanator", flag.ContinueOnError)
+	configPath := flags.String("config", envDefault(configPathEnv, "config.json"), "path to config.json")
+	addr := flags.String("addr", "", "address to listen on, overriding server_address")
+	templatesDir := flags.String("templates-dir", envDefault(templatesDirEnv, "templates"), "path to the templates directory")
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		fatal("Invalid flags", "error", err)
+	}
+
+	configs, err := newConfigStore(*configPath, *addr)
+	if err != nil {
+		fatal("Failed to load server configuration", "error", err)
+	}
+	config := configs.get()
+	setupLogging(config.Logging)
+	setupOpenTelemetry(config.OpenTelemetry)
+
+	templates, err := newTemplateStore(*templatesDir)
+	if err != nil {
+		fatal("Failed to load and cache templates", "error", err)
+	}
+
+	outputs, err := loadOutputs(config.Outputs, configs)
+	if err != nil {
+		fatal("Failed to load outputs", "error", err)
+	}
+
+	config.Actions.approvals.outputs = outputs
+	if config.latency, err = newLatencyTracker(config.Latency, outputs); err != nil {
+		fatal("Invalid latency config", "error", err)
+	}
+
+	history, err := loadHistory(config.History)
+	if err != nil {
+		fatal("Failed to load history", "error", err)
+	}
+
+	// The history key also encrypts the saved cache and conversations
+	stateCipher, err := historyCipher(config.History)
+	if err != nil {
+		fatal("Invalid history key", "error", err)
+	}
+	if config.Cache.Path != "" {
+		if err := config.cache.persist(config.Cache.Path, stateCipher); err != nil {
+			fatal("Failed to load the response cache", "error", err)
+		}
+	}
+
+	if config.Memory.Enabled && config.Memory.Path != "" {
+		if err := config.memory.persist(config.Memory.Path, config.Memory, stateCipher); err != nil {
+			fatal("Failed to load conversations", "error", err)
+		}
+	}
+
+	watchShutdown(config)
+
+	// Health checks follow api_urls through reloads
+	go config.balancer.checkHealth(configs)
+
+	signer, err := newSigner(config.Signing)
 	if err != nil {
-		log.Fatalf("Failed to load server configuration: %v", err)
+		fatal("Failed to load signing key", "error", err)
+	}
+	if key := signer.PublicKey(); key != "" {
+		slog.Info("Signing responses with ed25519", "public_key", key)
 	}
 
-	templateConfig, err := loadAndCacheTemplates("./templates")
+	summary := newServerSummary(config)
+	jobs := newJobs(config)
+	mqtt := newMQTTClient(config.MQTT)
+
+	// Handlers are built per request from the current config and templates, so
+	// reloads apply without registering routes again
+	templateConfig := templates.get()
+	http.HandleFunc("/template/", liveTemplateRoute(configs, templates, "/template/", func(config *Config, templateConfig *TemplateConfig, templateName string) http.HandlerFunc {
+		return signResponses(signer, templateHandler(config, templateConfig, outputs, jobs, mqtt, history, templateName))
+	}))
+	http.HandleFunc("/text/", liveTemplateRoute(configs, templates, "/text/", func(config *Config, templateConfig *TemplateConfig, templateName string) http.HandlerFunc {
+		return signResponses(signer, compactHandler(config, templateConfig, outputs, history, templateName))
+	}))
+	http.HandleFunc("/batch/", liveTemplateRoute(configs, templates, "/batch/", func(config *Config, templateConfig *TemplateConfig, templateName string) http.HandlerFunc {
+		return signResponses(signer, batchHandler(config, templateConfig, history, templateName))
+	}))
+	summary.setTemplateRoutes(config, templateConfig)
+	refreshSummary := func(config *Config, templateConfig *TemplateConfig) {
+		summary.setConfig(config)
+		summary.setTemplateRoutes(config, templateConfig)
+		checkTemplateReferences(config, templateConfig)
+	}
+	configs.onReload = append(configs.onReload, func(config *Config) { refreshSummary(config, templates.get()) })
+	configs.onReload = append(configs.onReload, func(config *Config) {
+		level, _ := config.Logging.level()
+		logLevel.Set(level)
+	})
+	templates.onReload = append(templates.onReload, func(templateConfig *TemplateConfig) { refreshSummary(configs.get(), templateConfig) })
+
+	// Webhooks map third-party payloads onto template requests
+	webhooks, err := loadWebhooks(config.Webhooks, templateConfig)
 	if err != nil {
-		log.Fatalf("Failed to load and cache templates: %v", err)
+		fatal("Failed to load webhooks", "error", err)
+	}
+	for _, hook := range webhooks {
+		hook, templateName := hook, hook.config.Template
+		http.HandleFunc("/webhook/"+hook.config.Name, liveHandler(configs, templates, func(config *Config, templateConfig *TemplateConfig) http.HandlerFunc {
+			return signResponses(signer, webhookHandler(config, hook, templateHandler(config, templateConfig, outputs, jobs, mqtt, history, templateName)))
+		}))
+		summary.addRoute(RouteInfo{Path: "/webhook/" + hook.config.Name, Methods: []string{http.MethodPost}, Kind: "webhook", Auth: "token", Template: templateName, Model: templateConfig.defaultModel(config, templateName)})
+	}
+
+	if config.Frigate.URL != "" {
+		if err := checkFrigateConfig(config.Frigate, templateConfig); err != nil {
+			fatal("Invalid frigate config", "error", err)
+		}
+		http.HandleFunc("/frigate", liveHandler(configs, templates, func(config *Config, templateConfig *TemplateConfig) http.HandlerFunc {
+			return frigateHandler(config, templateConfig, outputs, mqtt, history)
+		}))
+		summary.addRoute(RouteInfo{Path: "/frigate", Methods: []string{http.MethodPost}, Kind: "frigate", Auth: "token", Template: config.Frigate.Template, Model: config.Frigate.Model})
 	}
 
-	for templateName := range templateConfig.Templates {
-		http.HandleFunc("/template/"+templateName, templateHandler(config, templateConfig, templateName))
-		println("-  /template/" + templateName)
+	if config.Alerts.Template != "" {
+		alertGroups, err := newAlertGroups(configs, templates, outputs, history)
+		if err != nil {
+			fatal("Invalid alerts config", "error", err)
+		}
+		http.HandleFunc("/alerts", liveHandler(configs, templates, func(config *Config, _ *TemplateConfig) http.HandlerFunc {
+			return alertsHandler(config, alertGroups)
+		}))
+		summary.addRoute(RouteInfo{Path: "/alerts", Methods: []string{http.MethodPost}, Kind: "alerts", Auth: "token", Template: config.Alerts.Template, Model: config.Alerts.Model})
+	}
+
+	if len(config.GitHub.Templates) > 0 {
+		if err := checkGitHubConfig(config.GitHub, templateConfig); err != nil {
+			fatal("Invalid github config", "error", err)
+		}
+		http.HandleFunc("/github", liveHandler(configs, templates, func(config *Config, templateConfig *TemplateConfig) http.HandlerFunc {
+			return githubHandler(config, templateConfig, outputs, history)
+		}))
+		summary.addRoute(RouteInfo{Path: "/github", Methods: []string{http.MethodPost}, Kind: "github", Auth: "signature", Model: config.GitHub.Model})
+	}
+
+	for _, feed := range outputs.feeds() {
+		feed := feed
+		http.HandleFunc("/feeds/"+feed.name+"/", liveHandler(configs, templates, func(config *Config, _ *TemplateConfig) http.HandlerFunc {
+			return feed.handler(config)
+		}))
+		auth := "token"
+		if feed.public {
+			auth = "public"
+		}
+		summary.addRoute(RouteInfo{Path: "/feeds/" + feed.name + "/", Methods: []string{http.MethodGet}, Kind: "feed", Auth: auth})
+	}
+
+	http.HandleFunc("/templates", liveHandler(configs, templates, func(config *Config, templateConfig *TemplateConfig) http.HandlerFunc {
+		return templatesHandler(config, templateConfig)
+	}))
+	summary.addRoute(RouteInfo{Path: "/templates", Methods: []string{http.MethodGet}, Kind: "discovery", Auth: "token"})
+
+	openAIModels := liveHandler(configs, templates, func(config *Config, templateConfig *TemplateConfig) http.HandlerFunc {
+		return openAIModelsHandler(config, templateConfig)
+	})
+	http.HandleFunc("/v1/models", openAIModels)
+	http.HandleFunc("/v1/models/", openAIModels)
+	summary.addRoute(RouteInfo{Path: "/v1/models", Methods: []string{http.MethodGet}, Kind: "openai", Auth: "token"})
+	http.HandleFunc("/v1/embeddings", liveHandler(configs, templates, func(config *Config, _ *TemplateConfig) http.HandlerFunc {
+		return openAIEmbeddingsHandler(config)
+	}))
+	summary.addRoute(RouteInfo{Path: "/v1/embeddings", Methods: []string{http.MethodPost}, Kind: "openai", Auth: "token"})
+	http.HandleFunc("/v1/chat/completions", liveHandler(configs, templates, func(config *Config, templateConfig *TemplateConfig) http.HandlerFunc {
+		return openAIChatHandler(config, templateConfig, history)
+	}))
+	summary.addRoute(RouteInfo{Path: "/v1/chat/completions", Methods: []string{http.MethodPost}, Kind: "openai", Auth: "token"})
+	http.HandleFunc("/v1/messages", liveHandler(configs, templates, func(config *Config, _ *TemplateConfig) http.HandlerFunc {
+		return anthropicMessagesHandler(config, history)
+	}))
+	summary.addRoute(RouteInfo{Path: "/v1/messages", Methods: []string{http.MethodPost}, Kind: "anthropic", Auth: "token"})
+	http.HandleFunc("/api/chat", liveHandler(configs, templates, func(config *Config, _ *TemplateConfig) http.HandlerFunc {
+		return ollamaChatIngressHandler(config)
+	}))
+	summary.addRoute(RouteInfo{Path: "/api/chat", Methods: []string{http.MethodPost}, Kind: "ollama", Auth: "token"})
+	http.HandleFunc("/api/conversation/process", liveHandler(configs, templates, func(config *Config, templateConfig *TemplateConfig) http.HandlerFunc {
+		return conversationHandler(config, templateConfig, history)
+	}))
+	summary.addRoute(RouteInfo{Path: "/api/conversation/process", Methods: []string{http.MethodPost}, Kind: "conversation", Auth: "token"})
+	for _, path := range []string{"/api/tags", "/api/version"} {
+		path := path
+		http.HandleFunc(path, liveHandler(configs, templates, func(config *Config, _ *TemplateConfig) http.HandlerFunc {
+			return ollamaPassthroughHandler(config, path)
+		}))
+		summary.addRoute(RouteInfo{Path: path, Methods: []string{http.MethodGet}, Kind: "ollama", Auth: "token"})
+	}
+
+	http.HandleFunc("/jobs/", liveHandler(configs, templates, func(config *Config, _ *TemplateConfig) http.HandlerFunc {
+		return signResponses(signer, jobsHandler(config, jobs))
+	}))
+	summary.addRoute(RouteInfo{Path: "/jobs/{id}", Methods: []string{http.MethodGet}, Kind: "jobs", Auth: "token"})
+	summary.addRoute(RouteInfo{Path: "/jobs/{id}/stream", Methods: []string{http.MethodGet}, Kind: "jobs", Auth: "token"})
+
+	admin := func(path string, methods []string, build func(*Config, *TemplateConfig) http.HandlerFunc) {
+		http.HandleFunc(path, liveHandler(configs, templates, func(config *Config, templateConfig *TemplateConfig) http.HandlerFunc {
+			return authenticateAdmin(config, build(config, templateConfig))
+		}))
+		summary.addRoute(RouteInfo{Path: path, Methods: methods, Kind: "admin", Auth: "admin"})
+	}
+	admin("/admin/routes", []string{http.MethodGet}, func(*Config, *TemplateConfig) http.HandlerFunc {
+		return summary.handler
+	})
+	admin("/admin/history", []string{http.MethodGet, http.MethodDelete}, func(*Config, *TemplateConfig) http.HandlerFunc {
+		return historyHandler(history)
+	})
+	admin("/admin/history/export", []string{http.MethodGet}, func(*Config, *TemplateConfig) http.HandlerFunc {
+		return historyExportHandler(history)
+	})
+	admin("/admin/aggregate", []string{http.MethodPost}, func(config *Config, templateConfig *TemplateConfig) http.HandlerFunc {
+		return aggregateHandler(config, templateConfig, outputs, history)
+	})
+	admin("/admin/recommendations", []string{http.MethodGet}, func(*Config, *TemplateConfig) http.HandlerFunc {
+		return recommendationsHandler(history)
+	})
+	admin("/admin/probe", []string{http.MethodGet}, func(config *Config, templateConfig *TemplateConfig) http.HandlerFunc {
+		return probeHandler(config, templateConfig)
+	})
+	admin("/admin/latency", []string{http.MethodGet}, func(config *Config, _ *TemplateConfig) http.HandlerFunc {
+		return latencyHandler(config)
+	})
+	admin("/admin/cache", []string{http.MethodDelete}, func(config *Config, _ *TemplateConfig) http.HandlerFunc {
+		return cacheHandler(config)
+	})
+	admin("/admin/watermark", []string{http.MethodPost}, func(*Config, *TemplateConfig) http.HandlerFunc {
+		return watermarkHandler
+	})
+	admin("/admin/approvals/", []string{http.MethodGet, http.MethodPost}, func(config *Config, _ *TemplateConfig) http.HandlerFunc {
+		return approvalsHandler(config)
+	})
+	http.HandleFunc("/admin/approvals", liveHandler(configs, templates, func(config *Config, _ *TemplateConfig) http.HandlerFunc {
+		return authenticateAdmin(config, approvalsHandler(config))
+	}))
+	admin("/admin/reload", []string{http.MethodPost}, func(*Config, *TemplateConfig) http.HandlerFunc {
+		return reloadHandler(configs, templates)
+	})
+	admin("/admin/templates/", []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete}, func(config *Config, _ *TemplateConfig) http.HandlerFunc {
+		return templateAdminHandler(config, templates)
+	})
+	http.HandleFunc("/admin/templates", liveHandler(configs, templates, func(config *Config, _ *TemplateConfig) http.HandlerFunc {
+		return authenticateAdmin(config, templateAdminHandler(config, templates))
+	}))
+	admin("/admin/backends/", []string{http.MethodGet, http.MethodPut, http.MethodDelete}, func(*Config, *TemplateConfig) http.HandlerFunc {
+		return backendsHandler(configs, templates)
+	})
+	http.HandleFunc("/admin/backends", liveHandler(configs, templates, func(config *Config, _ *TemplateConfig) http.HandlerFunc {
+		return authenticateAdmin(config, backendsHandler(configs, templates))
+	}))
+	admin("/admin/flags/", []string{http.MethodGet, http.MethodPut}, func(config *Config, _ *TemplateConfig) http.HandlerFunc {
+		return flagsHandler(config)
+	})
+	http.HandleFunc("/admin/flags", liveHandler(configs, templates, func(config *Config, _ *TemplateConfig) http.HandlerFunc {
+		return authenticateAdmin(config, flagsHandler(config))
+	}))
+	http.HandleFunc("/readyz", liveHandler(configs, templates, func(config *Config, _ *TemplateConfig) http.HandlerFunc {
+		return readyHandler(config)
+	}))
+	summary.addRoute(RouteInfo{Path: "/readyz", Methods: []string{http.MethodGet}, Kind: "health", Auth: "public"})
+	http.HandleFunc("/healthz", healthHandler)
+	summary.addRoute(RouteInfo{Path: "/healthz", Methods: []string{http.MethodGet}, Kind: "health", Auth: "public"})
+	http.HandleFunc("/metrics", liveHandler(configs, templates, func(config *Config, _ *TemplateConfig) http.HandlerFunc {
+		return metricsHandler(config)
+	}))
+	metricsAuth := "admin"
+	if config.Metrics.Public {
+		metricsAuth = "public"
+	}
+	summary.addRoute(RouteInfo{Path: "/metrics", Methods: []string{http.MethodGet}, Kind: "metrics", Auth: metricsAuth})
+
+	scheduler, err := newScheduler(configs, templates, outputs, history)
+	if err != nil {
+		fatal("Failed to load schedules", "error", err)
+	}
+	scheduler.start()
+	admin("/admin/schedules/", []string{http.MethodGet, http.MethodPost}, func(*Config, *TemplateConfig) http.HandlerFunc {
+		return scheduler.handler
+	})
+	http.HandleFunc("/admin/schedules", liveHandler(configs, templates, func(config *Config, _ *TemplateConfig) http.HandlerFunc {
+		return authenticateAdmin(config, scheduler.handler)
+	}))
+
+	watchSignals(configs, templates)
+	if config.WatchTemplates {
+		templates.watchFiles()
 	}
 
-	log.Println("Starting server on", config.ServerAddress)
-	if err := http.ListenAndServe(config.ServerAddress, nil); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	summary.log()
+	if err := listenAndServe(config, traceRequests(assignRequestID(routeMiddleware(configs, http.DefaultServeMux))), scheduler.stop); err != nil {
+		fatal("Failed to start server", "error", err)
 	}
 }
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// MemoryConfig remembers conversations, so a request with the conversation_id
+// of an earlier one is sent with what was said before and follow-up questions
+// work. Conversations are forgotten TTL after their last turn, and keep their
+// last MaxTurns exchanges. Beyond MaxConversations the oldest is forgotten.
+// Path keeps the conversations across restarts.
+type MemoryConfig struct {
+	Enabled          bool   `json:"enabled"`
+	TTL              string `json:"ttl"`
+	MaxTurns         int    `json:"max_turns"`
+	MaxConversations int    `json:"max_conversations"`
+	Path             string `json:"path"`
+
+	ttl time.Duration
+}
+
+func (c *MemoryConfig) parse() error {
+	c.ttl = 30 * time.Minute
+	if c.TTL != "" {
+		ttl, err := time.ParseDuration(c.TTL)
+		if err != nil || ttl <= 0 {
+			return fmt.Errorf("invalid memory ttl '%s'", c.TTL)
+		}
+		c.ttl = ttl
+	}
+	if c.MaxTurns < 0 || c.MaxConversations < 0 {
+		return fmt.Errorf("memory max_turns and max_conversations can't be negative")
+	}
+	if c.MaxTurns == 0 {
+		c.MaxTurns = 10
+	}
+	if c.MaxConversations == 0 {
+		c.MaxConversations = 1000
+	}
+	return nil
+}
+
+// Memory keeps the conversations. It lives as long as the server, so reloads
+// don't forget them.
+type Memory struct {
+	mu            sync.Mutex
+	conversations map[string]*rememberedConversation
+	dirty         bool
+	// Encrypts the saved conversations, when history has a key
+	aead cipher.AEAD
+}
+
+type rememberedConversation struct {
+	Messages []ChatMessage `json:"messages"`
+	Updated  time.Time     `json:"updated"`
+}
+
+func newMemory() *Memory {
+	return &Memory{conversations: make(map[string]*rememberedConversation)}
+}
+
+// conversationKey is the key of a template's conversation. Each template has
+// its own conversations, so an ID used with two templates doesn't mix them.
+func conversationKey(templateName, id string) string {
+	return templateName + "/" + id
+}
+
+// recall returns what was said so far in the template's conversation, oldest
+// first.
+func (m *Memory) recall(templateName, id string, config MemoryConfig) []ChatMessage {
+	if !config.Enabled || id == "" {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	conversation, ok := m.conversations[conversationKey(templateName, id)]
+	if !ok || time.Since(conversation.Updated) > config.ttl {
+		return nil
+	}
+	return append([]ChatMessage(nil), conversation.Messages...)
+}
+
+// remember adds a query and its answer to the template's conversation,
+// dropping the oldest exchanges beyond max_turns.
+func (m *Memory) remember(templateName, id, query, answer string, config MemoryConfig) {
+	if !config.Enabled || id == "" {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	key := conversationKey(templateName, id)
+	conversation, ok := m.conversations[key]
+	if !ok || now.Sub(conversation.Updated) > config.ttl {
+		conversation = &rememberedConversation{}
+		m.conversations[key] = conversation
+	}
+	conversation.Messages = append(conversation.Messages,
+		ChatMessage{Role: "user", Content: query},
+		ChatMessage{Role: "assistant", Content: answer})
+	if excess := len(conversation.Messages) - 2*config.MaxTurns; excess > 0 {
+		conversation.Messages = append([]ChatMessage(nil), conversation.Messages[excess:]...)
+	}
+	conversation.Updated = now
+	m.dirty = true
+
+	var oldestID string
+	var oldest time.Time
+	for id, conversation := range m.conversations {
+		if now.Sub(conversation.Updated) > config.ttl {
+			delete(m.conversations, id)
+		} else if oldestID == "" || conversation.Updated.Before(oldest) {
+			oldestID, oldest = id, conversation.Updated
+		}
+	}
+	if len(m.conversations) > config.MaxConversations {
+		delete(m.conversations, oldestID)
+	}
+}
+
+// persist loads the conversations from path, then saves them there every
+// minute while they change, and when the server stops. With aead, the history cipher, the file is
+// encrypted.
+func (m *Memory) persist(path string, config MemoryConfig, aead cipher.AEAD) error {
+	m.aead = aead
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(data) > 0 {
+		encrypted := bytes.HasPrefix(data, []byte(encryptedRecordPrefix))
+		if data, err = unseal(aead, string(data)); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		var conversations map[string]*rememberedConversation
+		if err := json.Unmarshal(data, &conversations); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		m.mu.Lock()
+		for id, conversation := range conversations {
+			if conversation != nil && time.Since(conversation.Updated) <= config.ttl {
+				m.conversations[id] = conversation
+			}
+		}
+		// Written before the key was set, so encrypt it
+		m.dirty = aead != nil && !encrypted
+		m.mu.Unlock()
+	}
+
+	go func() {
+		for range time.Tick(time.Minute) {
+			if err := m.save(path); err != nil {
+				slog.Error("Failed to save conversations", "error", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// save writes the conversations to path if they changed.
+func (m *Memory) save(path string) error {
+	m.mu.Lock()
+	if !m.dirty {
+		m.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(m.conversations)
+	m.dirty = false
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if m.aead != nil {
+		sealed, err := seal(m.aead, data)
+		if err != nil {
+			return err
+		}
+		data = []byte(sealed)
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// withRecalled puts the remembered turns ahead of the request's own messages,
+// after its system message if it starts with one.
+func withRecalled(recalled, messages []ChatMessage) []ChatMessage {
+	if len(recalled) == 0 {
+		return messages
+	}
+	combined := make([]ChatMessage, 0, len(recalled)+len(messages))
+	if len(messages) > 0 && messages[0].Role == "system" {
+		combined = append(combined, messages[0])
+		messages = messages[1:]
+	}
+	combined = append(combined, recalled...)
+	return append(combined, messages...)
+}
+
+// addConversationInput reads the request's 'conversation_id'.
+func addConversationInput(request map[string]interface{}, data *TemplateData) error {
+	raw, ok := request["conversation_id"]
+	if !ok {
+		return nil
+	}
+	id, ok := raw.(string)
+	if !ok {
+		return badInput("Conversation ID must be a string")
+	}
+	data.ConversationID = id
+	return nil
+}
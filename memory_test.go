@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestMemoryConversations(t *testing.T) {
+	config := MemoryConfig{Enabled: true, MaxTurns: 2}
+	if err := config.parse(); err != nil {
+		t.Fatal(err)
+	}
+	memory := newMemory()
+	memory.remember("kitchen", "c1", "is the oven on?", "No.", config)
+	memory.remember("kitchen", "c1", "and the hob?", "Yes.", config)
+	memory.remember("garage", "c1", "is the door open?", "It's closed.", config)
+
+	tests := []struct {
+		name     string
+		template string
+		id       string
+		config   MemoryConfig
+		want     []string
+	}{
+		{"raw queries in order", "kitchen", "c1", config, []string{"is the oven on?", "No.", "and the hob?", "Yes."}},
+		{"same ID in another template", "garage", "c1", config, []string{"is the door open?", "It's closed."}},
+		{"unknown conversation", "kitchen", "c2", config, nil},
+		{"template without the conversation", "lights", "c1", config, nil},
+		{"no ID", "kitchen", "", config, nil},
+		{"disabled", "kitchen", "c1", MemoryConfig{}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, message := range memory.recall(tt.template, tt.id, tt.config) {
+				got = append(got, message.Content)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("recall() = %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("recall() = %q, want %q", got, tt.want)
+				}
+			}
+		})
+	}
+
+	// Beyond max_turns the oldest exchange is dropped
+	memory.remember("kitchen", "c1", "the grill?", "Off.", config)
+	if got := memory.recall("kitchen", "c1", config); len(got) != 4 || got[0].Content != "and the hob?" {
+		t.Errorf("recall() after max_turns = %v", got)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricsConfig controls the Prometheus /metrics endpoint. It needs the admin
+// token unless public is set.
+type MetricsConfig struct {
+	Public bool `json:"public"`
+}
+
+// Upper bounds of the latency histogram buckets, in seconds
+var latencyBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+type histogram struct {
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]int64, len(latencyBuckets))
+	}
+	seconds := d.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+type requestKey struct {
+	source, template, status string
+}
+
+type tokenKey struct {
+	template, model string
+}
+
+type originKey struct {
+	origin, status string
+}
+
+type tokenCounts struct {
+	prompt, completion int64
+}
+
+// Metrics counts generations for Prometheus. It lives as long as the server, so
+// reloads don't reset the counters.
+type Metrics struct {
+	mu         sync.Mutex
+	requests   map[requestKey]int64
+	tokens     map[tokenKey]*tokenCounts
+	duration   map[string]*histogram
+	firstToken map[string]*histogram
+	inFlight   map[string]int64
+	// Requests and tokens by the origin callers name, for those that do
+	origins      map[originKey]int64
+	originTokens map[string]*tokenCounts
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		requests:   make(map[requestKey]int64),
+		tokens:     make(map[tokenKey]*tokenCounts),
+		duration:   make(map[string]*histogram),
+		firstToken: make(map[string]*histogram),
+		inFlight:   make(map[string]int64),
+
+		origins:      make(map[originKey]int64),
+		originTokens: make(map[string]*tokenCounts),
+	}
+}
+
+// start counts a generation of the template as in flight until the returned
+// function is called.
+func (m *Metrics) start(templateName string) func() {
+	if m == nil {
+		return func() {}
+	}
+	m.mu.Lock()
+	m.inFlight[templateName]++
+	m.mu.Unlock()
+	return func() {
+		m.mu.Lock()
+		m.inFlight[templateName]--
+		m.mu.Unlock()
+	}
+}
+
+// record counts a finished generation. Latency and tokens are only recorded
+// for successful ones.
+func (m *Metrics) record(source, templateName, model, origin, status string, stats *GenerationStats, total time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestKey{source, templateName, status}]++
+	if origin != "" {
+		m.origins[originKey{origin, status}]++
+		if status == "ok" && stats != nil {
+			tokens := m.originTokens[origin]
+			if tokens == nil {
+				tokens = &tokenCounts{}
+				m.originTokens[origin] = tokens
+			}
+			tokens.prompt += int64(stats.PromptTokens)
+			tokens.completion += int64(stats.CompletionTokens)
+		}
+	}
+	if status != "ok" {
+		return
+	}
+
+	duration := m.duration[templateName]
+	if duration == nil {
+		duration = &histogram{}
+		m.duration[templateName] = duration
+	}
+	duration.observe(total)
+	if stats == nil {
+		return
+	}
+	if stats.FirstToken > 0 {
+		firstToken := m.firstToken[templateName]
+		if firstToken == nil {
+			firstToken = &histogram{}
+			m.firstToken[templateName] = firstToken
+		}
+		firstToken.observe(stats.FirstToken)
+	}
+	tokens := m.tokens[tokenKey{templateName, model}]
+	if tokens == nil {
+		tokens = &tokenCounts{}
+		m.tokens[tokenKey{templateName, model}] = tokens
+	}
+	tokens.prompt += int64(stats.PromptTokens)
+	tokens.completion += int64(stats.CompletionTokens)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats label pairs, given as name, value, name, value...
+func labels(pairs ...string) string {
+	var parts []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, pairs[i]+`="`+labelEscaper.Replace(pairs[i+1])+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func writeHistograms(w io.Writer, name, help string, histograms map[string]*histogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for _, templateName := range sortedKeys(histograms) {
+		h := histograms[templateName]
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, labels("template", templateName, "le", fmt.Sprint(bound)), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, labels("template", templateName, "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", name, labels("template", templateName), h.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", name, labels("template", templateName), h.count)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// write renders the metrics in the Prometheus text format.
+func (m *Metrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	requests := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		requests = append(requests, key)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		a, b := requests[i], requests[j]
+		if a.source != b.source {
+			return a.source < b.source
+		}
+		if a.template != b.template {
+			return a.template < b.template
+		}
+		return a.status < b.status
+	})
+	fmt.Fprintln(w, "# HELP llamanator_requests_total Generations by source, template and status (ok, cached, coalesced, error or rate_limited).")
+	fmt.Fprintln(w, "# TYPE llamanator_requests_total counter")
+	for _, key := range requests {
+		fmt.Fprintf(w, "llamanator_requests_total%s %d\n", labels("source", key.source, "template", key.template, "status", key.status), m.requests[key])
+	}
+
+	tokens := make([]tokenKey, 0, len(m.tokens))
+	for key := range m.tokens {
+		tokens = append(tokens, key)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		if tokens[i].template != tokens[j].template {
+			return tokens[i].template < tokens[j].template
+		}
+		return tokens[i].model < tokens[j].model
+	})
+	fmt.Fprintln(w, "# HELP llamanator_prompt_tokens_total Prompt tokens read by the model (prompt_eval_count).")
+	fmt.Fprintln(w, "# TYPE llamanator_prompt_tokens_total counter")
+	for _, key := range tokens {
+		fmt.Fprintf(w, "llamanator_prompt_tokens_total%s %d\n", labels("template", key.template, "model", key.model), m.tokens[key].prompt)
+	}
+	fmt.Fprintln(w, "# HELP llamanator_completion_tokens_total Tokens generated by the model (eval_count).")
+	fmt.Fprintln(w, "# TYPE llamanator_completion_tokens_total counter")
+	for _, key := range tokens {
+		fmt.Fprintf(w, "llamanator_completion_tokens_total%s %d\n", labels("template", key.template, "model", key.model), m.tokens[key].completion)
+	}
+
+	origins := make([]originKey, 0, len(m.origins))
+	for key := range m.origins {
+		origins = append(origins, key)
+	}
+	sort.Slice(origins, func(i, j int) bool {
+		if origins[i].origin != origins[j].origin {
+			return origins[i].origin < origins[j].origin
+		}
+		return origins[i].status < origins[j].status
+	})
+	fmt.Fprintln(w, "# HELP llamanator_origin_requests_total Generations by the origin the request named and status.")
+	fmt.Fprintln(w, "# TYPE llamanator_origin_requests_total counter")
+	for _, key := range origins {
+		fmt.Fprintf(w, "llamanator_origin_requests_total%s %d\n", labels("origin", key.origin, "status", key.status), m.origins[key])
+	}
+	fmt.Fprintln(w, "# HELP llamanator_origin_tokens_total Prompt and completion tokens by the origin the request named.")
+	fmt.Fprintln(w, "# TYPE llamanator_origin_tokens_total counter")
+	for _, origin := range sortedKeys(m.originTokens) {
+		fmt.Fprintf(w, "llamanator_origin_tokens_total%s %d\n", labels("origin", origin, "type", "prompt"), m.originTokens[origin].prompt)
+		fmt.Fprintf(w, "llamanator_origin_tokens_total%s %d\n", labels("origin", origin, "type", "completion"), m.originTokens[origin].completion)
+	}
+
+	writeHistograms(w, "llamanator_generation_duration_seconds", "Time from request to complete response.", m.duration)
+	writeHistograms(w, "llamanator_first_token_seconds", "Time to the first token from the upstream.", m.firstToken)
+
+	fmt.Fprintln(w, "# HELP llamanator_in_flight_requests Generations waiting on the upstream.")
+	fmt.Fprintln(w, "# TYPE llamanator_in_flight_requests gauge")
+	for _, templateName := range sortedKeys(m.inFlight) {
+		fmt.Fprintf(w, "llamanator_in_flight_requests%s %d\n", labels("template", templateName), m.inFlight[templateName])
+	}
+}
+
+// metricsHandler serves GET /metrics.
+func metricsHandler(config *Config) http.HandlerFunc {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		config.metrics.write(w)
+		config.queues.writeMetrics(w, "llamanator_queue", "model", "each model with a concurrency limit")
+		config.pools.writeMetrics(w, "llamanator_pool", "pool", "each worker pool with a concurrency limit")
+	}
+	if config.Metrics.Public {
+		return handler
+	}
+	return authenticateAdmin(config, handler)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Ollama's context size when a request doesn't set num_ctx
+	defaultNumCtx = 2048
+	// Tokens kept free for the answer when num_predict isn't set
+	defaultAnswerTokens = 512
+	// How long a failed /api/show lookup is remembered before retrying
+	modelInfoRetry = 5 * time.Minute
+)
+
+// ollamaEndpoint returns the URL of another Ollama API path on the same server
+// as api_url, e.g. /api/show.
+func ollamaEndpoint(config *Config, path string) string {
+	base := strings.TrimSuffix(config.APIURL, "/")
+	if i := strings.LastIndex(base, "/api/"); i >= 0 {
+		base = base[:i]
+	}
+	return base + path
+}
+
+// ModelInfo is what the backend reports about a model.
+type ModelInfo struct {
+	ContextLength int
+	fetched       time.Time
+	err           error
+}
+
+// ModelCatalog caches model details from Ollama's /api/show, and how fast each
+// model has been.
+type ModelCatalog struct {
+	mu     sync.Mutex
+	models map[string]ModelInfo
+	warned map[string]bool
+	speeds map[string]*ModelSpeed
+}
+
+func newModelCatalog() *ModelCatalog {
+	return &ModelCatalog{models: make(map[string]ModelInfo), warned: make(map[string]bool)}
+}
+
+// warnOnce reports whether a warning hasn't been logged yet for key.
+func (c *ModelCatalog) warnOnce(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.warned[key] {
+		return false
+	}
+	c.warned[key] = true
+	return true
+}
+
+// contextLength returns the model's maximum context in tokens, or 0 if the
+// backend doesn't report it.
+func (c *ModelCatalog) contextLength(ctx context.Context, config *Config, model string) int {
+	c.mu.Lock()
+	info, ok := c.models[model]
+	c.mu.Unlock()
+	if ok && (info.err == nil || time.Since(info.fetched) < modelInfoRetry) {
+		return info.ContextLength
+	}
+
+	info = ModelInfo{fetched: time.Now()}
+	info.ContextLength, info.err = fetchContextLength(ctx, config, model)
+	if info.err != nil {
+		slog.Error("Failed to look up the context length", "model", model, "error", info.err)
+	}
+
+	c.mu.Lock()
+	c.models[model] = info
+	c.mu.Unlock()
+	return info.ContextLength
+}
+
+// ollamaJSON calls an Ollama API path on the api_url server, sending request
+// as JSON (unless nil) and decoding the response into response.
+func ollamaJSON(ctx context.Context, config *Config, method, path string, request, response interface{}) error {
+	var body io.Reader
+	if request != nil {
+		data, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, ollamaEndpoint(config, path), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Authorization", "Bearer "+config.APIKey)
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := sendTraced(http.DefaultClient, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("Ollama API returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+func fetchContextLength(ctx context.Context, config *Config, model string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	var show struct {
+		ModelInfo map[string]interface{} `json:"model_info"`
+	}
+	if err := ollamaJSON(ctx, config, http.MethodPost, "/api/show", map[string]string{"model": model}, &show); err != nil {
+		return 0, err
+	}
+	// The key is prefixed with the architecture, e.g. "llama.context_length"
+	for key, value := range show.ModelInfo {
+		if strings.HasSuffix(key, ".context_length") {
+			if length, ok := value.(float64); ok {
+				return int(length), nil
+			}
+		}
+	}
+	return 0, nil
+}
+
+// estimateTokens roughly counts the tokens in text, about four characters each.
+func estimateTokens(text string) int {
+	return (len([]rune(text)) + 3) / 4
+}
+
+func intOption(options map[string]interface{}, name string) int {
+	value, _ := options[name].(float64)
+	return int(value)
+}
+
+// answerTokens is the room kept for the answer: num_predict when it's set.
+func answerTokens(options map[string]interface{}) int {
+	if answer := intOption(options, "num_predict"); answer > 0 {
+		return answer
+	}
+	return defaultAnswerTokens
+}
+
+// fitContextWindow checks num_ctx against the model's context length, lowering
+// it when it's larger than the model supports. With auto_num_ctx it also raises
+// num_ctx (up to the model's limit) when the prompt and answer won't fit in the
+// default window. It returns the context budget in tokens.
+func fitContextWindow(ctx context.Context, config *Config, model, prompt string, options map[string]interface{}) int {
+	maxContext := config.models.contextLength(ctx, config, model)
+	numCtx := intOption(options, "num_ctx")
+
+	if numCtx > 0 && maxContext > 0 && numCtx > maxContext {
+		if config.models.warnOnce("num_ctx " + model) {
+			slog.Warn("num_ctx is larger than the model's context, using the context length", "num_ctx", numCtx, "context_length", maxContext, "model", model)
+		}
+		numCtx = maxContext
+		options["num_ctx"] = numCtx
+	}
+
+	if numCtx == 0 && config.AutoNumCtx {
+		if needed := estimateTokens(prompt) + answerTokens(options); needed > defaultNumCtx {
+			// Round up to a multiple of 1024 to avoid reloading the model for every size
+			numCtx = (needed + 1023) / 1024 * 1024
+			if maxContext > 0 {
+				numCtx = min(numCtx, maxContext)
+			}
+			options["num_ctx"] = numCtx
+			traceLog(ctx, config, "Set num_ctx for the prompt", "num_ctx", numCtx, "prompt_tokens", estimateTokens(prompt), "model", model)
+		}
+	}
+
+	if numCtx == 0 {
+		numCtx = defaultNumCtx
+	}
+	return numCtx
+}
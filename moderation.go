@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Actions moderation can take on a delivery, from least to most severe
+const (
+	moderationAllow  = "allow"
+	moderationFlag   = "flag"
+	moderationRedact = "redact"
+	moderationBlock  = "block"
+)
+
+var moderationSeverity = map[string]int{moderationAllow: 0, moderationFlag: 1, moderationRedact: 2, moderationBlock: 3}
+
+// Replaces redacted responses, unless the config gives its own message
+const defaultModerationMessage = "This message was withheld by moderation."
+
+// How long moderation waits for the classifier
+const moderationTimeout = 2 * time.Minute
+
+// ModerationConfig has a small local model check responses before they're
+// delivered to outputs with "moderate" set, such as family-facing
+// notifications. Guard models like llama-guard3 classify the query and
+// response with their own categories (S1, S2...). Other models are asked about
+// Categories instead, a description of each by name. Actions picks what
+// happens to a response in each category: "block" drops the delivery,
+// "redact" delivers Message in its place, "flag" delivers it with its
+// moderation result and "allow" ignores the category. Action applies to
+// categories Actions leaves out and defaults to "block". With FailOpen,
+// responses are delivered when the model can't be asked, instead of withheld.
+type ModerationConfig struct {
+	Model      string            `json:"model"`
+	Categories map[string]string `json:"categories"`
+	Actions    map[string]string `json:"actions"`
+	Action     string            `json:"action"`
+	Message    string            `json:"message"`
+	FailOpen   bool              `json:"fail_open"`
+}
+
+// ModerationResult is what moderation found in a delivered response.
+type ModerationResult struct {
+	Action     string   `json:"action"`
+	Categories []string `json:"categories"`
+}
+
+func (c *ModerationConfig) check(outputs []OutputConfig) error {
+	if c.Model == "" {
+		for _, oc := range outputs {
+			if oc.Moderate {
+				return fmt.Errorf("output '%s' is moderated but moderation has no model", oc.Name)
+			}
+		}
+	}
+	if _, ok := moderationSeverity[c.Action]; c.Action != "" && !ok {
+		return fmt.Errorf("invalid moderation action '%s'", c.Action)
+	}
+	for category, action := range c.Actions {
+		if _, ok := moderationSeverity[action]; !ok {
+			return fmt.Errorf("invalid moderation action '%s' for category '%s'", action, category)
+		}
+	}
+	return nil
+}
+
+// action is what to do with a response in the category.
+func (c *ModerationConfig) action(category string) string {
+	for name, action := range c.Actions {
+		if strings.EqualFold(name, category) {
+			return action
+		}
+	}
+	if c.Action != "" {
+		return c.Action
+	}
+	return moderationBlock
+}
+
+func (c *ModerationConfig) message() string {
+	if c.Message != "" {
+		return c.Message
+	}
+	return defaultModerationMessage
+}
+
+// classify asks the moderation model for the categories the response falls
+// in, none when it's safe.
+func (c *ModerationConfig) classify(ctx context.Context, backend Backend, query, response string) ([]string, error) {
+	var messages []map[string]interface{}
+	if len(c.Categories) == 0 {
+		// Guard models are given the exchange and judge the last turn
+		if query != "" {
+			messages = append(messages, map[string]interface{}{"role": "user", "content": query})
+		}
+		messages = append(messages, map[string]interface{}{"role": "assistant", "content": response})
+	} else {
+		messages = []map[string]interface{}{{"role": "user", "content": c.prompt(response)}}
+	}
+	// The classifier's tokens aren't the answer's
+	ctx = withGenerationStats(ctx, &GenerationStats{})
+	verdict, err := backend.Chat(ctx, map[string]interface{}{
+		"model":    c.Model,
+		"messages": messages,
+		"stream":   false,
+		"options":  map[string]interface{}{"temperature": 0, "num_predict": 30},
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return parseVerdict(responseContent(verdict, true))
+}
+
+// prompt asks a general-purpose model to classify the response.
+func (c *ModerationConfig) prompt(response string) string {
+	var prompt strings.Builder
+	prompt.WriteString("You moderate messages sent to a family. Check whether the message below falls in any of these categories:\n\n")
+	names := make([]string, 0, len(c.Categories))
+	for name := range c.Categories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&prompt, "- %s: %s\n", name, c.Categories[name])
+	}
+	prompt.WriteString("\nReply with only \"safe\" if it falls in none of them, otherwise \"unsafe\" and the names of the categories it falls in, separated by commas.\n\nMessage:\n")
+	prompt.WriteString(response)
+	return prompt.String()
+}
+
+// parseVerdict reads a "safe" or "unsafe" reply, the latter followed by the
+// categories, as in llama-guard's "unsafe\nS1,S10".
+func parseVerdict(text string) ([]string, error) {
+	text = strings.TrimSpace(text)
+	lower := strings.ToLower(text)
+	switch {
+	case strings.HasPrefix(lower, "unsafe"):
+		categories := strings.FieldsFunc(text[len("unsafe"):], func(r rune) bool {
+			return r == ',' || r == ':' || r == '.' || unicode.IsSpace(r)
+		})
+		if len(categories) == 0 {
+			categories = []string{"unsafe"}
+		}
+		return categories, nil
+	case strings.HasPrefix(lower, "safe"):
+		return nil, nil
+	}
+	return nil, fmt.Errorf("expected safe or unsafe, got %q", text)
+}
+
+// moderate checks the delivery's response and returns the delivery to make,
+// false when it's blocked.
+func (c *ModerationConfig) moderate(config *Config, d Delivery) (Delivery, bool) {
+	backend, err := newBackend(config, "", 0)
+	if err != nil {
+		slog.Error("Failed to moderate delivery", "template", d.Template, "error", err)
+		return d, c.FailOpen
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), moderationTimeout)
+	defer cancel()
+	categories, err := c.classify(ctx, backend, d.Query, d.Response)
+	if err != nil {
+		slog.Error("Failed to moderate delivery", "template", d.Template, "model", c.Model, "fail_open", c.FailOpen, "error", err)
+		return d, c.FailOpen
+	}
+
+	action := moderationAllow
+	for _, category := range categories {
+		if moderationSeverity[c.action(category)] > moderationSeverity[action] {
+			action = c.action(category)
+		}
+	}
+	if action == moderationAllow {
+		return d, true
+	}
+	slog.Warn("Moderation caught a response", "template", d.Template, "categories", categories, "action", action)
+	d.Moderation = &ModerationResult{Action: action, Categories: categories}
+	switch action {
+	case moderationBlock:
+		return d, false
+	case moderationRedact:
+		// Other fields may repeat what was redacted
+		d.Response = c.message()
+		d.Fields = map[string]interface{}{"response": d.Response}
+	}
+	fields := make(map[string]interface{}, len(d.Fields)+1)
+	for key, value := range d.Fields {
+		fields[key] = value
+	}
+	fields["moderation"] = d.Moderation
+	d.Fields = fields
+	return d, true
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// MQTTConfig is the broker that streamed tokens are published to when a request
+// sets 'mqtt_topic'. Reply topics must start with topic_prefix.
+type MQTTConfig struct {
+	Broker      string `json:"broker"`
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	ClientID    string `json:"client_id"`
+	TopicPrefix string `json:"topic_prefix"`
+}
+
+// MQTTClient is a minimal publish-only MQTT 3.1.1 client. Messages are sent
+// with QoS 0 over a single connection that is re-established on failure.
+// Publishing only queues a message, so a slow or unreachable broker never
+// holds up a generation.
+type MQTTClient struct {
+	config MQTTConfig
+	queue  chan mqttOutgoing
+	conn   net.Conn
+	// failing is set after a write fails, so an unreachable broker is logged
+	// once rather than for every message
+	failing bool
+	// retryAt delays reconnecting after a failed connection, so queued
+	// messages are dropped quickly instead of each waiting for a dial
+	retryAt time.Time
+}
+
+type mqttOutgoing struct {
+	topic   string
+	payload []byte
+}
+
+// mqttQueueSize is how many messages can wait for the broker before publish
+// starts dropping them
+const mqttQueueSize = 1024
+
+// mqttRetryDelay is how long to wait before reconnecting to a broker that
+// couldn't be reached
+const mqttRetryDelay = 5 * time.Second
+
+var (
+	errMQTTQueueFull   = errors.New("MQTT publish queue is full")
+	errMQTTUnavailable = errors.New("MQTT broker is unavailable")
+)
+
+func newMQTTClient(config MQTTConfig) *MQTTClient {
+	if config.ClientID == "" {
+		// Brokers disconnect a client when another connects with the same ID,
+		// so instances sharing a broker need their own
+		config.ClientID = "llamanator-" + newRequestID()[:8]
+	}
+	if config.TopicPrefix == "" {
+		config.TopicPrefix = "llamanator/"
+	}
+	c := &MQTTClient{config: config, queue: make(chan mqttOutgoing, mqttQueueSize)}
+	if config.Broker != "" {
+		go c.run()
+	}
+	return c
+}
+
+func (c *MQTTClient) enabled() bool {
+	return c != nil && c.config.Broker != ""
+}
+
+// publish queues payload to be sent to topic, returning an error only if the
+// queue is full.
+func (c *MQTTClient) publish(topic string, payload []byte) error {
+	select {
+	case c.queue <- mqttOutgoing{topic: topic, payload: payload}:
+		return nil
+	default:
+		return errMQTTQueueFull
+	}
+}
+
+// run sends queued messages in order.
+func (c *MQTTClient) run() {
+	for message := range c.queue {
+		err := c.write(mqttPublishPacket(message.topic, message.payload))
+		if err != nil && !c.failing {
+			slog.Error("Failed to publish to MQTT", "topic", message.topic, "error", err)
+		} else if err == nil && c.failing {
+			slog.Info("Publishing to MQTT again")
+		}
+		c.failing = err != nil
+	}
+}
+
+// write sends packet, reconnecting once if the connection was lost.
+func (c *MQTTClient) write(packet []byte) error {
+	for attempt := 0; ; attempt++ {
+		if c.conn == nil {
+			if time.Now().Before(c.retryAt) {
+				return errMQTTUnavailable
+			}
+			conn, err := c.connect()
+			if err != nil {
+				c.retryAt = time.Now().Add(mqttRetryDelay)
+				return err
+			}
+			c.conn = conn
+		}
+
+		c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		_, err := c.conn.Write(packet)
+		if err == nil {
+			return nil
+		}
+		c.conn.Close()
+		c.conn = nil
+		if attempt == 1 {
+			return err
+		}
+	}
+}
+
+func (c *MQTTClient) connect() (net.Conn, error) {
+	address, useTLS := c.config.Broker, false
+	if strings.Contains(address, "://") {
+		parsed, err := url.Parse(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MQTT broker: %w", err)
+		}
+		address, useTLS = parsed.Host, parsed.Scheme == "mqtts" || parsed.Scheme == "ssl"
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		port := "1883"
+		if useTLS {
+			port = "8883"
+		}
+		address = net.JoinHostPort(address, port)
+	}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	var err error
+	if useTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, nil)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write(mqttConnectPacket(c.config)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	connack := make([]byte, 4)
+	if _, err := io.ReadFull(conn, connack); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("no CONNACK from MQTT broker: %w", err)
+	}
+	if connack[0] != 0x20 || connack[3] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("MQTT broker refused the connection (code %d)", connack[3])
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// reply returns a publisher for a request's reply topic after checking it is
+// allowed.
+func (c *MQTTClient) reply(topic string, haContext HAContext) (*mqttReply, error) {
+	if !c.enabled() {
+		return nil, badInput("MQTT is not configured")
+	}
+	if strings.ContainsAny(topic, "+#\x00") {
+		return nil, badInput("MQTT topic must not contain wildcards")
+	}
+	if !strings.HasPrefix(topic, c.config.TopicPrefix) {
+		return nil, badInput("MQTT topic must start with '%s'", c.config.TopicPrefix)
+	}
+	return &mqttReply{client: c, topic: topic, contextID: haContext.ID}, nil
+}
+
+// mqttReply publishes the tokens of one generation as JSON messages:
+// {"type":"token","text":"..."} per chunk, then {"type":"done","response":"..."}
+// or {"type":"error","error":"..."}. Messages carry the request's context_id.
+type mqttReply struct {
+	client    *MQTTClient
+	topic     string
+	contextID string
+	failed    bool
+}
+
+type mqttMessage struct {
+	Type      string `json:"type"`
+	Text      string `json:"text,omitempty"`
+	Response  string `json:"response,omitempty"`
+	Error     string `json:"error,omitempty"`
+	ContextID string `json:"context_id,omitempty"`
+}
+
+func (r *mqttReply) send(message mqttMessage) {
+	// A full queue stops publishing but never the generation
+	if r.failed {
+		return
+	}
+	message.ContextID = r.contextID
+	payload, _ := json.Marshal(message)
+	if err := r.client.publish(r.topic, payload); err != nil {
+		slog.Error("Failed to publish to MQTT", "topic", r.topic, "error", err)
+		r.failed = true
+	}
+}
+
+func (r *mqttReply) token(chunk string) {
+	r.send(mqttMessage{Type: "token", Text: chunk})
+}
+
+// wrap publishes each chunk before passing it on to next.
+func (r *mqttReply) wrap(next func(string)) func(string) {
+	return func(chunk string) {
+		r.token(chunk)
+		next(chunk)
+	}
+}
+
+func (r *mqttReply) finish(filteredResponse map[string]interface{}, err error) {
+	if err != nil {
+		_, message := templateError(err)
+		r.send(mqttMessage{Type: "error", Error: message})
+		return
+	}
+	response, _ := filteredResponse["response"].(string)
+	r.send(mqttMessage{Type: "done", Response: response})
+}
+
+func mqttString(buf *bytes.Buffer, s string) {
+	buf.WriteByte(byte(len(s) >> 8))
+	buf.WriteByte(byte(len(s)))
+	buf.WriteString(s)
+}
+
+// mqttPacket prefixes body with the fixed header and variable length encoding.
+func mqttPacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+func mqttConnectPacket(config MQTTConfig) []byte {
+	var body bytes.Buffer
+	mqttString(&body, "MQTT")
+	body.WriteByte(4) // protocol level 3.1.1
+
+	flags := byte(0x02) // clean session
+	if config.Username != "" {
+		flags |= 0x80
+		if config.Password != "" {
+			flags |= 0x40
+		}
+	}
+	body.WriteByte(flags)
+	body.Write([]byte{0, 0}) // no keep alive, the connection is only used to publish
+
+	mqttString(&body, config.ClientID)
+	if config.Username != "" {
+		mqttString(&body, config.Username)
+		if config.Password != "" {
+			mqttString(&body, config.Password)
+		}
+	}
+	return mqttPacket(0x10, body.Bytes())
+}
+
+func mqttPublishPacket(topic string, payload []byte) []byte {
+	var body bytes.Buffer
+	mqttString(&body, topic)
+	body.Write(payload)
+	return mqttPacket(0x30, body.Bytes())
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readMQTTPacket reads one packet, returning its fixed header byte and body.
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit&0x7f) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return header, body, err
+}
+
+// fakeBroker accepts one connection, accepts its CONNECT and sends each PUBLISH as "topic payload" on the returned channel. With silent
+// set it never answers.
+func fakeBroker(t *testing.T, silent bool) (string, <-chan string, <-chan []byte) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	published := make(chan string, 16)
+	connects := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if silent {
+			time.Sleep(2 * time.Second)
+			return
+		}
+
+		reader := bufio.NewReader(conn)
+		for {
+			header, body, err := readMQTTPacket(reader)
+			if err != nil {
+				return
+			}
+			switch header & 0xf0 {
+			case 0x10:
+				connects <- body
+				conn.Write([]byte{0x20, 0x02, 0x00, 0x00})
+			case 0x30:
+				topicLength := int(body[0])<<8 | int(body[1])
+				published <- string(body[2:2+topicLength]) + " " + string(body[2+topicLength:])
+			}
+		}
+	}()
+	return listener.Addr().String(), published, connects
+}
+
+func TestMQTTPacketLength(t *testing.T) {
+	tests := []struct {
+		length int
+		want   []byte
+	}{
+		{0, []byte{0x30, 0x00}},
+		{127, []byte{0x30, 0x7f}},
+		{128, []byte{0x30, 0x80, 0x01}},
+		{16383, []byte{0x30, 0xff, 0x7f}},
+		{16384, []byte{0x30, 0x80, 0x80, 0x01}},
+	}
+	for _, tt := range tests {
+		packet := mqttPacket(0x30, make([]byte, tt.length))
+		if got := packet[:len(tt.want)]; !bytes.Equal(got, tt.want) || len(packet) != len(tt.want)+tt.length {
+			t.Errorf("length %d: header %x, want %x", tt.length, got, tt.want)
+		}
+	}
+}
+
+func TestMQTTClientID(t *testing.T) {
+	first := newMQTTClient(MQTTConfig{}).config.ClientID
+	second := newMQTTClient(MQTTConfig{}).config.ClientID
+	if first == second {
+		t.Errorf("default client IDs are both %q", first)
+	}
+	// MQTT 3.1.1 brokers only have to accept IDs of up to 23 characters
+	if !strings.HasPrefix(first, "llamanator-") || len(first) > 23 {
+		t.Errorf("default client ID = %q", first)
+	}
+	if id := newMQTTClient(MQTTConfig{ClientID: "kitchen"}).config.ClientID; id != "kitchen" {
+		t.Errorf("configured client ID = %q", id)
+	}
+}
+
+func TestMQTTPublish(t *testing.T) {
+	addr, published, connects := fakeBroker(t, false)
+	client := newMQTTClient(MQTTConfig{Broker: addr, ClientID: "test-client", Username: "user", Password: "secret"})
+
+	for _, payload := range []string{"one", "two", "three"} {
+		if err := client.publish("llamanator/test", []byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	connect := <-connects
+	for _, want := range []string{"MQTT", "test-client", "user", "secret"} {
+		if !bytes.Contains(connect, []byte(want)) {
+			t.Errorf("CONNECT missing %q", want)
+		}
+	}
+	for _, want := range []string{"one", "two", "three"} {
+		select {
+		case got := <-published:
+			if got != "llamanator/test "+want {
+				t.Errorf("published %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+}
+
+func TestMQTTPublishDoesNotBlock(t *testing.T) {
+	// The broker never sends a CONNACK, so the first message holds up the queue
+	addr, _, _ := fakeBroker(t, true)
+	client := newMQTTClient(MQTTConfig{Broker: addr})
+
+	start := time.Now()
+	var err error
+	for i := 0; i <= mqttQueueSize+1 && err == nil; i++ {
+		err = client.publish("llamanator/test", []byte("token"))
+	}
+	if !errors.Is(err, errMQTTQueueFull) {
+		t.Errorf("error = %v, want a full queue", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("publishing took %s", elapsed)
+	}
+}
+
+func TestMQTTReplyTopic(t *testing.T) {
+	client := newMQTTClient(MQTTConfig{Broker: "127.0.0.1:1"})
+	tests := []struct {
+		topic   string
+		wantErr bool
+	}{
+		{"llamanator/kitchen", false},
+		{"llamanator/#", true},
+		{"llamanator/+/display", true},
+		{"other/topic", true},
+	}
+	for _, tt := range tests {
+		_, err := client.reply(tt.topic, HAContext{})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("reply(%q) error = %v, wantErr %v", tt.topic, err, tt.wantErr)
+		}
+	}
+	if _, err := newMQTTClient(MQTTConfig{}).reply("llamanator/kitchen", HAContext{}); err == nil {
+		t.Error("expected an error when MQTT isn't configured")
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// OllamaIngressConfig configures the Ollama-compatible /api/chat ingress. The
+// persona and guardrails are added to the system message of every chat.
+type OllamaIngressConfig struct {
+	Persona    string   `json:"persona"`
+	Guardrails []string `json:"guardrails"`
+	// ReplaceSystem discards the client's own system message instead of
+	// appending it after the injected one
+	ReplaceSystem bool `json:"replace_system"`
+}
+
+// systemPrompt is the text injected ahead of every chat.
+func (c OllamaIngressConfig) systemPrompt() string {
+	var prompt strings.Builder
+	prompt.WriteString(strings.TrimSpace(c.Persona))
+	if len(c.Guardrails) > 0 {
+		if prompt.Len() > 0 {
+			prompt.WriteString("\n\n")
+		}
+		prompt.WriteString("Always follow these rules:")
+		for _, rule := range c.Guardrails {
+			prompt.WriteString("\n- " + strings.TrimSpace(rule))
+		}
+	}
+	return prompt.String()
+}
+
+// injectSystemPrompt adds the configured system prompt to the messages of an
+// Ollama chat request, merging it with a system message the client sent.
+func injectSystemPrompt(config OllamaIngressConfig, chatRequest map[string]interface{}) {
+	system := config.systemPrompt()
+	if system == "" {
+		return
+	}
+	messages, _ := chatRequest["messages"].([]interface{})
+	if len(messages) > 0 {
+		if first, ok := messages[0].(map[string]interface{}); ok && first["role"] == "system" {
+			if existing, _ := first["content"].(string); existing != "" && !config.ReplaceSystem {
+				system += "\n\n" + existing
+			}
+			first["content"] = system
+			return
+		}
+	}
+	injected := map[string]interface{}{"role": "system", "content": system}
+	chatRequest["messages"] = append([]interface{}{injected}, messages...)
+}
+
+// ollamaChatIngressHandler serves POST /api/chat for Ollama clients. Requests
+// are sent to the backend like template requests, with the injected system
+// prompt, and the response (streamed or not) comes back in Ollama's shape.
+func ollamaChatIngressHandler(config *Config) http.HandlerFunc {
+	return authenticate(config, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var chatRequest map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&chatRequest); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if _, ok := chatRequest["messages"].([]interface{}); !ok {
+			http.Error(w, "messages is required", http.StatusBadRequest)
+			return
+		}
+		if model, _ := chatRequest["model"].(string); model == "" {
+			chatRequest["model"] = config.DefaultModel
+		}
+		injectSystemPrompt(config.OllamaIngress, chatRequest)
+
+		// Ollama streams unless told not to. Tool calls don't come through
+		// streamed chunks, so chats with tools are answered in one piece
+		stream, ok := chatRequest["stream"].(bool)
+		if !ok {
+			stream = true
+		}
+		if stream && !config.Flags.Enabled(flagStreaming) {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "Streaming is disabled"})
+			return
+		}
+		_, tools := chatRequest["tools"]
+		chatRequest["stream"] = stream && !tools
+
+		ctx := requestTraceContext(r.Context(), config, r)
+		release, err := waitForModel(ctx, config, chatRequest["model"].(string))
+		if err != nil {
+			slog.Warn("Too many requests are waiting for the model", "model", chatRequest["model"], "error", err)
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": ollamaBusy})
+			return
+		}
+		defer release()
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(config.RequestTimeout)*time.Second)
+		defer cancel()
+		if !stream {
+			response, err := postChat(ctx, config, "ollama", chatRequest, nil)
+			if err != nil {
+				writeOllamaError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, response)
+			return
+		}
+		streamOllamaChat(ctx, w, config, chatRequest)
+	})
+}
+
+// streamOllamaChat answers a chat as Ollama's stream of JSON lines: a chunk
+// per piece of the answer, then the final response with the statistics.
+func streamOllamaChat(ctx context.Context, w http.ResponseWriter, config *Config, chatRequest map[string]interface{}) {
+	flusher, _ := w.(http.Flusher)
+	started := false
+	encoder := json.NewEncoder(w)
+	write := func(line interface{}) {
+		if !started {
+			w.Header().Set("Content-Type", ndjsonType)
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+		encoder.Encode(line)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	var onChunk func(string)
+	if chatRequest["stream"] == true {
+		onChunk = func(chunk string) {
+			write(map[string]interface{}{
+				"model":      chatRequest["model"],
+				"created_at": time.Now().UTC().Format(time.RFC3339Nano),
+				"message":    map[string]string{"role": "assistant", "content": chunk},
+				"done":       false,
+			})
+		}
+	}
+	response, err := postChat(ctx, config, "ollama", chatRequest, onChunk)
+	if err != nil {
+		if !started {
+			writeOllamaError(w, err)
+			return
+		}
+		slog.Error("Failed to stream a response from the Ollama API", "error", err)
+		write(map[string]string{"error": "Failed to get a response from the Ollama API"})
+		return
+	}
+	// The chunks already carried the answer
+	if message, ok := response["message"].(map[string]interface{}); ok && onChunk != nil {
+		final := make(map[string]interface{}, len(message))
+		for key, value := range message {
+			final[key] = value
+		}
+		final["content"] = ""
+		response["message"] = final
+	}
+	write(response)
+}
+
+// ollamaBusy is the error Ollama answers with when too many requests are
+// waiting, which its clients know to retry.
+const ollamaBusy = "server busy, please try again.  maximum pending requests exceeded"
+
+// writeOllamaError responds to a failed chat the way Ollama does, passing on
+// the backend's status when it refused the request.
+func writeOllamaError(w http.ResponseWriter, err error) {
+	slog.Error("Failed to get a response from the Ollama API", "error", err)
+	var upstream *upstreamStatusError
+	if errors.As(err, &upstream) && upstream.status < http.StatusInternalServerError {
+		writeJSON(w, upstream.status, map[string]string{"error": upstream.msg})
+		return
+	}
+	writeJSON(w, http.StatusBadGateway, map[string]string{"error": "Failed to get a response from the Ollama API"})
+}
+
+// ollamaPassthroughHandler forwards read-only Ollama API calls such as
+// /api/tags, which Ollama clients use to discover models.
+func ollamaPassthroughHandler(config *Config, path string) http.HandlerFunc {
+	return authenticate(config, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		defer cancel()
+		proxyOllama(ctx, config, w, path)
+	})
+}
+
+// proxyOllama sends a GET request to the Ollama API and copies the response
+// to w, flushing as it goes.
+func proxyOllama(ctx context.Context, config *Config, w http.ResponseWriter, path string) {
+	// With api_urls the balancer picks the server
+	backend := config
+	if len(config.APIURLs) > 0 {
+		backend = failoverBackend(config, config.balancer.order(config)[0])
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ollamaEndpoint(backend, path), nil)
+	if err != nil {
+		http.Error(w, "Failed to create the Ollama API request", http.StatusInternalServerError)
+		return
+	}
+	req.Header.Add("Authorization", "Bearer "+config.APIKey)
+
+	resp, err := sendTraced(http.DefaultClient, req)
+	if err != nil {
+		slog.Error("Failed to send request to Ollama API", "path", path, "error", err)
+		http.Error(w, "Failed to get a response from the Ollama API", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, writeErr := w.Write(buf[:n]); writeErr != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				slog.Error("Failed to read response from Ollama API", "path", path, "error", err)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOllamaChatIngress(t *testing.T) {
+	down, _ := fakeOllama(t, http.StatusServiceUnavailable, "")
+	up, _ := fakeOllama(t, http.StatusOK, "the heating is on")
+	missing, _ := fakeOllama(t, http.StatusNotFound, "")
+
+	tests := []struct {
+		name       string
+		apiURLs    []string
+		body       string
+		wantStatus int
+		wantLines  int
+		wantText   string
+	}{
+		{"streamed by default", []string{down.URL, up.URL}, `{"messages":[{"role":"user","content":"heating?"}]}`, http.StatusOK, 5, "the heating is on"},
+		{"plain", []string{down.URL, up.URL}, `{"stream":false,"messages":[{"role":"user","content":"heating?"}]}`, http.StatusOK, 1, "the heating is on"},
+		{"tools answered in one piece", []string{up.URL}, `{"tools":[],"messages":[{"role":"user","content":"heating?"}]}`, http.StatusOK, 1, "the heating is on"},
+		{"backend refuses", []string{missing.URL}, `{"stream":false,"messages":[]}`, http.StatusNotFound, 1, ""},
+		{"every backend fails", []string{down.URL}, `{"messages":[]}`, http.StatusBadGateway, 1, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			urls, _ := json.Marshal(tt.apiURLs)
+			config := testConfig(t, `{"auth_token": "tok", "default_model": "llama3", "api_urls": `+string(urls)+`}`)
+			r := httptest.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(tt.body))
+			r.Header.Set("Authorization", "Bearer tok")
+			w := httptest.NewRecorder()
+			ollamaChatIngressHandler(config)(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+
+			var lines []map[string]interface{}
+			decoder := json.NewDecoder(w.Body)
+			for decoder.More() {
+				var line map[string]interface{}
+				if err := decoder.Decode(&line); err != nil {
+					t.Fatalf("response isn't JSON: %v", err)
+				}
+				lines = append(lines, line)
+			}
+			if len(lines) != tt.wantLines {
+				t.Fatalf("got %d lines, want %d: %v", len(lines), tt.wantLines, lines)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if _, ok := lines[0]["error"].(string); !ok {
+					t.Errorf("response = %v, want an error", lines[0])
+				}
+				return
+			}
+			var text strings.Builder
+			for _, line := range lines {
+				text.WriteString(responseContent(line, true))
+			}
+			if text.String() != tt.wantText {
+				t.Errorf("answer = %q, want %q", text.String(), tt.wantText)
+			}
+			if done, _ := lines[len(lines)-1]["done"].(bool); !done {
+				t.Errorf("last line isn't done: %v", lines[len(lines)-1])
+			}
+		})
+	}
+}
+
+func TestOllamaChatIngressBusy(t *testing.T) {
+	up, requests := fakeOllama(t, http.StatusOK, "the heating is on")
+	config := testConfig(t, `{"auth_token": "tok", "default_model": "llama3", "api_url": "`+up.URL+`/api/generate",
+		"queue": {"max_concurrent": 1, "timeout": "10ms"}}`)
+	release, err := waitForModel(context.Background(), config, "llama3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	r := httptest.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(`{"messages":[{"role":"user","content":"heating?"}]}`))
+	r.Header.Set("Authorization", "Bearer tok")
+	w := httptest.NewRecorder()
+	ollamaChatIngressHandler(config)(w, r)
+	var body map[string]string
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != http.StatusServiceUnavailable || body["error"] != ollamaBusy {
+		t.Errorf("response = %d %s, want Ollama's busy error", w.Code, w.Body.String())
+	}
+	if requests.Load() != 0 {
+		t.Errorf("backend got %d requests while the model was busy", requests.Load())
+	}
+}
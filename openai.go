@@ -0,0 +1,472 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// writeOpenAIError writes an error in the shape OpenAI clients expect.
+func writeOpenAIError(w http.ResponseWriter, status int, errorType, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"error": map[string]interface{}{"message": message, "type": errorType},
+	})
+}
+
+type openAIModel struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+// openAIModelsHandler serves GET /v1/models and /v1/models/{id} from the
+// models installed on the backend. Templates are listed too, as chat
+// completions can select them by name.
+func openAIModelsHandler(config *Config, templateConfig *TemplateConfig) http.HandlerFunc {
+	return authenticate(config, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "Method not allowed")
+			return
+		}
+
+		var tags struct {
+			Models []struct {
+				Name       string    `json:"name"`
+				ModifiedAt time.Time `json:"modified_at"`
+			} `json:"models"`
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		defer cancel()
+		if err := ollamaJSON(ctx, config, http.MethodGet, "/api/tags", nil, &tags); err != nil {
+			slog.Error("Failed to list models", "error", err)
+			writeOpenAIError(w, http.StatusBadGateway, "api_error", "Failed to list models from the Ollama API")
+			return
+		}
+
+		models := make([]openAIModel, 0, len(tags.Models))
+		for _, model := range tags.Models {
+			created := int64(0)
+			if !model.ModifiedAt.IsZero() {
+				created = model.ModifiedAt.Unix()
+			}
+			models = append(models, openAIModel{ID: model.Name, Object: "model", Created: created, OwnedBy: "library"})
+		}
+		for templateName := range templateConfig.Templates {
+			models = append(models, openAIModel{ID: templateName, Object: "model", OwnedBy: "llamanator"})
+		}
+		sort.Slice(models, func(i, j int) bool { return models[i].ID < models[j].ID })
+
+		if id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/v1/models"), "/"); id != "" {
+			for _, model := range models {
+				if model.ID == id {
+					writeJSON(w, http.StatusOK, model)
+					return
+				}
+			}
+			writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", "The model '"+id+"' does not exist")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"object": "list", "data": models})
+	})
+}
+
+type openAIEmbeddingRequest struct {
+	Model          string          `json:"model"`
+	Input          json.RawMessage `json:"input"`
+	EncodingFormat string          `json:"encoding_format"`
+}
+
+type openAIEmbedding struct {
+	Object    string      `json:"object"`
+	Index     int         `json:"index"`
+	Embedding interface{} `json:"embedding"`
+}
+
+// openAIEmbeddingsHandler serves POST /v1/embeddings using Ollama's /api/embed.
+func openAIEmbeddingsHandler(config *Config) http.HandlerFunc {
+	return authenticate(config, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "Method not allowed")
+			return
+		}
+
+		var request openAIEmbeddingRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "Invalid request")
+			return
+		}
+		if request.Model == "" {
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "model is required")
+			return
+		}
+
+		// Input is a string or a list of strings
+		var inputs []string
+		var single string
+		if err := json.Unmarshal(request.Input, &single); err == nil {
+			inputs = []string{single}
+		} else if err := json.Unmarshal(request.Input, &inputs); err != nil || len(inputs) == 0 {
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "input must be a string or a list of strings")
+			return
+		}
+
+		backend, err := newBackend(config, config.OpenAI.EmbeddingsBackend, 0)
+		if err != nil {
+			slog.Error("Failed to create embeddings", "model", request.Model, "error", err)
+			writeOpenAIError(w, http.StatusInternalServerError, "api_error", "The embeddings backend is misconfigured")
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(config.RequestTimeout)*time.Second)
+		defer cancel()
+		embeddings, promptTokens, err := backend.Embed(ctx, request.Model, inputs)
+		if err != nil {
+			slog.Error("Failed to create embeddings", "model", request.Model, "error", err)
+			writeOpenAIError(w, http.StatusBadGateway, "api_error", "Failed to get embeddings from the backend")
+			return
+		}
+
+		data := make([]openAIEmbedding, len(embeddings))
+		for i, vector := range embeddings {
+			data[i] = openAIEmbedding{Object: "embedding", Index: i, Embedding: vector}
+			if request.EncodingFormat == "base64" {
+				data[i].Embedding = encodeEmbedding(vector)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"object": "list",
+			"data":   data,
+			"model":  request.Model,
+			"usage":  map[string]int{"prompt_tokens": promptTokens, "total_tokens": promptTokens},
+		})
+	})
+}
+
+// encodeEmbedding packs a vector as little-endian float32s in base64, the format
+// OpenAI clients request by default.
+func encodeEmbedding(vector []float64) string {
+	buf := make([]byte, 4*len(vector))
+	for i, value := range vector {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(float32(value)))
+	}
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+// OpenAIConfig configures /v1/chat/completions. Requests for a model named after
+// a template use that template, others use template when it is set.
+type OpenAIConfig struct {
+	Template string `json:"template"`
+	// EmbeddingsBackend is a name from backends to create embeddings with,
+	// empty for api_url
+	EmbeddingsBackend string `json:"embeddings_backend"`
+}
+
+type openAIChatRequest struct {
+	Model         string              `json:"model"`
+	Messages      []openAIChatMessage `json:"messages"`
+	Stream        bool                `json:"stream"`
+	StreamOptions struct {
+		IncludeUsage bool `json:"include_usage"`
+	} `json:"stream_options"`
+	MaxTokens           int             `json:"max_tokens"`
+	MaxCompletionTokens int             `json:"max_completion_tokens"`
+	Temperature         *float64        `json:"temperature"`
+	TopP                *float64        `json:"top_p"`
+	Seed                *int            `json:"seed"`
+	PresencePenalty     *float64        `json:"presence_penalty"`
+	FrequencyPenalty    *float64        `json:"frequency_penalty"`
+	Stop                json.RawMessage `json:"stop"`
+	// User identifies the caller, and is the origin unless the header sets one
+	User string `json:"user"`
+	// ConversationID continues a conversation remembered by the server, for
+	// clients that only send the latest message
+	ConversationID string `json:"conversation_id"`
+}
+
+type openAIChatMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+// openAIContent flattens message content, a string or a list of parts, into
+// text and base64 images from data URLs.
+func openAIContent(raw json.RawMessage) (string, []string, error) {
+	var text string
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil, nil
+	}
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text, nil, nil
+	}
+
+	var parts []struct {
+		Type     string `json:"type"`
+		Text     string `json:"text"`
+		ImageURL struct {
+			URL string `json:"url"`
+		} `json:"image_url"`
+	}
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return "", nil, errors.New("content must be a string or a list of content parts")
+	}
+	var texts, images []string
+	for _, part := range parts {
+		switch part.Type {
+		case "text":
+			texts = append(texts, part.Text)
+		case "image_url":
+			_, data, ok := strings.Cut(part.ImageURL.URL, ";base64,")
+			if !ok || !strings.HasPrefix(part.ImageURL.URL, "data:") {
+				return "", nil, errors.New("only base64 data URLs are supported for images")
+			}
+			images = append(images, data)
+		default:
+			return "", nil, fmt.Errorf("content parts of type %q are not supported", part.Type)
+		}
+	}
+	return strings.Join(texts, "\n"), images, nil
+}
+
+// openAIOptions maps OpenAI sampling parameters to Ollama options.
+func openAIOptions(request openAIChatRequest) (map[string]interface{}, error) {
+	// Options are decoded from JSON elsewhere, so numbers are kept as float64
+	options := make(map[string]interface{})
+	if request.MaxCompletionTokens > 0 {
+		options["num_predict"] = float64(request.MaxCompletionTokens)
+	} else if request.MaxTokens > 0 {
+		options["num_predict"] = float64(request.MaxTokens)
+	}
+	if request.Temperature != nil {
+		options["temperature"] = *request.Temperature
+	}
+	if request.TopP != nil {
+		options["top_p"] = *request.TopP
+	}
+	if request.Seed != nil {
+		options["seed"] = float64(*request.Seed)
+	}
+	if request.PresencePenalty != nil {
+		options["presence_penalty"] = *request.PresencePenalty
+	}
+	if request.FrequencyPenalty != nil {
+		options["frequency_penalty"] = *request.FrequencyPenalty
+	}
+	if len(request.Stop) > 0 && string(request.Stop) != "null" {
+		var stop []string
+		var single string
+		if err := json.Unmarshal(request.Stop, &single); err == nil {
+			stop = []string{single}
+		} else if err := json.Unmarshal(request.Stop, &stop); err != nil {
+			return nil, errors.New("stop must be a string or a list of strings")
+		}
+		options["stop"] = stop
+	}
+	return options, nil
+}
+
+// openAITemplate picks the template and model for a requested model: a template
+// name selects that template and its model, anything else is a model (or one
+// of the model_aliases) used with the configured template, if any. A model
+// the template's allowed_models doesn't list is an error.
+func openAITemplate(config *Config, templateConfig *TemplateConfig, requested string) (string, string, error) {
+	if _, ok := templateConfig.Templates[requested]; ok {
+		return requested, templateConfig.defaultModel(config, requested), nil
+	}
+	templateName := config.OpenAI.Template
+	if requested == "" {
+		return templateName, templateConfig.defaultModel(config, templateName), nil
+	}
+	if !templateConfig.modelAllowed(templateName, requested) {
+		return templateName, "", fmt.Errorf("model '%s' is not allowed for this template", requested)
+	}
+	if alias, ok := config.ModelAliases[requested]; ok {
+		return templateName, alias, nil
+	}
+	return templateName, requested, nil
+}
+
+func openAIFinishReason(stats *GenerationStats) string {
+	if stats.Truncated() {
+		return "length"
+	}
+	return "stop"
+}
+
+func openAIUsage(stats *GenerationStats) map[string]int {
+	return map[string]int{
+		"prompt_tokens":     stats.PromptTokens,
+		"completion_tokens": stats.CompletionTokens,
+		"total_tokens":      stats.PromptTokens + stats.CompletionTokens,
+	}
+}
+
+// openAIChatHandler serves POST /v1/chat/completions. The last user message is
+// the query for the template, which is rendered and sent to Ollama after the
+// rest of the conversation.
+func openAIChatHandler(config *Config, templateConfig *TemplateConfig, history *History) http.HandlerFunc {
+	return authenticate(config, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "Method not allowed")
+			return
+		}
+
+		var request openAIChatRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "Invalid request")
+			return
+		}
+		if len(request.Messages) == 0 || request.Messages[len(request.Messages)-1].Role != "user" {
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "messages must end with a user message")
+			return
+		}
+		if request.Stream && !config.Flags.Enabled(flagStreaming) {
+			writeOpenAIError(w, http.StatusServiceUnavailable, "api_error", "Streaming is disabled")
+			return
+		}
+
+		var data TemplateData
+		for i, message := range request.Messages {
+			text, images, err := openAIContent(message.Content)
+			if err != nil {
+				writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("messages[%d]: %v", i, err))
+				return
+			}
+			if i == len(request.Messages)-1 {
+				data.Query, data.Images = text, images
+				break
+			}
+			role := message.Role
+			if role == "developer" {
+				role = "system"
+			}
+			if role != "system" && role != "user" && role != "assistant" {
+				writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("messages[%d]: role %q is not supported", i, message.Role))
+				return
+			}
+			data.Messages = append(data.Messages, ChatMessage{Role: role, Content: text})
+		}
+		options, err := openAIOptions(request)
+		if err != nil {
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+			return
+		}
+		data.Options = options
+		data.ConversationID = request.ConversationID
+
+		haContext := HAContext{Origin: requestOrigin(r)}
+		if haContext.Origin == "" && validOrigin(request.User) {
+			haContext.Origin = request.User
+		}
+		templateName, model, err := openAITemplate(config, templateConfig, request.Model)
+		if err != nil {
+			slog.Warn("Rejected model for template", "model", request.Model, "template", templateName, "remote_addr", r.RemoteAddr)
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+			return
+		}
+		ctx := withGenerationStats(requestTraceContext(r.Context(), config, r), &GenerationStats{})
+		id := "chatcmpl-" + newJobID()
+		created := time.Now().Unix()
+		if request.Stream {
+			streamOpenAIChat(ctx, w, config, templateConfig, history, request, templateName, model, data, haContext, id, created)
+			return
+		}
+
+		start := time.Now()
+		filteredResponse, err := generate(ctx, config, templateConfig, templateName, data, model)
+		recordGeneration(ctx, config, history, "openai", templateName, data, model, haContext, start, filteredResponse, err)
+		if err != nil {
+			slog.Error("Failed to generate chat completion", "model", model, "error", err)
+			var limited *rateLimitError
+			if errors.As(err, &limited) {
+				limited.setRetryAfter(w)
+				writeOpenAIError(w, http.StatusTooManyRequests, "rate_limit_error", limited.Error())
+			} else if errors.Is(err, errPromptTooLong) {
+				writeOpenAIError(w, http.StatusRequestEntityTooLarge, "invalid_request_error", "Prompt is too long for the model's context window")
+			} else if errors.Is(err, errQueueFull) || errors.Is(err, errQueueTimeout) {
+				writeOpenAIError(w, http.StatusServiceUnavailable, "server_error", "Too many requests are waiting for the model")
+			} else {
+				writeOpenAIError(w, http.StatusBadGateway, "api_error", "Failed to get a response from the Ollama API")
+			}
+			return
+		}
+
+		stats := generationStats(ctx)
+		setUsageHeaders(ctx, w)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"id":      id,
+			"object":  "chat.completion",
+			"created": created,
+			"model":   request.Model,
+			"choices": []map[string]interface{}{{
+				"index":         0,
+				"message":       map[string]string{"role": "assistant", "content": filteredResponse["response"].(string)},
+				"finish_reason": openAIFinishReason(stats),
+			}},
+			"usage": openAIUsage(stats),
+		})
+	})
+}
+
+// streamOpenAIChat streams the response as chat.completion.chunk server-sent
+// events, ending with "data: [DONE]".
+func streamOpenAIChat(ctx context.Context, w http.ResponseWriter, config *Config, templateConfig *TemplateConfig, history *History, request openAIChatRequest, templateName, model string, data TemplateData, haContext HAContext, id string, created int64) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeOpenAIError(w, http.StatusInternalServerError, "api_error", "Streaming is not supported")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	writeChunk := func(delta map[string]string, finishReason interface{}, usage interface{}) {
+		chunk := map[string]interface{}{
+			"id":      id,
+			"object":  "chat.completion.chunk",
+			"created": created,
+			"model":   request.Model,
+			"choices": []map[string]interface{}{{"index": 0, "delta": delta, "finish_reason": finishReason}},
+		}
+		if usage != nil {
+			chunk["choices"] = []interface{}{}
+			chunk["usage"] = usage
+		}
+		payload, _ := json.Marshal(chunk)
+		fmt.Fprintf(w, "data: %s\n\n", payload)
+		flusher.Flush()
+	}
+
+	writeChunk(map[string]string{"role": "assistant", "content": ""}, nil, nil)
+	start := time.Now()
+	filteredResponse, err := generateStream(ctx, config, templateConfig, templateName, data, model, func(chunk string) {
+		writeChunk(map[string]string{"content": chunk}, nil, nil)
+	})
+	recordGeneration(ctx, config, history, "openai", templateName, data, model, haContext, start, filteredResponse, err)
+	if err != nil {
+		slog.Error("Failed to stream chat completion", "model", model, "error", err)
+		payload, _ := json.Marshal(map[string]interface{}{
+			"error": map[string]string{"message": "Failed to get a response from the Ollama API", "type": "api_error"},
+		})
+		fmt.Fprintf(w, "data: %s\n\n", payload)
+		flusher.Flush()
+		return
+	}
+
+	stats := generationStats(ctx)
+	writeChunk(map[string]string{}, openAIFinishReason(stats), nil)
+	if request.StreamOptions.IncludeUsage {
+		writeChunk(nil, nil, openAIUsage(stats))
+	}
+	fmt.Fprint(w, "data: [DONE]\n\n")
+	flusher.Flush()
+}
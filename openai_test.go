@@ -0,0 +1,46 @@
+package main
+
+import (
+	"html/template"
+	"strings"
+	"testing"
+)
+
+func TestOpenAITemplate(t *testing.T) {
+	config := &Config{DefaultModel: "llama3", ModelAliases: map[string]string{"fast": "phi3"}}
+	config.OpenAI.Template = "chat"
+	templateConfig := &TemplateConfig{
+		Templates: map[string]*template.Template{"chat": template.New("chat"), "summary": template.New("summary")},
+		Settings:  map[string]*TemplateSettings{"chat": {AllowedModels: []string{"mistral", "fast"}}},
+	}
+
+	tests := []struct {
+		requested    string
+		wantTemplate string
+		wantModel    string
+		wantErr      string
+	}{
+		{"", "chat", "llama3", ""},
+		{"summary", "summary", "llama3", ""},
+		{"mistral", "chat", "mistral", ""},
+		{"fast", "chat", "phi3", ""},
+		{"gemma", "", "", "model 'gemma' is not allowed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.requested, func(t *testing.T) {
+			templateName, model, err := openAITemplate(config, templateConfig, tt.requested)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if templateName != tt.wantTemplate || model != tt.wantModel {
+				t.Errorf("got %s/%s, want %s/%s", templateName, model, tt.wantTemplate, tt.wantModel)
+			}
+		})
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	mathrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OpenTelemetryConfig exports spans for each request to an OpenTelemetry
+// collector over OTLP/HTTP, such as http://localhost:4318. SampleRatio is the
+// share of requests traced (default 1), unless the caller's traceparent header
+// has already decided.
+type OpenTelemetryConfig struct {
+	Endpoint    string            `json:"endpoint"`
+	Headers     map[string]string `json:"headers"`
+	ServiceName string            `json:"service_name"`
+	SampleRatio *float64          `json:"sample_ratio"`
+}
+
+func (c OpenTelemetryConfig) check() error {
+	if c.SampleRatio != nil && (*c.SampleRatio < 0 || *c.SampleRatio > 1) {
+		return fmt.Errorf("opentelemetry sample_ratio must be from 0 to 1")
+	}
+	if c.Endpoint != "" && !strings.HasPrefix(c.Endpoint, "http://") && !strings.HasPrefix(c.Endpoint, "https://") {
+		return fmt.Errorf("opentelemetry endpoint must be an http or https URL")
+	}
+	return nil
+}
+
+// OTLP span kinds and status codes
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+
+	spanStatusError = 2
+)
+
+// Spans waiting to be exported, beyond which new ones are dropped
+const maxQueuedSpans = 2048
+
+// Header carrying the W3C trace context between services
+const traceparentHeader = "traceparent"
+
+// spanExporter is set at startup when OpenTelemetry is configured
+var spanExporter *otlpExporter
+
+type otlpExporter struct {
+	config OpenTelemetryConfig
+	url    string
+	ratio  float64
+	client *http.Client
+
+	mu      sync.Mutex
+	queue   []*span
+	dropped int
+	flush   chan struct{}
+}
+
+// setupOpenTelemetry starts exporting spans if an endpoint is configured.
+func setupOpenTelemetry(c OpenTelemetryConfig) {
+	if c.Endpoint == "" {
+		return
+	}
+	if c.ServiceName == "" {
+		c.ServiceName = "llamanator"
+	}
+	url := strings.TrimSuffix(c.Endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+	ratio := 1.0
+	if c.SampleRatio != nil {
+		ratio = *c.SampleRatio
+	}
+	spanExporter = &otlpExporter{
+		config: c,
+		url:    url,
+		ratio:  ratio,
+		client: &http.Client{Timeout: 10 * time.Second},
+		flush:  make(chan struct{}, 1),
+	}
+	go spanExporter.run()
+	slog.Info("Exporting OpenTelemetry spans", "url", url, "service_name", c.ServiceName, "sample_ratio", ratio)
+}
+
+// span is a timed operation within a trace. A nil span, for requests that
+// aren't traced, ignores everything done to it.
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+
+	mu     sync.Mutex
+	attrs  []any
+	err    error
+	finish time.Time
+}
+
+type spanKey struct{}
+
+// remoteSpan is the caller's span, from its traceparent header
+type remoteSpan struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+type remoteSpanKey struct{}
+
+// startSpan starts a span as a child of the context's span, or of the caller's
+// span for a server span, and returns the context carrying it. Nothing is
+// recorded when OpenTelemetry isn't configured or the trace isn't sampled.
+func startSpan(ctx context.Context, name string, kind int, args ...any) (context.Context, *span) {
+	if spanExporter == nil {
+		return ctx, nil
+	}
+	s := &span{name: name, kind: kind, start: time.Now(), attrs: args}
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok {
+		if parent == nil {
+			return ctx, nil
+		}
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else if remote, ok := ctx.Value(remoteSpanKey{}).(remoteSpan); ok {
+		if !remote.sampled {
+			return context.WithValue(ctx, spanKey{}, (*span)(nil)), nil
+		}
+		s.traceID = remote.traceID
+		s.parentID = remote.spanID
+	} else {
+		if mathrand.Float64() >= spanExporter.ratio {
+			return context.WithValue(ctx, spanKey{}, (*span)(nil)), nil
+		}
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// set adds attributes, as key value pairs, to the span.
+func (s *span) set(args ...any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, args...)
+	s.mu.Unlock()
+}
+
+// end finishes the span, marking it failed if err is set, and queues it for
+// export.
+func (s *span) end(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.err = err
+	s.finish = time.Now()
+	s.mu.Unlock()
+	spanExporter.enqueue(s)
+}
+
+// traceparent is the W3C trace context header value for the span.
+func (s *span) traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:]))
+}
+
+// traceID returns the trace ID of the context's span, or "".
+func traceID(ctx context.Context) string {
+	if s, ok := ctx.Value(spanKey{}).(*span); ok && s != nil {
+		return hex.EncodeToString(s.traceID[:])
+	}
+	return ""
+}
+
+// injectTraceparent passes the context's span on to an upstream request.
+func injectTraceparent(ctx context.Context, req *http.Request) {
+	if s, ok := ctx.Value(spanKey{}).(*span); ok && s != nil {
+		req.Header.Set(traceparentHeader, s.traceparent())
+	}
+}
+
+// parseTraceparent reads a W3C traceparent header of
+// 00-<trace id>-<parent id>-<flags>.
+func parseTraceparent(value string) (remoteSpan, bool) {
+	var remote remoteSpan
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return remote, false
+	}
+	traceID, err1 := hex.DecodeString(parts[1])
+	spanID, err2 := hex.DecodeString(parts[2])
+	flags, err3 := hex.DecodeString(parts[3])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return remote, false
+	}
+	copy(remote.traceID[:], traceID)
+	copy(remote.spanID[:], spanID)
+	if remote.traceID == [16]byte{} || remote.spanID == [8]byte{} {
+		return remote, false
+	}
+	remote.sampled = flags[0]&1 == 1
+	return remote, true
+}
+
+// traceRequests records a server span for each request, continuing the
+// caller's trace when it sends a traceparent header.
+func traceRequests(next http.Handler) http.Handler {
+	if spanExporter == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if remote, ok := parseTraceparent(r.Header.Get(traceparentHeader)); ok {
+			ctx = context.WithValue(ctx, remoteSpanKey{}, remote)
+		}
+		ctx, s := startSpan(ctx, r.Method+" "+r.URL.Path, spanKindServer,
+			"http.request.method", r.Method,
+			"url.path", r.URL.Path,
+			"client.address", r.RemoteAddr)
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+		var err error
+		if recorder.status >= http.StatusInternalServerError {
+			err = fmt.Errorf("%d %s", recorder.status, http.StatusText(recorder.status))
+		}
+		s.set("http.response.status_code", recorder.status)
+		s.end(err)
+	})
+}
+
+// sendTraced sends an upstream request with a client span, passing the trace
+// on in its traceparent header. The span ends when the response headers arrive.
+func sendTraced(client *http.Client, req *http.Request) (*http.Response, error) {
+	ctx, s := startSpan(req.Context(), req.Method+" "+req.URL.Path, spanKindClient,
+		"http.request.method", req.Method,
+		"url.full", req.URL.Redacted())
+	if s == nil {
+		return client.Do(req)
+	}
+	req = req.WithContext(ctx)
+	injectTraceparent(ctx, req)
+	resp, err := client.Do(req)
+	if err == nil {
+		s.set("http.response.status_code", resp.StatusCode)
+		if resp.StatusCode >= http.StatusBadRequest {
+			err = fmt.Errorf("%s", resp.Status)
+		}
+	}
+	s.end(err)
+	return resp, err
+}
+
+func (e *otlpExporter) enqueue(s *span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.queue) >= maxQueuedSpans {
+		e.dropped++
+		return
+	}
+	e.queue = append(e.queue, s)
+	if len(e.queue) >= maxQueuedSpans/4 {
+		select {
+		case e.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run exports queued spans every five seconds, or sooner when many are queued.
+func (e *otlpExporter) run() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-e.flush:
+		}
+		e.mu.Lock()
+		spans, dropped := e.queue, e.dropped
+		e.queue, e.dropped = nil, 0
+		e.mu.Unlock()
+		if dropped > 0 {
+			slog.Warn("Dropped OpenTelemetry spans, the export queue was full", "spans", dropped)
+		}
+		if len(spans) > 0 {
+			if err := e.export(spans); err != nil {
+				slog.Warn("Failed to export OpenTelemetry spans", "spans", len(spans), "error", err)
+			}
+		}
+	}
+}
+
+// export sends spans to the collector as OTLP JSON.
+func (e *otlpExporter) export(spans []*span) error {
+	otlpSpans := make([]map[string]interface{}, len(spans))
+	for i, s := range spans {
+		otlpSpans[i] = s.otlp()
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes([]any{"service.name", e.config.ServiceName}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "llamanator"},
+				"spans": otlpSpans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range e.config.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s returned %s: %s", e.url, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// otlp is the span in the OTLP JSON encoding.
+func (s *span) otlp() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	encoded := map[string]interface{}{
+		"traceId":           hex.EncodeToString(s.traceID[:]),
+		"spanId":            hex.EncodeToString(s.spanID[:]),
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.finish.UnixNano(), 10),
+		"attributes":        otlpAttributes(s.attrs),
+	}
+	if s.parentID != [8]byte{} {
+		encoded["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+	}
+	if s.err != nil {
+		encoded["status"] = map[string]interface{}{"code": spanStatusError, "message": s.err.Error()}
+	}
+	return encoded
+}
+
+// otlpAttributes encodes key value pairs as OTLP attributes.
+func otlpAttributes(args []any) []map[string]interface{} {
+	attributes := []map[string]interface{}{}
+	for i := 0; i+1 < len(args); i += 2 {
+		key, ok := args[i].(string)
+		if !ok {
+			continue
+		}
+		var value map[string]interface{}
+		switch v := args[i+1].(type) {
+		case string:
+			value = map[string]interface{}{"stringValue": v}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		attributes = append(attributes, map[string]interface{}{"key": key, "value": value})
+	}
+	return attributes
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOpenTelemetryConfigCheck(t *testing.T) {
+	ratio := func(r float64) *float64 { return &r }
+	tests := []struct {
+		name    string
+		config  OpenTelemetryConfig
+		wantErr string
+	}{
+		{"off", OpenTelemetryConfig{}, ""},
+		{"valid", OpenTelemetryConfig{Endpoint: "http://localhost:4318", SampleRatio: ratio(0.5)}, ""},
+		{"ratio too high", OpenTelemetryConfig{SampleRatio: ratio(1.5)}, "sample_ratio"},
+		{"ratio negative", OpenTelemetryConfig{SampleRatio: ratio(-0.1)}, "sample_ratio"},
+		{"not http", OpenTelemetryConfig{Endpoint: "grpc://localhost:4317"}, "http or https"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.check()
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name        string
+		value       string
+		wantOK      bool
+		wantSampled bool
+	}{
+		{"sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"not sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"future version", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true, true},
+		{"invalid version", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"zero trace id", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"short span id", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa-01", false, false},
+		{"not hex", "00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01", false, false},
+		{"empty", "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote, ok := parseTraceparent(tt.value)
+			if ok != tt.wantOK || remote.sampled != tt.wantSampled {
+				t.Fatalf("got %v sampled=%v, want %v sampled=%v", ok, remote.sampled, tt.wantOK, tt.wantSampled)
+			}
+			if ok && hex.EncodeToString(remote.traceID[:]) != "4bf92f3577b34da6a3ce929d0e0e4736" {
+				t.Errorf("trace ID = %x", remote.traceID)
+			}
+		})
+	}
+}
+
+func TestOTLPAttributes(t *testing.T) {
+	got := otlpAttributes([]any{"s", "text", "b", true, "i", 3, "i64", int64(4), "f", 0.5, "other", []int{1}, 7, "skipped", "odd"})
+	want := []map[string]interface{}{
+		{"key": "s", "value": map[string]interface{}{"stringValue": "text"}},
+		{"key": "b", "value": map[string]interface{}{"boolValue": true}},
+		{"key": "i", "value": map[string]interface{}{"intValue": "3"}},
+		{"key": "i64", "value": map[string]interface{}{"intValue": "4"}},
+		{"key": "f", "value": map[string]interface{}{"doubleValue": 0.5}},
+		{"key": "other", "value": map[string]interface{}{"stringValue": "[1]"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("attributes = %v, want %v", got, want)
+	}
+}
+
+// testExporter installs an exporter sending to a fake collector, without its
+// background loop, and returns the spans the collector receives.
+func testExporter(t *testing.T, ratio float64) *[]map[string]interface{} {
+	t.Helper()
+	var received []map[string]interface{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []map[string]interface{} `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		for _, resource := range body.ResourceSpans {
+			for _, scope := range resource.ScopeSpans {
+				received = append(received, scope.Spans...)
+			}
+		}
+	}))
+	t.Cleanup(collector.Close)
+
+	previous := spanExporter
+	spanExporter = &otlpExporter{
+		config: OpenTelemetryConfig{ServiceName: "llamanator"},
+		url:    collector.URL + "/v1/traces",
+		ratio:  ratio,
+		client: collector.Client(),
+		flush:  make(chan struct{}, 1),
+	}
+	t.Cleanup(func() { spanExporter = previous })
+	return &received
+}
+
+func TestTraceRequests(t *testing.T) {
+	received := testExporter(t, 1)
+	var upstreamTraceparent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamTraceparent = r.Header.Get(traceparentHeader)
+	}))
+	defer upstream.Close()
+
+	handler := traceRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, _ := http.NewRequestWithContext(r.Context(), http.MethodPost, upstream.URL+"/api/generate", nil)
+		resp, err := sendTraced(http.DefaultClient, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		http.Error(w, "failed", http.StatusBadGateway)
+	}))
+	r := httptest.NewRequest(http.MethodPost, "/template/default", nil)
+	r.Header.Set(traceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	if err := spanExporter.export(spanExporter.queue); err != nil {
+		t.Fatal(err)
+	}
+	spans := *received
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2: %v", len(spans), spans)
+	}
+	client, server := spans[0], spans[1]
+	if server["name"] != "POST /template/default" || server["traceId"] != "4bf92f3577b34da6a3ce929d0e0e4736" || server["parentSpanId"] != "00f067aa0ba902b7" {
+		t.Errorf("server span = %v", server)
+	}
+	if status, _ := server["status"].(map[string]interface{}); status["code"] != float64(spanStatusError) {
+		t.Errorf("server span status = %v, want an error for the 502", server["status"])
+	}
+	if client["name"] != "POST /api/generate" || client["traceId"] != server["traceId"] || client["parentSpanId"] != server["spanId"] {
+		t.Errorf("client span = %v", client)
+	}
+	if want := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + client["spanId"].(string) + "-01"; upstreamTraceparent != want {
+		t.Errorf("upstream traceparent = %q, want %q", upstreamTraceparent, want)
+	}
+}
+
+func TestStartSpanSampling(t *testing.T) {
+	testExporter(t, 0)
+	ctx, s := startSpan(context.Background(), "unsampled", spanKindInternal)
+	if s != nil {
+		t.Fatal("span recorded with a sample ratio of 0")
+	}
+	if _, child := startSpan(ctx, "child", spanKindInternal); child != nil {
+		t.Error("child of an unsampled span recorded")
+	}
+
+	remote, _ := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx = context.WithValue(context.Background(), remoteSpanKey{}, remote)
+	if _, s := startSpan(ctx, "sampled by caller", spanKindServer); s == nil {
+		t.Error("span the caller sampled wasn't recorded")
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type feedItem struct {
+	ID       string    `json:"id"`
+	Source   string    `json:"source"`
+	Time     time.Time `json:"time"`
+	Response string    `json:"response"`
+}
+
+// feedSink keeps the most recent deliveries for each source (schedule or template)
+// and serves them as RSS and Atom feeds. With a path, the items are saved
+// there after each delivery and loaded at startup.
+type feedSink struct {
+	name     string
+	maxItems int
+	public   bool
+	path     string
+	baseURL  string
+
+	mu    sync.RWMutex
+	items map[string][]feedItem
+}
+
+func newFeedSink(oc OutputConfig) (*feedSink, error) {
+	maxItems := oc.MaxItems
+	if maxItems <= 0 {
+		maxItems = 20
+	}
+	if oc.URL != "" {
+		if parsed, err := url.Parse(oc.URL); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			return nil, fmt.Errorf("url must be absolute, such as https://llamanator.example.com")
+		}
+	}
+	sink := &feedSink{
+		name:     oc.Name,
+		maxItems: maxItems,
+		public:   oc.Public,
+		path:     oc.Path,
+		baseURL:  strings.TrimSuffix(oc.URL, "/"),
+		items:    make(map[string][]feedItem),
+	}
+	if err := sink.load(); err != nil {
+		return nil, fmt.Errorf("failed to load feed items: %w", err)
+	}
+	return sink, nil
+}
+
+// load reads the items saved at the feed's path, if there are any.
+func (s *feedSink) load() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &s.items); err != nil {
+		return fmt.Errorf("%s: %w", s.path, err)
+	}
+	for source, items := range s.items {
+		if len(items) > s.maxItems {
+			s.items[source] = items[:s.maxItems]
+		}
+	}
+	return nil
+}
+
+func (s *feedSink) Deliver(d Delivery) error {
+	item := feedItem{ID: fmt.Sprintf("%s/%d", d.Source, d.Time.UnixNano()), Source: d.Source, Time: d.Time, Response: d.Response}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Newest first, trimmed to the configured size
+	items := append([]feedItem{item}, s.items[d.Source]...)
+	if len(items) > s.maxItems {
+		items = items[:s.maxItems]
+	}
+	s.items[d.Source] = items
+
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(s.items)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+func (s *feedSink) recent(source string) []feedItem {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]feedItem(nil), s.items[source]...)
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Description string  `xml:"description"`
+	PubDate     string  `xml:"pubDate"`
+	GUID        rssGUID `xml:"guid"`
+}
+
+type rssGUID struct {
+	Value       string `xml:",chardata"`
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Link    atomLink    `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+}
+
+type atomEntry struct {
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Content atomContent `xml:"content"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomContent struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+func feedItemTitle(item feedItem) string {
+	return fmt.Sprintf("%s - %s", item.Source, item.Time.Format("Mon 2 Jan 2006 15:04"))
+}
+
+// handler serves /feeds/{output}/{source}.rss and /feeds/{output}/{source}.atom
+func (s *feedSink) handler(config *Config) http.HandlerFunc {
+	serve := func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/feeds/"+s.name+"/")
+
+		var source, format string
+		switch {
+		case strings.HasSuffix(name, ".rss"):
+			source, format = strings.TrimSuffix(name, ".rss"), "rss"
+		case strings.HasSuffix(name, ".atom"):
+			source, format = strings.TrimSuffix(name, ".atom"), "atom"
+		default:
+			http.NotFound(w, r)
+			return
+		}
+
+		// The Host header is the client's to set, so links only start with
+		// the configured url
+		link := s.baseURL + r.URL.Path
+
+		var body interface{}
+		contentType := "application/rss+xml; charset=utf-8"
+		items := s.recent(source)
+		if format == "rss" {
+			feed := rssFeed{Version: "2.0", Channel: rssChannel{
+				Title:       "llamanator: " + source,
+				Link:        link,
+				Description: "Recent results for " + source,
+			}}
+			for _, item := range items {
+				feed.Channel.Items = append(feed.Channel.Items, rssItem{
+					Title:       feedItemTitle(item),
+					Description: item.Response,
+					PubDate:     item.Time.Format(time.RFC1123Z),
+					GUID:        rssGUID{Value: item.ID},
+				})
+			}
+			body = feed
+		} else {
+			contentType = "application/atom+xml; charset=utf-8"
+			updated := time.Now()
+			if len(items) > 0 {
+				updated = items[0].Time
+			}
+			feed := atomFeed{
+				ID:      "urn:llamanator:" + s.name + ":" + source,
+				Title:   "llamanator: " + source,
+				Updated: updated.Format(time.RFC3339),
+				Link:    atomLink{Href: link, Rel: "self"},
+			}
+			for _, item := range items {
+				feed.Entries = append(feed.Entries, atomEntry{
+					ID:      "urn:llamanator:" + s.name + ":" + item.ID,
+					Title:   feedItemTitle(item),
+					Updated: item.Time.Format(time.RFC3339),
+					Author:  atomAuthor{Name: "llamanator"},
+					Content: atomContent{Type: "text", Value: item.Response},
+				})
+			}
+			body = feed
+		}
+
+		output, err := xml.MarshalIndent(body, "", "  ")
+		if err != nil {
+			http.Error(w, "Failed to render feed", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		w.Write([]byte(xml.Header))
+		w.Write(output)
+	}
+
+	if s.public {
+		return serve
+	}
+	return authenticate(config, serve)
+}
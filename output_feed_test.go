@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFeedSinkPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "feed.json")
+	oc := OutputConfig{Name: "digest", Path: path, MaxItems: 2}
+	sink, err := newFeedSink(oc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)
+	for i, response := range []string{"first", "second", "third"} {
+		if err := sink.Deliver(Delivery{Source: "morning", Response: response, Time: start.Add(time.Duration(i) * time.Minute)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reloaded, err := newFeedSink(oc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := reloaded.recent("morning")
+	if len(items) != 2 || items[0].Response != "third" || items[1].Response != "second" {
+		t.Fatalf("reloaded items = %+v", items)
+	}
+	if !items[0].Time.Equal(start.Add(2 * time.Minute)) {
+		t.Errorf("reloaded time = %s", items[0].Time)
+	}
+}
+
+func TestFeedSinkLinks(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+		want string
+	}{
+		{"configured url", "https://llamanator.example.com/", "https://llamanator.example.com/feeds/digest/morning.rss"},
+		{"no url", "", "<link>/feeds/digest/morning.rss</link>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink, err := newFeedSink(OutputConfig{Name: "digest", URL: tt.url, Public: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(http.MethodGet, "/feeds/digest/morning.rss", nil)
+			req.Host = "evil.example.com"
+			rec := httptest.NewRecorder()
+			sink.handler(&Config{})(rec, req)
+
+			body := rec.Body.String()
+			if !strings.Contains(body, tt.want) {
+				t.Errorf("feed missing %q:\n%s", tt.want, body)
+			}
+			if strings.Contains(body, "evil.example.com") {
+				t.Error("feed links use the request's Host header")
+			}
+		})
+	}
+
+	if _, err := newFeedSink(OutputConfig{Name: "digest", URL: "llamanator.local"}); err == nil {
+		t.Error("expected an error for a relative url")
+	}
+}
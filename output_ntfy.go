@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type ntfySink struct {
+	url      string
+	token    string
+	priority string
+	tags     string
+	title    *template.Template
+	content  *template.Template
+	client   *http.Client
+}
+
+func newNtfySink(oc OutputConfig) (*ntfySink, error) {
+	if oc.Topic == "" {
+		return nil, fmt.Errorf("ntfy outputs require a topic")
+	}
+
+	server := oc.URL
+	if server == "" {
+		server = "https://ntfy.sh"
+	}
+
+	var title *template.Template
+	if oc.Title != "" {
+		var err error
+		title, err = parseOutputTemplate("title", oc.Title)
+		if err != nil {
+			return nil, fmt.Errorf("invalid title template: %w", err)
+		}
+	}
+
+	contentText := oc.Content
+	if contentText == "" {
+		contentText = "{{.Response}}"
+	}
+	content, err := parseOutputTemplate("content", contentText)
+	if err != nil {
+		return nil, fmt.Errorf("invalid content template: %w", err)
+	}
+
+	return &ntfySink{
+		url:      strings.TrimSuffix(server, "/") + "/" + oc.Topic,
+		token:    oc.Token,
+		priority: oc.Priority,
+		tags:     strings.Join(oc.Tags, ","),
+		title:    title,
+		content:  content,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+var headerNewlines = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ")
+
+func (s *ntfySink) Deliver(d Delivery) error {
+	content, err := renderOutputTemplate(s.content, d)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.url, strings.NewReader(content))
+	if err != nil {
+		return err
+	}
+
+	if s.title != nil {
+		title, err := renderOutputTemplate(s.title, d)
+		if err != nil {
+			return err
+		}
+		// A rendered field such as .Query may span lines, which a header can't
+		req.Header.Set("Title", strings.TrimSpace(headerNewlines.Replace(title)))
+	}
+	if s.priority != "" {
+		req.Header.Set("Priority", s.priority)
+	}
+	if s.tags != "" {
+		req.Header.Set("Tags", s.tags)
+	}
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("ntfy returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
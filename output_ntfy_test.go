@@ -0,0 +1,32 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNtfySinkTitle(t *testing.T) {
+	var title, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		title = r.Header.Get("Title")
+		data, _ := io.ReadAll(r.Body)
+		body = string(data)
+	}))
+	defer server.Close()
+
+	sink, err := newNtfySink(OutputConfig{URL: server.URL, Topic: "home", Title: "{{.Query}}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Deliver(Delivery{Query: "first line\r\nsecond\nthird\r", Response: "answer"}); err != nil {
+		t.Fatal(err)
+	}
+	if title != "first line second third" {
+		t.Errorf("title = %q", title)
+	}
+	if body != "answer" {
+		t.Errorf("body = %q", body)
+	}
+}
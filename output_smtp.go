@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type smtpSink struct {
+	addr       string
+	host       string
+	auth       smtp.Auth
+	from       string
+	to         []string
+	subject    *template.Template
+	content    *template.Template
+	attachJSON bool
+	timeout    time.Duration
+}
+
+// smtpTimeout bounds a whole delivery, from dialling the server to QUIT
+const smtpTimeout = 30 * time.Second
+
+func newSMTPSink(oc OutputConfig) (*smtpSink, error) {
+	if oc.Host == "" {
+		return nil, fmt.Errorf("smtp outputs require a host")
+	}
+	if oc.From == "" || len(oc.To) == 0 {
+		return nil, fmt.Errorf("smtp outputs require a from address and at least one to address")
+	}
+
+	port := oc.Port
+	if port == 0 {
+		port = 587
+	}
+
+	subjectText := oc.Subject
+	if subjectText == "" {
+		subjectText = "llamanator: {{.Source}}"
+	}
+	subject, err := parseOutputTemplate("subject", subjectText)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subject template: %w", err)
+	}
+
+	contentText := oc.Content
+	if contentText == "" {
+		contentText = "{{.Response}}\n"
+	}
+	content, err := parseOutputTemplate("content", contentText)
+	if err != nil {
+		return nil, fmt.Errorf("invalid content template: %w", err)
+	}
+
+	var auth smtp.Auth
+	if oc.Username != "" {
+		auth = smtp.PlainAuth("", oc.Username, oc.Password, oc.Host)
+	}
+
+	return &smtpSink{
+		addr:       net.JoinHostPort(oc.Host, strconv.Itoa(port)),
+		host:       oc.Host,
+		auth:       auth,
+		from:       oc.From,
+		to:         oc.To,
+		subject:    subject,
+		content:    content,
+		attachJSON: oc.AttachJSON,
+		timeout:    smtpTimeout,
+	}, nil
+}
+
+func (s *smtpSink) Deliver(d Delivery) error {
+	subject, err := renderOutputTemplate(s.subject, d)
+	if err != nil {
+		return err
+	}
+	content, err := renderOutputTemplate(s.content, d)
+	if err != nil {
+		return err
+	}
+
+	message, err := s.buildMessage(strings.TrimSpace(subject), content, d)
+	if err != nil {
+		return err
+	}
+
+	return s.send(message)
+}
+
+// send does what smtp.SendMail does, upgrading to STARTTLS when the server
+// offers it, but with a deadline so an unresponsive server can't hang the
+// delivery.
+func (s *smtpSink) send(message []byte) error {
+	dialer := &net.Dialer{Timeout: s.timeout}
+	conn, err := dialer.Dial("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(s.timeout))
+
+	client, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if err := client.Hello("localhost"); err != nil {
+		return err
+	}
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: s.host}); err != nil {
+			return err
+		}
+	}
+	if s.auth != nil {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			return fmt.Errorf("smtp server doesn't support AUTH")
+		}
+		if err := client.Auth(s.auth); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(s.from); err != nil {
+		return err
+	}
+	for _, to := range s.to {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	data, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := data.Write(message); err != nil {
+		return err
+	}
+	if err := data.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+func (s *smtpSink) buildMessage(subject, content string, d Delivery) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", s.from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(s.to, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", d.Time.Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+
+	if !s.attachJSON {
+		buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+		buf.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+		writeBase64Lines(&buf, []byte(content))
+		return buf.Bytes(), nil
+	}
+
+	writer := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", writer.Boundary())
+
+	textPart, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	writeBase64Lines(textPart, []byte(content))
+
+	raw, err := json.MarshalIndent(d.Fields, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	jsonPart, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"application/json"},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {`attachment; filename="response.json"`},
+	})
+	if err != nil {
+		return nil, err
+	}
+	writeBase64Lines(jsonPart, raw)
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeBase64Lines writes data as base64 wrapped at 76 characters, as required by RFC 2045.
+func writeBase64Lines(w io.Writer, data []byte) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		w.Write([]byte(encoded[:76] + "\r\n"))
+		encoded = encoded[76:]
+	}
+	w.Write([]byte(encoded + "\r\n"))
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSMTP accepts one connection and speaks enough SMTP to take a message,
+// sending what it received on the returned channel. With silent set it never
+// replies.
+func fakeSMTP(t *testing.T, silent bool) (string, <-chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if silent {
+			time.Sleep(2 * time.Second)
+			return
+		}
+
+		var transcript strings.Builder
+		reader := bufio.NewReader(conn)
+		conn.Write([]byte("220 fake ESMTP\r\n"))
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			transcript.WriteString(line)
+			switch command := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(command, "EHLO"):
+				conn.Write([]byte("250-fake\r\n250 8BITMIME\r\n"))
+			case command == "DATA":
+				conn.Write([]byte("354 go ahead\r\n"))
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					transcript.WriteString(line)
+					if line == ".\r\n" {
+						break
+					}
+				}
+				conn.Write([]byte("250 queued\r\n"))
+			case command == "QUIT":
+				conn.Write([]byte("221 bye\r\n"))
+				received <- transcript.String()
+				return
+			default:
+				conn.Write([]byte("250 ok\r\n"))
+			}
+		}
+	}()
+	return listener.Addr().String(), received
+}
+
+func testSMTPSink(t *testing.T, addr string) *smtpSink {
+	t.Helper()
+	host, port, _ := net.SplitHostPort(addr)
+	portNumber, _ := strconv.Atoi(port)
+	sink, err := newSMTPSink(OutputConfig{Host: host, Port: portNumber, From: "llamanator@example.com", To: []string{"me@example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sink
+}
+
+func TestSMTPSinkDelivers(t *testing.T) {
+	addr, received := fakeSMTP(t, false)
+	sink := testSMTPSink(t, addr)
+
+	if err := sink.Deliver(Delivery{Source: "test", Response: "hello", Time: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	transcript := <-received
+	for _, want := range []string{"MAIL FROM:<llamanator@example.com>", "RCPT TO:<me@example.com>", "Subject: llamanator: test"} {
+		if !strings.Contains(transcript, want) {
+			t.Errorf("transcript missing %q:\n%s", want, transcript)
+		}
+	}
+}
+
+func TestSMTPSinkTimesOut(t *testing.T) {
+	addr, _ := fakeSMTP(t, true)
+	sink := testSMTPSink(t, addr)
+	sink.timeout = 100 * time.Millisecond
+
+	start := time.Now()
+	err := sink.Deliver(Delivery{Response: "hello", Time: time.Now()})
+	if err == nil {
+		t.Fatal("expected a timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("delivery took %s, want it to give up after the timeout", elapsed)
+	}
+}
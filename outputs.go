@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// OutputConfig describes a delivery target that generated responses are sent to
+// in addition to being returned to the caller.
+type OutputConfig struct {
+	Name      string   `json:"name"`
+	Type      string   `json:"type"`
+	Templates []string `json:"templates"`
+	// Moderate checks responses with the moderation model before delivering them
+	Moderate bool `json:"moderate"`
+
+	// File output (content is also used as the message body for other outputs)
+	Path        string            `json:"path"`
+	Content     string            `json:"content"`
+	Append      bool              `json:"append"`
+	FrontMatter map[string]string `json:"front_matter"`
+
+	// SMTP output
+	Host       string   `json:"host"`
+	Port       int      `json:"port"`
+	Username   string   `json:"username"`
+	Password   string   `json:"password"`
+	From       string   `json:"from"`
+	To         []string `json:"to"`
+	Subject    string   `json:"subject"`
+	AttachJSON bool     `json:"attach_json"`
+
+	// ntfy output
+	URL      string   `json:"url"`
+	Topic    string   `json:"topic"`
+	Token    string   `json:"token"`
+	Priority string   `json:"priority"`
+	Tags     []string `json:"tags"`
+	Title    string   `json:"title"`
+
+	// Feed output (path keeps the items across restarts, and url is the
+	// server's public address that feed links start with)
+	MaxItems int  `json:"max_items"`
+	Public   bool `json:"public"`
+}
+
+// Delivery is the data made available to output sinks and their templates.
+type Delivery struct {
+	Source   string
+	Template string
+	Query    string
+	Model    string
+	Response string
+	Fields   map[string]interface{}
+	Context  HAContext
+	Time     time.Time
+	// Moderation is set when moderation flagged or redacted the response
+	Moderation *ModerationResult
+}
+
+// Date returns the delivery date in YYYY-MM-DD format, handy for daily note paths.
+func (d Delivery) Date() string {
+	return d.Time.Format("2006-01-02")
+}
+
+type OutputSink interface {
+	Deliver(d Delivery) error
+}
+
+type output struct {
+	config OutputConfig
+	sink   OutputSink
+}
+
+type Outputs struct {
+	outputs []output
+	configs *ConfigStore
+}
+
+func loadOutputs(configs []OutputConfig, store *ConfigStore) (*Outputs, error) {
+	outputs := &Outputs{configs: store}
+	for _, oc := range configs {
+		if oc.Name == "" {
+			return nil, fmt.Errorf("output of type '%s' is missing a name", oc.Type)
+		}
+
+		var sink OutputSink
+		var err error
+		switch oc.Type {
+		case "file":
+			sink, err = newFileSink(oc)
+		case "smtp":
+			sink, err = newSMTPSink(oc)
+		case "ntfy":
+			sink, err = newNtfySink(oc)
+		case "feed":
+			sink, err = newFeedSink(oc)
+		default:
+			err = fmt.Errorf("unknown output type '%s'", oc.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("output '%s': %w", oc.Name, err)
+		}
+
+		outputs.outputs = append(outputs.outputs, output{config: oc, sink: sink})
+	}
+	return outputs, nil
+}
+
+// deliverForTemplate sends the delivery to every output attached to the template.
+// Deliveries run in the background so a slow target never delays the caller.
+func (o *Outputs) deliverForTemplate(templateName string, d Delivery) {
+	var targets []output
+	for _, out := range o.outputs {
+		for _, name := range out.config.Templates {
+			if name == templateName {
+				targets = append(targets, out)
+				break
+			}
+		}
+	}
+	o.deliver(targets, d)
+}
+
+// deliverTo sends the delivery to the named outputs, used by schedules.
+func (o *Outputs) deliverTo(names []string, d Delivery) {
+	var targets []output
+	for _, out := range o.outputs {
+		for _, name := range names {
+			if name == out.config.Name {
+				targets = append(targets, out)
+				break
+			}
+		}
+	}
+	o.deliver(targets, d)
+}
+
+// deliver sends the delivery to the outputs in the background, moderating it
+// once first when any of them asks for that.
+func (o *Outputs) deliver(targets []output, d Delivery) {
+	var moderated []output
+	for _, out := range targets {
+		if out.config.Moderate {
+			moderated = append(moderated, out)
+			continue
+		}
+		go out.deliver(d)
+	}
+	if len(moderated) == 0 {
+		return
+	}
+	go func() {
+		config := o.configs.get()
+		d, ok := config.Moderation.moderate(config, d)
+		if !ok {
+			return
+		}
+		for _, out := range moderated {
+			go out.deliver(d)
+		}
+	}()
+}
+
+func (o *Outputs) has(name string) bool {
+	for _, out := range o.outputs {
+		if out.config.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *Outputs) feeds() []*feedSink {
+	var feeds []*feedSink
+	for _, out := range o.outputs {
+		if feed, ok := out.sink.(*feedSink); ok {
+			feeds = append(feeds, feed)
+		}
+	}
+	return feeds
+}
+
+func (out output) deliver(d Delivery) {
+	if err := out.sink.Deliver(d); err != nil {
+		slog.Error("Failed to deliver response to output", "output", out.config.Name, "error", err)
+	}
+}
+
+func parseOutputTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Option("missingkey=zero").Parse(text)
+}
+
+func renderOutputTemplate(tmpl *template.Template, d Delivery) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, d); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+type fileSink struct {
+	path *template.Template
+	// root is the directory before the path template's first action, which
+	// rendered paths must stay inside
+	root        string
+	content     *template.Template
+	append      bool
+	frontMatter map[string]*template.Template
+}
+
+func newFileSink(oc OutputConfig) (*fileSink, error) {
+	if oc.Path == "" {
+		return nil, fmt.Errorf("file outputs require a path")
+	}
+
+	path, err := parseOutputTemplate("path", oc.Path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid path template: %w", err)
+	}
+
+	contentText := oc.Content
+	if contentText == "" {
+		contentText = "{{.Response}}\n"
+	}
+	content, err := parseOutputTemplate("content", contentText)
+	if err != nil {
+		return nil, fmt.Errorf("invalid content template: %w", err)
+	}
+
+	frontMatter := make(map[string]*template.Template)
+	for key, value := range oc.FrontMatter {
+		tmpl, err := parseOutputTemplate(key, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid front matter template for '%s': %w", key, err)
+		}
+		frontMatter[key] = tmpl
+	}
+
+	root := oc.Path
+	if i := strings.Index(root, "{{"); i >= 0 {
+		root = root[:i]
+	}
+	root = filepath.Dir(root)
+
+	return &fileSink{path: path, root: root, content: content, append: oc.Append, frontMatter: frontMatter}, nil
+}
+
+// fileLocks serialises writes to each output file, so appends from concurrent
+// requests don't interleave or both write front matter.
+var fileLocks = struct {
+	sync.Mutex
+	paths map[string]*sync.Mutex
+}{paths: make(map[string]*sync.Mutex)}
+
+func lockFile(path string) func() {
+	fileLocks.Lock()
+	lock, ok := fileLocks.paths[path]
+	if !ok {
+		lock = &sync.Mutex{}
+		fileLocks.paths[path] = lock
+	}
+	fileLocks.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+func (s *fileSink) Deliver(d Delivery) error {
+	path, err := renderOutputTemplate(s.path, d)
+	if err != nil {
+		return err
+	}
+	path = filepath.Clean(strings.TrimSpace(path))
+	// Fields such as .Query come from callers and could contain "../"
+	if rel, err := filepath.Rel(s.root, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("output path '%s' is outside '%s'", path, s.root)
+	}
+
+	content, err := renderOutputTemplate(s.content, d)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	defer lockFile(path)()
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if s.append {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+
+	// Front matter is only written when the file is new (or being replaced)
+	writeFrontMatter := len(s.frontMatter) > 0
+	if s.append {
+		if info, err := os.Stat(path); err == nil && info.Size() > 0 {
+			writeFrontMatter = false
+		}
+	}
+
+	file, err := os.OpenFile(path, flags, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if writeFrontMatter {
+		frontMatter, err := s.renderFrontMatter(d)
+		if err != nil {
+			return err
+		}
+		content = frontMatter + content
+	}
+
+	_, err = file.WriteString(content)
+	return err
+}
+
+func (s *fileSink) renderFrontMatter(d Delivery) (string, error) {
+	values := make(map[string]interface{}, len(s.frontMatter))
+	for key, tmpl := range s.frontMatter {
+		value, err := renderOutputTemplate(tmpl, d)
+		if err != nil {
+			return "", err
+		}
+		values[key] = value
+	}
+
+	// Values are encoded as YAML strings, so a query or response containing
+	// ": " or "---" can't break the front matter
+	var buf bytes.Buffer
+	buf.WriteString("---\n")
+	encodeYAML(&buf, values, 0)
+	buf.WriteString("---\n\n")
+	return buf.String(), nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileSinkFrontMatter(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := newFileSink(OutputConfig{
+		Path:        filepath.Join(dir, "{{.Date}}.md"),
+		Content:     "{{.Response}}\n",
+		Append:      true,
+		FrontMatter: map[string]string{"title": "{{.Query}}", "tags": "llamanator"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := Delivery{Query: "Weather: today\n---\nevil: true", Response: "Sunny", Time: time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)}
+	if err := sink.Deliver(d); err != nil {
+		t.Fatal(err)
+	}
+	d.Response = "Rain later"
+	if err := sink.Deliver(d); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "2026-10-16.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The multi-line query is indented in a literal block, so its "---" can't end the front matter
+	want := "---\ntags: llamanator\ntitle: |-\n  Weather: today\n  ---\n  evil: true\n---\n\nSunny\nRain later\n"
+	if string(data) != want {
+		t.Errorf("file = %q, want %q", data, want)
+	}
+}
+
+func TestFileSinkPathOutsideRoot(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := newFileSink(OutputConfig{Path: filepath.Join(dir, "notes", "{{.Query}}.md")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query   string
+		wantErr bool
+	}{
+		{"today", false},
+		{"sub/today", false},
+		{"../escaped", true},
+		{"../../etc/passwd", true},
+		{"a/../../notes-other/x", true},
+	}
+	for _, tt := range tests {
+		err := sink.Deliver(Delivery{Query: tt.query, Response: "ok"})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Deliver(%q) error = %v, wantErr %v", tt.query, err, tt.wantErr)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped.md")); err == nil {
+		t.Error("file written outside the output directory")
+	}
+}
+
+func TestFileSinkConcurrentAppends(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := newFileSink(OutputConfig{
+		Path:        filepath.Join(dir, "log.md"),
+		Append:      true,
+		FrontMatter: map[string]string{"title": "Log"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := sink.Deliver(Delivery{Response: "line"}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	data, err := os.ReadFile(filepath.Join(dir, "log.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "title: Log"); n != 1 {
+		t.Errorf("front matter written %d times", n)
+	}
+	if n := strings.Count(string(data), "line\n"); n != 20 {
+		t.Errorf("got %d lines, want 20", n)
+	}
+}
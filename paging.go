@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listParams are the query parameters every admin list takes. Any other
+// parameter, apart from a handler's own, filters the list by a field.
+var listParams = []string{"limit", "offset", "sort", "since", "until"}
+
+// ListQuery is how a request pages through, sorts and filters an admin list:
+// ?limit=20&offset=40&sort=-duration_ms&template=kitchen&since=2024-05-01.
+// Filters name a field, nested ones by a dotted path such as context.origin,
+// and repeating one accepts any of the values. since and until compare the
+// time field.
+type ListQuery struct {
+	Limit  int
+	Offset int
+	// Sort is a field to sort by, descending with a leading '-'
+	Sort         string
+	Since, Until time.Time
+	Filters      map[string][]string
+}
+
+// parseListQuery reads the list parameters of a request. own are the handler's
+// own parameters, which aren't filters.
+func parseListQuery(r *http.Request, defaultLimit int, own ...string) (*ListQuery, error) {
+	query := r.URL.Query()
+	q := &ListQuery{Limit: defaultLimit, Sort: query.Get("sort"), Filters: make(map[string][]string)}
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return nil, badInput("limit must be a positive number")
+		}
+		q.Limit = n
+	}
+	if value := query.Get("offset"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, badInput("offset must be zero or a positive number")
+		}
+		q.Offset = n
+	}
+	for name, target := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if value := query.Get(name); value != "" {
+			var err error
+			if *target, err = time.Parse(time.RFC3339, value); err != nil {
+				if *target, err = time.ParseInLocation("2006-01-02", value, time.Local); err != nil {
+					return nil, badInput("%s must be a date (YYYY-MM-DD) or RFC 3339 time", name)
+				}
+			}
+		}
+	}
+	for name, values := range query {
+		if slices.Contains(listParams, name) || slices.Contains(own, name) {
+			continue
+		}
+		if _, err := parseJSONPath(name); err != nil {
+			return nil, badInput("Invalid filter '%s'", name)
+		}
+		q.Filters[name] = values
+	}
+	return q, nil
+}
+
+// applyListQuery filters, sorts and pages items, setting X-Total-Count to the
+// number that matched. The items themselves are returned unchanged.
+func applyListQuery[T any](w http.ResponseWriter, q *ListQuery, items []T) ([]T, error) {
+	if len(q.Filters) > 0 || q.Sort != "" || !q.Since.IsZero() || !q.Until.IsZero() {
+		if fields := jsonFieldNames(reflect.TypeOf((*T)(nil)).Elem()); fields != nil {
+			for _, name := range sortedKeys(q.Filters) {
+				if field, _, _ := strings.Cut(name, "."); !slices.Contains(fields, field) {
+					return nil, badInput("Unknown field '%s'", field)
+				}
+			}
+			if (!q.Since.IsZero() || !q.Until.IsZero()) && !slices.Contains(fields, "time") {
+				return nil, badInput("since and until need a list with times")
+			}
+		}
+
+		// Fields are looked up by their JSON names
+		objects := make([]interface{}, len(items))
+		for i, item := range items {
+			data, err := json.Marshal(item)
+			if err != nil {
+				return nil, err
+			}
+			json.Unmarshal(data, &objects[i])
+		}
+
+		var matched []int
+		for i, object := range objects {
+			if q.matches(object) {
+				matched = append(matched, i)
+			}
+		}
+		if q.Sort != "" {
+			descending := strings.HasPrefix(q.Sort, "-")
+			path, err := parseJSONPath(strings.TrimPrefix(q.Sort, "-"))
+			if err != nil {
+				return nil, badInput("Invalid sort '%s'", q.Sort)
+			}
+			sort.SliceStable(matched, func(i, j int) bool {
+				a, aOK := lookupJSONPath(objects[matched[i]], path)
+				b, bOK := lookupJSONPath(objects[matched[j]], path)
+				// Items without the field come last either way
+				if !aOK || !bOK {
+					return aOK && !bOK
+				}
+				if descending {
+					return lessJSON(b, a)
+				}
+				return lessJSON(a, b)
+			})
+		}
+
+		selected := make([]T, len(matched))
+		for i, index := range matched {
+			selected[i] = items[index]
+		}
+		items = selected
+	}
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(items)))
+	items = items[min(q.Offset, len(items)):]
+	if q.Limit > 0 && len(items) > q.Limit {
+		items = items[:q.Limit]
+	}
+	return items, nil
+}
+
+// jsonFieldNames are the JSON names of a struct's fields, or nil for other
+// types.
+func jsonFieldNames(t reflect.Type) []string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	names := []string{}
+	for _, field := range reflect.VisibleFields(t) {
+		if field.Anonymous || !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// matches reports whether an item passes the filters and time range.
+func (q *ListQuery) matches(object interface{}) bool {
+	for name, values := range q.Filters {
+		path, _ := parseJSONPath(name)
+		value, ok := lookupJSONPath(object, path)
+		if !ok || !slices.Contains(values, jsonString(value)) {
+			return false
+		}
+	}
+	if !q.Since.IsZero() || !q.Until.IsZero() {
+		value, _ := lookupJSONPath(object, []interface{}{"time"})
+		text, _ := value.(string)
+		t, err := time.Parse(time.RFC3339Nano, text)
+		if err != nil || (!q.Since.IsZero() && t.Before(q.Since)) || (!q.Until.IsZero() && !t.Before(q.Until)) {
+			return false
+		}
+	}
+	return true
+}
+
+// jsonString is a decoded JSON value as it's written in a query string.
+func jsonString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case nil:
+		return ""
+	}
+	return compactJSON(value)
+}
+
+// lessJSON orders decoded JSON values: numbers by value, anything else by
+// its text, which orders RFC 3339 times in the same zone too.
+func lessJSON(a, b interface{}) bool {
+	x, xOK := a.(float64)
+	y, yOK := b.(float64)
+	if xOK && yOK {
+		return x < y
+	}
+	return jsonString(a) < jsonString(b)
+}
+
+// writeListError writes an error from parsing or applying a list query.
+func writeListError(w http.ResponseWriter, err error) {
+	var inputErr *inputError
+	if errors.As(err, &inputErr) {
+		http.Error(w, inputErr.msg, http.StatusBadRequest)
+		return
+	}
+	slog.Error("Failed to list", "error", err)
+	http.Error(w, "Failed to list", http.StatusInternalServerError)
+}
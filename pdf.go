@@ -0,0 +1,742 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// A minimal PDF reader, just enough to pull the text out of each page. It handles
+// FlateDecode streams, object streams and ToUnicode font maps, which covers the
+// PDFs produced by office suites and browsers. Scanned documents have no text to
+// extract.
+
+type pdfName string
+type pdfKeyword string
+type pdfString []byte
+type pdfArray []interface{}
+type pdfDict map[string]interface{}
+
+type pdfRef struct {
+	num int
+}
+
+type pdfObject struct {
+	value  interface{}
+	stream []byte
+}
+
+type pdfDocument struct {
+	objects map[int]*pdfObject
+	// Decoded streams, so fonts shared by pages are only decoded once
+	decoded map[int][]byte
+	// Bytes streams may still decompress to, and the error once they ran out
+	budget int64
+	err    error
+}
+
+// Limits that keep a small, malicious PDF from using up memory or time
+const (
+	maxPDFPages = 5000
+	maxPDFDepth = 32
+)
+
+var pdfObjectHeader = regexp.MustCompile(`(\d+)\s+(\d+)\s+obj\b`)
+
+type pdfLexer struct {
+	data []byte
+	pos  int
+}
+
+func isPDFSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\f' || c == 0
+}
+
+func isPDFDelimiter(c byte) bool {
+	return strings.IndexByte("()<>[]{}/%", c) >= 0
+}
+
+func (l *pdfLexer) skipSpace() {
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		if isPDFSpace(c) {
+			l.pos++
+		} else if c == '%' {
+			for l.pos < len(l.data) && l.data[l.pos] != '\n' && l.data[l.pos] != '\r' {
+				l.pos++
+			}
+		} else {
+			return
+		}
+	}
+}
+
+func (l *pdfLexer) regular() string {
+	start := l.pos
+	for l.pos < len(l.data) && !isPDFSpace(l.data[l.pos]) && !isPDFDelimiter(l.data[l.pos]) {
+		l.pos++
+	}
+	return string(l.data[start:l.pos])
+}
+
+// value parses the next object. Keywords (operators in content streams, and
+// delimiters such as "]" and ">>") are returned as pdfKeyword.
+func (l *pdfLexer) value() (interface{}, error) {
+	l.skipSpace()
+	if l.pos >= len(l.data) {
+		return nil, io.EOF
+	}
+
+	c := l.data[l.pos]
+	switch {
+	case c == '/':
+		l.pos++
+		return pdfName(l.regular()), nil
+	case c == '(':
+		return l.literalString(), nil
+	case c == '<' && l.pos+1 < len(l.data) && l.data[l.pos+1] == '<':
+		l.pos += 2
+		dict := pdfDict{}
+		for {
+			key, err := l.value()
+			if err != nil {
+				return nil, err
+			}
+			if key == pdfKeyword(">>") {
+				return dict, nil
+			}
+			name, ok := key.(pdfName)
+			if !ok {
+				continue
+			}
+			value, err := l.value()
+			if err != nil {
+				return nil, err
+			}
+			dict[string(name)] = value
+		}
+	case c == '<':
+		end := bytes.IndexByte(l.data[l.pos:], '>')
+		if end < 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		hexString := strings.Map(func(r rune) rune {
+			if isPDFSpace(byte(r)) {
+				return -1
+			}
+			return r
+		}, string(l.data[l.pos+1:l.pos+end]))
+		if len(hexString)%2 == 1 {
+			hexString += "0"
+		}
+		l.pos += end + 1
+		decoded, _ := hex.DecodeString(hexString)
+		return pdfString(decoded), nil
+	case c == '>' && l.pos+1 < len(l.data) && l.data[l.pos+1] == '>':
+		l.pos += 2
+		return pdfKeyword(">>"), nil
+	case c == '[':
+		l.pos++
+		var array pdfArray
+		for {
+			item, err := l.value()
+			if err != nil {
+				return nil, err
+			}
+			if item == pdfKeyword("]") {
+				return array, nil
+			}
+			array = append(array, item)
+		}
+	case c == ']' || c == '{' || c == '}' || c == '>' || c == ')':
+		l.pos++
+		return pdfKeyword(string(c)), nil
+	}
+
+	token := l.regular()
+	if token == "" {
+		l.pos++
+		return pdfKeyword(string(c)), nil
+	}
+	if number, err := strconv.ParseFloat(token, 64); err == nil {
+		// Look ahead for an indirect reference: "12 0 R"
+		if num, err := strconv.Atoi(token); err == nil {
+			saved := l.pos
+			l.skipSpace()
+			if _, err := strconv.Atoi(l.regular()); err == nil {
+				l.skipSpace()
+				if l.regular() == "R" {
+					return pdfRef{num: num}, nil
+				}
+			}
+			l.pos = saved
+		}
+		return number, nil
+	}
+	switch token {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+	return pdfKeyword(token), nil
+}
+
+func (l *pdfLexer) literalString() pdfString {
+	l.pos++ // opening parenthesis
+	var buf []byte
+	depth := 1
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		l.pos++
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return buf
+			}
+		case '\\':
+			if l.pos >= len(l.data) {
+				return buf
+			}
+			e := l.data[l.pos]
+			l.pos++
+			switch e {
+			case 'n':
+				buf = append(buf, '\n')
+			case 'r':
+				buf = append(buf, '\r')
+			case 't':
+				buf = append(buf, '\t')
+			case 'b':
+				buf = append(buf, '\b')
+			case 'f':
+				buf = append(buf, '\f')
+			case '\r':
+				if l.pos < len(l.data) && l.data[l.pos] == '\n' {
+					l.pos++
+				}
+			case '\n':
+			default:
+				if e >= '0' && e <= '7' {
+					value := int(e - '0')
+					for i := 0; i < 2 && l.pos < len(l.data) && l.data[l.pos] >= '0' && l.data[l.pos] <= '7'; i++ {
+						value = value*8 + int(l.data[l.pos]-'0')
+						l.pos++
+					}
+					buf = append(buf, byte(value))
+				} else {
+					buf = append(buf, e)
+				}
+			}
+			continue
+		}
+		buf = append(buf, c)
+	}
+	return buf
+}
+
+func parsePDF(data []byte) (*pdfDocument, error) {
+	if !bytes.HasPrefix(bytes.TrimLeft(data, " \r\n\t"), []byte("%PDF")) {
+		return nil, fmt.Errorf("not a PDF document")
+	}
+
+	doc := &pdfDocument{objects: make(map[int]*pdfObject), decoded: make(map[int][]byte), budget: maxDocumentExpansion}
+	for _, match := range pdfObjectHeader.FindAllSubmatchIndex(data, -1) {
+		num, _ := strconv.Atoi(string(data[match[2]:match[3]]))
+		lexer := &pdfLexer{data: data, pos: match[1]}
+		value, err := lexer.value()
+		if err != nil {
+			continue
+		}
+
+		object := &pdfObject{value: value}
+		saved := lexer.pos
+		if keyword, _ := lexer.value(); keyword == pdfKeyword("stream") {
+			object.stream = streamData(data, lexer.pos, value)
+		} else {
+			lexer.pos = saved
+		}
+		// Later definitions win, matching incremental updates
+		doc.objects[num] = object
+	}
+
+	// Objects can also be packed into compressed object streams
+	for _, object := range doc.objects {
+		dict, ok := object.value.(pdfDict)
+		if !ok || dict["Type"] != pdfName("ObjStm") {
+			continue
+		}
+		doc.loadObjectStream(dict, object.stream)
+	}
+
+	return doc, nil
+}
+
+func streamData(data []byte, pos int, value interface{}) []byte {
+	// The stream keyword is followed by CRLF or LF
+	if pos < len(data) && data[pos] == '\r' {
+		pos++
+	}
+	if pos < len(data) && data[pos] == '\n' {
+		pos++
+	}
+
+	if dict, ok := value.(pdfDict); ok {
+		if length, ok := dict["Length"].(float64); ok {
+			end := pos + int(length)
+			if end <= len(data) && bytes.Contains(data[end:min(end+20, len(data))], []byte("endstream")) {
+				return data[pos:end]
+			}
+		}
+	}
+
+	end := bytes.Index(data[pos:], []byte("endstream"))
+	if end < 0 {
+		return nil
+	}
+	return bytes.TrimRight(data[pos:pos+end], "\r\n")
+}
+
+func (doc *pdfDocument) loadObjectStream(dict pdfDict, raw []byte) {
+	data, err := doc.decodeStream(dict, raw)
+	if err != nil {
+		return
+	}
+	count, _ := doc.resolve(dict["N"]).(float64)
+	first, _ := doc.resolve(dict["First"]).(float64)
+
+	header := &pdfLexer{data: data}
+	for i := 0; i < int(count); i++ {
+		num, err1 := header.value()
+		offset, err2 := header.value()
+		if err1 != nil || err2 != nil {
+			return
+		}
+		objectNum, _ := num.(float64)
+		objectOffset, _ := offset.(float64)
+		if _, exists := doc.objects[int(objectNum)]; exists {
+			continue
+		}
+		lexer := &pdfLexer{data: data, pos: int(first) + int(objectOffset)}
+		if value, err := lexer.value(); err == nil {
+			doc.objects[int(objectNum)] = &pdfObject{value: value}
+		}
+	}
+}
+
+func (doc *pdfDocument) resolve(value interface{}) interface{} {
+	for i := 0; i < 16; i++ {
+		ref, ok := value.(pdfRef)
+		if !ok {
+			return value
+		}
+		object, ok := doc.objects[ref.num]
+		if !ok {
+			return nil
+		}
+		value = object.value
+	}
+	return nil
+}
+
+func (doc *pdfDocument) dict(value interface{}) pdfDict {
+	dict, _ := doc.resolve(value).(pdfDict)
+	return dict
+}
+
+func (doc *pdfDocument) streamFor(value interface{}) ([]byte, error) {
+	ref, ok := value.(pdfRef)
+	if !ok {
+		return nil, fmt.Errorf("stream is not an indirect object")
+	}
+	if data, ok := doc.decoded[ref.num]; ok {
+		return data, nil
+	}
+	object, ok := doc.objects[ref.num]
+	if !ok || object.stream == nil {
+		return nil, fmt.Errorf("stream object %d not found", ref.num)
+	}
+	dict, _ := object.value.(pdfDict)
+	data, err := doc.decodeStream(dict, object.stream)
+	if err != nil {
+		return nil, err
+	}
+	doc.decoded[ref.num] = data
+	return data, nil
+}
+
+func (doc *pdfDocument) decodeStream(dict pdfDict, raw []byte) ([]byte, error) {
+	var filters []interface{}
+	switch filter := doc.resolve(dict["Filter"]).(type) {
+	case pdfName:
+		filters = []interface{}{filter}
+	case pdfArray:
+		filters = filter
+	}
+
+	data := raw
+	for _, filter := range filters {
+		switch doc.resolve(filter) {
+		case pdfName("FlateDecode"):
+			reader, err := zlib.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			// Truncated streams are common, keep whatever decompressed cleanly
+			decoded, err := io.ReadAll(&expansionLimit{r: reader, left: doc.budget})
+			doc.budget -= int64(len(decoded))
+			if errors.Is(err, errDocumentTooLarge) {
+				doc.err = err
+				return nil, err
+			}
+			if err != nil && len(decoded) == 0 {
+				return nil, err
+			}
+			data = decoded
+		case pdfName("ASCIIHexDecode"):
+			cleaned := strings.Map(func(r rune) rune {
+				if isPDFSpace(byte(r)) || r == '>' {
+					return -1
+				}
+				return r
+			}, string(data))
+			if len(cleaned)%2 == 1 {
+				cleaned += "0"
+			}
+			decoded, err := hex.DecodeString(cleaned)
+			if err != nil {
+				return nil, err
+			}
+			data = decoded
+		default:
+			return nil, fmt.Errorf("unsupported stream filter %v", filter)
+		}
+	}
+	return data, nil
+}
+
+type pdfPage struct {
+	dict      pdfDict
+	resources pdfDict
+}
+
+// pages walks the page tree from the document catalog in reading order.
+func (doc *pdfDocument) pages() []pdfPage {
+	var root interface{}
+	for _, object := range doc.objects {
+		if dict, ok := object.value.(pdfDict); ok && dict["Type"] == pdfName("Catalog") {
+			root = dict["Pages"]
+			break
+		}
+	}
+	if doc.dict(root) == nil {
+		return nil
+	}
+
+	// Each node is walked once, so Kids repeating a node can't blow up the walk
+	var pages []pdfPage
+	visited := make(map[int]bool)
+	var walk func(value interface{}, resources pdfDict, depth int)
+	walk = func(value interface{}, resources pdfDict, depth int) {
+		if ref, ok := value.(pdfRef); ok {
+			if visited[ref.num] {
+				return
+			}
+			visited[ref.num] = true
+		}
+		node := doc.dict(value)
+		if node == nil || depth > maxPDFDepth || len(pages) >= maxPDFPages {
+			return
+		}
+		if own := doc.dict(node["Resources"]); own != nil {
+			resources = own
+		}
+		if node["Type"] == pdfName("Page") {
+			pages = append(pages, pdfPage{dict: node, resources: resources})
+			return
+		}
+		kids, _ := doc.resolve(node["Kids"]).(pdfArray)
+		for _, kid := range kids {
+			walk(kid, resources, depth+1)
+		}
+	}
+	walk(root, nil, 0)
+	return pages
+}
+
+// cmap maps character codes to unicode text using a font's ToUnicode stream.
+type cmap struct {
+	codeLength int
+	mapping    map[string]string
+}
+
+var cmapSection = regexp.MustCompile(`(?s)begin(bfchar|bfrange)(.*?)end(?:bfchar|bfrange)`)
+
+func decodeUTF16BE(data []byte) string {
+	units := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		units = append(units, uint16(data[i])<<8|uint16(data[i+1]))
+	}
+	return string(utf16.Decode(units))
+}
+
+func parseCMap(data []byte) *cmap {
+	cm := &cmap{codeLength: 1, mapping: make(map[string]string)}
+	for _, section := range cmapSection.FindAllSubmatch(data, -1) {
+		lexer := &pdfLexer{data: section[2]}
+		var values []interface{}
+		for {
+			value, err := lexer.value()
+			if err != nil {
+				break
+			}
+			values = append(values, value)
+		}
+
+		if string(section[1]) == "bfchar" {
+			for i := 0; i+1 < len(values); i += 2 {
+				src, ok1 := values[i].(pdfString)
+				dst, ok2 := values[i+1].(pdfString)
+				if ok1 && ok2 {
+					cm.codeLength = len(src)
+					cm.mapping[string(src)] = decodeUTF16BE(dst)
+				}
+			}
+			continue
+		}
+
+		for i := 0; i+2 < len(values); i += 3 {
+			lo, ok1 := values[i].(pdfString)
+			hi, ok2 := values[i+1].(pdfString)
+			if !ok1 || !ok2 || len(lo) != len(hi) || len(lo) == 0 || len(lo) > 4 {
+				continue
+			}
+			cm.codeLength = len(lo)
+			loCode, hiCode := bytesToInt(lo), bytesToInt(hi)
+			if hiCode-loCode > 0xffff {
+				continue
+			}
+			for code := loCode; code <= hiCode; code++ {
+				key := string(intToBytes(code, len(lo)))
+				switch dst := values[i+2].(type) {
+				case pdfString:
+					target := append([]byte(nil), dst...)
+					if len(target) >= 2 {
+						last := int(target[len(target)-2])<<8 | int(target[len(target)-1])
+						last += code - loCode
+						target[len(target)-2], target[len(target)-1] = byte(last>>8), byte(last)
+					}
+					cm.mapping[key] = decodeUTF16BE(target)
+				case pdfArray:
+					if index := code - loCode; index < len(dst) {
+						if target, ok := dst[index].(pdfString); ok {
+							cm.mapping[key] = decodeUTF16BE(target)
+						}
+					}
+				}
+			}
+		}
+	}
+	return cm
+}
+
+func bytesToInt(data []byte) int {
+	value := 0
+	for _, b := range data {
+		value = value<<8 | int(b)
+	}
+	return value
+}
+
+func intToBytes(value, length int) []byte {
+	data := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		data[i] = byte(value)
+		value >>= 8
+	}
+	return data
+}
+
+func (cm *cmap) decode(data []byte) string {
+	if cm == nil {
+		// Without a ToUnicode map, treat the bytes as Latin-1 which covers
+		// the standard encodings for plain text
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		return string(runes)
+	}
+
+	var buf strings.Builder
+	for i := 0; i < len(data); i += cm.codeLength {
+		end := min(i+cm.codeLength, len(data))
+		if text, ok := cm.mapping[string(data[i:end])]; ok {
+			buf.WriteString(text)
+		}
+	}
+	return buf.String()
+}
+
+func (doc *pdfDocument) fontMaps(resources pdfDict) map[string]*cmap {
+	maps := make(map[string]*cmap)
+	fonts := doc.dict(resources["Font"])
+	for name, fontRef := range fonts {
+		font := doc.dict(fontRef)
+		if font == nil || font["ToUnicode"] == nil {
+			maps[name] = nil
+			continue
+		}
+		data, err := doc.streamFor(font["ToUnicode"])
+		if err != nil {
+			maps[name] = nil
+			continue
+		}
+		maps[name] = parseCMap(data)
+	}
+	return maps
+}
+
+// pageText extracts the text shown on a page, starting a new line whenever the
+// text position moves vertically.
+func (doc *pdfDocument) pageText(page pdfPage) string {
+	var contents []byte
+	switch value := page.dict["Contents"].(type) {
+	case pdfRef:
+		if data, err := doc.streamFor(value); err == nil {
+			contents = data
+		} else if array, ok := doc.resolve(value).(pdfArray); ok {
+			for _, part := range array {
+				data, _ := doc.streamFor(part)
+				contents = append(append(contents, data...), '\n')
+			}
+		}
+	case pdfArray:
+		for _, part := range value {
+			data, _ := doc.streamFor(part)
+			contents = append(append(contents, data...), '\n')
+		}
+	}
+
+	fonts := doc.fontMaps(page.resources)
+	var current *cmap
+	var buf strings.Builder
+	var operands []interface{}
+	newline := func() {
+		if buf.Len() > 0 && !strings.HasSuffix(buf.String(), "\n") {
+			buf.WriteString("\n")
+		}
+	}
+
+	lexer := &pdfLexer{data: contents}
+	for {
+		value, err := lexer.value()
+		if err != nil {
+			break
+		}
+		op, ok := value.(pdfKeyword)
+		if !ok {
+			operands = append(operands, value)
+			continue
+		}
+
+		switch op {
+		case "Tf":
+			if len(operands) >= 2 {
+				if name, ok := operands[len(operands)-2].(pdfName); ok {
+					current = fonts[string(name)]
+				}
+			}
+		case "Tj":
+			if len(operands) > 0 {
+				if text, ok := operands[len(operands)-1].(pdfString); ok {
+					buf.WriteString(current.decode(text))
+				}
+			}
+		case "'", "\"":
+			newline()
+			if len(operands) > 0 {
+				if text, ok := operands[len(operands)-1].(pdfString); ok {
+					buf.WriteString(current.decode(text))
+				}
+			}
+		case "TJ":
+			if len(operands) > 0 {
+				array, _ := operands[len(operands)-1].(pdfArray)
+				for _, item := range array {
+					switch item := item.(type) {
+					case pdfString:
+						buf.WriteString(current.decode(item))
+					case float64:
+						// Large negative adjustments are how many producers encode spaces
+						if item < -200 {
+							buf.WriteString(" ")
+						}
+					}
+				}
+			}
+		case "Td", "TD":
+			if len(operands) >= 2 {
+				if ty, ok := operands[len(operands)-1].(float64); ok && ty != 0 {
+					newline()
+				} else if !strings.HasSuffix(buf.String(), " ") {
+					buf.WriteString(" ")
+				}
+			}
+		case "T*", "Tm":
+			newline()
+		case "ET":
+			if !strings.HasSuffix(buf.String(), "\n") && !strings.HasSuffix(buf.String(), " ") {
+				buf.WriteString(" ")
+			}
+		case "ID":
+			// Skip inline image data
+			end := bytes.Index(contents[lexer.pos:], []byte("EI"))
+			if end < 0 {
+				lexer.pos = len(contents)
+			} else {
+				lexer.pos += end + 2
+			}
+		}
+		operands = operands[:0]
+	}
+
+	return strings.TrimSpace(buf.String())
+}
+
+// extractPDFPages returns the text of every page in the document.
+func extractPDFPages(data []byte) ([]string, error) {
+	doc, err := parsePDF(data)
+	if err != nil {
+		return nil, err
+	}
+
+	pages := doc.pages()
+	if doc.err != nil {
+		return nil, doc.err
+	}
+	if len(pages) == 0 {
+		return nil, fmt.Errorf("no pages found, the PDF may be encrypted or use an unsupported structure")
+	}
+
+	texts := make([]string, len(pages))
+	for i, page := range pages {
+		texts[i] = doc.pageText(page)
+		if doc.err != nil {
+			return nil, doc.err
+		}
+	}
+	return texts, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// buildPDF puts objects, numbered from 1, into a PDF.
+func buildPDF(objects ...string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	for i, object := range objects {
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	buf.WriteString("%%EOF\n")
+	return buf.Bytes()
+}
+
+// pdfStream is a stream object holding data, deflated when flate is set.
+func pdfStream(data []byte, flate bool) string {
+	filter := ""
+	if flate {
+		var compressed bytes.Buffer
+		writer := zlib.NewWriter(&compressed)
+		writer.Write(data)
+		writer.Close()
+		data, filter = compressed.Bytes(), " /Filter /FlateDecode"
+	}
+	return fmt.Sprintf("<< /Length %d%s >>\nstream\n%s\nendstream", len(data), filter, data)
+}
+
+func TestExtractPDFPages(t *testing.T) {
+	catalog := "<< /Type /Catalog /Pages 2 0 R >>"
+	tests := []struct {
+		name    string
+		pdf     []byte
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "plain content",
+			pdf: buildPDF(catalog,
+				"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+				"<< /Type /Page /Parent 2 0 R /Contents 4 0 R >>",
+				pdfStream([]byte("BT (Hello) Tj ET"), false)),
+			want: []string{"Hello"},
+		},
+		{
+			name: "deflated content over two pages",
+			pdf: buildPDF(catalog,
+				"<< /Type /Pages /Kids [3 0 R 5 0 R] /Count 2 >>",
+				"<< /Type /Page /Parent 2 0 R /Contents 4 0 R >>",
+				pdfStream([]byte("BT (Kitchen) Tj ET"), true),
+				"<< /Type /Page /Parent 2 0 R /Contents 6 0 R >>",
+				pdfStream([]byte("BT (Garage) Tj ET"), true)),
+			want: []string{"Kitchen", "Garage"},
+		},
+		{
+			name: "kids repeating a page are read once",
+			pdf: buildPDF(catalog,
+				"<< /Type /Pages /Kids [3 0 R 3 0 R 3 0 R] /Count 3 >>",
+				"<< /Type /Page /Parent 2 0 R /Contents 4 0 R >>",
+				pdfStream([]byte("BT (Once) Tj ET"), false)),
+			want: []string{"Once"},
+		},
+		{
+			name: "page tree that contains itself",
+			pdf: buildPDF(catalog,
+				"<< /Type /Pages /Kids [2 0 R] /Count 1 >>"),
+			wantErr: "no pages found",
+		},
+		{
+			name:    "not a PDF",
+			pdf:     []byte("hello"),
+			wantErr: "not a PDF",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pages, err := extractPDFPages(tt.pdf)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("extractPDFPages() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("extractPDFPages() error = %v", err)
+			}
+			if strings.Join(pages, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("pages = %q, want %q", pages, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractPDFPagesDecompressionBomb(t *testing.T) {
+	bomb := bytes.Repeat([]byte{' '}, maxDocumentExpansion+1)
+	pdf := buildPDF("<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /Contents 4 0 R >>",
+		pdfStream(bomb, true))
+	if _, err := extractPDFPages(pdf); !errors.Is(err, errDocumentTooLarge) {
+		t.Fatalf("extractPDFPages() error = %v, want errDocumentTooLarge", err)
+	}
+}
+
+func TestPDFPagesRepeatedKids(t *testing.T) {
+	// Every level lists the next one 50 times, which without tracking visited
+	// nodes is 50^20 walks
+	objects := []string{"<< /Type /Catalog /Pages 2 0 R >>"}
+	const levels = 20
+	for level := 0; level < levels; level++ {
+		kids := strings.Repeat(fmt.Sprintf("%d 0 R ", level+3), 50)
+		objects = append(objects, fmt.Sprintf("<< /Type /Pages /Kids [%s] >>", kids))
+	}
+	objects = append(objects, "<< /Type /Page >>")
+	doc, err := parsePDF(buildPDF(objects...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pages := doc.pages(); len(pages) != 1 {
+		t.Errorf("got %d pages, want 1", len(pages))
+	}
+}
+
+func TestPDFPagesLimit(t *testing.T) {
+	kids := make([]string, maxPDFPages+10)
+	objects := []string{"<< /Type /Catalog /Pages 2 0 R >>", ""}
+	for i := range kids {
+		kids[i] = fmt.Sprintf("%d 0 R", i+3)
+		objects = append(objects, "<< /Type /Page >>")
+	}
+	objects[1] = fmt.Sprintf("<< /Type /Pages /Kids [%s] >>", strings.Join(kids, " "))
+	doc, err := parsePDF(buildPDF(objects...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pages := doc.pages(); len(pages) != maxPDFPages {
+		t.Errorf("got %d pages, want %d", len(pages), maxPDFPages)
+	}
+}
+
+func TestExpansionLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		limit   int64
+		wantErr bool
+	}{
+		{"under", 10, 20, false},
+		{"exactly", 20, 20, false},
+		{"over", 21, 20, true},
+		{"far over", 1 << 20, 20, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			_, err := buf.ReadFrom(&expansionLimit{r: bytes.NewReader(make([]byte, tt.size)), left: tt.limit})
+			if got := errors.Is(err, errDocumentTooLarge); got != tt.wantErr {
+				t.Fatalf("error = %v, want too large: %v", err, tt.wantErr)
+			}
+			if int64(buf.Len()) > tt.limit {
+				t.Errorf("read %d bytes, more than the %d limit", buf.Len(), tt.limit)
+			}
+		})
+	}
+}
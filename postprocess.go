@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Post-processing steps
+const (
+	postProcessReplace       = "replace"
+	postProcessStripMarkdown = "strip_markdown"
+	postProcessStripEmoji    = "strip_emoji"
+	postProcessSentences     = "sentences"
+	postProcessStripThink    = "strip_think"
+)
+
+// PostProcessStep is a step of the post_process chain, which tidies responses
+// before they're returned, such as for text-to-speech. "replace" replaces
+// matches of Pattern with Replacement, which may refer to groups as $1,
+// "strip_markdown" and "strip_emoji" remove formatting and emoji,
+// "sentences" keeps the first Count sentences and "strip_think" removes the
+// <think> blocks of reasoning models.
+type PostProcessStep struct {
+	Type        string `json:"type"`
+	Pattern     string `json:"pattern,omitempty"`
+	Replacement string `json:"replacement,omitempty"`
+	Count       int    `json:"count,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// parsePostProcess checks the steps and compiles their patterns.
+func parsePostProcess(steps []PostProcessStep) error {
+	for i := range steps {
+		step := &steps[i]
+		switch step.Type {
+		case postProcessReplace:
+			pattern, err := regexp.Compile(step.Pattern)
+			if err != nil || step.Pattern == "" {
+				return fmt.Errorf("post_process step %d has invalid pattern '%s'", i, step.Pattern)
+			}
+			step.pattern = pattern
+		case postProcessSentences:
+			if step.Count <= 0 {
+				return fmt.Errorf("post_process step %d needs a positive count", i)
+			}
+		case postProcessStripMarkdown, postProcessStripEmoji, postProcessStripThink:
+		default:
+			return fmt.Errorf("post_process step %d has unknown type '%s'", i, step.Type)
+		}
+	}
+	return nil
+}
+
+// postProcess is the template's post_process chain, or the global one.
+func (tc *TemplateConfig) postProcess(config *Config, templateName string) []PostProcessStep {
+	if settings, ok := tc.Settings[templateName]; ok && settings.PostProcess != nil {
+		return settings.PostProcess
+	}
+	return config.PostProcess
+}
+
+// applyPostProcess runs the text through the steps in order.
+func applyPostProcess(steps []PostProcessStep, text string) string {
+	for _, step := range steps {
+		switch step.Type {
+		case postProcessReplace:
+			text = step.pattern.ReplaceAllString(text, step.Replacement)
+		case postProcessStripMarkdown:
+			text = stripMarkdown(text)
+		case postProcessStripEmoji:
+			text = stripEmoji(text)
+		case postProcessSentences:
+			text = firstSentences(text, step.Count)
+		case postProcessStripThink:
+			text = strings.TrimSpace(thinkBlock.ReplaceAllString(text, ""))
+		}
+	}
+	return text
+}
+
+var (
+	// A reasoning model's thoughts, or the start of them when cut short
+	thinkBlock = regexp.MustCompile(`(?s)<think>.*?(</think>|$)`)
+
+	markdownFence    = regexp.MustCompile("(?m)^\\s*```.*$\n?")
+	markdownImage    = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	markdownLink     = regexp.MustCompile(`\[([^\]]*)\]\([^)]*\)`)
+	markdownHeading  = regexp.MustCompile(`(?m)^\s{0,3}#{1,6}\s+`)
+	markdownQuote    = regexp.MustCompile(`(?m)^\s{0,3}>\s?`)
+	markdownBullet   = regexp.MustCompile(`(?m)^(\s*)[-*+]\s+`)
+	markdownRule     = regexp.MustCompile(`(?m)^\s{0,3}([-*_]\s*){3,}$`)
+	markdownEmphasis = regexp.MustCompile(`(\*{1,3}|~~)(\S(?:.*?\S)?)(\*{1,3}|~~)`)
+	// Underscores only emphasise outside words, unlike in snake_case
+	markdownUnderscore = regexp.MustCompile(`(^|\W)_{1,3}(\S(?:.*?\S)?)_{1,3}(\W|$)`)
+	markdownCode       = regexp.MustCompile("`([^`]*)`")
+	markdownTableRow   = regexp.MustCompile(`(?m)^\s*\|?(\s*:?-+:?\s*\|)+\s*:?-*:?\s*$\n?`)
+
+	emojiGap       = regexp.MustCompile(`[ \t]{2,}`)
+	emojiGapBefore = regexp.MustCompile(`[ \t]+([,.!?;:\n]|$)`)
+
+	// A sentence ends with punctuation followed by a space or the end
+	sentenceEnd = regexp.MustCompile(`[.!?…]+["')\]]*(\s+|$)`)
+)
+
+// stripMarkdown reduces markdown to the plain text it would show.
+func stripMarkdown(text string) string {
+	text = markdownFence.ReplaceAllString(text, "")
+	text = markdownTableRow.ReplaceAllString(text, "")
+	text = markdownRule.ReplaceAllString(text, "")
+	text = markdownImage.ReplaceAllString(text, "$1")
+	text = markdownLink.ReplaceAllString(text, "$1")
+	text = markdownHeading.ReplaceAllString(text, "")
+	text = markdownQuote.ReplaceAllString(text, "")
+	text = markdownBullet.ReplaceAllString(text, "$1")
+	text = markdownEmphasis.ReplaceAllString(text, "$2")
+	text = markdownUnderscore.ReplaceAllString(text, "$1$2$3")
+	text = markdownCode.ReplaceAllString(text, "$1")
+	// Table cells become comma separated
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if trimmed := strings.TrimSpace(line); strings.HasPrefix(trimmed, "|") && strings.HasSuffix(trimmed, "|") {
+			cells := strings.Split(strings.Trim(trimmed, "|"), "|")
+			for j := range cells {
+				cells[j] = strings.TrimSpace(cells[j])
+			}
+			lines[i] = strings.Join(cells, ", ")
+		}
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// stripEmoji removes emoji, with their modifiers and joiners.
+func stripEmoji(text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		if !isEmoji(r) {
+			b.WriteRune(r)
+		}
+	}
+	// Emoji leave the spaces around them behind
+	text = emojiGap.ReplaceAllString(b.String(), " ")
+	text = emojiGapBefore.ReplaceAllString(text, "$1")
+	return strings.TrimSpace(text)
+}
+
+func isEmoji(r rune) bool {
+	switch {
+	case r >= 0x1F000 && r <= 0x1FAFF, // pictographs, emoticons, flags and skin tones
+		r >= 0x2600 && r <= 0x27BF,   // symbols and dingbats
+		r >= 0x2B00 && r <= 0x2BFF,   // stars, circles and arrows
+		r >= 0xFE00 && r <= 0xFE0F,   // variation selectors
+		r >= 0xE0020 && r <= 0xE007F, // tag sequences
+		r == 0x200D, r == 0x20E3:     // joiners and keycaps
+		return true
+	}
+	return false
+}
+
+// firstSentences keeps the first count sentences of the text.
+func firstSentences(text string, count int) string {
+	ends := sentenceEnd.FindAllStringIndex(text, -1)
+	if len(ends) <= count {
+		return strings.TrimSpace(text)
+	}
+	return strings.TrimSpace(text[:ends[count-1][1]])
+}
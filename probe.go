@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// The fixed generation used to probe a model: short and deterministic so runs
+// are comparable after driver or model updates
+const probePrompt = "Count from 1 to 20, separated by commas."
+
+// ProbeResult is the performance of one model on the probe generation.
+type ProbeResult struct {
+	Model            string  `json:"model"`
+	LoadMS           int64   `json:"load_ms"`
+	FirstTokenMS     int64   `json:"first_token_ms"`
+	TotalMS          int64   `json:"total_ms"`
+	CompletionTokens int     `json:"completion_tokens"`
+	TokensPerSecond  float64 `json:"tokens_per_second"`
+	Error            string  `json:"error,omitempty"`
+}
+
+// probeModels are the models the server is configured to use: the default
+// model and every template's model.
+func probeModels(config *Config, templateConfig *TemplateConfig) []string {
+	seen := map[string]bool{config.DefaultModel: true}
+	models := []string{config.DefaultModel}
+	for templateName := range templateConfig.Templates {
+		if model := templateConfig.defaultModel(config, templateName); !seen[model] {
+			seen[model] = true
+			models = append(models, model)
+		}
+	}
+	sort.Strings(models[1:])
+	return models
+}
+
+// probeModel runs the probe generation on a model, streamed so the time to the
+// first token can be measured.
+func probeModel(ctx context.Context, config *Config, model string) ProbeResult {
+	result := ProbeResult{Model: model}
+	stats := &GenerationStats{}
+	ctx = withGenerationStats(ctx, stats)
+	ollamaRequest := map[string]interface{}{
+		"model":   model,
+		"prompt":  probePrompt,
+		"stream":  true,
+		"options": map[string]interface{}{"temperature": 0, "seed": 1, "num_predict": 64},
+	}
+
+	start := time.Now()
+	_, err := postOllama(ctx, config, ollamaRequest, func(string) {})
+	result.TotalMS = time.Since(start).Milliseconds()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.LoadMS = stats.Load.Milliseconds()
+	result.FirstTokenMS = stats.FirstToken.Milliseconds()
+	result.CompletionTokens = stats.CompletionTokens
+	if stats.Eval > 0 {
+		result.TokensPerSecond = math.Round(float64(stats.CompletionTokens)/stats.Eval.Seconds()*10) / 10
+	}
+	return result
+}
+
+// probeHandler serves GET /admin/probe, probing the configured models one at a
+// time, or those given with ?model=.
+func probeHandler(config *Config, templateConfig *TemplateConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		models := r.URL.Query()["model"]
+		if len(models) == 0 {
+			models = probeModels(config, templateConfig)
+		}
+		results := make([]ProbeResult, 0, len(models))
+		for _, model := range models {
+			result := probeModel(r.Context(), config, model)
+			if result.Error != "" {
+				slog.Warn("Probe failed", "model", model, "error", result.Error)
+			}
+			results = append(results, result)
+		}
+		writeJSON(w, http.StatusOK, results)
+	}
+}
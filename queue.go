@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Requests that may wait for each model, unless the config says otherwise
+const defaultMaxQueued = 100
+
+var (
+	errQueueFull    = errors.New("too many requests are waiting for the model")
+	errQueueTimeout = errors.New("timed out waiting for the model")
+)
+
+// QueueConfig limits how many generations run on each model at once, so bursts
+// don't make Ollama swap models in and out of VRAM. MaxConcurrent applies to
+// every model, and Models sets the limit of particular ones, with 0 for none.
+// Further requests wait in order, up to MaxQueued of them for each model and
+// for at most Timeout. Pools are named worker pools that templates can be
+// assigned to, each with its own limits, taken before the model's.
+type QueueConfig struct {
+	MaxConcurrent int                    `json:"max_concurrent"`
+	Models        map[string]int         `json:"models"`
+	MaxQueued     int                    `json:"max_queued"`
+	Timeout       string                 `json:"timeout"`
+	Pools         map[string]*PoolConfig `json:"pools"`
+
+	timeout time.Duration
+}
+
+// PoolConfig limits the generations of the templates in a worker pool, so a
+// flood of batch requests can't hold up the voice assistant's templates.
+type PoolConfig struct {
+	MaxConcurrent int    `json:"max_concurrent"`
+	MaxQueued     int    `json:"max_queued"`
+	Timeout       string `json:"timeout"`
+
+	timeout time.Duration
+}
+
+func (c *PoolConfig) parse(name string) error {
+	if c.MaxConcurrent < 0 || c.MaxQueued < 0 {
+		return fmt.Errorf("pool '%s' max_concurrent and max_queued can't be negative", name)
+	}
+	if c.Timeout == "" {
+		return nil
+	}
+	timeout, err := time.ParseDuration(c.Timeout)
+	if err != nil || timeout <= 0 {
+		return fmt.Errorf("invalid timeout '%s' of pool '%s'", c.Timeout, name)
+	}
+	c.timeout = timeout
+	return nil
+}
+
+func (c *PoolConfig) maxQueued() int {
+	if c.MaxQueued == 0 {
+		return defaultMaxQueued
+	}
+	return c.MaxQueued
+}
+
+func (c *QueueConfig) parse() error {
+	if c.MaxConcurrent < 0 || c.MaxQueued < 0 {
+		return fmt.Errorf("queue max_concurrent and max_queued can't be negative")
+	}
+	for model, limit := range c.Models {
+		if limit < 0 {
+			return fmt.Errorf("queue limit of model '%s' can't be negative", model)
+		}
+	}
+	for name, pool := range c.Pools {
+		if pool == nil {
+			return fmt.Errorf("pool '%s' has no settings", name)
+		}
+		if err := pool.parse(name); err != nil {
+			return err
+		}
+	}
+	if c.Timeout == "" {
+		return nil
+	}
+	timeout, err := time.ParseDuration(c.Timeout)
+	if err != nil || timeout <= 0 {
+		return fmt.Errorf("invalid queue timeout '%s'", c.Timeout)
+	}
+	c.timeout = timeout
+	return nil
+}
+
+// limit is how many generations may run on the model at once, 0 for any number.
+func (c *QueueConfig) limit(model string) int {
+	if limit, ok := c.Models[model]; ok {
+		return limit
+	}
+	return c.MaxConcurrent
+}
+
+func (c *QueueConfig) maxQueued() int {
+	if c.MaxQueued == 0 {
+		return defaultMaxQueued
+	}
+	return c.MaxQueued
+}
+
+// Queues hands out slots to run generations, in the order they were asked for.
+// It lives as long as the server, so reloads don't lose waiting requests.
+type Queues struct {
+	mu     sync.Mutex
+	queues map[string]*queue
+}
+
+type queue struct {
+	running int
+	waiting []chan struct{}
+}
+
+// QueueStatus is how busy a queue is.
+type QueueStatus struct {
+	Running int `json:"running"`
+	Waiting int `json:"waiting"`
+}
+
+func newQueues() *Queues {
+	return &Queues{queues: make(map[string]*queue)}
+}
+
+// acquire waits for one of limit slots of the named queue, in turn after those
+// already waiting, and returns the function releasing it. It fails at once when
+// maxQueued requests are waiting, and after timeout (unless zero) or when ctx
+// ends.
+func (q *Queues) acquire(ctx context.Context, name string, limit, maxQueued int, timeout time.Duration) (release func(), err error) {
+	if limit <= 0 {
+		return func() {}, nil
+	}
+	q.mu.Lock()
+	current, ok := q.queues[name]
+	if !ok {
+		current = &queue{}
+		q.queues[name] = current
+	}
+	release = func() { q.release(name) }
+	if current.running < limit && len(current.waiting) == 0 {
+		current.running++
+		q.mu.Unlock()
+		return release, nil
+	}
+	if len(current.waiting) >= maxQueued {
+		q.mu.Unlock()
+		return nil, errQueueFull
+	}
+	turn := make(chan struct{})
+	current.waiting = append(current.waiting, turn)
+	position := len(current.waiting)
+	q.mu.Unlock()
+	slog.Debug("Waiting for the model", "queue", name, "position", position, "request_id", requestID(ctx))
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-turn:
+		return release, nil
+	case <-expired:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, waiting := range current.waiting {
+		if waiting == turn {
+			current.waiting = append(current.waiting[:i], current.waiting[i+1:]...)
+			return nil, err
+		}
+	}
+	// The slot was handed over while giving up, so pass it on
+	q.releaseLocked(name)
+	return nil, err
+}
+
+func (q *Queues) release(name string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.releaseLocked(name)
+}
+
+// releaseLocked hands a slot to the first request waiting for it, or frees it.
+func (q *Queues) releaseLocked(name string) {
+	current := q.queues[name]
+	if len(current.waiting) > 0 {
+		close(current.waiting[0])
+		current.waiting = current.waiting[1:]
+		return
+	}
+	current.running--
+}
+
+// status reports how busy each queue is.
+func (q *Queues) status() map[string]QueueStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	status := make(map[string]QueueStatus, len(q.queues))
+	for name, current := range q.queues {
+		status[name] = QueueStatus{Running: current.running, Waiting: len(current.waiting)}
+	}
+	return status
+}
+
+// writeMetrics renders the queues as Prometheus gauges named prefix_running
+// and prefix_waiting, labelled with the queue's name. What describes the queues
+// in the help text.
+func (q *Queues) writeMetrics(w io.Writer, prefix, label, what string) {
+	status := q.status()
+	fmt.Fprintf(w, "# HELP %s_running Generations running on %s.\n", prefix, what)
+	fmt.Fprintf(w, "# TYPE %s_running gauge\n", prefix)
+	for _, name := range sortedKeys(status) {
+		fmt.Fprintf(w, "%s_running%s %d\n", prefix, labels(label, name), status[name].Running)
+	}
+	fmt.Fprintf(w, "# HELP %s_waiting Generations waiting for %s.\n", prefix, what)
+	fmt.Fprintf(w, "# TYPE %s_waiting gauge\n", prefix)
+	for _, name := range sortedKeys(status) {
+		fmt.Fprintf(w, "%s_waiting%s %d\n", prefix, labels(label, name), status[name].Waiting)
+	}
+}
+
+// waitForModel takes a slot to run a generation on the model, waiting in the
+// model's queue when the config limits it.
+func waitForModel(ctx context.Context, config *Config, model string) (func(), error) {
+	return config.queues.acquire(ctx, model, config.Queue.limit(model), config.Queue.maxQueued(), config.Queue.timeout)
+}
+
+// pool is the worker pool the template is assigned to, if any.
+func (tc *TemplateConfig) pool(templateName string) string {
+	if settings, ok := tc.Settings[templateName]; ok {
+		return settings.Pool
+	}
+	return ""
+}
+
+// waitForPool takes a slot of the template's worker pool, waiting in the pool's
+// queue when it has a limit.
+func waitForPool(ctx context.Context, config *Config, templateConfig *TemplateConfig, templateName string) (func(), error) {
+	name := templateConfig.pool(templateName)
+	if name == "" {
+		return func() {}, nil
+	}
+	pool, ok := config.Queue.Pools[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown pool '%s'", name)
+	}
+	release, err := config.pools.acquire(ctx, name, pool.MaxConcurrent, pool.maxQueued(), pool.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("pool '%s': %w", name, err)
+	}
+	return release, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimitConfig allows a template at most Requests generations in any Per
+// window, such as 10 per "1m".
+type RateLimitConfig struct {
+	Requests int    `json:"requests"`
+	Per      string `json:"per"`
+
+	per time.Duration
+}
+
+func (c *RateLimitConfig) parse() error {
+	per, err := time.ParseDuration(c.Per)
+	if err != nil {
+		return fmt.Errorf("invalid rate_limit 'per' duration: %w", err)
+	}
+	if c.Requests <= 0 || per <= 0 {
+		return fmt.Errorf("rate_limit requires positive 'requests' and 'per'")
+	}
+	c.per = per
+	return nil
+}
+
+// parseLimits checks the rate_limit and cooldown of template settings.
+func (s *TemplateSettings) parseLimits() error {
+	if s.RateLimit != nil {
+		if err := s.RateLimit.parse(); err != nil {
+			return err
+		}
+	}
+	if s.Cooldown != "" {
+		cooldown, err := time.ParseDuration(s.Cooldown)
+		if err != nil {
+			return fmt.Errorf("invalid cooldown duration: %w", err)
+		}
+		s.cooldown = cooldown
+	}
+	return nil
+}
+
+// rateLimitError is returned when a template's rate limit or cooldown rejects a
+// generation.
+type rateLimitError struct {
+	template   string
+	retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("template %s is rate limited, retry after %s", e.template, e.retryAfter.Round(time.Second))
+}
+
+// setRetryAfter sets the Retry-After header in whole seconds.
+func (e *rateLimitError) setRetryAfter(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(e.retryAfter.Seconds()))))
+}
+
+// RateLimiter tracks recent generations of each template. It lives as long as
+// the server, so reloads don't reset the limits.
+type RateLimiter struct {
+	mu     sync.Mutex
+	starts map[string][]time.Time
+}
+
+func newRateLimiter() *RateLimiter {
+	return &RateLimiter{starts: make(map[string][]time.Time)}
+}
+
+// allow records a generation of the template, or returns a *rateLimitError if
+// its rate limit or cooldown doesn't allow one yet.
+func (l *RateLimiter) allow(templateName string, settings *TemplateSettings) error {
+	if l == nil || settings == nil || (settings.RateLimit == nil && settings.cooldown <= 0) {
+		return nil
+	}
+	if wait := l.reserve(templateName, settings.RateLimit, settings.cooldown); wait > 0 {
+		return &rateLimitError{template: templateName, retryAfter: wait}
+	}
+	return nil
+}
+
+// reserve records a request under the key, or returns how long to wait before
+// the limit and cooldown allow one.
+func (l *RateLimiter) reserve(key string, limit *RateLimitConfig, cooldown time.Duration) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	// Only as much history as the longer of the two windows is needed
+	window := cooldown
+	if limit != nil {
+		window = max(window, limit.per)
+	}
+	starts := l.starts[key]
+	for len(starts) > 0 && now.Sub(starts[0]) >= window {
+		starts = starts[1:]
+	}
+	l.starts[key] = starts
+
+	var wait time.Duration
+	if n := len(starts); n > 0 && cooldown > 0 {
+		wait = starts[n-1].Add(cooldown).Sub(now)
+	}
+	if limit != nil {
+		var recent []time.Time
+		for _, start := range starts {
+			if now.Sub(start) < limit.per {
+				recent = append(recent, start)
+			}
+		}
+		if len(recent) >= limit.Requests {
+			wait = max(wait, recent[len(recent)-limit.Requests].Add(limit.per).Sub(now))
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+
+	l.starts[key] = append(starts, now)
+	return 0
+}
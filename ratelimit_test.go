@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimitConfigParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings TemplateSettings
+		wantErr  bool
+	}{
+		{"none", TemplateSettings{}, false},
+		{"limit", TemplateSettings{RateLimit: &RateLimitConfig{Requests: 10, Per: "1m"}}, false},
+		{"cooldown", TemplateSettings{Cooldown: "30s"}, false},
+		{"bad per", TemplateSettings{RateLimit: &RateLimitConfig{Requests: 10, Per: "minute"}}, true},
+		{"no requests", TemplateSettings{RateLimit: &RateLimitConfig{Per: "1m"}}, true},
+		{"negative per", TemplateSettings{RateLimit: &RateLimitConfig{Requests: 1, Per: "-1m"}}, true},
+		{"bad cooldown", TemplateSettings{Cooldown: "soon"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.settings.parseLimits()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseLimits() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	limited := &TemplateSettings{RateLimit: &RateLimitConfig{Requests: 2, Per: "1h"}}
+	cooldown := &TemplateSettings{Cooldown: "1h"}
+	for _, settings := range []*TemplateSettings{limited, cooldown} {
+		if err := settings.parseLimits(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		settings *TemplateSettings
+		allowed  int
+	}{
+		{"rate limit", limited, 2},
+		{"cooldown", cooldown, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := newRateLimiter()
+			for i := 0; i < tt.allowed; i++ {
+				if err := limiter.allow("doorbell", tt.settings); err != nil {
+					t.Fatalf("request %d: %v", i+1, err)
+				}
+			}
+
+			err := limiter.allow("doorbell", tt.settings)
+			var limitErr *rateLimitError
+			if !errors.As(err, &limitErr) {
+				t.Fatalf("error = %v, want a rate limit error", err)
+			}
+			if limitErr.retryAfter <= 59*time.Minute || limitErr.retryAfter > time.Hour {
+				t.Errorf("retry after %s, want about an hour", limitErr.retryAfter)
+			}
+			rec := httptest.NewRecorder()
+			limitErr.setRetryAfter(rec)
+			if got := rec.Header().Get("Retry-After"); got != "3600" {
+				t.Errorf("Retry-After = %q", got)
+			}
+
+			// Limits are per template
+			if err := limiter.allow("weather", tt.settings); err != nil {
+				t.Errorf("other template: %v", err)
+			}
+		})
+	}
+}
+
+func TestRateLimiterWindow(t *testing.T) {
+	limiter := newRateLimiter()
+	limit := &RateLimitConfig{Requests: 2, per: time.Minute}
+
+	// Requests older than the window no longer count
+	limiter.starts["doorbell"] = []time.Time{time.Now().Add(-2 * time.Minute), time.Now().Add(-30 * time.Second)}
+	if wait := limiter.reserve("doorbell", limit, 0); wait != 0 {
+		t.Fatalf("wait = %s, want the expired request ignored", wait)
+	}
+	// The oldest of the two recent requests leaves the window in about 30s
+	wait := limiter.reserve("doorbell", limit, 0)
+	if wait <= 29*time.Second || wait > 30*time.Second {
+		t.Errorf("wait = %s, want about 30s", wait)
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	var nilLimiter *RateLimiter
+	if err := nilLimiter.allow("doorbell", &TemplateSettings{Cooldown: "1h"}); err != nil {
+		t.Errorf("nil limiter: %v", err)
+	}
+	limiter := newRateLimiter()
+	for i := 0; i < 100; i++ {
+		if err := limiter.allow("doorbell", &TemplateSettings{}); err != nil {
+			t.Fatalf("unlimited template: %v", err)
+		}
+	}
+	if err := limiter.allow("doorbell", nil); err != nil {
+		t.Errorf("no settings: %v", err)
+	}
+}
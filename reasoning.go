@@ -0,0 +1,136 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Tags around the thoughts of reasoning models such as DeepSeek-R1
+const (
+	thinkOpen  = "<think>"
+	thinkClose = "</think>"
+)
+
+// ReasoningConfig handles the thinking of reasoning models. Strip removes the
+// <think> blocks from responses, streamed ones included. Field returns the
+// reasoning in that response field, including the thinking Ollama returns
+// separately when think is set in ollama_params.
+type ReasoningConfig struct {
+	Strip bool   `json:"strip"`
+	Field string `json:"field"`
+}
+
+// reasoning is the template's reasoning config, or the global one.
+func (tc *TemplateConfig) reasoning(config *Config, templateName string) ReasoningConfig {
+	if settings, ok := tc.Settings[templateName]; ok && settings.Reasoning != nil {
+		return *settings.Reasoning
+	}
+	return config.Reasoning
+}
+
+// splitReasoning separates the <think> blocks of a response from the answer.
+// A block cut short runs to the end of the response.
+func splitReasoning(text string) (answer, thoughts string) {
+	var answers, blocks []string
+	for {
+		start := strings.Index(text, thinkOpen)
+		if start < 0 {
+			answers = append(answers, text)
+			break
+		}
+		answers = append(answers, text[:start])
+		text = text[start+len(thinkOpen):]
+		end := strings.Index(text, thinkClose)
+		if end < 0 {
+			blocks = append(blocks, strings.TrimSpace(text))
+			break
+		}
+		blocks = append(blocks, strings.TrimSpace(text[:end]))
+		text = text[end+len(thinkClose):]
+	}
+	return strings.TrimSpace(strings.Join(answers, "")), strings.Join(blocks, "\n\n")
+}
+
+// responseThinking is the thinking Ollama returned apart from the response.
+func responseThinking(ollamaResponseMap map[string]interface{}, chat bool) string {
+	if chat {
+		message, _ := ollamaResponseMap["message"].(map[string]interface{})
+		thinking, _ := message["thinking"].(string)
+		return thinking
+	}
+	thinking, _ := ollamaResponseMap["thinking"].(string)
+	return thinking
+}
+
+// thinkFilter passes streamed text on without its <think> blocks. A tag may be
+// split across chunks, so text that could be the start of one is held back
+// until the next chunk, or flush.
+type thinkFilter struct {
+	next    func(string)
+	inside  bool
+	pending string
+	// Until the answer starts, whitespace such as that after a block is dropped
+	trimLeading bool
+}
+
+func newThinkFilter(next func(string)) *thinkFilter {
+	return &thinkFilter{next: next, trimLeading: true}
+}
+
+func (f *thinkFilter) write(chunk string) {
+	text := f.pending + chunk
+	f.pending = ""
+	var out strings.Builder
+	for text != "" {
+		tag := thinkOpen
+		if f.inside {
+			tag = thinkClose
+		}
+		if i := strings.Index(text, tag); i >= 0 {
+			if !f.inside {
+				out.WriteString(text[:i])
+			}
+			text = text[i+len(tag):]
+			f.inside = !f.inside
+			continue
+		}
+		held := partialTag(text, tag)
+		if !f.inside {
+			out.WriteString(text[:len(text)-held])
+		}
+		f.pending = text[len(text)-held:]
+		break
+	}
+	f.emit(out.String())
+}
+
+// flush passes on the text held back at the end of the stream.
+func (f *thinkFilter) flush() {
+	if !f.inside {
+		f.emit(f.pending)
+	}
+	f.pending = ""
+}
+
+func (f *thinkFilter) emit(text string) {
+	if f.trimLeading {
+		text = strings.TrimLeftFunc(text, unicode.IsSpace)
+		if text == "" {
+			return
+		}
+		f.trimLeading = false
+	}
+	if text != "" {
+		f.next(text)
+	}
+}
+
+// partialTag is the length of the longest end of text that begins tag.
+func partialTag(text, tag string) int {
+	for n := min(len(tag)-1, len(text)); n > 0; n-- {
+		if strings.HasSuffix(text, tag[:n]) {
+			return n
+		}
+	}
+	return 0
+}
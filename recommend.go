@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Models need this many requests for a template before they are compared
+	minRecommendationSamples = 10
+	// A query asked again for the same template within this window counts as a retry
+	retryWindow = 2 * time.Minute
+)
+
+var modelSizePattern = regexp.MustCompile(`(?i)[:\-_](\d+(?:\.\d+)?)b(?:$|[\-_.])`)
+
+// ModelUsage is how one model has performed for a template.
+type ModelUsage struct {
+	Model               string  `json:"model"`
+	Requests            int     `json:"requests"`
+	ErrorRate           float64 `json:"error_rate"`
+	TruncationRate      float64 `json:"truncation_rate"`
+	RetryRate           float64 `json:"retry_rate"`
+	P50MS               int64   `json:"p50_ms"`
+	P95MS               int64   `json:"p95_ms"`
+	AvgCompletionTokens float64 `json:"avg_completion_tokens"`
+}
+
+// TemplateReport holds the per-model usage of a template and recommendations.
+type TemplateReport struct {
+	Template        string       `json:"template"`
+	CurrentModel    string       `json:"current_model"`
+	Models          []ModelUsage `json:"models"`
+	Recommendations []string     `json:"recommendations"`
+}
+
+// modelSize returns the parameter count in billions from a model tag such as
+// "llama3.2:3b", or 0 when the tag doesn't say.
+func modelSize(model string) float64 {
+	match := modelSizePattern.FindStringSubmatch(model)
+	if match == nil {
+		return 0
+	}
+	size, _ := strconv.ParseFloat(match[1], 64)
+	return size
+}
+
+func percentile(sorted []int64, p float64) int64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(float64(len(sorted)-1)*p)]
+}
+
+// retriedRecords marks records whose query was asked again for the same
+// template shortly afterwards, a sign the first answer wasn't useful.
+func retriedRecords(records []HistoryRecord) map[int]bool {
+	retried := make(map[int]bool)
+	last := make(map[string]int)
+	for i, record := range records {
+		key := record.Template + "\x00" + strings.ToLower(strings.TrimSpace(record.Query))
+		if previous, ok := last[key]; ok && record.Time.Sub(records[previous].Time) <= retryWindow {
+			retried[previous] = true
+		}
+		last[key] = i
+	}
+	return retried
+}
+
+// buildRecommendations analyses history since 'since' per template and model.
+func buildRecommendations(records []HistoryRecord, since time.Time) []TemplateReport {
+	retried := retriedRecords(records)
+
+	type sample struct {
+		requests, errors, truncated, retries, completionTokens int
+		durations                                              []int64
+	}
+	samples := make(map[string]map[string]*sample)
+	for i, record := range records {
+		if record.Time.Before(since) || record.Template == "" {
+			continue
+		}
+		if samples[record.Template] == nil {
+			samples[record.Template] = make(map[string]*sample)
+		}
+		s := samples[record.Template][record.Model]
+		if s == nil {
+			s = &sample{}
+			samples[record.Template][record.Model] = s
+		}
+		s.requests++
+		if record.Error != "" {
+			s.errors++
+			continue
+		}
+		if record.Truncated {
+			s.truncated++
+		}
+		if retried[i] {
+			s.retries++
+		}
+		s.completionTokens += record.CompletionTokens
+		s.durations = append(s.durations, record.DurationMS)
+	}
+
+	reports := make([]TemplateReport, 0, len(samples))
+	for templateName, models := range samples {
+		report := TemplateReport{Template: templateName, Recommendations: []string{}}
+		for model, s := range models {
+			usage := ModelUsage{Model: model, Requests: s.requests, ErrorRate: float64(s.errors) / float64(s.requests)}
+			if succeeded := len(s.durations); succeeded > 0 {
+				sort.Slice(s.durations, func(i, j int) bool { return s.durations[i] < s.durations[j] })
+				usage.TruncationRate = float64(s.truncated) / float64(succeeded)
+				usage.RetryRate = float64(s.retries) / float64(succeeded)
+				usage.P50MS = percentile(s.durations, 0.5)
+				usage.P95MS = percentile(s.durations, 0.95)
+				usage.AvgCompletionTokens = float64(s.completionTokens) / float64(succeeded)
+			}
+			report.Models = append(report.Models, usage)
+		}
+		sort.Slice(report.Models, func(i, j int) bool {
+			if report.Models[i].Requests != report.Models[j].Requests {
+				return report.Models[i].Requests > report.Models[j].Requests
+			}
+			return report.Models[i].Model < report.Models[j].Model
+		})
+		report.CurrentModel = report.Models[0].Model
+		report.Recommendations = recommend(templateName, report.Models)
+		reports = append(reports, report)
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Template < reports[j].Template })
+	return reports
+}
+
+// recommend compares the most used model of a template with the alternatives
+// that have enough samples.
+func recommend(templateName string, models []ModelUsage) []string {
+	recommendations := []string{}
+	current := models[0]
+	if current.Requests < minRecommendationSamples {
+		return recommendations
+	}
+
+	if current.ErrorRate > 0.1 {
+		recommendations = append(recommendations, fmt.Sprintf("%.0f%% of requests to %s fail, check the model is available and the request_timeout is long enough", current.ErrorRate*100, current.Model))
+	}
+	if current.TruncationRate > 0.1 {
+		recommendations = append(recommendations, fmt.Sprintf("%.0f%% of responses hit the token limit, raise num_predict or ask for shorter answers in the template", current.TruncationRate*100))
+	}
+	if current.RetryRate > 0.2 {
+		recommendations = append(recommendations, fmt.Sprintf("%.0f%% of queries are asked again within %s, the answers may not be helpful: try a larger model or improve the prompt", current.RetryRate*100, retryWindow))
+	}
+
+	similar := func(alt ModelUsage) bool {
+		return alt.ErrorRate <= current.ErrorRate+0.05 &&
+			alt.TruncationRate <= current.TruncationRate+0.05 &&
+			alt.RetryRate <= current.RetryRate+0.05
+	}
+
+	foundAlternative := false
+	for _, alt := range models[1:] {
+		if alt.Requests < minRecommendationSamples || !similar(alt) {
+			continue
+		}
+		smaller := modelSize(alt.Model) > 0 && modelSize(alt.Model) < modelSize(current.Model)
+		faster := alt.P50MS < current.P50MS*3/4
+		slower := alt.P50MS > current.P50MS*5/4+100
+		if (smaller || faster) && !slower {
+			foundAlternative = true
+			recommendations = append(recommendations, fmt.Sprintf("Template %s would likely be fine on %s: p50 %dms vs %dms on %s with similar error, truncation and retry rates", templateName, alt.Model, alt.P50MS, current.P50MS, current.Model))
+		}
+	}
+
+	if !foundAlternative && modelSize(current.Model) >= 7 && current.AvgCompletionTokens > 0 && current.AvgCompletionTokens < 60 &&
+		current.TruncationRate < 0.02 && current.RetryRate < 0.05 && current.ErrorRate < 0.05 {
+		recommendations = append(recommendations, fmt.Sprintf("Template %s gets short answers (%.0f tokens on average) that are rarely retried, a 3B model would likely be fine: compare them with llamanator benchmark-models", templateName, current.AvgCompletionTokens))
+	}
+	return recommendations
+}
+
+// recommendationsHandler serves GET /admin/recommendations?days=30.
+func recommendationsHandler(history *History) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if history == nil {
+			http.Error(w, "History is not enabled", http.StatusNotFound)
+			return
+		}
+
+		query, err := parseListQuery(r, 0, "days")
+		if err != nil {
+			writeListError(w, err)
+			return
+		}
+		days := 30
+		if value := r.URL.Query().Get("days"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				http.Error(w, "days must be a positive number", http.StatusBadRequest)
+				return
+			}
+			days = n
+		}
+
+		history.mu.Lock()
+		reports := buildRecommendations(history.records, time.Now().AddDate(0, 0, -days))
+		history.mu.Unlock()
+		if reports, err = applyListQuery(w, query, reports); err != nil {
+			writeListError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, reports)
+	}
+}
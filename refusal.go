@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Statuses a response gets when refusal detection is on
+const (
+	statusAnswered = "answered"
+	statusDeclined = "declined"
+)
+
+// Patterns of common refusals and non-answers, used unless the config gives
+// its own
+var defaultRefusalPatterns = []string{
+	`\bI(?:['’]m| am) (?:sorry|afraid)\b.{0,60}\b(?:can(?:not|['’]t)|unable|won['’]t)\b`,
+	`\bI (?:can(?:not|['’]t)|am unable to|['’]m unable to|am not able to|['’]m not able to|won['’]t be able to) (?:help|assist|provide|answer|do that|comply|fulfil)`,
+	`\bas an AI(?: language model| assistant)?\b`,
+	`\bI (?:don['’]t|do not) have (?:access to|the ability to|real[- ]time)`,
+	`\bI (?:must|have to) (?:decline|refuse)\b`,
+}
+
+// RefusalConfig detects responses where the model declined or didn't answer,
+// so automations can branch on a status field instead of announcing the
+// boilerplate. Patterns are case-insensitive regular expressions replacing the
+// built-in ones. With RetryPrompt, a declined generation is asked once more
+// with it added to the prompt.
+type RefusalConfig struct {
+	Enabled     bool     `json:"enabled"`
+	Patterns    []string `json:"patterns"`
+	RetryPrompt string   `json:"retry_prompt"`
+
+	patterns []*regexp.Regexp
+}
+
+func (c *RefusalConfig) parse() error {
+	patterns := c.Patterns
+	if len(patterns) == 0 {
+		patterns = defaultRefusalPatterns
+	}
+	c.patterns = make([]*regexp.Regexp, len(patterns))
+	for i, pattern := range patterns {
+		re, err := regexp.Compile("(?is)" + pattern)
+		if err != nil {
+			return fmt.Errorf("invalid refusal pattern '%s': %w", pattern, err)
+		}
+		c.patterns[i] = re
+	}
+	return nil
+}
+
+// declined reports whether the response matches a refusal pattern.
+func (c *RefusalConfig) declined(response string) bool {
+	for _, re := range c.patterns {
+		if re.MatchString(response) {
+			return true
+		}
+	}
+	return false
+}
+
+// refusals is how the template detects refusals, nil when it doesn't.
+func (tc *TemplateConfig) refusals(config *Config, templateName string) *RefusalConfig {
+	refusals := &config.Refusals
+	if settings, ok := tc.Settings[templateName]; ok && settings.Refusals != nil {
+		refusals = settings.Refusals
+	}
+	if !refusals.Enabled {
+		return nil
+	}
+	return refusals
+}
+
+// followUpRequest is the request asking the model once more after its answer,
+// with text such as a retry prompt or a correction: as a user message after
+// the answer for chat, or after the prompt and the answer otherwise.
+func followUpRequest(ollamaRequest map[string]interface{}, chat bool, answer, text string) map[string]interface{} {
+	retry := make(map[string]interface{}, len(ollamaRequest))
+	for key, value := range ollamaRequest {
+		retry[key] = value
+	}
+	if chat {
+		messages, _ := ollamaRequest["messages"].([]map[string]interface{})
+		messages = append(append([]map[string]interface{}{}, messages...),
+			map[string]interface{}{"role": "assistant", "content": answer},
+			map[string]interface{}{"role": "user", "content": text})
+		retry["messages"] = messages
+	} else {
+		prompt, _ := ollamaRequest["prompt"].(string)
+		retry["prompt"] = prompt + "\n\nYour answer was:\n" + answer + "\n\n" + text
+	}
+	return retry
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFollowUpRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		request map[string]interface{}
+		chat    bool
+		want    map[string]interface{}
+	}{
+		{
+			"generate",
+			map[string]interface{}{"model": "llama3", "prompt": "Is the door locked?"},
+			false,
+			map[string]interface{}{"model": "llama3", "prompt": "Is the door locked?\n\nYour answer was:\nI can't say.\n\nAnswer again."},
+		},
+		{
+			"chat",
+			map[string]interface{}{"model": "llama3", "messages": []map[string]interface{}{{"role": "user", "content": "Is the door locked?"}}},
+			true,
+			map[string]interface{}{"model": "llama3", "messages": []map[string]interface{}{
+				{"role": "user", "content": "Is the door locked?"},
+				{"role": "assistant", "content": "I can't say."},
+				{"role": "user", "content": "Answer again."},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			original := map[string]interface{}{}
+			for key, value := range tt.request {
+				original[key] = value
+			}
+			got := followUpRequest(tt.request, tt.chat, "I can't say.", "Answer again.")
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("request = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(tt.request, original) {
+				t.Errorf("original request changed to %v", tt.request)
+			}
+		})
+	}
+}
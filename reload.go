@@ -0,0 +1,428 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ConfigStore holds the server configuration. Reloading swaps in a new Config,
+// so a request always sees one consistent configuration.
+type ConfigStore struct {
+	path    string
+	current atomic.Pointer[Config]
+	// address is the -addr flag, which overrides server_address
+	address string
+
+	// Serialises reloads
+	mu       sync.Mutex
+	onReload []func(*Config)
+}
+
+func newConfigStore(path, address string) (*ConfigStore, error) {
+	config, err := loadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	store := &ConfigStore{path: path, address: address}
+	store.override(config)
+	store.current.Store(config)
+	return store, nil
+}
+
+// override applies the command-line flags to a loaded config.
+func (s *ConfigStore) override(config *Config) {
+	if s.address != "" {
+		config.ServerAddress = s.address
+	}
+}
+
+func (s *ConfigStore) get() *Config {
+	return s.current.Load()
+}
+
+// reload re-reads the config file and swaps it in. Settings that are only
+// applied at startup keep their current values, and the names of those that
+// changed are returned so the caller can say a restart is needed.
+func (s *ConfigStore) reload() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reloadLocked()
+}
+
+func (s *ConfigStore) reloadLocked() ([]string, error) {
+	config, err := loadConfig(s.path)
+	if err != nil {
+		return nil, err
+	}
+	s.override(config)
+	previous := s.get()
+	restart := keepStartupSettings(previous, config)
+	s.current.Store(config)
+	slog.Info("Reloaded config", "path", s.path)
+	for _, name := range restart {
+		slog.Warn("Setting changed, restart to apply it", "setting", name, "path", s.path)
+	}
+	for _, fn := range s.onReload {
+		fn(config)
+	}
+	return restart, nil
+}
+
+// edit changes the config file, keeping the other fields as they are, and
+// reloads it. The file is put back if the edited config doesn't load.
+func (s *ConfigStore) edit(change func(raw map[string]json.RawMessage) error) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	original, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(original, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", s.path, err)
+	}
+	if err := change(raw); err != nil {
+		return nil, err
+	}
+	edited, err := json.MarshalIndent(raw, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(s.path, append(edited, '\n'), 0o600); err != nil {
+		return nil, err
+	}
+	restart, err := s.reloadLocked()
+	if err != nil {
+		if restoreErr := os.WriteFile(s.path, original, 0o600); restoreErr != nil {
+			slog.Error("Failed to restore config", "path", s.path, "error", restoreErr)
+		}
+		return nil, err
+	}
+	return restart, nil
+}
+
+// keepStartupSettings copies the settings that can't change at runtime, and the
+// runtime state, from the previous config into the reloaded one. It returns the
+// settings whose reloaded values were ignored.
+func keepStartupSettings(previous, config *Config) []string {
+	startup := []struct {
+		name              string
+		previous, current interface{}
+	}{
+		{"server_address", &previous.ServerAddress, &config.ServerAddress},
+		{"tls_cert", &previous.TLSCert, &config.TLSCert},
+		{"tls_key", &previous.TLSKey, &config.TLSKey},
+		{"autocert", &previous.Autocert, &config.Autocert},
+		{"watch_templates", &previous.WatchTemplates, &config.WatchTemplates},
+		{"job_retention", &previous.JobRetention, &config.JobRetention},
+		{"outputs", &previous.Outputs, &config.Outputs},
+		{"schedules", &previous.Schedules, &config.Schedules},
+		{"scheduling", &previous.Scheduling, &config.Scheduling},
+		{"webhooks", &previous.Webhooks, &config.Webhooks},
+		{"mqtt", &previous.MQTT, &config.MQTT},
+		{"signing", &previous.Signing, &config.Signing},
+		{"history", &previous.History, &config.History},
+		{"frigate", &previous.Frigate, &config.Frigate},
+		{"alerts", &previous.Alerts, &config.Alerts},
+		{"github", &previous.GitHub, &config.GitHub},
+		{"latency", &previous.Latency, &config.Latency},
+		{"cache.path", &previous.Cache.Path, &config.Cache.Path},
+		{"memory.path", &previous.Memory.Path, &config.Memory.Path},
+		{"logging.format", &previous.Logging.Format, &config.Logging.Format},
+		{"opentelemetry", &previous.OpenTelemetry, &config.OpenTelemetry},
+	}
+	var changed []string
+	for _, setting := range startup {
+		kept := reflect.ValueOf(setting.previous).Elem()
+		reloaded := reflect.ValueOf(setting.current).Elem()
+		if !reflect.DeepEqual(kept.Interface(), reloaded.Interface()) {
+			changed = append(changed, setting.name)
+			reloaded.Set(kept)
+		}
+	}
+
+	// Runtime state carries over, including flags toggled with /admin/flags,
+	// though flags config.json changed take the new value
+	if flags := previous.Flags.reload(config.Flags); len(flags) > 0 {
+		slog.Info("Feature flags changed by reload", "flags", flags)
+	}
+	config.Flags = previous.Flags
+	config.models = previous.models
+	config.latency = previous.latency
+	config.limits = previous.limits
+	config.metrics = previous.metrics
+	config.cache = previous.cache
+	config.balancer = previous.balancer
+	config.queues = previous.queues
+	config.pools = previous.pools
+	config.routeCache = previous.routeCache
+	config.coalescer = previous.coalescer
+	config.memory = previous.memory
+	config.Actions.approvals = previous.Actions.approvals
+	return changed
+}
+
+// liveHandler builds the handler for each request from the current config and
+// templates. Reloads apply to new requests, and requests already running
+// finish with the config and templates they started with.
+func liveHandler(configs *ConfigStore, templates *TemplateStore, build func(*Config, *TemplateConfig) http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		build(configs.get(), templates.get())(w, r)
+	}
+}
+
+// liveTemplateRoute serves prefix+name for every template, including those
+// added by a reload. Unknown names get 404, and disabled templates 503.
+func liveTemplateRoute(configs *ConfigStore, templates *TemplateStore, prefix string, build func(*Config, *TemplateConfig, string) http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		templateConfig := templates.get()
+		templateName := strings.TrimPrefix(r.URL.Path, prefix)
+		if _, ok := templateConfig.Templates[templateName]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if templateConfig.disabled(templateName) {
+			http.Error(w, fmt.Sprintf("Template '%s' is disabled", templateName), http.StatusServiceUnavailable)
+			return
+		}
+		r, templateConfig = templates.routeCanary(r, templateConfig, templateName)
+		build(configs.get(), templateConfig, templateName)(w, r)
+	}
+}
+
+// reloadAll reloads the config, then the templates.
+func reloadAll(configs *ConfigStore, templates *TemplateStore) ([]string, *TemplateConfig, error) {
+	restart, err := configs.reload()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to reload config: %w", err)
+	}
+	templateConfig, err := templates.reload()
+	if err != nil {
+		return restart, nil, fmt.Errorf("failed to reload templates: %w", err)
+	}
+	return restart, templateConfig, nil
+}
+
+// watchSignals reloads the config and templates on SIGHUP.
+func watchSignals(configs *ConfigStore, templates *TemplateStore) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			slog.Info("Received SIGHUP, reloading config and templates")
+			if _, _, err := reloadAll(configs, templates); err != nil {
+				slog.Error("Reload failed", "error", err)
+			}
+		}
+	}()
+}
+
+// saveState writes the response cache and conversations to their paths, for
+// the next process to load.
+func saveState(config *Config) {
+	if config.Cache.Path != "" {
+		if err := config.cache.save(config.Cache.Path); err != nil {
+			slog.Error("Failed to save the response cache", "error", err)
+		}
+	}
+	if config.Memory.Path != "" {
+		if err := config.memory.save(config.Memory.Path); err != nil {
+			slog.Error("Failed to save conversations", "error", err)
+		}
+	}
+}
+
+// watchShutdown saves the state when the server is stopped with SIGINT or
+// SIGTERM, which would otherwise lose up to a minute of it.
+func watchShutdown(config *Config) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		received := <-signals
+		slog.Info("Shutting down", "signal", received.String())
+		saveState(config)
+		os.Exit(0)
+	}()
+}
+
+// reloadHandler serves POST /admin/reload.
+func reloadHandler(configs *ConfigStore, templates *TemplateStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		restart, templateConfig, err := reloadAll(configs, templates)
+		if err != nil {
+			slog.Error("Reload failed", "error", err)
+			http.Error(w, "Reload failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if restart == nil {
+			restart = []string{}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"templates":        len(templateConfig.Templates),
+			"restart_required": restart,
+		})
+	}
+}
+
+// How often the templates directory is checked for changes with watch_templates
+const templateWatchInterval = 2 * time.Second
+
+// TemplateStore holds the loaded templates. Reloading swaps in a complete new
+// TemplateConfig, so a request always sees one consistent set of templates.
+type TemplateStore struct {
+	dir     string
+	current atomic.Pointer[TemplateConfig]
+
+	// Serialises reloads
+	mu       sync.Mutex
+	onReload []func(*TemplateConfig)
+
+	// Serialises changes made through /admin/templates
+	edit     sync.Mutex
+	canaries canaries
+}
+
+func newTemplateStore(dir string) (*TemplateStore, error) {
+	templateConfig, err := loadAndCacheTemplates(dir)
+	if err != nil {
+		return nil, err
+	}
+	store := &TemplateStore{dir: dir}
+	store.current.Store(templateConfig)
+	return store, nil
+}
+
+func (s *TemplateStore) get() *TemplateConfig {
+	return s.current.Load()
+}
+
+// reload re-reads the templates directory and swaps in the result. Requests
+// already running finish with the templates they started with.
+func (s *TemplateStore) reload() (*TemplateConfig, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	templateConfig, err := loadAndCacheTemplates(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	previous := s.current.Swap(templateConfig)
+	added, removed := templateChanges(previous, templateConfig)
+	slog.Info("Reloaded templates", "count", len(templateConfig.Templates), "path", s.dir, "added", listOrNone(added), "removed", listOrNone(removed))
+	for _, fn := range s.onReload {
+		fn(templateConfig)
+	}
+	return templateConfig, nil
+}
+
+// watchFiles polls the templates directory and reloads when a file is added,
+// removed or modified.
+func (s *TemplateStore) watchFiles() {
+	last, err := templateDirState(s.dir)
+	if err != nil {
+		slog.Error("Failed to watch templates directory", "path", s.dir, "error", err)
+		return
+	}
+	go func() {
+		for range time.Tick(templateWatchInterval) {
+			state, err := templateDirState(s.dir)
+			if err != nil || state == last {
+				continue
+			}
+			last = state
+			if _, err := s.reload(); err != nil {
+				slog.Error("Failed to reload templates", "error", err)
+			}
+		}
+	}()
+}
+
+// templateDirState summarises the names, sizes and modification times of the
+// files in the templates directory.
+func templateDirState(dir string) (string, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	var state strings.Builder
+	for _, file := range files {
+		if filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(&state, "%s %d %d\n", file.Name(), info.Size(), info.ModTime().UnixNano())
+	}
+	return state.String(), nil
+}
+
+func templateChanges(previous, current *TemplateConfig) (added, removed []string) {
+	for name := range current.Templates {
+		if _, ok := previous.Templates[name]; !ok {
+			added = append(added, name)
+		}
+	}
+	for name := range previous.Templates {
+		if _, ok := current.Templates[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+func listOrNone(names []string) string {
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
+
+// checkTemplateReferences warns about configured features whose template no
+// longer exists after a reload. They fail until the template is restored.
+func checkTemplateReferences(config *Config, templateConfig *TemplateConfig) {
+	references := map[string]string{}
+	for _, sc := range config.Schedules {
+		references["schedule '"+sc.Name+"'"] = sc.Template
+	}
+	for _, wc := range config.Webhooks {
+		references["webhook '"+wc.Name+"'"] = wc.Template
+	}
+	for event, templateName := range config.GitHub.Templates {
+		references["github "+event] = templateName
+	}
+	if config.Frigate.URL != "" {
+		references["frigate"] = config.Frigate.Template
+	}
+	if config.Alerts.Template != "" {
+		references["alerts"] = config.Alerts.Template
+	}
+	if config.Conversation.Template != "" {
+		references["conversation"] = config.Conversation.Template
+	}
+	for user, templateName := range references {
+		if _, ok := templateConfig.Templates[templateName]; !ok {
+			slog.Warn("Missing template is still in use", "user", user, "template", templateName)
+		}
+	}
+}
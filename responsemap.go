@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// checkResponseMap checks the targets of a template's response_map. A target
+// is a field name, a dotted path such as stats.eval_count to nest the field,
+// or empty to drop it.
+func (s *TemplateSettings) checkResponseMap() error {
+	for field, target := range s.ResponseMap {
+		if target == "" {
+			continue
+		}
+		for _, part := range strings.Split(target, ".") {
+			if part == "" {
+				return fmt.Errorf("invalid response_map target '%s' for field %s", target, field)
+			}
+		}
+	}
+	return nil
+}
+
+// mapResponse renames and nests the fields of a template's response as its
+// response_map says, so the JSON matches what the client already expects.
+// Fields that aren't mapped keep their names. The response is not modified.
+func (tc *TemplateConfig) mapResponse(templateName string, response map[string]interface{}) map[string]interface{} {
+	settings, ok := tc.Settings[templateName]
+	if !ok || len(settings.ResponseMap) == 0 || response == nil {
+		return response
+	}
+	mapped := make(map[string]interface{}, len(response))
+	for _, field := range sortedKeys(response) {
+		target, ok := settings.ResponseMap[field]
+		if !ok {
+			target = field
+		}
+		if target == "" {
+			continue
+		}
+		setPath(mapped, strings.Split(target, "."), response[field])
+	}
+	return mapped
+}
+
+// setPath sets the value at a path of nested objects, creating them as needed.
+func setPath(object map[string]interface{}, path []string, value interface{}) {
+	for _, key := range path[:len(path)-1] {
+		child, ok := object[key].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			object[key] = child
+		}
+		object = child
+	}
+	object[path[len(path)-1]] = value
+}
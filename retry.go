@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// RetryConfig retries generations that fail for transient reasons: the
+// backend refusing or dropping the connection, or answering with a 5xx.
+// Attempts is how many times to retry after the first try. The delay between
+// retries doubles from InitialDelayMS up to MaxDelayMS.
+type RetryConfig struct {
+	Attempts       int `json:"attempts"`
+	InitialDelayMS int `json:"initial_delay_ms"`
+	MaxDelayMS     int `json:"max_delay_ms"`
+}
+
+// delay is how long to wait before the retry after the given number of tries.
+func (c RetryConfig) delay(tries int) time.Duration {
+	delay := 500 * time.Millisecond
+	if c.InitialDelayMS > 0 {
+		delay = time.Duration(c.InitialDelayMS) * time.Millisecond
+	}
+	maxDelay := 10 * time.Second
+	if c.MaxDelayMS > 0 {
+		maxDelay = time.Duration(c.MaxDelayMS) * time.Millisecond
+	}
+	for i := 1; i < tries && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxDelay)
+}
+
+// upstreamStatusError is a response from the Ollama API other than 200 OK.
+type upstreamStatusError struct {
+	status int
+	msg    string
+}
+
+func (e *upstreamStatusError) Error() string {
+	return e.msg
+}
+
+// transientError reports whether a failed request is worth retrying, or
+// sending to another backend: the connection failed or the backend had a
+// server error.
+func transientError(err error) bool {
+	var statusErr *upstreamStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.status >= http.StatusInternalServerError
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// failoverBackend is the config with a failover URL in place of api_url.
+func failoverBackend(config *Config, baseURL string) *Config {
+	backend := *config
+	backend.APIURL = ollamaEndpoint(&Config{APIURL: baseURL}, "/api/generate")
+	return &backend
+}
+
+// postOllamaFailover sends the request to api_url, or the server of api_urls
+// the balancer picks, and when it fails for a transient reason to each of the
+// other servers and then the failover URLs in turn. A server of api_urls that
+// fails is marked down until it passes a health check. When every backend
+// has failed it starts over after a backoff, up to the retry attempts. Once
+// tokens have been passed to onChunk the request is never retried, as the
+// client already has part of the answer.
+func postOllamaFailover(ctx context.Context, config *Config, path string, ollamaRequest map[string]interface{}, onChunk func(string), hedgeAfter time.Duration) (map[string]interface{}, error) {
+	// With api_urls the balancer chooses the order of the servers. balanced
+	// holds the api_urls entry of each backend, empty for the others
+	backends := []*Config{config}
+	balanced := []string{""}
+	if len(config.APIURLs) > 0 {
+		backends, balanced = nil, nil
+		for _, url := range config.balancer.order(config) {
+			backends = append(backends, failoverBackend(config, url))
+			balanced = append(balanced, url)
+		}
+	}
+	for _, url := range config.FailoverURLs {
+		backends = append(backends, failoverBackend(config, url))
+		balanced = append(balanced, "")
+	}
+	streamed := false
+	if onChunk != nil {
+		forward := onChunk
+		onChunk = func(chunk string) {
+			streamed = true
+			forward(chunk)
+		}
+	}
+
+	for tries := 1; ; tries++ {
+		var err error
+		for i, backend := range backends {
+			var response map[string]interface{}
+			if balanced[i] != "" {
+				release := config.balancer.acquire(balanced[i])
+				response, err = postOllamaHedged(ctx, backend, path, ollamaRequest, onChunk, hedgeAfter)
+				release()
+				if err != nil && ctx.Err() == nil && transientError(err) {
+					config.balancer.setDown(balanced[i], true)
+				}
+			} else {
+				response, err = postOllamaHedged(ctx, backend, path, ollamaRequest, onChunk, hedgeAfter)
+			}
+			if err == nil {
+				return response, nil
+			}
+			if streamed || ctx.Err() != nil || !transientError(err) {
+				return nil, err
+			}
+			if i+1 < len(backends) {
+				slog.Warn("Ollama API failed, failing over", "url", backendURL(backend, path), "next_url", backendURL(backends[i+1], path), "error", err)
+			}
+		}
+		if tries > config.Retry.Attempts {
+			return nil, err
+		}
+
+		delay := config.Retry.delay(tries)
+		slog.Warn("Ollama API failed, retrying", "delay", delay, "try", tries, "attempts", config.Retry.Attempts, "error", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w (after %d tries)", err, tries)
+		}
+	}
+}
+
+// postChat sends a chat request that isn't made by a template, such as one
+// from the Anthropic or Ollama APIs, the way template requests are sent:
+// through the balancer, failover and retries, hedged after hedge.after_ms,
+// and answered from the response cache within cache.ttl. A cached response
+// streams as a single chunk.
+func postChat(ctx context.Context, config *Config, source string, ollamaRequest map[string]interface{}, onChunk func(string)) (map[string]interface{}, error) {
+	var key string
+	if config.Cache.ttl > 0 && config.Flags.Enabled(flagCaching) {
+		key = responseCacheKey(source, "", ollamaRequest)
+		if response, ok := config.cache.get(key); ok {
+			if stats := generationStats(ctx); stats != nil {
+				stats.Cached = true
+			}
+			if onChunk != nil {
+				onChunk(responseContent(response, true))
+			}
+			return response, nil
+		}
+	}
+	response, err := postOllamaFailover(ctx, config, "/api/chat", ollamaRequest, onChunk, config.Hedge.after())
+	if err != nil {
+		return nil, err
+	}
+	if key != "" {
+		config.cache.put(key, response, config.Cache.ttl, config.Cache.MaxEntries)
+	}
+	return response, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testConfig loads a config.json holding the fields of configJSON, with a
+// request timeout.
+func testConfig(t *testing.T, configJSON string) *Config {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	configJSON = `{"config_version": 2, "request_timeout": 10, ` + strings.TrimPrefix(configJSON, "{")
+	if err := os.WriteFile(path, []byte(configJSON), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+// fakeOllama is an Ollama server answering chat requests with answer, or with
+// status when it isn't 200. It counts the requests it gets.
+func fakeOllama(t *testing.T, status int, answer string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if status != http.StatusOK {
+			http.Error(w, `{"error":"failed"}`, status)
+			return
+		}
+		var request map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&request)
+		done := map[string]interface{}{"model": request["model"], "done": true, "done_reason": "stop",
+			"message": map[string]string{"role": "assistant", "content": answer}}
+		if stream, _ := request["stream"].(bool); stream {
+			for _, word := range strings.SplitAfter(answer, " ") {
+				json.NewEncoder(w).Encode(map[string]interface{}{"model": request["model"], "done": false,
+					"message": map[string]string{"role": "assistant", "content": word}})
+			}
+			done["message"] = map[string]string{"role": "assistant", "content": ""}
+		}
+		json.NewEncoder(w).Encode(done)
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		name   string
+		config RetryConfig
+		tries  int
+		want   time.Duration
+	}{
+		{"default first", RetryConfig{}, 1, 500 * time.Millisecond},
+		{"default doubles", RetryConfig{}, 3, 2 * time.Second},
+		{"initial delay", RetryConfig{InitialDelayMS: 100}, 2, 200 * time.Millisecond},
+		{"capped", RetryConfig{InitialDelayMS: 100, MaxDelayMS: 300}, 5, 300 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config.delay(tt.tries); got != tt.want {
+				t.Errorf("delay(%d) = %v, want %v", tt.tries, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPostChatFailsOver(t *testing.T) {
+	down, downCalls := fakeOllama(t, http.StatusServiceUnavailable, "")
+	up, upCalls := fakeOllama(t, http.StatusOK, "the lights are off")
+	request := map[string]interface{}{"model": "llama3", "messages": []interface{}{map[string]string{"role": "user", "content": "lights?"}}}
+
+	tests := []struct {
+		name   string
+		stream bool
+	}{
+		{"plain", false},
+		{"streamed", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig(t, `{"api_url": "`+down.URL+`/api/generate", "failover_urls": ["`+up.URL+`"]}`)
+			downCalls.Store(0)
+			upCalls.Store(0)
+			var streamed strings.Builder
+			var onChunk func(string)
+			if tt.stream {
+				onChunk = func(chunk string) { streamed.WriteString(chunk) }
+			}
+			response, err := postChat(context.Background(), config, "test", request, onChunk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.stream && streamed.String() != "the lights are off" {
+				t.Errorf("streamed %q", streamed.String())
+			}
+			if !tt.stream && responseContent(response, true) != "the lights are off" {
+				t.Errorf("response = %v", response)
+			}
+			if downCalls.Load() != 1 || upCalls.Load() != 1 {
+				t.Errorf("calls = %d down, %d up, want 1 each", downCalls.Load(), upCalls.Load())
+			}
+		})
+	}
+}
+
+func TestPostChatBalances(t *testing.T) {
+	first, firstCalls := fakeOllama(t, http.StatusOK, "one")
+	second, secondCalls := fakeOllama(t, http.StatusOK, "two")
+	config := testConfig(t, `{"api_urls": ["`+first.URL+`", "`+second.URL+`"]}`)
+	request := map[string]interface{}{"model": "llama3", "messages": []interface{}{}}
+	for i := 0; i < 4; i++ {
+		if _, err := postChat(context.Background(), config, "test", request, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if firstCalls.Load() != 2 || secondCalls.Load() != 2 {
+		t.Errorf("calls = %d and %d, want 2 each", firstCalls.Load(), secondCalls.Load())
+	}
+}
+
+func TestPostChatCache(t *testing.T) {
+	server, calls := fakeOllama(t, http.StatusOK, "it's sunny")
+	config := testConfig(t, `{"api_url": "`+server.URL+`/api/generate", "cache": {"ttl": "1m"}}`)
+	request := map[string]interface{}{"model": "llama3", "messages": []interface{}{map[string]string{"role": "user", "content": "weather?"}}}
+
+	if _, err := postChat(context.Background(), config, "test", request, nil); err != nil {
+		t.Fatal(err)
+	}
+	var streamed string
+	if _, err := postChat(context.Background(), config, "test", request, func(chunk string) { streamed += chunk }); err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("backend called %d times, want 1", calls.Load())
+	}
+	if streamed != "it's sunny" {
+		t.Errorf("cached response streamed %q", streamed)
+	}
+	if _, err := postChat(context.Background(), config, "other", request, nil); err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("other sources share the cache: backend called %d times, want 2", calls.Load())
+	}
+}
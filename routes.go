@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Middleware a route can list
+const (
+	middlewareLog       = "log"
+	middlewareAuth      = "auth"
+	middlewareRateLimit = "rate_limit"
+	middlewareCache     = "cache"
+)
+
+// RouteConfig replaces the middleware of the routes under a path with
+// Middleware, run in the order listed: "log" logs the request, "auth" requires
+// the auth_token, "rate_limit" allows RateLimit requests to the route and
+// "cache" serves repeated GET requests from memory for CacheTTL, to callers
+// with the same token. Leaving out "auth" makes the route public. Paths ending
+// in / cover every route under them, and the longest one applies. Admin routes
+// still require the admin token, and are never cached.
+type RouteConfig struct {
+	Middleware []string         `json:"middleware"`
+	RateLimit  *RateLimitConfig `json:"rate_limit"`
+	CacheTTL   string           `json:"cache_ttl"`
+
+	cacheTTL time.Duration
+}
+
+func (c *RouteConfig) parse(path string) error {
+	seen := make(map[string]bool)
+	for _, name := range c.Middleware {
+		switch name {
+		case middlewareLog, middlewareAuth, middlewareRateLimit, middlewareCache:
+		default:
+			return fmt.Errorf("route '%s' has unknown middleware '%s'", path, name)
+		}
+		if seen[name] {
+			return fmt.Errorf("route '%s' lists middleware '%s' twice", path, name)
+		}
+		seen[name] = true
+	}
+	if seen[middlewareRateLimit] {
+		if c.RateLimit == nil {
+			return fmt.Errorf("route '%s' needs a rate_limit for its rate_limit middleware", path)
+		}
+		if err := c.RateLimit.parse(); err != nil {
+			return fmt.Errorf("route '%s': %w", path, err)
+		}
+	}
+	if seen[middlewareCache] {
+		// Admin handlers check their token themselves, after the cache
+		if isAdminPath(path) {
+			return fmt.Errorf("route '%s' can't use the cache middleware on admin routes", path)
+		}
+		if !seen[middlewareAuth] || slices.Index(c.Middleware, middlewareAuth) > slices.Index(c.Middleware, middlewareCache) {
+			return fmt.Errorf("route '%s' needs auth before its cache middleware", path)
+		}
+		ttl, err := time.ParseDuration(c.CacheTTL)
+		if err != nil || ttl <= 0 {
+			return fmt.Errorf("route '%s' needs a positive cache_ttl for its cache middleware", path)
+		}
+		c.cacheTTL = ttl
+	}
+	return nil
+}
+
+// isAdminPath reports whether a path is, or covers, the admin routes.
+func isAdminPath(path string) bool {
+	return path == "/" || path == "/admin" || strings.HasPrefix(path, "/admin/")
+}
+
+// route finds the route config covering the path, returning the path it was
+// given for.
+func (c *Config) route(path string) (string, *RouteConfig) {
+	if route, ok := c.Routes[path]; ok {
+		return path, route
+	}
+	var pattern string
+	var found *RouteConfig
+	for prefix, route := range c.Routes {
+		if strings.HasSuffix(prefix, "/") && strings.HasPrefix(path, prefix) && len(prefix) > len(pattern) {
+			pattern, found = prefix, route
+		}
+	}
+	return pattern, found
+}
+
+type routeAuthKey struct{}
+
+// routeChecksAuth reports whether the request's route middleware decides
+// about the auth token, instead of the handler.
+func routeChecksAuth(ctx context.Context) bool {
+	checks, _ := ctx.Value(routeAuthKey{}).(bool)
+	return checks
+}
+
+// routeMiddleware runs each request through the middleware its route lists.
+// Routes without any are logged, and their handlers check the auth token.
+func routeMiddleware(configs *ConfigStore, next http.Handler) http.Handler {
+	logged := logRequests(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := configs.get()
+		pattern, route := config.route(r.URL.Path)
+		if route == nil {
+			logged.ServeHTTP(w, r)
+			return
+		}
+		handler := next
+		for i := len(route.Middleware) - 1; i >= 0; i-- {
+			switch route.Middleware[i] {
+			case middlewareLog:
+				handler = logRequests(handler)
+			case middlewareAuth:
+				handler = requireToken(config, handler.ServeHTTP)
+			case middlewareRateLimit:
+				handler = limitRoute(config, pattern, route.RateLimit, handler)
+			case middlewareCache:
+				// A route such as / also covers the admin routes
+				if !isAdminPath(r.URL.Path) && config.Flags.Enabled(flagCaching) {
+					handler = config.routeCache.serve(route.cacheTTL, handler)
+				}
+			}
+		}
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), routeAuthKey{}, true)))
+	})
+}
+
+// limitRoute rejects requests beyond the route's rate limit with 429.
+func limitRoute(config *Config, pattern string, limit *RateLimitConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if wait := config.limits.reserve("route "+pattern, limit, 0); wait > 0 {
+			slog.Warn("Route rate limited", "path", r.URL.Path, "route", pattern, "retry_after", wait.Round(time.Second), "request_id", requestID(r.Context()))
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, fmt.Sprintf("route %s is rate limited", pattern), http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RouteCache keeps the responses of routes with the cache middleware. It lives
+// as long as the server, so reloads don't empty it.
+type RouteCache struct {
+	mu      sync.Mutex
+	entries map[string]routeCacheEntry
+}
+
+type routeCacheEntry struct {
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+func newRouteCache() *RouteCache {
+	return &RouteCache{entries: make(map[string]routeCacheEntry)}
+}
+
+// serve answers GET requests from a successful response to the same URL, for
+// the same Authorization header, less than ttl ago, and keeps the successful
+// responses of the others. Streamed responses aren't kept.
+func (c *RouteCache) serve(ttl time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token := sha256.Sum256([]byte(r.Header.Get("Authorization")))
+		key := r.URL.RequestURI() + " " + hex.EncodeToString(token[:])
+		c.mu.Lock()
+		entry, ok := c.entries[key]
+		c.mu.Unlock()
+		if ok && time.Now().Before(entry.expires) {
+			maps.Copy(w.Header(), entry.header)
+			w.Write(entry.body)
+			return
+		}
+
+		recorder := &cacheRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		if (recorder.status != http.StatusOK && recorder.status != 0) || recorder.streamed {
+			return
+		}
+		now := time.Now()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for key, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+		header := w.Header().Clone()
+		header.Del(requestIDHeader)
+		c.entries[key] = routeCacheEntry{header: header, body: recorder.body.Bytes(), expires: now.Add(ttl)}
+	})
+}
+
+// cacheRecorder keeps a copy of the response it writes, until it's flushed
+// as a stream.
+type cacheRecorder struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	streamed bool
+}
+
+func (r *cacheRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *cacheRecorder) Write(data []byte) (int, error) {
+	if !r.streamed {
+		r.body.Write(data)
+	}
+	return r.ResponseWriter.Write(data)
+}
+
+// Flush passes a stream through, and stops keeping a copy of it.
+func (r *cacheRecorder) Flush() {
+	r.streamed = true
+	r.body = bytes.Buffer{}
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRouteConfigParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		route   RouteConfig
+		wantErr string
+	}{
+		{"auth then cache", "/v1/models", RouteConfig{Middleware: []string{"log", "auth", "cache"}, CacheTTL: "30s"}, ""},
+		{"cache without auth", "/v1/models", RouteConfig{Middleware: []string{"cache"}, CacheTTL: "30s"}, "needs auth before"},
+		{"cache before auth", "/template/", RouteConfig{Middleware: []string{"cache", "auth"}, CacheTTL: "30s"}, "needs auth before"},
+		{"cache on admin", "/admin/", RouteConfig{Middleware: []string{"auth", "cache"}, CacheTTL: "30s"}, "admin routes"},
+		{"cache on root", "/", RouteConfig{Middleware: []string{"auth", "cache"}, CacheTTL: "30s"}, "admin routes"},
+		{"cache without ttl", "/v1/models", RouteConfig{Middleware: []string{"auth", "cache"}}, "cache_ttl"},
+		{"unknown middleware", "/templates", RouteConfig{Middleware: []string{"gzip"}}, "unknown middleware"},
+		{"twice", "/templates", RouteConfig{Middleware: []string{"log", "log"}}, "twice"},
+		{"rate limit without limit", "/templates", RouteConfig{Middleware: []string{"rate_limit"}}, "needs a rate_limit"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.route.parse(tt.path)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("parse() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("parse() = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRouteCacheServe(t *testing.T) {
+	calls := 0
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte("answer for " + r.Header.Get("Authorization")))
+	})
+	handler := newRouteCache().serve(time.Minute, next)
+
+	tests := []struct {
+		name      string
+		method    string
+		token     string
+		wantBody  string
+		wantCalls int
+	}{
+		{"first request", http.MethodGet, "Bearer a", "answer for Bearer a", 1},
+		{"same token is cached", http.MethodGet, "Bearer a", "answer for Bearer a", 1},
+		{"other token isn't served the cached answer", http.MethodGet, "Bearer b", "answer for Bearer b", 2},
+		{"no token", http.MethodGet, "", "answer for ", 3},
+		{"POST isn't cached", http.MethodPost, "Bearer a", "answer for Bearer a", 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/v1/models", nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", tt.token)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", w.Body.String(), tt.wantBody)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("handler called %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRouteCacheSkipsStreams(t *testing.T) {
+	calls := 0
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			t.Fatal("cached route doesn't support streaming")
+		}
+		w.Write([]byte("data: 1\n\n"))
+		flusher.Flush()
+		w.Write([]byte("data: 2\n\n"))
+	})
+	handler := newRouteCache().serve(time.Minute, next)
+	for i := 1; i <= 2; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/jobs/1/stream", nil))
+		if w.Body.String() != "data: 1\n\ndata: 2\n\n" {
+			t.Errorf("body = %q", w.Body.String())
+		}
+		if !w.Flushed {
+			t.Error("stream wasn't flushed")
+		}
+		if calls != i {
+			t.Errorf("handler called %d times, want %d: streams shouldn't be cached", calls, i)
+		}
+	}
+}
+
+func TestRouteMiddlewareNeverCachesAdmin(t *testing.T) {
+	config := &Config{
+		AuthToken:  "tok",
+		Routes:     map[string]*RouteConfig{"/": {Middleware: []string{"auth", "cache"}, cacheTTL: time.Minute}},
+		routeCache: newRouteCache(),
+	}
+	store := &ConfigStore{}
+	store.current.Store(config)
+
+	calls := 0
+	handler := routeMiddleware(store, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte("ok"))
+	}))
+	for i := 1; i <= 2; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/admin/history", nil)
+		r.Header.Set("Authorization", "Bearer tok")
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		if calls != i {
+			t.Fatalf("admin handler called %d times, want %d", calls, i)
+		}
+	}
+}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ScheduleConfig runs a template on a timer and delivers the result to outputs.
+// Either every (a duration such as "30m") or at (a daily "HH:MM" time, optionally
+// limited to certain days of the week) must be set.
+type ScheduleConfig struct {
+	Name     string   `json:"name"`
+	Template string   `json:"template"`
+	Query    string   `json:"query"`
+	Model    string   `json:"model"`
+	Every    string   `json:"every"`
+	At       string   `json:"at"`
+	Days     []string `json:"days"`
+	Outputs  []string `json:"outputs"`
+	// Inputs are other request fields for the template, such as url or log
+	Inputs map[string]interface{} `json:"inputs"`
+	// Jitter delays each run by a random duration up to this long
+	Jitter string `json:"jitter"`
+	// OnMissed is "skip" (the default) or "run" to run once at startup if a
+	// run was missed while the server was down
+	OnMissed string `json:"on_missed"`
+}
+
+// Policies for runs missed while the server was down
+const (
+	missedSkip = "skip"
+	missedRun  = "run"
+)
+
+// SchedulingConfig applies to every schedule. StatePath keeps when each
+// schedule last ran, so missed runs can be caught up after a restart.
+type SchedulingConfig struct {
+	MaxConcurrent int    `json:"max_concurrent"`
+	StatePath     string `json:"state_path"`
+}
+
+type schedule struct {
+	config ScheduleConfig
+	every  time.Duration
+	hour   int
+	minute int
+	days   map[time.Weekday]bool
+	jitter time.Duration
+
+	// Runtime state, shown and changed through /admin/schedules
+	mu      sync.Mutex
+	nextRun time.Time
+	lastRun time.Time
+	paused  bool
+}
+
+type Scheduler struct {
+	configs   *ConfigStore
+	templates *TemplateStore
+	outputs   *Outputs
+	history   *History
+	schedules []*schedule
+
+	// Limits runs at once to scheduling.max_concurrent, nil for no limit
+	slots chan struct{}
+	// Serialises writes of the state file
+	stateMu sync.Mutex
+	// Closed by stop, ending every schedule's loop
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+func newScheduler(configs *ConfigStore, templates *TemplateStore, outputs *Outputs, history *History) (*Scheduler, error) {
+	scheduler := &Scheduler{configs: configs, templates: templates, outputs: outputs, history: history, stopped: make(chan struct{})}
+
+	for _, sc := range configs.get().Schedules {
+		s, err := parseSchedule(sc)
+		if err != nil {
+			return nil, fmt.Errorf("schedule '%s': %w", sc.Name, err)
+		}
+		if _, ok := templates.get().Templates[sc.Template]; !ok {
+			return nil, fmt.Errorf("schedule '%s': unknown template '%s'", sc.Name, sc.Template)
+		}
+		for _, name := range sc.Outputs {
+			if !outputs.has(name) {
+				return nil, fmt.Errorf("schedule '%s': unknown output '%s'", sc.Name, name)
+			}
+		}
+		if sc.OnMissed == missedRun && configs.get().Scheduling.StatePath == "" {
+			return nil, fmt.Errorf("schedule '%s': on_missed '%s' requires scheduling.state_path", sc.Name, missedRun)
+		}
+		scheduler.schedules = append(scheduler.schedules, s)
+	}
+
+	scheduling := configs.get().Scheduling
+	if scheduling.MaxConcurrent > 0 {
+		scheduler.slots = make(chan struct{}, scheduling.MaxConcurrent)
+	}
+	if err := scheduler.loadState(scheduling.StatePath); err != nil {
+		return nil, fmt.Errorf("failed to load schedule state: %w", err)
+	}
+	return scheduler, nil
+}
+
+// loadState reads when each schedule last ran from the state file, if there
+// is one.
+func (s *Scheduler) loadState(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var lastRuns map[string]time.Time
+	if err := json.Unmarshal(data, &lastRuns); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for _, sched := range s.schedules {
+		sched.lastRun = lastRuns[sched.config.Name]
+	}
+	return nil
+}
+
+// saveState writes when each schedule last ran to the state file.
+func (s *Scheduler) saveState() {
+	path := s.configs.get().Scheduling.StatePath
+	if path == "" {
+		return
+	}
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	lastRuns := make(map[string]time.Time, len(s.schedules))
+	for _, sched := range s.schedules {
+		sched.mu.Lock()
+		if !sched.lastRun.IsZero() {
+			lastRuns[sched.config.Name] = sched.lastRun
+		}
+		sched.mu.Unlock()
+	}
+	data, _ := json.MarshalIndent(lastRuns, "", "  ")
+	if err := writeFileAtomic(path, data); err != nil {
+		slog.Error("Failed to save schedule state", "path", path, "error", err)
+	}
+}
+
+func parseSchedule(sc ScheduleConfig) (*schedule, error) {
+	if sc.Name == "" {
+		return nil, fmt.Errorf("schedules require a name")
+	}
+
+	s := &schedule{config: sc}
+	switch {
+	case sc.Every != "" && sc.At != "":
+		return nil, fmt.Errorf("only one of 'every' and 'at' may be set")
+	case sc.Every != "":
+		every, err := time.ParseDuration(sc.Every)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'every' duration: %w", err)
+		}
+		if every < time.Minute {
+			return nil, fmt.Errorf("'every' must be at least one minute")
+		}
+		s.every = every
+	case sc.At != "":
+		at, err := time.Parse("15:04", sc.At)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'at' time, expected HH:MM: %w", err)
+		}
+		s.hour, s.minute = at.Hour(), at.Minute()
+	default:
+		return nil, fmt.Errorf("one of 'every' or 'at' must be set")
+	}
+
+	if sc.Jitter != "" {
+		jitter, err := time.ParseDuration(sc.Jitter)
+		if err != nil || jitter < 0 {
+			return nil, fmt.Errorf("invalid 'jitter' duration '%s'", sc.Jitter)
+		}
+		if s.every > 0 && jitter >= s.every {
+			return nil, fmt.Errorf("'jitter' must be shorter than 'every'")
+		}
+		s.jitter = jitter
+	}
+	switch sc.OnMissed {
+	case "", missedSkip, missedRun:
+	default:
+		return nil, fmt.Errorf("unknown on_missed policy '%s', expected %s or %s", sc.OnMissed, missedSkip, missedRun)
+	}
+
+	if len(sc.Days) > 0 {
+		if sc.At == "" {
+			return nil, fmt.Errorf("'days' can only be used with 'at'")
+		}
+		s.days = make(map[time.Weekday]bool)
+		for _, day := range sc.Days {
+			weekday, ok := weekdays[strings.ToLower(day)]
+			if !ok {
+				return nil, fmt.Errorf("unknown day '%s'", day)
+			}
+			s.days[weekday] = true
+		}
+	}
+
+	return s, nil
+}
+
+// next returns the first run time strictly after the given time.
+func (s *schedule) next(after time.Time) time.Time {
+	if s.every > 0 {
+		return after.Add(s.every)
+	}
+
+	for i := 0; i <= 7; i++ {
+		day := after.AddDate(0, 0, i)
+		candidate := time.Date(day.Year(), day.Month(), day.Day(), s.hour, s.minute, 0, 0, after.Location())
+		if !candidate.After(after) {
+			continue
+		}
+		if s.days != nil && !s.days[candidate.Weekday()] {
+			continue
+		}
+		return candidate
+	}
+
+	// Unreachable with a valid schedule, but never spin if it happens
+	return after.Add(24 * time.Hour)
+}
+
+func (s *Scheduler) start() {
+	for _, sched := range s.schedules {
+		go s.loop(sched)
+	}
+}
+
+// stop ends the schedules' loops, so that after a zero-downtime restart only
+// the new process runs them. Runs already in progress finish.
+func (s *Scheduler) stop() {
+	s.stopOnce.Do(func() {
+		slog.Info("Stopping schedules")
+		close(s.stopped)
+	})
+}
+
+func (s *Scheduler) loop(sched *schedule) {
+	sched.mu.Lock()
+	lastRun := sched.lastRun
+	sched.mu.Unlock()
+	if sched.config.OnMissed == missedRun && !lastRun.IsZero() && !sched.next(lastRun).After(time.Now()) {
+		slog.Info("Schedule missed a run, running it now", "schedule", sched.config.Name, "missed", sched.next(lastRun))
+		s.run(sched)
+	}
+
+	slot := time.Now()
+	for {
+		slot = sched.nextSlot(slot, time.Now())
+		next := slot.Add(sched.randomJitter())
+		sched.mu.Lock()
+		sched.nextRun = next
+		sched.mu.Unlock()
+		slog.Info("Schedule next runs", "schedule", sched.config.Name, "at", next)
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case <-s.stopped:
+			timer.Stop()
+			return
+		}
+
+		sched.mu.Lock()
+		paused := sched.paused
+		sched.mu.Unlock()
+		if paused {
+			slog.Info("Skipping paused schedule", "schedule", sched.config.Name)
+			continue
+		}
+		s.run(sched)
+	}
+}
+
+// nextSlot is the first run time after last that is still to come. Slots
+// follow each other rather than the end of a run, so neither jitter nor a
+// run's duration moves later runs, and slots a long run overlapped are
+// skipped.
+func (sched *schedule) nextSlot(last, now time.Time) time.Time {
+	slot := sched.next(last)
+	for !slot.After(now) {
+		slot = sched.next(slot)
+	}
+	return slot
+}
+
+// randomJitter is a random delay up to the schedule's jitter.
+func (sched *schedule) randomJitter() time.Duration {
+	if sched.jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(sched.jitter)))
+}
+
+// upcoming returns the schedule's next count run times, none while it is
+// paused.
+func (sched *schedule) upcoming(count int) []time.Time {
+	sched.mu.Lock()
+	next, paused := sched.nextRun, sched.paused
+	sched.mu.Unlock()
+	if paused {
+		return []time.Time{}
+	}
+	if next.IsZero() {
+		next = sched.next(time.Now())
+	}
+	runs := []time.Time{next}
+	for len(runs) < count {
+		runs = append(runs, sched.next(runs[len(runs)-1]))
+	}
+	return runs
+}
+
+// errSchedulesDisabled is returned for runs while the schedules feature flag
+// is off.
+var errSchedulesDisabled = errors.New("schedules are disabled by feature flag")
+
+// run generates the schedule's response and delivers it to the schedule's
+// outputs.
+func (s *Scheduler) run(sched *schedule) (map[string]interface{}, error) {
+	sc := sched.config
+	config := s.configs.get()
+	if !config.Flags.Enabled(flagSchedules) {
+		slog.Info("Skipping schedule, schedules are disabled by feature flag", "schedule", sc.Name)
+		return nil, errSchedulesDisabled
+	}
+	if s.slots != nil {
+		select {
+		case s.slots <- struct{}{}:
+		default:
+			slog.Info("Schedule is waiting for other scheduled runs", "schedule", sc.Name, "running", cap(s.slots))
+			s.slots <- struct{}{}
+		}
+		defer func() { <-s.slots }()
+	}
+	slog.Info("Running schedule", "schedule", sc.Name, "template", sc.Template)
+	sched.mu.Lock()
+	sched.lastRun = time.Now()
+	sched.mu.Unlock()
+	s.saveState()
+
+	templateConfig := s.templates.get()
+	model := sc.Model
+	if model == "" {
+		model = templateConfig.defaultModel(config, sc.Template)
+	}
+
+	request := map[string]interface{}{"query": sc.Query}
+	for field, value := range sc.Inputs {
+		request[field] = value
+	}
+	ctx := withGenerationStats(context.Background(), &GenerationStats{})
+	data, err := buildTemplateData(ctx, config, request)
+	if err != nil {
+		slog.Error("Schedule failed to prepare inputs", "schedule", sc.Name, "error", err)
+		return nil, err
+	}
+	start := time.Now()
+	filteredResponse, err := generate(ctx, config, templateConfig, sc.Template, data, model)
+	recordGeneration(ctx, config, s.history, "schedule", sc.Template, data, model, HAContext{}, start, filteredResponse, err)
+	if err != nil {
+		slog.Error("Schedule failed", "schedule", sc.Name, "error", err)
+		return nil, err
+	}
+
+	if !config.Flags.Enabled(flagOutputs) {
+		return filteredResponse, nil
+	}
+	s.outputs.deliverTo(sc.Outputs, Delivery{
+		Source:   sc.Name,
+		Template: sc.Template,
+		Query:    sc.Query,
+		Model:    model,
+		Response: filteredResponse["response"].(string),
+		Fields:   filteredResponse,
+		Time:     time.Now(),
+	})
+	return filteredResponse, nil
+}
+
+// Run times listed per schedule, unless the request says otherwise
+const defaultUpcomingRuns = 5
+
+// ScheduleStatus is a schedule and its upcoming runs, as listed by
+// GET /admin/schedules.
+type ScheduleStatus struct {
+	Name     string      `json:"name"`
+	Template string      `json:"template"`
+	Every    string      `json:"every,omitempty"`
+	At       string      `json:"at,omitempty"`
+	Days     []string    `json:"days,omitempty"`
+	Outputs  []string    `json:"outputs,omitempty"`
+	Paused   bool        `json:"paused"`
+	LastRun  *time.Time  `json:"last_run,omitempty"`
+	NextRuns []time.Time `json:"next_runs"`
+}
+
+func (sched *schedule) status(count int) ScheduleStatus {
+	sc := sched.config
+	sched.mu.Lock()
+	paused, lastRun := sched.paused, sched.lastRun
+	sched.mu.Unlock()
+	status := ScheduleStatus{
+		Name:     sc.Name,
+		Template: sc.Template,
+		Every:    sc.Every,
+		At:       sc.At,
+		Days:     sc.Days,
+		Outputs:  sc.Outputs,
+		Paused:   paused,
+		NextRuns: sched.upcoming(count),
+	}
+	if !lastRun.IsZero() {
+		status.LastRun = &lastRun
+	}
+	return status
+}
+
+// find returns the schedule with the name, or nil.
+func (s *Scheduler) find(name string) *schedule {
+	for _, sched := range s.schedules {
+		if sched.config.Name == name {
+			return sched
+		}
+	}
+	return nil
+}
+
+// handler serves GET /admin/schedules?count=N, listing each schedule's next N
+// runs (default 5), GET /admin/schedules/{name}, POST
+// /admin/schedules/{name}/pause and /resume, and POST
+// /admin/schedules/{name}/run to run one straight away. Pausing lasts until the
+// server restarts.
+func (s *Scheduler) handler(w http.ResponseWriter, r *http.Request) {
+	count := defaultUpcomingRuns
+	if value := r.URL.Query().Get("count"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 100 {
+			http.Error(w, "count must be a number from 1 to 100", http.StatusBadRequest)
+			return
+		}
+		count = n
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/schedules"), "/")
+	if path == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		query, err := parseListQuery(r, 0, "count")
+		if err != nil {
+			writeListError(w, err)
+			return
+		}
+		statuses := make([]ScheduleStatus, len(s.schedules))
+		for i, sched := range s.schedules {
+			statuses[i] = sched.status(count)
+		}
+		if statuses, err = applyListQuery(w, query, statuses); err != nil {
+			writeListError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"schedules": statuses})
+		return
+	}
+
+	name, action, _ := strings.Cut(path, "/")
+	sched := s.find(name)
+	if sched == nil {
+		http.Error(w, fmt.Sprintf("Unknown schedule '%s'", name), http.StatusNotFound)
+		return
+	}
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+	case (action == "pause" || action == "resume") && r.Method == http.MethodPost:
+		sched.mu.Lock()
+		sched.paused = action == "pause"
+		sched.mu.Unlock()
+		slog.Info("Schedule "+action+"d", "schedule", name, "remote_addr", r.RemoteAddr)
+	case action == "run" && r.Method == http.MethodPost:
+		// Runs now, even while paused, without changing the next scheduled run
+		slog.Info("Schedule run now", "schedule", name, "remote_addr", r.RemoteAddr)
+		filteredResponse, err := s.run(sched)
+		if errors.Is(err, errSchedulesDisabled) {
+			http.Error(w, "Schedules are disabled", http.StatusServiceUnavailable)
+			return
+		}
+		var inputErr *inputError
+		if errors.As(err, &inputErr) {
+			http.Error(w, inputErr.msg, http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			writeTemplateError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"schedule": name, "outputs": sched.config.Outputs, "result": filteredResponse})
+		return
+	case action == "" || action == "pause" || action == "resume" || action == "run":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, sched.status(count))
+}
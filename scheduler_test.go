@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleNextSlot(t *testing.T) {
+	every, err := parseSchedule(ScheduleConfig{Name: "every", Every: "30m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	daily, err := parseSchedule(ScheduleConfig{Name: "daily", At: "07:00"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		sched *schedule
+		last  time.Time
+		now   time.Time
+		want  time.Time
+	}{
+		// A run finishing late, or a jittered start, doesn't move the next slot
+		{"every after a slow run", every, base, base.Add(12 * time.Minute), base.Add(30 * time.Minute)},
+		{"every skips overlapped slots", every, base, base.Add(65 * time.Minute), base.Add(90 * time.Minute)},
+		{"daily", daily, base, base.Add(time.Hour), time.Date(2026, 10, 17, 7, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.sched.nextSlot(tt.last, tt.now); !got.Equal(tt.want) {
+				t.Errorf("nextSlot = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSchedulerStop(t *testing.T) {
+	sched, err := parseSchedule(ScheduleConfig{Name: "hourly", Every: "1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduler := &Scheduler{schedules: []*schedule{sched}, stopped: make(chan struct{})}
+
+	done := make(chan struct{})
+	go func() {
+		scheduler.loop(sched)
+		close(done)
+	}()
+	scheduler.stop()
+	// Stopping twice, as a second handover might, is harmless
+	scheduler.stop()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("schedule loop didn't stop")
+	}
+}
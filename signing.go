@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	signatureHeader          = "X-Llamanator-Signature"
+	signatureAlgorithmHeader = "X-Llamanator-Signature-Algorithm"
+	signatureTimestampHeader = "X-Llamanator-Timestamp"
+)
+
+// SigningConfig enables signing of response bodies so consumers can verify an
+// answer came from llamanator. The key is the HMAC secret for hmac-sha256, or
+// the base64 encoded 32 byte seed of the private key for ed25519.
+type SigningConfig struct {
+	Algorithm string `json:"algorithm"`
+	Key       string `json:"key"`
+}
+
+type Signer struct {
+	algorithm  string
+	hmacKey    []byte
+	privateKey ed25519.PrivateKey
+}
+
+// newSigner returns nil when signing is not configured.
+func newSigner(config SigningConfig) (*Signer, error) {
+	if config.Algorithm == "" && config.Key == "" {
+		return nil, nil
+	}
+	if config.Key == "" {
+		return nil, fmt.Errorf("signing requires a key")
+	}
+
+	switch config.Algorithm {
+	case "", "hmac-sha256":
+		return &Signer{algorithm: "hmac-sha256", hmacKey: []byte(config.Key)}, nil
+	case "ed25519":
+		seed, err := base64.StdEncoding.DecodeString(config.Key)
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("ed25519 keys must be a base64 encoded %d byte seed", ed25519.SeedSize)
+		}
+		return &Signer{algorithm: "ed25519", privateKey: ed25519.NewKeyFromSeed(seed)}, nil
+	default:
+		return nil, fmt.Errorf("unknown signing algorithm '%s'", config.Algorithm)
+	}
+}
+
+// PublicKey returns the base64 encoded ed25519 public key, or "" for HMAC.
+func (s *Signer) PublicKey() string {
+	if s == nil || s.privateKey == nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(s.privateKey.Public().(ed25519.PublicKey))
+}
+
+// sign signs "<timestamp>.<body>" so a captured response can't be replayed with
+// a fresh timestamp.
+func (s *Signer) sign(timestamp string, body []byte) string {
+	message := append([]byte(timestamp+"."), body...)
+	if s.privateKey != nil {
+		return base64.StdEncoding.EncodeToString(ed25519.Sign(s.privateKey, message))
+	}
+	mac := hmac.New(sha256.New, s.hmacKey)
+	mac.Write(message)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signResponses buffers the response of next and adds signature headers.
+// Streamed responses are passed through unsigned as soon as they are flushed.
+func signResponses(signer *Signer, next http.HandlerFunc) http.HandlerFunc {
+	if signer == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		sw := &signingWriter{ResponseWriter: w, status: http.StatusOK}
+		next(sw, r)
+		if sw.streaming {
+			return
+		}
+
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		w.Header().Set(signatureTimestampHeader, timestamp)
+		w.Header().Set(signatureAlgorithmHeader, signer.algorithm)
+		w.Header().Set(signatureHeader, signer.sign(timestamp, sw.body.Bytes()))
+		w.WriteHeader(sw.status)
+		w.Write(sw.body.Bytes())
+	}
+}
+
+type signingWriter struct {
+	http.ResponseWriter
+	status    int
+	body      bytes.Buffer
+	streaming bool
+}
+
+func (w *signingWriter) WriteHeader(status int) {
+	if w.streaming {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.status = status
+}
+
+func (w *signingWriter) Write(data []byte) (int, error) {
+	if w.streaming {
+		return w.ResponseWriter.Write(data)
+	}
+	return w.body.Write(data)
+}
+
+func (w *signingWriter) Flush() {
+	if !w.streaming {
+		w.streaming = true
+		w.ResponseWriter.WriteHeader(w.status)
+		w.ResponseWriter.Write(w.body.Bytes())
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
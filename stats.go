@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Token usage headers let clients and reverse proxies account usage without
+// parsing response bodies.
+const (
+	promptTokensHeader     = "X-Llamanator-Prompt-Tokens"
+	completionTokensHeader = "X-Llamanator-Completion-Tokens"
+	// cacheHeader is set to hit when the response came from the response cache
+	cacheHeader = "X-Llamanator-Cache"
+)
+
+// GenerationStats are the upstream metrics of a generation. Callers that want
+// them attach a *GenerationStats to the context with withGenerationStats and
+// postOllama fills it in.
+type GenerationStats struct {
+	PromptTokens     int
+	CompletionTokens int
+	DoneReason       string
+	FirstToken       time.Duration
+	Load             time.Duration
+	PromptEval       time.Duration
+	Eval             time.Duration
+	// Cached is set when the response came from the response cache
+	Cached bool
+	// Coalesced is set when the response was shared by an identical request
+	// in flight
+	Coalesced bool
+	// Declined is set when refusal detection found the model declined
+	Declined bool
+}
+
+// Truncated reports whether the model stopped because it hit the token limit.
+func (s *GenerationStats) Truncated() bool {
+	return s.DoneReason == "length"
+}
+
+type statsKey struct{}
+
+func withGenerationStats(ctx context.Context, stats *GenerationStats) context.Context {
+	return context.WithValue(ctx, statsKey{}, stats)
+}
+
+func generationStats(ctx context.Context) *GenerationStats {
+	stats, _ := ctx.Value(statsKey{}).(*GenerationStats)
+	return stats
+}
+
+// timeFirstToken wraps onChunk to record the time to the first token in the
+// stats attached to ctx, if any.
+func timeFirstToken(ctx context.Context, onChunk func(string)) func(string) {
+	stats := generationStats(ctx)
+	if stats == nil {
+		return onChunk
+	}
+	start := time.Now()
+	return func(chunk string) {
+		if stats.FirstToken == 0 {
+			stats.FirstToken = time.Since(start)
+		}
+		onChunk(chunk)
+	}
+}
+
+// collectStats copies the metrics of a final Ollama response into the stats
+// attached to ctx, if any. Ollama reports durations in nanoseconds.
+func collectStats(ctx context.Context, response map[string]interface{}) {
+	stats := generationStats(ctx)
+	if stats == nil {
+		return
+	}
+	if count, ok := response["prompt_eval_count"].(float64); ok {
+		stats.PromptTokens = int(count)
+	}
+	if count, ok := response["eval_count"].(float64); ok {
+		stats.CompletionTokens = int(count)
+	}
+	if nanos, ok := response["load_duration"].(float64); ok {
+		stats.Load = time.Duration(nanos)
+	}
+	if nanos, ok := response["prompt_eval_duration"].(float64); ok {
+		stats.PromptEval = time.Duration(nanos)
+	}
+	if nanos, ok := response["eval_duration"].(float64); ok {
+		stats.Eval = time.Duration(nanos)
+	}
+	// Without streaming the first token isn't seen, so estimate it from the time
+	// Ollama spent loading the model and reading the prompt
+	if stats.FirstToken == 0 {
+		stats.FirstToken = stats.Load + stats.PromptEval
+	}
+	stats.DoneReason, _ = response["done_reason"].(string)
+}
+
+// setUsageHeaders adds the token counts reported by the backend for the
+// generation in ctx to the response headers.
+func setUsageHeaders(ctx context.Context, w http.ResponseWriter) {
+	stats := generationStats(ctx)
+	if stats == nil {
+		return
+	}
+	if stats.Cached {
+		w.Header().Set(cacheHeader, "hit")
+	} else if stats.Coalesced {
+		w.Header().Set(cacheHeader, "coalesced")
+	}
+	if stats.PromptTokens == 0 && stats.CompletionTokens == 0 {
+		return
+	}
+	w.Header().Set(promptTokensHeader, strconv.Itoa(stats.PromptTokens))
+	w.Header().Set(completionTokensHeader, strconv.Itoa(stats.CompletionTokens))
+}
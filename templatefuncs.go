@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// templateFuncs are the functions available to templates. Names and argument
+// order follow Sprig, so pipelines such as {{ now | date "Monday" }} and
+// {{ .Query | default "unknown" }} work as they do in Helm charts.
+var templateFuncs = template.FuncMap{
+	// Dates
+	"now":        time.Now,
+	"date":       formatDate,
+	"dateInZone": formatDateInZone,
+	"toDate":     toDate,
+	"unixEpoch":  func(t time.Time) string { return strconv.FormatInt(t.Unix(), 10) },
+	"ago":        func(t interface{}) string { return time.Since(toTime(t)).Round(time.Second).String() },
+
+	// Strings
+	"upper":      strings.ToUpper,
+	"lower":      strings.ToLower,
+	"title":      title,
+	"trim":       strings.TrimSpace,
+	"trimAll":    func(cutset, s string) string { return strings.Trim(s, cutset) },
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"contains":   func(substr, s string) bool { return strings.Contains(s, substr) },
+	"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+	"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+	"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+	"repeat":     func(count int, s string) string { return strings.Repeat(s, count) },
+	"trunc":      trunc,
+	"abbrev":     abbrev,
+	"indent":     indent,
+	"nindent":    func(spaces int, s string) string { return "\n" + indent(spaces, s) },
+	"splitList":  func(sep, s string) []string { return strings.Split(s, sep) },
+	"join":       joinList,
+
+	// Defaults
+	"default":  defaultValue,
+	"empty":    empty,
+	"coalesce": coalesce,
+	"ternary": func(whenTrue, whenFalse interface{}, condition bool) interface{} {
+		if condition {
+			return whenTrue
+		}
+		return whenFalse
+	},
+
+	// JSON
+	"toJson":       toJSON,
+	"toPrettyJson": toPrettyJSON,
+	"fromJson":     fromJSON,
+
+	// Lists
+	"list":  func(items ...interface{}) []interface{} { return items },
+	"first": func(list interface{}) interface{} { return listItem(list, 0) },
+	"last":  func(list interface{}) interface{} { return listItem(list, -1) },
+
+	// Maths, on integers as in Sprig
+	"add":  func(a, b interface{}) int64 { return toInt64(a) + toInt64(b) },
+	"add1": func(a interface{}) int64 { return toInt64(a) + 1 },
+	"sub":  func(a, b interface{}) int64 { return toInt64(a) - toInt64(b) },
+	"mul":  func(a, b interface{}) int64 { return toInt64(a) * toInt64(b) },
+	"div":  divide,
+	"mod":  modulo,
+	"max": func(a, b interface{}) int64 {
+		if toInt64(a) > toInt64(b) {
+			return toInt64(a)
+		}
+		return toInt64(b)
+	},
+	"min": func(a, b interface{}) int64 {
+		if toInt64(a) < toInt64(b) {
+			return toInt64(a)
+		}
+		return toInt64(b)
+	},
+}
+
+// parsePromptTemplate parses a template with templateFuncs.
+func parsePromptTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Parse(text)
+}
+
+// toTime converts a time, a Unix timestamp or an RFC 3339 string, as JSON
+// inputs give, to a time. Anything else is the zero time.
+func toTime(value interface{}) time.Time {
+	switch v := value.(type) {
+	case time.Time:
+		return v
+	case *time.Time:
+		if v != nil {
+			return *v
+		}
+	case int:
+		return time.Unix(int64(v), 0)
+	case int64:
+		return time.Unix(v, 0)
+	case float64:
+		return time.Unix(int64(v), 0)
+	case json.Number:
+		n, _ := v.Int64()
+		return time.Unix(n, 0)
+	case string:
+		t, _ := time.Parse(time.RFC3339, v)
+		return t
+	}
+	return time.Time{}
+}
+
+// formatDate formats a time in the server's time zone with a Go layout, such
+// as "Monday" or "2006-01-02".
+func formatDate(layout string, value interface{}) string {
+	return toTime(value).Local().Format(layout)
+}
+
+func formatDateInZone(layout string, value interface{}, zone string) (string, error) {
+	location, err := time.LoadLocation(zone)
+	if err != nil {
+		return "", err
+	}
+	return toTime(value).In(location).Format(layout), nil
+}
+
+func toDate(layout, value string) (time.Time, error) {
+	return time.ParseInLocation(layout, value, time.Local)
+}
+
+// title upper cases the first letter of each word.
+func title(s string) string {
+	previous := ' '
+	return strings.Map(func(r rune) rune {
+		start := !unicode.IsLetter(previous) && !unicode.IsDigit(previous)
+		previous = r
+		if start {
+			return unicode.ToTitle(r)
+		}
+		return r
+	}, s)
+}
+
+// trunc keeps the first length characters, or the last with a negative length.
+func trunc(length int, s string) string {
+	runes := []rune(s)
+	switch {
+	case length >= 0 && len(runes) > length:
+		return string(runes[:length])
+	case length < 0 && len(runes) > -length:
+		return string(runes[len(runes)+length:])
+	}
+	return s
+}
+
+// abbrev shortens a string to width characters, ending it with "..." if cut.
+func abbrev(width int, s string) string {
+	runes := []rune(s)
+	if width < 4 || len(runes) <= width {
+		return s
+	}
+	return string(runes[:width-3]) + "..."
+}
+
+func indent(spaces int, s string) string {
+	pad := strings.Repeat(" ", spaces)
+	return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+}
+
+func joinList(sep string, list interface{}) string {
+	value := reflect.ValueOf(list)
+	if value.Kind() != reflect.Slice && value.Kind() != reflect.Array {
+		return fmt.Sprint(list)
+	}
+	parts := make([]string, value.Len())
+	for i := range parts {
+		parts[i] = fmt.Sprint(value.Index(i).Interface())
+	}
+	return strings.Join(parts, sep)
+}
+
+// defaultValue is the given value, or def if it is missing or empty.
+func defaultValue(def interface{}, given ...interface{}) interface{} {
+	if len(given) == 0 || empty(given[0]) {
+		return def
+	}
+	return given[0]
+}
+
+// empty reports whether a value is nil or its type's zero value, including
+// empty strings, lists and maps.
+func empty(value interface{}) bool {
+	v := reflect.ValueOf(value)
+	if !v.IsValid() {
+		return true
+	}
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Array, reflect.Map:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return v.IsZero()
+}
+
+// coalesce returns the first value that isn't empty.
+func coalesce(values ...interface{}) interface{} {
+	for _, value := range values {
+		if !empty(value) {
+			return value
+		}
+	}
+	return nil
+}
+
+// toJSON encodes a value as JSON. The result is marked safe so the template
+// doesn't escape its quotes.
+func toJSON(value interface{}) (template.HTML, error) {
+	data, err := json.Marshal(value)
+	return template.HTML(data), err
+}
+
+func toPrettyJSON(value interface{}) (template.HTML, error) {
+	data, err := json.MarshalIndent(value, "", "  ")
+	return template.HTML(data), err
+}
+
+func fromJSON(s string) (interface{}, error) {
+	var value interface{}
+	err := json.Unmarshal([]byte(s), &value)
+	return value, err
+}
+
+// listItem returns the item of a list at index, counting from the end if
+// negative, or nil for an empty list or anything else.
+func listItem(list interface{}, index int) interface{} {
+	value := reflect.ValueOf(list)
+	if value.Kind() != reflect.Slice && value.Kind() != reflect.Array || value.Len() == 0 {
+		return nil
+	}
+	if index < 0 {
+		index += value.Len()
+	}
+	return value.Index(index).Interface()
+}
+
+// toInt64 converts a number, or a string holding one, to an integer. Anything
+// else is 0.
+func toInt64(value interface{}) int64 {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		return int64(v.Float())
+	case reflect.String:
+		n, err := strconv.ParseFloat(v.String(), 64)
+		if err == nil {
+			return int64(n)
+		}
+	}
+	return 0
+}
+
+func divide(a, b interface{}) (int64, error) {
+	if toInt64(b) == 0 {
+		return 0, fmt.Errorf("division by zero")
+	}
+	return toInt64(a) / toInt64(b), nil
+}
+
+func modulo(a, b interface{}) (int64, error) {
+	if toInt64(b) == 0 {
+		return 0, fmt.Errorf("division by zero")
+	}
+	return toInt64(a) % toInt64(b), nil
+}
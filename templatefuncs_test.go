@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestTemplateFuncs(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		query    string
+		want     string
+		wantErr  bool
+	}{
+		{"date", `{{ toDate "2006-01-02" "2026-03-02" | date "Monday 2 Jan" }}`, "", "Monday 2 Mar", false},
+		{"date of a timestamp", `{{ dateInZone "2006" 0 "UTC" }}`, "", "1970", false},
+		{"date of RFC 3339", `{{ dateInZone "15:04" "2026-03-02T10:00:00Z" "UTC" }}`, "", "10:00", false},
+		{"unknown zone", `{{ dateInZone "2006" 0 "Mars/Olympus" }}`, "", "", true},
+		{"strings", `{{ .Query | trim | upper }} {{ "kitchen lights" | title }}`, " hi ", "HI Kitchen Lights", false},
+		{"trim and replace", `{{ .Query | trimPrefix "ok " | replace "a" "o" }}`, "ok banana", "bonono", false},
+		{"trunc", `{{ .Query | trunc 3 }} {{ .Query | trunc -3 }}`, "abcdef", "abc def", false},
+		{"abbrev", `{{ .Query | abbrev 6 }}`, "abcdefgh", "abc...", false},
+		{"indent", `{{ .Query | nindent 2 }}`, "a\nb", "\n  a\n  b", false},
+		{"split and join", `{{ .Query | splitList "," | join " & " }}`, "a,b,c", "a &amp; b &amp; c", false},
+		{"default of empty", `{{ .Query | default "unknown" }}`, "", "unknown", false},
+		{"default of value", `{{ .Query | default "unknown" }}`, "set", "set", false},
+		{"coalesce", `{{ coalesce "" .Query "last" }}`, "first", "first", false},
+		{"ternary", `{{ ternary "yes" "no" (empty .Query) }}`, "", "yes", false},
+		{"toJson", `{{ list 1 "two" | toJson }}`, "", `[1,"two"]`, false},
+		{"fromJson", `{{ (fromJson .Query).room }}`, `{"room": "hall"}`, "hall", false},
+		{"first and last", `{{ list "a" "b" "c" | first }}{{ list "a" "b" "c" | last }}`, "", "ac", false},
+		{"maths", `{{ add 2 3 }} {{ sub 2 3 }} {{ mul "4" 2 }} {{ div 7 2 }} {{ mod 7 2 }} {{ max 1 5 }} {{ min 1 5 }} {{ add1 1 }}`, "", "5 -1 8 3 1 5 1 2", false},
+		{"division by zero", `{{ div 1 0 }}`, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := parsePromptTemplate("test.json", tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := processTemplate(tmpl, TemplateData{Query: tt.query})
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Template names the admin API accepts, so a name can't reach outside the
+// templates directory or clash with a settings file
+var templateNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+var (
+	errTemplateExists   = errors.New("template already exists")
+	errTemplateNotFound = errors.New("template not found")
+)
+
+// TemplateSource is a template's text and settings as stored in the templates
+// directory.
+type TemplateSource struct {
+	Name     string          `json:"name"`
+	Template string          `json:"template"`
+	Settings json.RawMessage `json:"settings,omitempty"`
+	// Version identifies the template's text in watermarks
+	Version string `json:"version"`
+	// Canary is a new version being tried on some of the requests
+	Canary *CanaryStatus `json:"canary,omitempty"`
+}
+
+// source reads a template and its settings file from the templates directory.
+func (s *TemplateStore) source(name string) (*TemplateSource, error) {
+	text, err := os.ReadFile(filepath.Join(s.dir, name+".json"))
+	if os.IsNotExist(err) {
+		return nil, errTemplateNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	source := &TemplateSource{Name: name, Template: string(text), Version: templateVersion(string(text))}
+	settings, err := os.ReadFile(filepath.Join(s.dir, name+templateSettingsSuffix))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if json.Valid(settings) {
+		source.Settings = settings
+	}
+	source.Canary = s.canaryStatus(name)
+	return source, nil
+}
+
+// save checks a template and its settings, writes them to the templates
+// directory and reloads. Settings left out keep the template's settings file,
+// and null removes it. With create, an existing template is not replaced.
+func (s *TemplateStore) save(source TemplateSource, create bool) error {
+	s.edit.Lock()
+	defer s.edit.Unlock()
+
+	templatePath := filepath.Join(s.dir, source.Name+".json")
+	settingsPath := filepath.Join(s.dir, source.Name+templateSettingsSuffix)
+	if _, err := os.Stat(templatePath); err == nil && create {
+		return errTemplateExists
+	}
+	if _, err := parsePromptTemplate(source.Name+".json", source.Template); err != nil {
+		return badInput("Invalid template: %v", err)
+	}
+	var settings []byte
+	if len(source.Settings) > 0 && !bytes.Equal(source.Settings, []byte("null")) {
+		if _, err := parseTemplateSettings(source.Settings); err != nil {
+			return badInput("Invalid settings: %v", err)
+		}
+		var indented bytes.Buffer
+		json.Indent(&indented, source.Settings, "", "  ")
+		settings = append(indented.Bytes(), '\n')
+	}
+
+	if err := writeFileAtomic(templatePath, []byte(source.Template)); err != nil {
+		return err
+	}
+	switch {
+	case settings != nil:
+		if err := writeFileAtomic(settingsPath, settings); err != nil {
+			return err
+		}
+	case len(source.Settings) > 0:
+		if err := os.Remove(settingsPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	_, err := s.reload()
+	return err
+}
+
+// remove deletes a template and its settings file and reloads.
+func (s *TemplateStore) remove(name string) error {
+	s.edit.Lock()
+	defer s.edit.Unlock()
+
+	err := os.Remove(filepath.Join(s.dir, name+".json"))
+	if os.IsNotExist(err) {
+		return errTemplateNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(s.dir, name+templateSettingsSuffix)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	_, err = s.reload()
+	return err
+}
+
+// disabled reports whether the template's settings take it out of service.
+func (tc *TemplateConfig) disabled(templateName string) bool {
+	settings, ok := tc.Settings[templateName]
+	return ok && settings.Disabled
+}
+
+// setDisabled sets disabled in a template's settings file, keeping its other
+// settings, and reloads.
+func (s *TemplateStore) setDisabled(name string, disabled bool) error {
+	s.edit.Lock()
+	defer s.edit.Unlock()
+
+	if _, err := os.Stat(filepath.Join(s.dir, name+".json")); os.IsNotExist(err) {
+		return errTemplateNotFound
+	}
+	settingsPath := filepath.Join(s.dir, name+templateSettingsSuffix)
+	settings := map[string]interface{}{}
+	data, err := os.ReadFile(settingsPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &settings); err != nil {
+			return fmt.Errorf("%s: %w", settingsPath, err)
+		}
+	}
+
+	if disabled {
+		settings["disabled"] = true
+	} else {
+		delete(settings, "disabled")
+	}
+	if len(settings) == 0 {
+		if err := os.Remove(settingsPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		data, _ := json.MarshalIndent(settings, "", "  ")
+		if err := writeFileAtomic(settingsPath, append(data, '\n')); err != nil {
+			return err
+		}
+	}
+	_, err = s.reload()
+	return err
+}
+
+// writeFileAtomic writes through a temporary file, so the template watcher and
+// reloads never see a partly written file. The temporary name doesn't end in
+// .json, so it is never loaded as a template.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// templateAdminHandler serves the template management API: GET /admin/templates
+// lists the templates, GET, POST (create), PUT (create or replace) and DELETE
+// /admin/templates/{name} manage one, and POST /admin/templates/{name}/disable
+// and /enable take one out of service and back. Changes are written to the
+// templates directory and served straight away, except a PUT with a canary,
+// which is served to some requests until POST .../promote or .../rollback.
+// GET /admin/templates/{name}/lint lints a template, and POST lints the one in
+// the body without saving it.
+func templateAdminHandler(config *Config, templates *TemplateStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/templates"), "/")
+		name, action, _ := strings.Cut(path, "/")
+
+		if name == "" {
+			if r.Method != http.MethodGet {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			query, err := parseListQuery(r, 0)
+			if err != nil {
+				writeListError(w, err)
+				return
+			}
+			sources := []*TemplateSource{}
+			for _, name := range sortedKeys(templates.get().Templates) {
+				source, err := templates.source(name)
+				if err != nil {
+					slog.Error("Failed to read template", "template", name, "error", err)
+					continue
+				}
+				sources = append(sources, source)
+			}
+			if sources, err = applyListQuery(w, query, sources); err != nil {
+				writeListError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{"templates": sources})
+			return
+		}
+
+		if !templateNamePattern.MatchString(name) {
+			http.Error(w, "Template names may only contain letters, digits, '-' and '_'", http.StatusBadRequest)
+			return
+		}
+
+		switch action {
+		case "":
+		case "disable", "enable":
+			if r.Method != http.MethodPost {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			if err := templates.setDisabled(name, action == "disable"); err != nil {
+				writeTemplateAdminError(w, name, err)
+				return
+			}
+			slog.Info("Template "+action+"d", "template", name, "remote_addr", r.RemoteAddr)
+			writeJSON(w, http.StatusOK, map[string]bool{"disabled": action == "disable"})
+			return
+		case "promote", "rollback":
+			if r.Method != http.MethodPost {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			var err error
+			done := "promoted"
+			if action == "promote" {
+				err = templates.promoteCanary(name)
+			} else {
+				_, err = templates.stopCanary(name)
+				done = "rolled back"
+			}
+			if err != nil {
+				writeTemplateAdminError(w, name, err)
+				return
+			}
+			slog.Info("Template canary "+done, "template", name, "remote_addr", r.RemoteAddr)
+			source, err := templates.source(name)
+			if err != nil {
+				writeTemplateAdminError(w, name, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, source)
+			return
+		case "lint":
+			if r.Method != http.MethodGet && r.Method != http.MethodPost {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			problems, err := lintTemplateRequest(r, config, templates, name)
+			if err != nil {
+				writeTemplateAdminError(w, name, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{"template": name, "problems": problems})
+			return
+		default:
+			http.NotFound(w, r)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			source, err := templates.source(name)
+			if err != nil {
+				writeTemplateAdminError(w, name, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, source)
+		case http.MethodPost, http.MethodPut:
+			var source TemplateSource
+			if err := json.NewDecoder(r.Body).Decode(&source); err != nil || source.Template == "" {
+				http.Error(w, `Expected a body of {"template": "...", "settings": {...}}`, http.StatusBadRequest)
+				return
+			}
+			source.Name = name
+			if source.Canary != nil {
+				if r.Method != http.MethodPut {
+					http.Error(w, "Start a canary with PUT on an existing template", http.StatusBadRequest)
+					return
+				}
+				if err := templates.startCanary(source); err != nil {
+					writeTemplateAdminError(w, name, err)
+					return
+				}
+				slog.Info("Template canary started", "template", name, "percent", source.Canary.Percent, "remote_addr", r.RemoteAddr)
+				saved, err := templates.source(name)
+				if err != nil {
+					writeTemplateAdminError(w, name, err)
+					return
+				}
+				writeJSON(w, http.StatusAccepted, saved)
+				return
+			}
+			if err := templates.save(source, r.Method == http.MethodPost); err != nil {
+				writeTemplateAdminError(w, name, err)
+				return
+			}
+			// Saving outright replaces any canary
+			templates.stopCanary(name)
+			slog.Info("Template saved", "template", name, "remote_addr", r.RemoteAddr)
+			saved, err := templates.source(name)
+			if err != nil {
+				writeTemplateAdminError(w, name, err)
+				return
+			}
+			status := http.StatusOK
+			if r.Method == http.MethodPost {
+				status = http.StatusCreated
+			}
+			writeJSON(w, status, saved)
+		case http.MethodDelete:
+			if err := templates.remove(name); err != nil {
+				writeTemplateAdminError(w, name, err)
+				return
+			}
+			templates.stopCanary(name)
+			slog.Info("Template deleted", "template", name, "remote_addr", r.RemoteAddr)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// lintTemplateRequest lints the saved template for a GET, and the template in
+// the body for a POST. Settings left out of the body are the saved ones.
+func lintTemplateRequest(r *http.Request, config *Config, templates *TemplateStore, name string) ([]LintProblem, error) {
+	templateConfig := templates.get()
+	var text string
+	if r.Method == http.MethodGet {
+		source, err := templates.source(name)
+		if err != nil {
+			return nil, err
+		}
+		text = source.Template
+	} else {
+		var source TemplateSource
+		if err := json.NewDecoder(r.Body).Decode(&source); err != nil || source.Template == "" {
+			return nil, badInput(`Expected a body of {"template": "...", "settings": {...}}`)
+		}
+		text = source.Template
+		if len(source.Settings) > 0 {
+			settings := &TemplateSettings{}
+			if !bytes.Equal(source.Settings, []byte("null")) {
+				var err error
+				if settings, err = parseTemplateSettings(source.Settings); err != nil {
+					return nil, badInput("Invalid settings: %v", err)
+				}
+			}
+			templateConfig = singleTemplateConfig(name, settings)
+		}
+	}
+	problems, err := lintTemplate(r.Context(), config, templateConfig, name, text)
+	if err != nil {
+		return nil, badInput("Invalid template: %v", err)
+	}
+	if problems == nil {
+		problems = []LintProblem{}
+	}
+	return problems, nil
+}
+
+func writeTemplateAdminError(w http.ResponseWriter, name string, err error) {
+	var inputErr *inputError
+	switch {
+	case errors.Is(err, errTemplateNotFound):
+		http.Error(w, fmt.Sprintf("Unknown template '%s'", name), http.StatusNotFound)
+	case errors.Is(err, errNoCanary):
+		http.Error(w, fmt.Sprintf("Template '%s' has no canary", name), http.StatusNotFound)
+	case errors.Is(err, errTemplateExists):
+		http.Error(w, fmt.Sprintf("Template '%s' already exists", name), http.StatusConflict)
+	case errors.As(err, &inputErr):
+		http.Error(w, inputErr.msg, http.StatusBadRequest)
+	default:
+		slog.Error("Failed to update template", "template", name, "error", err)
+		http.Error(w, "Failed to update template", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// AdaptiveTimeoutConfig replaces the fixed request_timeout with one estimated
+// from the prompt size and how fast the model has been: its load time, prompt
+// processing and generation speed, times factor and kept within the bounds.
+// Templates with their own request_timeout keep it.
+type AdaptiveTimeoutConfig struct {
+	Enabled    bool    `json:"enabled"`
+	Factor     float64 `json:"factor"`
+	MinSeconds int     `json:"min_seconds"`
+	MaxSeconds int     `json:"max_seconds"`
+}
+
+const (
+	// Generations seen before a model's speed is trusted for timeouts
+	minSpeedSamples = 3
+	// Weight of the newest generation in the moving averages
+	speedWeight = 0.2
+)
+
+// ModelSpeed is how fast a model has been recently.
+type ModelSpeed struct {
+	Samples int
+	// Tokens per second reading the prompt and generating the answer
+	PromptRate float64
+	EvalRate   float64
+	// The longest load seen, as the model may have to be loaded again
+	MaxLoad time.Duration
+}
+
+// recordSpeed updates the model's speed from the statistics of a finished
+// generation.
+func (c *ModelCatalog) recordSpeed(model string, response map[string]interface{}) {
+	promptTokens, _ := response["prompt_eval_count"].(float64)
+	promptNanos, _ := response["prompt_eval_duration"].(float64)
+	evalTokens, _ := response["eval_count"].(float64)
+	evalNanos, _ := response["eval_duration"].(float64)
+	loadNanos, _ := response["load_duration"].(float64)
+	if model == "" || evalTokens <= 0 || evalNanos <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.speeds == nil {
+		c.speeds = make(map[string]*ModelSpeed)
+	}
+	speed := c.speeds[model]
+	if speed == nil {
+		speed = &ModelSpeed{}
+		c.speeds[model] = speed
+	}
+	speed.EvalRate = movingAverage(speed.EvalRate, evalTokens/(evalNanos/1e9), speed.Samples)
+	// A prompt served from Ollama's cache takes no time and says little
+	if promptTokens > 0 && promptNanos > 0 {
+		speed.PromptRate = movingAverage(speed.PromptRate, promptTokens/(promptNanos/1e9), speed.Samples)
+	}
+	speed.MaxLoad = max(speed.MaxLoad, time.Duration(loadNanos))
+	speed.Samples++
+}
+
+func movingAverage(average, value float64, samples int) float64 {
+	if samples == 0 || average == 0 {
+		return value
+	}
+	return average + speedWeight*(value-average)
+}
+
+// adaptiveTimeout estimates how long the model needs for a prompt and answer of
+// the given sizes. It returns fallback until the model's speed is known.
+func (c *ModelCatalog) adaptiveTimeout(config *Config, model string, promptTokens, answerTokens int, fallback time.Duration) time.Duration {
+	c.mu.Lock()
+	speed, ok := c.speeds[model]
+	if ok {
+		copied := *speed
+		speed = &copied
+	}
+	c.mu.Unlock()
+	if !ok || speed.Samples < minSpeedSamples || speed.PromptRate <= 0 {
+		return fallback
+	}
+
+	settings := config.AdaptiveTimeout
+	factor := settings.Factor
+	if factor <= 0 {
+		factor = 3
+	}
+	minimum := time.Duration(settings.MinSeconds) * time.Second
+	if minimum <= 0 {
+		minimum = 10 * time.Second
+	}
+	maximum := time.Duration(settings.MaxSeconds) * time.Second
+	if maximum <= 0 {
+		maximum = 10 * time.Minute
+	}
+
+	seconds := float64(promptTokens)/speed.PromptRate + float64(answerTokens)/speed.EvalRate
+	estimate := speed.MaxLoad + time.Duration(seconds*factor*float64(time.Second))
+	return min(max(estimate, minimum), maximum)
+}
+
+// generationTimeout is the timeout of a generation for the template: the
+// adaptive estimate when enabled, otherwise the request_timeout.
+func generationTimeout(ctx context.Context, config *Config, templateConfig *TemplateConfig, templateName, model string, promptTokens, answerTokens int) time.Duration {
+	timeout := templateConfig.requestTimeout(config, templateName)
+	if _, fixed := templateConfig.RequestTimeouts[templateName]; fixed || !config.AdaptiveTimeout.Enabled {
+		return timeout
+	}
+	timeout = config.models.adaptiveTimeout(config, model, promptTokens, answerTokens, timeout)
+	traceLog(ctx, config, "Set timeout for the prompt", "prompt_tokens", promptTokens, "answer_tokens", answerTokens, "model", model, "timeout", timeout.Round(time.Second))
+	return timeout
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// AutocertConfig obtains and renews a certificate for the domains from Let's
+// Encrypt (or another ACME CA). The CA must be able to reach http_address on
+// port 80 of each domain, or the server itself on port 443.
+type AutocertConfig struct {
+	Domains      []string `json:"domains"`
+	Email        string   `json:"email"`
+	CacheDir     string   `json:"cache_dir"`
+	DirectoryURL string   `json:"directory_url"`
+	HTTPAddress  string   `json:"http_address"`
+}
+
+// Certificates are renewed when they have less than this left
+const renewBefore = 30 * 24 * time.Hour
+
+// newCertManager returns the autocert manager for the domains, which obtains
+// certificates when they're first needed and renews them in the background.
+// Challenges are answered over HTTP on http_address or with TLS-ALPN on the
+// server itself.
+func newCertManager(config AutocertConfig) (*autocert.Manager, error) {
+	if config.CacheDir == "" {
+		config.CacheDir = "certs"
+	}
+	if err := os.MkdirAll(config.CacheDir, 0o700); err != nil {
+		return nil, err
+	}
+	manager := &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(config.CacheDir),
+		HostPolicy:  autocert.HostWhitelist(config.Domains...),
+		RenewBefore: renewBefore,
+		Email:       config.Email,
+	}
+	if config.DirectoryURL != "" {
+		manager.Client = &acme.Client{DirectoryURL: config.DirectoryURL}
+	}
+	return manager, nil
+}
+
+// challengeHandler answers HTTP challenges and redirects everything else to
+// HTTPS on serverAddress.
+func challengeHandler(manager *autocert.Manager, serverAddress string) http.Handler {
+	_, port, _ := net.SplitHostPort(serverAddress)
+	return manager.HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	}))
+}
+
+// listenAndServe serves handler over HTTPS with the configured certificate or
+// autocert, or plain HTTP without either. After a zero-downtime restart it
+// calls handover once the new process is serving, and returns once the
+// requests in progress have finished.
+func listenAndServe(config *Config, handler http.Handler, handover func()) error {
+	if (config.TLSCert != "" || config.TLSKey != "") && (config.TLSCert == "" || config.TLSKey == "") {
+		return errors.New("tls_cert and tls_key must be set together")
+	}
+	listener, err := listen(config.ServerAddress)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Addr: config.ServerAddress, Handler: handler}
+	drained := watchUpgrades(config, server, listener, handover)
+
+	if len(config.Autocert.Domains) > 0 {
+		manager, managerErr := newCertManager(config.Autocert)
+		if managerErr != nil {
+			return fmt.Errorf("failed to set up autocert: %w", managerErr)
+		}
+		httpAddress := config.Autocert.HTTPAddress
+		if httpAddress == "" {
+			httpAddress = ":80"
+		}
+		go func() {
+			if err := http.ListenAndServe(httpAddress, challengeHandler(manager, config.ServerAddress)); err != nil {
+				fatal("Failed to serve ACME challenges", "address", httpAddress, "error", err)
+			}
+		}()
+		server.TLSConfig = manager.TLSConfig()
+		server.TLSConfig.MinVersion = tls.VersionTLS12
+		slog.Info("Serving HTTPS", "domains", config.Autocert.Domains)
+		notifyReady()
+		err = server.ServeTLS(listener, "", "")
+	} else if config.TLSCert != "" {
+		// Loaded up front so a bad certificate fails before a restart hands over
+		cert, loadErr := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+		if loadErr != nil {
+			return loadErr
+		}
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+		slog.Info("Serving HTTPS", "certificate", config.TLSCert)
+		notifyReady()
+		err = server.ServeTLS(listener, "", "")
+	} else {
+		notifyReady()
+		err = server.Serve(listener)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		<-drained
+		slog.Info("Requests finished, exiting")
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewCertManager(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "certs")
+	manager, err := newCertManager(AutocertConfig{
+		Domains:      []string{"llamanator.example.com"},
+		CacheDir:     dir,
+		DirectoryURL: "https://acme-staging-v02.api.letsencrypt.org/directory",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(dir); err != nil || info.Mode().Perm() != 0o700 {
+		t.Fatalf("cache dir = %v, %v, want a 0700 directory", info, err)
+	}
+	if manager.Client == nil || manager.Client.DirectoryURL != "https://acme-staging-v02.api.letsencrypt.org/directory" {
+		t.Errorf("client = %+v, want the staging directory", manager.Client)
+	}
+
+	tests := []struct {
+		host    string
+		allowed bool
+	}{
+		{"llamanator.example.com", true},
+		{"other.example.com", false},
+		{"example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			if err := manager.HostPolicy(context.Background(), tt.host); (err == nil) != tt.allowed {
+				t.Errorf("HostPolicy(%s) = %v, want allowed: %v", tt.host, err, tt.allowed)
+			}
+		})
+	}
+
+	defaults, err := newCertManager(AutocertConfig{Domains: []string{"a.example.com"}, CacheDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if defaults.Client != nil {
+		t.Errorf("client = %+v, want autocert's Let's Encrypt default", defaults.Client)
+	}
+}
+
+func TestChallengeHandler(t *testing.T) {
+	manager, err := newCertManager(AutocertConfig{Domains: []string{"llamanator.example.com"}, CacheDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		serverAddress string
+		host          string
+		path          string
+		wantStatus    int
+		wantLocation  string
+	}{
+		{"redirect to 443", ":443", "llamanator.example.com", "/template/kitchen?x=1", http.StatusMovedPermanently, "https://llamanator.example.com/template/kitchen?x=1"},
+		{"redirect keeps another port", ":8443", "llamanator.example.com:80", "/", http.StatusMovedPermanently, "https://llamanator.example.com:8443/"},
+		{"unknown challenge", ":443", "llamanator.example.com", "/.well-known/acme-challenge/token", http.StatusNotFound, ""},
+		{"challenge for another host", ":443", "other.example.com", "/.well-known/acme-challenge/token", http.StatusForbidden, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://"+tt.host+tt.path, nil)
+			w := httptest.NewRecorder()
+			challengeHandler(manager, tt.serverAddress).ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if location := w.Header().Get("Location"); location != tt.wantLocation {
+				t.Errorf("Location = %q, want %q", location, tt.wantLocation)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+)
+
+// traceHeader enables trace logging for a single request. Its value must be the
+// admin token so callers can't dump other users' prompts into the logs.
+const traceHeader = "X-Llamanator-Trace"
+
+type traceKey struct{}
+
+func withTrace(ctx context.Context) context.Context {
+	return context.WithValue(ctx, traceKey{}, true)
+}
+
+func tracing(ctx context.Context, config *Config) bool {
+	if config.Trace {
+		return true
+	}
+	enabled, _ := ctx.Value(traceKey{}).(bool)
+	return enabled
+}
+
+// adminTokenValid reports whether token matches the configured admin token.
+// Admin features are disabled when no admin token is set.
+func adminTokenValid(config *Config, token string) bool {
+	if config.AdminToken == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) == 1
+}
+
+// requestTraceContext returns ctx with tracing enabled if the request asks for it
+// with a valid admin token.
+func requestTraceContext(ctx context.Context, config *Config, r *http.Request) context.Context {
+	value := r.Header.Get(traceHeader)
+	if value == "" {
+		return ctx
+	}
+	if !adminTokenValid(config, value) {
+		slog.Warn("Ignoring trace header without a valid admin token", "header", traceHeader, "remote_addr", r.RemoteAddr)
+		return ctx
+	}
+	return withTrace(ctx)
+}
+
+// traceLog logs msg with the attributes in args when the request is traced.
+// Trace lines are logged at info level with trace=true.
+func traceLog(ctx context.Context, config *Config, msg string, args ...any) {
+	if tracing(ctx, config) {
+		args = append([]any{"trace", true, "request_id", requestID(ctx)}, args...)
+		slog.Info(msg, args...)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"strings"
+	"unicode/utf8"
+)
+
+// errPromptTooLong is returned when a prompt doesn't fit the context window and
+// the trimming strategies couldn't (or weren't allowed to) shorten it.
+var errPromptTooLong = errors.New("prompt is too long for the model's context window")
+
+const trimMarker = "\n[...trimmed to fit the context window...]\n"
+
+// Trimming strategies, applied in the order listed in prompt_trimming until the
+// prompt fits.
+const (
+	trimData   = "truncate_data"
+	trimPrompt = "truncate_prompt"
+	trimReject = "reject"
+	// Chat templates only: drops the oldest messages of the conversation
+	trimHistory = "drop_history"
+)
+
+// fitPrompt applies the configured trimming strategies when the rendered prompt
+// and the answer don't fit in budget tokens. Without strategies the prompt is
+// sent unchanged, as before, and only a warning is logged.
+func fitPrompt(ctx context.Context, config *Config, tmpl *template.Template, data TemplateData, prompt string, budget int, options map[string]interface{}) (string, error) {
+	available := budget - answerTokens(options)
+	if estimateTokens(prompt) <= available {
+		return prompt, nil
+	}
+	if len(config.PromptTrimming) == 0 {
+		slog.Warn("Prompt won't fit the context window with room for the answer, the model may ignore the start of it", "prompt_tokens", estimateTokens(prompt), "budget", budget)
+		return prompt, nil
+	}
+
+	for _, strategy := range config.PromptTrimming {
+		switch strategy {
+		case trimData:
+			if tmpl != nil {
+				var err error
+				if prompt, err = trimTemplateData(tmpl, data, prompt, available); err != nil {
+					return "", fmt.Errorf("%w: %v", errTemplateProcessing, err)
+				}
+			}
+		case trimPrompt:
+			prompt = trimMiddle(prompt, available)
+		case trimReject:
+			return "", fmt.Errorf("%w: about %d tokens with %d available", errPromptTooLong, estimateTokens(prompt), available)
+		}
+		if estimateTokens(prompt) <= available {
+			traceLog(ctx, config, "Trimmed prompt", "prompt_tokens", estimateTokens(prompt), "strategy", strategy)
+			return prompt, nil
+		}
+	}
+	return "", fmt.Errorf("%w: about %d tokens with %d available after trimming", errPromptTooLong, estimateTokens(prompt), available)
+}
+
+// dropHistory removes the oldest user and assistant messages until the
+// conversation and a prompt of promptTokens fit in available tokens. System
+// messages are kept.
+func dropHistory(messages []ChatMessage, promptTokens, available int) []ChatMessage {
+	kept := messages
+	for estimateTokens(messagesText(kept))+promptTokens > available {
+		oldest := -1
+		for i, message := range kept {
+			if message.Role != "system" {
+				oldest = i
+				break
+			}
+		}
+		if oldest < 0 {
+			break
+		}
+		kept = append(append([]ChatMessage{}, kept[:oldest]...), kept[oldest+1:]...)
+	}
+	return kept
+}
+
+// trimTemplateData shortens the largest injected input (document, web page, table,
+// calendar or logs) and re-renders the template, repeating until the prompt fits or
+// nothing is left to shorten.
+func trimTemplateData(tmpl *template.Template, data TemplateData, prompt string, available int) (string, error) {
+	for attempt := 0; attempt < 8; attempt++ {
+		excess := estimateTokens(prompt) - available
+		if excess <= 0 {
+			return prompt, nil
+		}
+		excessChars := excess*4 + len(trimMarker)
+
+		var changed bool
+		data, changed = shrinkLargestInput(data, excessChars)
+		if !changed {
+			return prompt, nil
+		}
+
+		var err error
+		if prompt, err = processTemplate(tmpl, data); err != nil {
+			return "", err
+		}
+	}
+	return prompt, nil
+}
+
+// shrinkLargestInput removes about excessChars characters from the largest
+// input. Inputs are copied so the caller's data is never modified.
+func shrinkLargestInput(data TemplateData, excessChars int) (TemplateData, bool) {
+	sizes := map[string]int{"events": len(data.EventList())}
+	if data.Document != nil {
+		sizes["document"] = len(data.Document.Text)
+	}
+	if data.Page != nil {
+		sizes["page"] = len(data.Page.Text)
+	}
+	if data.Table != nil {
+		sizes["table"] = len(data.TableText())
+	}
+	if data.Logs != nil {
+		sizes["logs"] = len(data.LogText())
+	}
+
+	largest, size := "", 0
+	for _, name := range []string{"document", "page", "table", "events", "logs"} {
+		if sizes[name] > size {
+			largest, size = name, sizes[name]
+		}
+	}
+	if size <= len(trimMarker) {
+		return data, false
+	}
+	keep := max(size-excessChars, 0)
+
+	switch largest {
+	case "document":
+		document := *data.Document
+		document.Text = truncateText(document.Text, keep)
+		document.Truncated = true
+		data.Document = &document
+	case "page":
+		page := *data.Page
+		page.Text = truncateText(page.Text, keep)
+		page.Truncated = true
+		data.Page = &page
+	case "table":
+		table := *data.Table
+		rows := len(table.Rows) * keep / size
+		if rows >= len(table.Rows) {
+			rows = len(table.Rows) - 1
+		}
+		table.Rows = table.Rows[:max(rows, 0)]
+		table.Truncated = true
+		data.Table = &table
+	case "events":
+		count := len(data.Events) * keep / size
+		if count >= len(data.Events) {
+			count = len(data.Events) - 1
+		}
+		data.Events = data.Events[:max(count, 0)]
+	case "logs":
+		// Drop the oldest lines, the latest matter most
+		logs := *data.Logs
+		count := len(logs.Lines) * keep / size
+		if count >= len(logs.Lines) {
+			count = len(logs.Lines) - 1
+		}
+		logs.Lines = logs.Lines[len(logs.Lines)-max(count, 0):]
+		logs.Truncated = true
+		data.Logs = &logs
+	}
+	return data, true
+}
+
+// truncateText cuts text to about keep bytes on a rune boundary and marks it.
+func truncateText(text string, keep int) string {
+	if keep >= len(text) {
+		return text
+	}
+	runes := []rune(text[:keep])
+	// text[:keep] may have split a rune, drop the partial one
+	if len(runes) > 0 && runes[len(runes)-1] == utf8.RuneError {
+		runes = runes[:len(runes)-1]
+	}
+	return strings.TrimSpace(string(runes)) + trimMarker
+}
+
+// trimMiddle keeps the start and end of the prompt, where instructions and the
+// question usually are, and cuts the middle.
+func trimMiddle(prompt string, available int) string {
+	runes := []rune(prompt)
+	keep := available*4 - len(trimMarker)
+	if keep <= 0 || keep >= len(runes) {
+		return prompt
+	}
+	head := keep / 2
+	tail := keep - head
+	return string(runes[:head]) + trimMarker + string(runes[len(runes)-tail:])
+}
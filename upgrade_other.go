@@ -0,0 +1,21 @@
+//go:build !unix
+
+package main
+
+import (
+	"net"
+	"net/http"
+)
+
+// Zero-downtime restarts hand the listening socket to a new process, which
+// needs Unix.
+
+func listen(address string) (net.Listener, error) {
+	return net.Listen("tcp", address)
+}
+
+func notifyReady() {}
+
+func watchUpgrades(config *Config, server *http.Server, listener net.Listener, handover func()) <-chan struct{} {
+	return nil
+}
@@ -0,0 +1,160 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Environment telling a new process which of its files are the listening
+// socket and the pipe to report readiness on
+const (
+	listenFDEnv = "LLAMANATOR_LISTEN_FD"
+	readyFDEnv  = "LLAMANATOR_READY_FD"
+)
+
+// How long a new process has to start serving before the upgrade is abandoned
+const upgradeTimeout = time.Minute
+
+// listen opens the server's socket, or takes over the one the previous
+// process handed over.
+func listen(address string) (net.Listener, error) {
+	fd := os.Getenv(listenFDEnv)
+	if fd == "" {
+		return net.Listen("tcp", address)
+	}
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s '%s'", listenFDEnv, fd)
+	}
+	file := os.NewFile(uintptr(n), "listener")
+	defer file.Close()
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to take over the listening socket: %w", err)
+	}
+	os.Unsetenv(listenFDEnv)
+	slog.Info("Took over the listening socket", "address", listener.Addr().String())
+	return listener, nil
+}
+
+// notifyReady tells the previous process that this one is serving, so it can
+// stop accepting requests, and systemd which process is now the service's.
+func notifyReady() {
+	if fd := os.Getenv(readyFDEnv); fd != "" {
+		os.Unsetenv(readyFDEnv)
+		if n, err := strconv.Atoi(fd); err == nil {
+			ready := os.NewFile(uintptr(n), "ready")
+			ready.Write([]byte{1})
+			ready.Close()
+		}
+	}
+	if socket := os.Getenv("NOTIFY_SOCKET"); socket != "" {
+		conn, err := net.Dial("unixgram", socket)
+		if err != nil {
+			slog.Warn("Failed to notify systemd", "error", err)
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "READY=1\nMAINPID=%d", os.Getpid())
+	}
+}
+
+// watchUpgrades starts the binary again on SIGUSR2, handing it the listening
+// socket. Once the new process is serving, this one calls handover, stops
+// accepting requests and finishes those it has, including long streams, then
+// closes the returned channel. If the new process fails to start, this one
+// carries on.
+func watchUpgrades(config *Config, server *http.Server, listener net.Listener, handover func()) <-chan struct{} {
+	drained := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+	go func() {
+		for range signals {
+			slog.Info("Received SIGUSR2, starting a new process")
+			if err := upgrade(config, listener); err != nil {
+				slog.Error("Upgrade failed", "error", err)
+				continue
+			}
+			signal.Stop(signals)
+			slog.Info("New process is serving, finishing requests in progress")
+			handover()
+			if err := server.Shutdown(context.Background()); err != nil {
+				slog.Error("Failed to finish requests in progress", "error", err)
+			}
+			close(drained)
+			return
+		}
+	}()
+	return drained
+}
+
+// upgrade starts the new process and waits until it's serving.
+func upgrade(config *Config, listener net.Listener) error {
+	if len(config.Autocert.Domains) > 0 {
+		return errors.New("zero-downtime restarts aren't supported with autocert")
+	}
+	tcp, ok := listener.(*net.TCPListener)
+	if !ok {
+		return errors.New("the listening socket can't be handed over")
+	}
+	socket, err := tcp.File()
+	if err != nil {
+		return err
+	}
+	defer socket.Close()
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+
+	// The new process loads what this one has kept so far
+	saveState(config)
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	// ExtraFiles start at fd 3
+	cmd.ExtraFiles = []*os.File{socket, readyWriter}
+	cmd.Env = append(os.Environ(), listenFDEnv+"=3", readyFDEnv+"=4")
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		return err
+	}
+	slog.Info("Started new process", "pid", cmd.Process.Pid)
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	readied := make(chan error, 1)
+	go func() {
+		_, err := ready.Read(make([]byte, 1))
+		readied <- err
+	}()
+	select {
+	case err := <-readied:
+		if err == nil {
+			return nil
+		}
+		// The pipe closed without a word, so the process has exited
+		return fmt.Errorf("new process exited: %v", <-exited)
+	case <-time.After(upgradeTimeout):
+		cmd.Process.Kill()
+		return fmt.Errorf("new process didn't start serving within %s", upgradeTimeout)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// UsageRow is the aggregate usage of one template, model and origin on one day.
+// It never includes prompt or response text.
+type UsageRow struct {
+	Date            string `json:"date"`
+	Template        string `json:"template"`
+	Model           string `json:"model"`
+	Origin          string `json:"origin"`
+	Requests        int    `json:"requests"`
+	Errors          int    `json:"errors"`
+	TotalDurationMS int64  `json:"total_duration_ms"`
+	AvgDurationMS   int64  `json:"avg_duration_ms"`
+}
+
+// aggregateUsage groups history records between from and to (inclusive dates)
+// by day, template, model and origin.
+func aggregateUsage(records []HistoryRecord, from, to time.Time) []UsageRow {
+	type key struct{ date, template, model, origin string }
+	rows := make(map[key]*UsageRow)
+	end := to.AddDate(0, 0, 1)
+
+	for _, record := range records {
+		if record.Time.Before(from) || !record.Time.Before(end) {
+			continue
+		}
+		k := key{record.Time.In(time.Local).Format("2006-01-02"), record.Template, record.Model, record.Context.Origin}
+		row, ok := rows[k]
+		if !ok {
+			row = &UsageRow{Date: k.date, Template: k.template, Model: k.model, Origin: k.origin}
+			rows[k] = row
+		}
+		row.Requests++
+		if record.Error != "" {
+			row.Errors++
+		}
+		row.TotalDurationMS += record.DurationMS
+	}
+
+	usage := make([]UsageRow, 0, len(rows))
+	for _, row := range rows {
+		row.AvgDurationMS = row.TotalDurationMS / int64(row.Requests)
+		usage = append(usage, *row)
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		a, b := usage[i], usage[j]
+		if a.Date != b.Date {
+			return a.Date < b.Date
+		}
+		if a.Template != b.Template {
+			return a.Template < b.Template
+		}
+		if a.Model != b.Model {
+			return a.Model < b.Model
+		}
+		return a.Origin < b.Origin
+	})
+	return usage
+}
+
+func writeUsageCSV(w io.Writer, usage []UsageRow) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"date", "template", "model", "origin", "requests", "errors", "total_duration_ms", "avg_duration_ms"})
+	for _, row := range usage {
+		writer.Write([]string{
+			row.Date, row.Template, row.Model, row.Origin,
+			strconv.Itoa(row.Requests), strconv.Itoa(row.Errors),
+			strconv.FormatInt(row.TotalDurationMS, 10), strconv.FormatInt(row.AvgDurationMS, 10),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// parseDays reads the -from and -to flags, YYYY-MM-DD in local time, keeping
+// the defaults for flags that aren't set.
+func parseDays(fromText, toText string, from, to time.Time) (time.Time, time.Time, error) {
+	for _, date := range []struct {
+		text   string
+		target *time.Time
+	}{{fromText, &from}, {toText, &to}} {
+		if date.text == "" {
+			continue
+		}
+		parsed, err := time.ParseInLocation("2006-01-02", date.text, time.Local)
+		if err != nil {
+			return from, to, fmt.Errorf("dates must be YYYY-MM-DD: %w", err)
+		}
+		*date.target = parsed
+	}
+	if !from.IsZero() && !to.IsZero() && to.Before(from) {
+		return from, to, fmt.Errorf("-to is before -from")
+	}
+	return from, to, nil
+}
+
+// runExportUsage implements `llamanator export-usage`, printing aggregate usage
+// from the history for a period as CSV or JSON.
+func runExportUsage(args []string) error {
+	flags := flag.NewFlagSet("export-usage", flag.ContinueOnError)
+	configPath := flags.String("config", envDefault(configPathEnv, "config.json"), "path to config.json")
+	fromText := flags.String("from", "", "first day to include, YYYY-MM-DD (default 30 days ago)")
+	toText := flags.String("to", "", "last day to include, YYYY-MM-DD (default today)")
+	format := flags.String("format", "csv", "output format, csv or json")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	from, to, err := parseDays(*fromText, *toText, today.AddDate(0, 0, -30), today)
+	if err != nil {
+		return err
+	}
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+	history, err := loadHistory(config.History)
+	if err != nil {
+		return fmt.Errorf("failed to load history: %w", err)
+	}
+	if history == nil {
+		return fmt.Errorf("history is not enabled, set history.path in %s", *configPath)
+	}
+
+	history.mu.Lock()
+	usage := aggregateUsage(history.records, from, to)
+	history.mu.Unlock()
+
+	switch *format {
+	case "csv":
+		return writeUsageCSV(os.Stdout, usage)
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(usage)
+	default:
+		return fmt.Errorf("unknown format '%s', use csv or json", *format)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const templateTestSuffix = ".test.json"
+
+// TemplateTests are the fixtures of a template, kept next to it as
+// <name>.test.json. Each case renders the template for a request and compares
+// the prompt with the expected one.
+type TemplateTests struct {
+	Cases []TemplateTestCase `json:"cases"`
+}
+
+// TemplateTestCase is a sample request and what its prompt should be: exactly
+// Prompt, or containing each of Contains.
+type TemplateTestCase struct {
+	Name     string                 `json:"name"`
+	Request  map[string]interface{} `json:"request"`
+	Prompt   *string                `json:"prompt,omitempty"`
+	Contains []string               `json:"contains,omitempty"`
+}
+
+// runValidate checks the config and every template and its settings, then
+// runs the template fixtures, failing if anything is wrong.
+func runValidate(args []string) error {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	configPath := flags.String("config", envDefault(configPathEnv, "config.json"), "path to config.json")
+	templatesDir := flags.String("templates", envDefault(templatesDirEnv, "templates"), "path to the templates directory")
+	update := flags.Bool("update", false, "write the rendered prompts into the fixtures as the expected ones")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	names, err := templateNames(*templatesDir)
+	if err != nil {
+		return err
+	}
+
+	var failures int
+	fail := func(format string, args ...interface{}) {
+		failures++
+		fmt.Printf("FAIL "+format+"\n", args...)
+	}
+	for _, name := range names {
+		fileName := name + ".json"
+		text, err := os.ReadFile(filepath.Join(*templatesDir, fileName))
+		if err != nil {
+			return err
+		}
+		tmpl, err := parsePromptTemplate(fileName, string(text))
+		if err != nil {
+			fail("%s: %v", name, err)
+			continue
+		}
+		if _, err := loadTemplateSettings(*templatesDir, name); err != nil {
+			fail("%s: settings: %v", name, err)
+			continue
+		}
+
+		testsPath := filepath.Join(*templatesDir, name+templateTestSuffix)
+		data, err := os.ReadFile(testsPath)
+		if errors.Is(err, os.ErrNotExist) {
+			fmt.Printf("ok   %s (no fixtures)\n", name)
+			continue
+		} else if err != nil {
+			return err
+		}
+		var tests TemplateTests
+		if err := json.Unmarshal(data, &tests); err != nil {
+			fail("%s: fixtures: %v", name, err)
+			continue
+		}
+
+		passed := true
+		for i := range tests.Cases {
+			test := &tests.Cases[i]
+			label := test.Name
+			if label == "" {
+				label = fmt.Sprintf("case %d", i+1)
+			}
+			if err := test.run(config, tmpl, *update); err != nil {
+				fail("%s: %s: %v", name, label, err)
+				passed = false
+			}
+		}
+		if *update {
+			// Prompts are kept readable, without escaping < and >
+			var updated bytes.Buffer
+			encoder := json.NewEncoder(&updated)
+			encoder.SetEscapeHTML(false)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(tests); err != nil {
+				return err
+			}
+			if err := os.WriteFile(testsPath, updated.Bytes(), 0o644); err != nil {
+				return err
+			}
+		}
+		if passed {
+			fmt.Printf("ok   %s (%d cases)\n", name, len(tests.Cases))
+		}
+	}
+	if failures > 0 {
+		return fmt.Errorf("%d problems found", failures)
+	}
+	return nil
+}
+
+// templateNames are the names of the templates in a directory, leaving out
+// their settings and fixtures.
+func templateNames(dir string) ([]string, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, file := range files {
+		fileName := file.Name()
+		if filepath.Ext(fileName) != ".json" || strings.HasSuffix(fileName, templateSettingsSuffix) || strings.HasSuffix(fileName, templateTestSuffix) {
+			continue
+		}
+		names = append(names, strings.TrimSuffix(fileName, ".json"))
+	}
+	return names, nil
+}
+
+// run renders the template for the case's request and checks the prompt. With
+// update the prompt becomes the expected one instead.
+func (c *TemplateTestCase) run(config *Config, tmpl *template.Template, update bool) error {
+	request := c.Request
+	if request == nil {
+		request = map[string]interface{}{}
+	}
+	data, err := buildTemplateData(context.Background(), config, request)
+	if err != nil {
+		return fmt.Errorf("request: %w", err)
+	}
+	prompt, err := processTemplate(tmpl, data)
+	if err != nil {
+		return err
+	}
+	if update {
+		c.Prompt = &prompt
+		return nil
+	}
+	if c.Prompt != nil && prompt != *c.Prompt {
+		return fmt.Errorf("prompt differs\n--- expected\n%s\n--- rendered\n%s", *c.Prompt, prompt)
+	}
+	for _, text := range c.Contains {
+		if !strings.Contains(prompt, text) {
+			return fmt.Errorf("prompt doesn't contain %q\n--- rendered\n%s", text, prompt)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// WatermarkConfig tags responses with the template version and model that
+// produced them, so generated text found later in notes or notifications can
+// be traced. Field adds a watermark field to the response, and ZeroWidth
+// appends the tag to the response text as invisible zero-width characters.
+type WatermarkConfig struct {
+	Field     bool `json:"field"`
+	ZeroWidth bool `json:"zero_width"`
+}
+
+// Watermark is the tag of a response.
+type Watermark struct {
+	Template string `json:"template"`
+	Version  string `json:"version"`
+	Model    string `json:"model"`
+}
+
+// Zero-width characters encoding a watermark: a word joiner either side of
+// the tag's bits, written as zero-width spaces (0) and non-joiners (1)
+const (
+	zeroWidthMark = '\u2060'
+	zeroWidthZero = '\u200b'
+	zeroWidthOne  = '\u200c'
+)
+
+// Prefix of encoded watermarks, so other zero-width text isn't mistaken for one
+const watermarkPrefix = "llamanator"
+
+// templateVersion identifies a version of a template by its text.
+func templateVersion(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:4])
+}
+
+// watermark is how the template's responses are tagged.
+func (tc *TemplateConfig) watermark(config *Config, templateName string) WatermarkConfig {
+	if settings, ok := tc.Settings[templateName]; ok && settings.Watermark != nil {
+		return *settings.Watermark
+	}
+	return config.Watermark
+}
+
+// encode writes the watermark as zero-width characters.
+func (w Watermark) encode() string {
+	tag := strings.Join([]string{watermarkPrefix, w.Template, w.Version, w.Model}, "|")
+	var b strings.Builder
+	b.WriteRune(zeroWidthMark)
+	for _, c := range []byte(tag) {
+		for bit := 7; bit >= 0; bit-- {
+			if c&(1<<bit) != 0 {
+				b.WriteRune(zeroWidthOne)
+			} else {
+				b.WriteRune(zeroWidthZero)
+			}
+		}
+	}
+	b.WriteRune(zeroWidthMark)
+	return b.String()
+}
+
+// findWatermarks decodes the zero-width watermarks in text.
+func findWatermarks(text string) []Watermark {
+	watermarks := []Watermark{}
+	parts := strings.Split(text, string(zeroWidthMark))
+	// Tags are the parts between pairs of marks
+	for i := 1; i < len(parts); i++ {
+		var tag []byte
+		var c byte
+		bits := 0
+		valid := parts[i] != ""
+		for _, r := range parts[i] {
+			switch r {
+			case zeroWidthZero:
+				c <<= 1
+			case zeroWidthOne:
+				c = c<<1 | 1
+			default:
+				valid = false
+			}
+			if bits++; bits%8 == 0 {
+				tag = append(tag, c)
+				c = 0
+			}
+		}
+		fields := strings.Split(string(tag), "|")
+		if !valid || bits%8 != 0 || len(fields) != 4 || fields[0] != watermarkPrefix {
+			continue
+		}
+		watermarks = append(watermarks, Watermark{Template: fields[1], Version: fields[2], Model: fields[3]})
+		i++
+	}
+	return watermarks
+}
+
+// watermarkHandler serves POST /admin/watermark, which finds the zero-width
+// watermarks in a body of {"text": "..."}.
+func watermarkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, `Expected a body of {"text": "..."}`, http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"watermarks": findWatermarks(body.Text)})
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+// WebhookConfig maps the payload of a third-party webhook (Grafana, GitHub,
+// Frigate...) onto a template request. Query and Fields are Go templates
+// rendered with the decoded JSON payload, e.g. "{{.title}}: {{.message}}".
+// Fields set other request fields, such as url or context.
+type WebhookConfig struct {
+	Name     string            `json:"name"`
+	Template string            `json:"template"`
+	Model    string            `json:"model"`
+	Query    string            `json:"query"`
+	Fields   map[string]string `json:"fields"`
+}
+
+// webhook is a parsed WebhookConfig.
+type webhook struct {
+	config WebhookConfig
+	query  *template.Template
+	fields map[string]*template.Template
+}
+
+var webhookFuncs = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		data, err := json.Marshal(value)
+		return string(data), err
+	},
+	"join": func(values []interface{}, sep string) string {
+		parts := make([]string, len(values))
+		for i, value := range values {
+			parts[i] = fmt.Sprint(value)
+		}
+		return strings.Join(parts, sep)
+	},
+}
+
+func parseWebhookTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Option("missingkey=zero").Funcs(webhookFuncs).Parse(text)
+}
+
+// loadWebhooks parses the configured webhooks, checking that their templates exist.
+func loadWebhooks(configs []WebhookConfig, templateConfig *TemplateConfig) ([]*webhook, error) {
+	var webhooks []*webhook
+	seen := make(map[string]bool)
+	for _, wc := range configs {
+		if wc.Name == "" {
+			return nil, fmt.Errorf("webhooks require a name")
+		}
+		if seen[wc.Name] {
+			return nil, fmt.Errorf("webhook '%s' is defined more than once", wc.Name)
+		}
+		seen[wc.Name] = true
+		if _, ok := templateConfig.Templates[wc.Template]; !ok {
+			return nil, fmt.Errorf("webhook '%s': unknown template '%s'", wc.Name, wc.Template)
+		}
+
+		// Without a query mapping the whole payload is the query
+		query := wc.Query
+		if query == "" {
+			query = "{{json .}}"
+		}
+		hook := &webhook{config: wc, fields: make(map[string]*template.Template)}
+		var err error
+		if hook.query, err = parseWebhookTemplate(wc.Name, query); err != nil {
+			return nil, fmt.Errorf("webhook '%s': query: %w", wc.Name, err)
+		}
+		for field, text := range wc.Fields {
+			if hook.fields[field], err = parseWebhookTemplate(wc.Name+"."+field, text); err != nil {
+				return nil, fmt.Errorf("webhook '%s': field '%s': %w", wc.Name, field, err)
+			}
+		}
+		webhooks = append(webhooks, hook)
+	}
+	return webhooks, nil
+}
+
+// request maps a webhook payload onto a template request.
+func (hook *webhook) request(payload interface{}) (map[string]interface{}, error) {
+	render := func(tmpl *template.Template) (string, error) {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, payload); err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(buf.String()), nil
+	}
+
+	request := make(map[string]interface{}, len(hook.fields)+2)
+	for field, tmpl := range hook.fields {
+		value, err := render(tmpl)
+		if err != nil {
+			return nil, fmt.Errorf("field '%s': %w", field, err)
+		}
+		// Fields that render to a JSON object or list, such as a context built
+		// with the json function, are passed on as JSON
+		var decoded interface{}
+		if strings.HasPrefix(value, "{") || strings.HasPrefix(value, "[") {
+			if json.Unmarshal([]byte(value), &decoded) == nil {
+				request[field] = decoded
+				continue
+			}
+		}
+		request[field] = value
+	}
+	query, err := render(hook.query)
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+	request["query"] = query
+	if hook.config.Model != "" {
+		request["model"] = hook.config.Model
+	}
+	return request, nil
+}
+
+// webhookHandler serves POST /webhook/{name}: the payload is mapped onto a
+// request for the webhook's template, which next handles as usual.
+func webhookHandler(config *Config, hook *webhook, next http.HandlerFunc) http.HandlerFunc {
+	return authenticate(config, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var payload interface{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		request, err := hook.request(payload)
+		if err != nil {
+			slog.Error("Failed to map payload for webhook", "webhook", hook.config.Name, "error", err)
+			http.Error(w, "Failed to map the webhook payload", http.StatusBadRequest)
+			return
+		}
+
+		body, err := json.Marshal(request)
+		if err != nil {
+			http.Error(w, "Failed to map the webhook payload", http.StatusInternalServerError)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		next(w, r)
+	})
+}